@@ -1,10 +1,27 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/appxpy/sphere-api/internal/config"
 	"github.com/appxpy/sphere-api/internal/transport/websocket"
 )
 
 func main() {
-	server := websocket.NewServer()
-	server.Start()
+	cfg, err := config.Load()
+	if err != nil {
+		panic(err)
+	}
+	server := websocket.NewServer(cfg)
+
+	// При остановке сервер сохраняет снимок состояния, чтобы клиенты могли продолжить сессии после рестарта
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go server.Start()
+	<-ctx.Done()
+	server.Stop()
 }
@@ -0,0 +1,120 @@
+// Команда replay повторяет журнал операций на свежем состоянии и печатает результат каждой операции
+// и итоговых ближайших клиентов. Конфигурация читается из тех же переменных окружения, что и у сервера,
+// поэтому повтор с конфигурацией сервера воспроизводит его поведение.
+//
+//	replay -journal /var/lib/sphere/journal [-snapshot /var/lib/sphere/snapshot.json] [-after 0]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/replay"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/zones"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		os.Exit(2)
+	}
+
+	dir := flag.String("journal", cfg.Journal.Dir, "journal directory")
+	snapshotPath := flag.String("snapshot", "", "snapshot to start from (entries it covers are skipped)")
+	after := flag.Uint64("after", 0, "replay only entries with a greater sequence number")
+	quiet := flag.Bool("quiet", false, "print only the final state")
+	flag.Parse()
+
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "replay: -journal is required")
+		os.Exit(2)
+	}
+
+	if err := run(cfg, *dir, *snapshotPath, *after, *quiet); err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg *config.Config, dir, snapshotPath string, after uint64, quiet bool) error {
+	repo, err := storage.New(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	geoUsecase := usecases.NewGeolocationUsecase(repo, cfg.Geolocation)
+	geoUsecase.SetPrivacy(cfg.Privacy)
+	for _, path := range cfg.Zones.Files {
+		loaded, err := zones.LoadFile(path)
+		if err != nil {
+			return err
+		}
+		geoUsecase.AddZones(loaded)
+	}
+	usersUsecase := usecases.NewUsersUsecase(repo, cfg.Privacy)
+
+	if snapshotPath != "" {
+		saved, err := snapshot.Load(snapshotPath)
+		if err != nil {
+			return err
+		}
+		// Зоны из снимка заменяют зоны из файлов, как и при запуске сервера
+		if saved.Zones != nil {
+			restored, err := zones.Parse(saved.Zones)
+			if err != nil {
+				return err
+			}
+			geoUsecase.RestoreZones(restored)
+		}
+		if err := usersUsecase.Restore(saved); err != nil {
+			return err
+		}
+		after = max(after, saved.JournalSeq)
+	}
+
+	var observe func(entry *journal.Entry, notify []string, err error)
+	if !quiet {
+		observe = func(entry *journal.Entry, notify []string, err error) {
+			line := fmt.Sprintf("%d %s %s %s", entry.Seq, entry.Time.Format("2006-01-02T15:04:05.000Z07:00"), entry.Kind, entry.ClientID)
+			if err != nil {
+				line += " error=" + err.Error()
+			}
+			if len(notify) > 0 {
+				line += " notify=" + strings.Join(notify, ",")
+			}
+			fmt.Println(line)
+		}
+	}
+
+	last, err := replay.New(geoUsecase, usersUsecase).Dir(dir, after, observe)
+	if err != nil {
+		return err
+	}
+
+	clients := usersUsecase.GetClients()
+	slices.SortFunc(clients, func(a, b *models.ClientInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	fmt.Printf("replayed up to %d, %d clients\n", last, len(clients))
+	for _, client := range clients {
+		if !client.HasPosition() {
+			fmt.Printf("%s room=%s no position\n", client.ID, client.Room)
+			continue
+		}
+		position := client.Position
+		fmt.Printf("%s room=%s lat=%.7f lon=%.7f nearest=%s distance=%.2f\n",
+			client.ID, client.Room, position.Latitude, position.Longitude, position.ClosestClientID, position.Distance)
+	}
+	return nil
+}
@@ -0,0 +1,625 @@
+// Package cluster - Режим нескольких узлов. Операции своих клиентов узел передает другим узлам как записи журнала,
+// а записи других узлов применяет к своей копии их клиентов так же, как повтор журнала. Уведомления о ближайших
+// каждый узел вычисляет сам и отправляет только своим клиентам, а сообщения, которые порождает только узел
+// отправителя (SyncStateResponse), пересылаются узлу получателя.
+//
+// Блокировки и зоны общие для всего кластера: их операции получает каждый узел, а узел, пропустивший события
+// другого узла, получает от него состояние заново.
+//
+// В режиме replicated каждый узел держит полную реплику всех клиентов. В режиме partitioned узлы делят ячейки
+// земной поверхности: клиент живет на узле своей ячейки, а узлы соседних ячеек держат его копию, пока он ближе
+// к их границе, чем halo. Если ближайший своего клиента дальше, чем гарантируют эти копии, поиск расширяется
+// на другие узлы. Клиент, перешедший в чужую ячейку, передается ее узлу и переподключается к нему.
+package cluster
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/replay"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
+	"github.com/gorilla/websocket"
+)
+
+// EventKind - Вид сообщения между узлами
+type EventKind string
+
+const (
+	// EventEntry - Операция клиента узла-отправителя
+	EventEntry EventKind = "entry"
+	// EventPush - Сообщение для клиента узла-получателя
+	EventPush EventKind = "push"
+	// EventHello - Узел запустился, остальные забывают его прежних клиентов, отвечают EventWelcome и в режиме
+	// replicated присылают ему своих клиентов
+	EventHello EventKind = "hello"
+	// EventWelcome - Ответ на EventHello: отправитель тоже в кластере. Несет блокировки и зоны отправителя.
+	EventWelcome EventKind = "welcome"
+	// EventLeave - Узел останавливается, остальные удаляют его клиентов
+	EventLeave EventKind = "leave"
+	// EventHandoff - Узел передает получателю клиента, перешедшего в его ячейку
+	EventHandoff EventKind = "handoff"
+	// EventHandoffAccepted - Получатель принял клиента и ждет его переподключения
+	EventHandoffAccepted EventKind = "handoff_accepted"
+	// EventResync - Отправитель не доставил получателю часть событий: получатель забывает клиентов отправителя
+	// и принимает его блокировки и зоны, а отправитель следом присылает своих клиентов заново
+	EventResync EventKind = "resync"
+	// EventLost - Транспорт не доставил узлу Node часть событий. Создается самим транспортом и по сети не передается.
+	EventLost EventKind = "lost"
+	// EventNearest - Ближайший своего клиента отправителя дальше, чем гарантируют копии соседних ячеек: получатель
+	// присылает копии своих клиентов в радиусе поиска и держит их у отправителя, пока поиск не отменен
+	EventNearest EventKind = "nearest"
+	// EventNearestDone - Отправитель отменяет поиск ближайшего для своего клиента
+	EventNearestDone EventKind = "nearest_done"
+)
+
+// Event - Сообщение между узлами
+type Event struct {
+	Kind EventKind `json:"kind"`
+	// Node - Узел-отправитель
+	Node string `json:"node"`
+	// Entry - Операция для EventEntry
+	Entry *journal.Entry `json:"entry,omitempty"`
+	// From, ClientID, Message - Отправитель, получатель и готовое сообщение для EventPush. ClientID - также клиент,
+	// для которого ищется ближайший, в EventNearest и EventNearestDone.
+	From     string          `json:"from,omitempty"`
+	ClientID string          `json:"client_id,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"`
+	// Client, RoomOptions, Token - Состояние переданного клиента, параметры его комнаты и токен его переподключения
+	// для EventHandoff. EventHandoffAccepted несет токен и ClientID принятого клиента.
+	Client      *snapshot.Client    `json:"client,omitempty"`
+	RoomOptions *models.RoomOptions `json:"room_options,omitempty"`
+	Token       string              `json:"token,omitempty"`
+	// Address - Публичный адрес принявшего узла для EventHandoffAccepted
+	Address string `json:"address,omitempty"`
+	// Blocks, Zones - Блокировки и зоны отправителя для EventWelcome и EventResync
+	Blocks map[string][]string `json:"blocks,omitempty"`
+	Zones  json.RawMessage     `json:"zones,omitempty"`
+	// Position, Radius, Room - Точка, радиус в метрах (0 - без ограничения) и комната поиска для EventNearest
+	Position *models.Position `json:"position,omitempty"`
+	Radius   float64          `json:"radius,omitempty"`
+	Room     string           `json:"room,omitempty"`
+}
+
+// Backplane - Транспорт сообщений между узлами. События от одного узла доставляются по порядку и не в горутине
+// отправителя, а обработчик вызывается последовательно. Publish и Send кодируют событие до возврата.
+type Backplane interface {
+	// Publish - Отправляет событие всем остальным узлам
+	Publish(event *Event) error
+	// Send - Отправляет событие одному узлу
+	Send(node string, event *Event) error
+	// Subscribe - Задает обработчик событий от других узлов
+	Subscribe(handler func(event *Event))
+	// Close - Доставляет отправленные события и отключает узел
+	Close() error
+}
+
+// Node - Узел кластера. Кроме Start и Stop, методы узла вызываются только из команд движка.
+type Node struct {
+	id           string
+	backplane    Backplane
+	geoUsecase   *usecases.GeolocationUsecase
+	usersUsecase *usecases.UsersUsecase
+	replayer     *replay.Replayer
+
+	// address - Публичный адрес узла, к которому переподключаются принятые им клиенты
+	address string
+
+	// journal - Локальный журнал, в который попадают только операции своих клиентов (nil - журнал выключен)
+	journal usecases.Journal
+	// schedule - Выполняет команду движка и ждет ее, notify - уведомляет своих клиентов о смене ближайших,
+	// transitions - о входе в зоны и выходе из них
+	schedule    func(command func()) bool
+	notify      func(notify []string)
+	transitions func(transitions []*models.ZoneTransition)
+
+	// owners - Узлы клиентов других узлов
+	owners map[string]string
+	// applying - Применяется операция другого узла, юзкейсы не должны публиковать ее снова
+	applying bool
+	// members - Другие работающие узлы
+	members map[string]struct{}
+
+	// partition - Деление ячеек в режиме partitioned (nil - режим replicated)
+	partition *partition
+	// holders - Узлы, которые держат копии своих клиентов
+	holders map[string]map[string]struct{}
+	// checking - Свои клиенты, для которых уже запланирована проверка после новой позиции
+	checking map[string]struct{}
+	// searches - Поиски ближайших своих клиентов, расширенные на другие узлы
+	searches map[string]*search
+	// watches - Поиски других узлов по узлам и их клиентам. Свои клиенты в радиусе поиска копируются его узлу.
+	watches map[string]map[string]*search
+	// handoffs - Токены своих клиентов, переданных другим узлам и ждущих подтверждения
+	handoffs map[string]string
+	// claims - Принятые от других узлов клиенты, ждущие переподключения, по токенам
+	claims map[string]string
+}
+
+// New - Создает узел id в режиме cfg.Mode. Принятые узлом клиенты переподключаются по cfg.Address, а если он пуст - по id.
+func New(id string, backplane Backplane, geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase, cfg config.Cluster) (*Node, error) {
+	address := cfg.Address
+	if address == "" {
+		address = id
+	}
+
+	node := &Node{
+		id:           id,
+		address:      address,
+		backplane:    backplane,
+		geoUsecase:   geoUsecase,
+		usersUsecase: usersUsecase,
+		replayer:     replay.New(geoUsecase, usersUsecase),
+		owners:       make(map[string]string),
+		members:      make(map[string]struct{}),
+		holders:      make(map[string]map[string]struct{}),
+		checking:     make(map[string]struct{}),
+		searches:     make(map[string]*search),
+		watches:      make(map[string]map[string]*search),
+		handoffs:     make(map[string]string),
+		claims:       make(map[string]string),
+	}
+
+	switch cfg.Mode {
+	case config.ClusterReplicated, "":
+	case config.ClusterPartitioned:
+		node.partition = newPartition(cfg.Partition)
+		node.updateRing()
+	default:
+		return nil, util.ErrUnknownClusterMode
+	}
+	return node, nil
+}
+
+// ID - Идентификатор узла
+func (n *Node) ID() string {
+	return n.id
+}
+
+// SetJournal - Задает локальный журнал, которому узел передает операции своих клиентов
+func (n *Node) SetJournal(journal usecases.Journal) {
+	n.journal = journal
+}
+
+// Start - Подписывается на события других узлов и объявляет о себе. В режиме replicated вместе с объявлением
+// узел публикует уже известных своих клиентов.
+func (n *Node) Start(schedule func(command func()) bool, notify func(notify []string), transitions func(transitions []*models.ZoneTransition)) {
+	n.schedule = schedule
+	n.notify = notify
+	n.transitions = transitions
+	n.backplane.Subscribe(n.receive)
+
+	n.schedule(func() {
+		n.publish(&Event{Kind: EventHello})
+		if n.partition == nil {
+			n.introduce(n.publish)
+		}
+	})
+}
+
+// Stop - Сообщает другим узлам об остановке и отключается от транспорта
+func (n *Node) Stop() {
+	n.schedule(func() { n.publish(&Event{Kind: EventLeave}) })
+	if err := n.backplane.Close(); err != nil {
+		logging.ErrorLogger.Printf("Failed to close cluster backplane: %v", err)
+	}
+}
+
+// Record - Передает операцию своего клиента локальному журналу и другим узлам
+func (n *Node) Record(entry *journal.Entry) {
+	if n.applying {
+		return
+	}
+
+	if n.journal != nil {
+		n.journal.Record(entry)
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if n.partition != nil && !shared(entry.Kind) {
+		n.replicate(entry)
+		return
+	}
+	n.publish(&Event{Kind: EventEntry, Entry: entry})
+}
+
+// Remote - Проверяет, подключен ли клиент к другому узлу
+func (n *Node) Remote(clientID string) bool {
+	_, ok := n.owners[clientID]
+	return ok
+}
+
+// Forward - Пересылает сообщение клиенту другого узла от клиента from. Возвращает false, если узел клиента неизвестен.
+func (n *Node) Forward(from, clientID string, message any) bool {
+	owner, ok := n.owners[clientID]
+	if !ok {
+		return false
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to encode message for client %s: %v", clientID, err)
+		return false
+	}
+
+	event := &Event{Kind: EventPush, Node: n.id, From: from, ClientID: clientID, Message: data}
+	if err := n.backplane.Send(owner, event); err != nil {
+		logging.ErrorLogger.Printf("Failed to forward message to client %s on node %s: %v", clientID, owner, err)
+		return false
+	}
+	return true
+}
+
+// Узлы кластера вместе с этим, по порядку
+func (n *Node) nodes() []string {
+	nodes := []string{n.id}
+	for node := range n.members {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+func (n *Node) publish(event *Event) error {
+	event.Node = n.id
+	if err := n.backplane.Publish(event); err != nil {
+		logging.ErrorLogger.Printf("Failed to publish %s event: %v", event.Kind, err)
+		return err
+	}
+	return nil
+}
+
+// Принимает событие в горутине транспорта и обрабатывает его командой движка
+func (n *Node) receive(event *Event) {
+	if event.Node == n.id {
+		return
+	}
+	n.schedule(func() { n.handle(event) })
+}
+
+func (n *Node) handle(event *Event) {
+	switch event.Kind {
+	case EventEntry:
+		if event.Entry != nil {
+			n.apply(event.Node, event.Entry)
+		}
+
+	case EventPush:
+		n.deliver(event)
+
+	case EventHello:
+		logging.InfoLogger.Printf("Cluster node joined: %s", event.Node)
+		// Узел, который уже был в кластере, перезапустился: его прежних клиентов и выданных ему копий больше нет
+		n.forget(event.Node)
+		n.join(event.Node)
+		if err := n.send(event.Node, n.withState(&Event{Kind: EventWelcome})); err != nil {
+			return
+		}
+		if n.partition == nil {
+			n.introduce(func(introduction *Event) error { return n.send(event.Node, introduction) })
+		} else {
+			n.sendSearches(event.Node)
+		}
+
+	case EventWelcome:
+		n.join(event.Node)
+		n.adoptState(event)
+
+	case EventResync:
+		logging.InfoLogger.Printf("Cluster node %s resynchronizes its clients", event.Node)
+		n.forget(event.Node)
+		n.adoptState(event)
+
+	case EventLost:
+		n.resync(event.Node)
+
+	case EventLeave:
+		logging.InfoLogger.Printf("Cluster node left: %s", event.Node)
+		n.leave(event.Node)
+
+	case EventHandoff:
+		if event.Client != nil {
+			n.adopt(event.Node, event)
+		}
+
+	case EventHandoffAccepted:
+		address := event.Address
+		if address == "" {
+			address = event.Node
+		}
+		n.handedOff(event.ClientID, event.Token, address)
+
+	case EventNearest:
+		if n.partition != nil && event.Position != nil {
+			n.watch(event.Node, event.ClientID, &search{room: event.Room, point: event.Position, radius: event.Radius})
+		}
+
+	case EventNearestDone:
+		n.unwatch(event.Node, event.ClientID)
+	}
+}
+
+func (n *Node) send(node string, event *Event) error {
+	event.Node = n.id
+	if err := n.backplane.Send(node, event); err != nil {
+		logging.ErrorLogger.Printf("Failed to send %s event to node %s: %v", event.Kind, node, err)
+		return err
+	}
+	return nil
+}
+
+func (n *Node) join(node string) {
+	if _, ok := n.members[node]; ok {
+		return
+	}
+	n.members[node] = struct{}{}
+	n.updateRing()
+}
+
+// Удаляет клиентов остановившегося узла и забывает выданные ему копии
+func (n *Node) leave(node string) {
+	n.forget(node)
+	delete(n.members, node)
+	n.updateRing()
+}
+
+// Удаляет копии клиентов узла node так же, как при их отключении, и забывает, какие копии держит node
+func (n *Node) forget(node string) {
+	now := time.Now()
+	for clientID, owner := range n.owners {
+		if owner == node {
+			n.apply(node, &journal.Entry{Time: now, Kind: journal.KindClientRemoved, ClientID: clientID})
+		}
+	}
+	for _, holders := range n.holders {
+		delete(holders, node)
+	}
+	delete(n.watches, node)
+}
+
+// Узел node пропустил часть событий: он забывает клиентов этого узла и получает их заново вместе с блокировками
+// и зонами. В режиме partitioned узел получает только те копии, которые держал, и поиски ближайших своих клиентов.
+func (n *Node) resync(node string) {
+	if _, ok := n.members[node]; !ok {
+		return
+	}
+	logging.InfoLogger.Printf("Resynchronizing clients with cluster node %s", node)
+	if err := n.send(node, n.withState(&Event{Kind: EventResync})); err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, client := range n.usersUsecase.GetClients() {
+		if n.Remote(client.ID) {
+			continue
+		}
+		if n.partition != nil {
+			if _, ok := n.holders[client.ID][node]; !ok {
+				continue
+			}
+		}
+		for _, entry := range n.introduction(client, now) {
+			if err := n.send(node, &Event{Kind: EventEntry, Entry: entry}); err != nil {
+				return
+			}
+		}
+	}
+	if n.partition != nil {
+		n.sendSearches(node)
+	}
+}
+
+// Добавляет к событию блокировки и зоны узла
+func (n *Node) withState(event *Event) *Event {
+	event.Blocks = n.usersUsecase.Blocks()
+	encoded, err := zones.Encode(n.geoUsecase.GetZones())
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to encode zones for cluster node: %v", err)
+		return event
+	}
+	event.Zones = encoded
+	return event
+}
+
+// Принимает блокировки и зоны другого узла. Блокировки объединяются, а зоны заменяются зонами узла,
+// который уже работал в кластере.
+func (n *Node) adoptState(event *Event) {
+	notify, err := n.geoUsecase.MergeBlocks(event.Blocks)
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to merge blocks of cluster node %s: %v", event.Node, err)
+	}
+	n.notify(notify)
+
+	if event.Zones == nil {
+		return
+	}
+	replaced, err := zones.Parse(event.Zones)
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to decode zones of cluster node %s: %v", event.Node, err)
+		return
+	}
+	transitions, notify := n.geoUsecase.ReplaceZones(replaced)
+	n.transitions(transitions)
+	n.notify(notify)
+}
+
+// Применяет операцию узла node. Операции над клиентом принимаются только от узла, который его добавил,
+// поэтому запоздавшие события прежнего узла клиента не портят реплику. Общие операции принимаются от любого узла.
+func (n *Node) apply(node string, entry *journal.Entry) {
+	if shared(entry.Kind) {
+		n.applyShared(node, entry)
+		return
+	}
+
+	owner, known := n.owners[entry.ClientID]
+	if entry.Kind == journal.KindClientAdded {
+		if _, err := n.usersUsecase.GetClientInfo(entry.ClientID); err == nil && !known {
+			logging.ErrorLogger.Printf("Node %s added client %s that is connected here", node, entry.ClientID)
+			return
+		}
+		if known {
+			// Копия клиента вводится заново, например после повторного знакомства узлов: прежняя копия заменяется
+			n.apply(owner, &journal.Entry{Time: entry.Time, Kind: journal.KindClientRemoved, ClientID: entry.ClientID})
+		}
+		n.owners[entry.ClientID] = node
+	} else if !known || owner != node {
+		return
+	}
+	if entry.Kind == journal.KindClientRemoved {
+		delete(n.owners, entry.ClientID)
+	}
+
+	n.applying = true
+	notify, err := n.replayer.Apply(entry)
+	n.applying = false
+	if err != nil {
+		logging.InfoLogger.Printf("Replicated %s of client %s failed: %v", entry.Kind, entry.ClientID, err)
+	}
+	n.notify(notify)
+}
+
+// Применяет блокировку или операцию с зонами. Блокировка применяется по идентичностям, потому что копии
+// одного из клиентов на этом узле может не быть.
+func (n *Node) applyShared(node string, entry *journal.Entry) {
+	n.applying = true
+	defer func() { n.applying = false }()
+
+	var (
+		notify      []string
+		transitions []*models.ZoneTransition
+		err         error
+	)
+	switch entry.Kind {
+	case journal.KindClientBlocked, journal.KindClientUnblocked:
+		notify, err = n.geoUsecase.SetIdentityBlock(entry.Identity, entry.TargetIdentity, entry.Kind == journal.KindClientBlocked)
+	case journal.KindZonesAdded:
+		var added []*zones.Zone
+		if added, err = zones.Parse(entry.Zones); err == nil {
+			transitions, notify = n.geoUsecase.AddZones(added)
+		}
+	case journal.KindZoneRemoved:
+		transitions, notify, err = n.geoUsecase.RemoveZone(entry.ZoneID)
+	}
+	if err != nil {
+		logging.InfoLogger.Printf("Replicated %s from node %s failed: %v", entry.Kind, node, err)
+	}
+	n.transitions(transitions)
+	n.notify(notify)
+}
+
+// Отправляет через send текущее состояние своих клиентов как операции, которые его создают
+func (n *Node) introduce(send func(event *Event) error) {
+	now := time.Now()
+	for _, client := range n.usersUsecase.GetClients() {
+		if n.Remote(client.ID) {
+			continue
+		}
+		for _, entry := range n.introduction(client, now) {
+			if err := send(&Event{Kind: EventEntry, Entry: entry}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Доставляет пересланное сообщение своему клиенту, если получатель не заблокировал отправителя на этом узле
+func (n *Node) deliver(event *Event) {
+	client, err := n.usersUsecase.GetClientInfo(event.ClientID)
+	if err != nil || client.Connection == nil || n.Remote(client.ID) {
+		return
+	}
+	if sender, err := n.usersUsecase.GetClientInfo(event.From); err == nil && n.usersUsecase.IsBlocked(sender, client) {
+		return
+	}
+
+	if err := client.Connection.WriteMessage(websocket.TextMessage, event.Message); err != nil {
+		logging.ErrorLogger.Printf("Error sending forwarded message to client %s: %v", client.ID, err)
+	}
+}
+
+// Операции, которые создают копию клиента в его текущем состоянии
+func (n *Node) introduction(client *models.ClientInfo, now time.Time) []*journal.Entry {
+	entries := []*journal.Entry{{
+		Time:          now,
+		Kind:          journal.KindClientAdded,
+		ClientID:      client.ID,
+		Identity:      client.Identity,
+		ResumeToken:   client.ResumeToken,
+		SphereID:      client.SphereID,
+		PrivacyOffset: client.PrivacyOffset,
+	}}
+	if client.WindowSettings != nil {
+		entries = append(entries, &journal.Entry{
+			Time:           now,
+			Kind:           journal.KindWindowSettingsChanged,
+			ClientID:       client.ID,
+			WindowSettings: client.WindowSettings,
+		})
+	}
+	if client.Privacy != nil {
+		entries = append(entries, &journal.Entry{Time: now, Kind: journal.KindPrivacyChanged, ClientID: client.ID, Privacy: client.Privacy})
+	}
+	if client.Preferences != nil {
+		entries = append(entries, &journal.Entry{Time: now, Kind: journal.KindPreferencesChanged, ClientID: client.ID, Preferences: client.Preferences})
+	}
+	if client.Room != "" && client.Room != models.GlobalRoom {
+		entries = append(entries, &journal.Entry{
+			Time:        now,
+			Kind:        journal.KindRoomJoined,
+			ClientID:    client.ID,
+			Room:        client.Room,
+			RoomOptions: n.roomOptions(client.Room),
+		})
+	}
+	if client.HasPosition() {
+		entries = append(entries, &journal.Entry{
+			Time:     now,
+			Kind:     journal.KindPositionUpdated,
+			ClientID: client.ID,
+			Position: lastFix(client.Position),
+		})
+	}
+	return entries
+}
+
+// Параметры комнаты name, с которыми ее создаст другой узел (nil - комнаты нет)
+func (n *Node) roomOptions(name string) *models.RoomOptions {
+	info, ok := n.geoUsecase.GetRoom(name)
+	if !ok {
+		return nil
+	}
+	return &models.RoomOptions{Limit: info.Limit, Metadata: info.Metadata, Pairing: info.Pairing}
+}
+
+// Операции, общие для всего кластера: их получают все узлы, а не только те, у которых есть копия клиента
+func shared(kind journal.Kind) bool {
+	switch kind {
+	case journal.KindClientBlocked, journal.KindClientUnblocked, journal.KindZonesAdded, journal.KindZoneRemoved:
+		return true
+	}
+	return false
+}
+
+// Восстанавливает фикс, который привел клиента в текущую позицию
+func lastFix(position *models.Position) *models.Position {
+	fix := &models.Position{
+		Latitude:  position.RawLatitude,
+		Longitude: position.RawLongitude,
+		Accuracy:  position.Accuracy,
+		Timestamp: position.Timestamp,
+		Source:    position.Source,
+	}
+	if position.Velocity != nil {
+		velocity := *position.Velocity
+		fix.Velocity = &velocity
+	}
+	return fix
+}
@@ -0,0 +1,689 @@
+package cluster_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/cluster"
+	"github.com/appxpy/sphere-api/internal/cluster/clustertest"
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/engine"
+	"github.com/appxpy/sphere-api/internal/geohash"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
+)
+
+// ClusterTestSuite runs several nodes in one process over the in-memory transport
+type ClusterTestSuite struct {
+	suite.Suite
+	cfg     *config.Config
+	network *cluster.MemoryNetwork
+	nodes   []*testNode
+}
+
+// testNode is a node with its own repository and engine, as one server process would have
+type testNode struct {
+	node  *cluster.Node
+	geo   *usecases.GeolocationUsecase
+	users *usecases.UsersUsecase
+	eng   *engine.Engine
+
+	mu       sync.Mutex
+	notified []string
+	entered  []string
+}
+
+// SetupTest creates an empty network
+func (t *ClusterTestSuite) SetupTest() {
+	t.cfg = config.Default()
+	t.network = cluster.NewMemoryNetwork()
+	t.nodes = nil
+}
+
+// TearDownTest stops the engines of all nodes
+func (t *ClusterTestSuite) TearDownTest() {
+	for _, node := range t.nodes {
+		node.eng.Stop()
+	}
+}
+
+// TestReplication tests that join, move and leave events of each node reach the replica of the other
+func (t *ClusterTestSuite) TestReplication() {
+	a, b := t.start("a"), t.start("b")
+
+	t.join(a, "alice", 55.75, 37.61)
+	t.join(b, "bob", 55.7501, 37.6101)
+	t.network.Settle()
+
+	for _, node := range []*testNode{a, b} {
+		t.Require().ElementsMatch([]string{"alice", "bob"}, t.clients(node))
+		t.Require().Equal("bob", t.nearest(node, "alice"), "Every replica pairs the clients in the same way")
+		t.Require().Equal("alice", t.nearest(node, "bob"))
+	}
+	t.Require().Contains(a.drain(), "bob", "The node of a remote client sees the change and notifies it")
+
+	a.eng.Do(func() {
+		t.Require().True(a.node.Remote("bob"))
+		t.Require().False(a.node.Remote("alice"))
+	})
+
+	t.move(a, "alice", 55.76, 37.62)
+	t.network.Settle()
+	b.eng.Do(func() {
+		alice, err := b.users.GetClientInfo("alice")
+		t.Require().NoError(err)
+		t.Require().InDelta(55.76, alice.Position.Latitude, 1e-9)
+	})
+
+	b.eng.Do(func() {
+		b.users.RemoveClient("bob")
+		b.geo.UpdateRelatedClients("bob")
+		b.geo.DeleteClientFromNearestReferences("bob")
+	})
+	t.network.Settle()
+	t.Require().Equal([]string{"alice"}, t.clients(a))
+	t.Require().Empty(t.nearest(a, "alice"))
+}
+
+// TestLateJoin tests that a node started later receives the clients that are already connected elsewhere
+func (t *ClusterTestSuite) TestLateJoin() {
+	a := t.start("a")
+	t.join(a, "alice", 55.75, 37.61)
+	a.eng.Do(func() {
+		t.Require().NoError(a.users.UpdateWindowSettings("alice", &models.WindowSettings{Width: 640}))
+	})
+	t.network.Settle()
+
+	c := t.start("c")
+	t.network.Settle()
+
+	c.eng.Do(func() {
+		alice, err := c.users.GetClientInfo("alice")
+		t.Require().NoError(err)
+		t.Require().True(alice.HasPosition())
+		t.Require().InDelta(55.75, alice.Position.Latitude, 1e-9)
+		t.Require().Equal(640, alice.WindowSettings.Width)
+	})
+}
+
+// TestNodeLeaves tests that clients of a stopped node disappear from the other replicas
+func (t *ClusterTestSuite) TestNodeLeaves() {
+	a, b := t.start("a"), t.start("b")
+	t.join(a, "alice", 55.75, 37.61)
+	t.join(b, "bob", 55.7501, 37.6101)
+	t.network.Settle()
+	a.drain()
+
+	b.node.Stop()
+	t.network.Settle()
+
+	t.Require().Equal([]string{"alice"}, t.clients(a))
+	t.Require().Empty(t.nearest(a, "alice"))
+	t.Require().Contains(a.drain(), "alice", "The local client learns that its nearest is gone")
+}
+
+// TestOwnership tests that a node cannot change clients of another node
+func (t *ClusterTestSuite) TestOwnership() {
+	a, b, c := t.start("a"), t.start("b"), t.start("c")
+	t.join(a, "alice", 55.75, 37.61)
+	t.network.Settle()
+
+	// A stale copy of alice on b is removed there, but the removal does not spread to the others
+	b.eng.Do(func() { b.users.RemoveClient("alice") })
+	t.network.Settle()
+
+	t.Require().Equal([]string{"alice"}, t.clients(a))
+	t.Require().Equal([]string{"alice"}, t.clients(c))
+}
+
+// TestSharedState tests that rooms, preferences, privacy, blocks and zones reach the other replicas and a node started later
+func (t *ClusterTestSuite) TestSharedState() {
+	a, b := t.start("a"), t.start("b")
+	t.join(a, "alice", 55.75, 37.61)
+	t.join(b, "bob", 55.7501, 37.6101)
+	t.join(b, "carol", 55.7502, 37.6102)
+	t.network.Settle()
+	b.drain()
+
+	maximum := 500.0
+	area, err := zones.Parse([]byte(`{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {"id": "park"},
+		"geometry": {"type": "Polygon", "coordinates": [[[37.6, 55.74], [37.62, 55.74], [37.62, 55.76], [37.6, 55.76], [37.6, 55.74]]]}}]}`))
+	t.Require().NoError(err)
+	a.eng.Do(func() {
+		_, err := a.geo.BlockClient("alice", "bob")
+		t.Require().NoError(err)
+		_, err = a.geo.SetPreferences("alice", &models.PairingPreferences{MaxDistance: &maximum})
+		t.Require().NoError(err)
+		t.Require().NoError(a.users.SetPrivacy("alice", &models.PrivacySettings{Coordinates: config.CoordinatesHidden}))
+		a.geo.AddZones(area)
+	})
+	t.network.Settle()
+
+	t.Require().Equal("carol", t.nearest(b, "bob"), "The block reaches the node of bob")
+	t.Require().Equal("carol", t.nearest(b, "alice"))
+	b.eng.Do(func() {
+		alice, err := b.users.GetClientInfo("alice")
+		t.Require().NoError(err)
+		t.Require().Equal(maximum, *alice.Preferences.MaxDistance)
+		t.Require().Equal(config.CoordinatesHidden, alice.Privacy.Coordinates)
+		t.Require().Len(b.geo.GetZones(), 1)
+	})
+	b.mu.Lock()
+	t.Require().ElementsMatch([]string{"bob", "carol", "alice"}, b.entered, "Clients of the node are told that they entered the zone")
+	b.mu.Unlock()
+
+	a.eng.Do(func() {
+		_, _, err := a.geo.JoinRoom("alice", "team", &models.RoomOptions{Limit: 4})
+		t.Require().NoError(err)
+	})
+	c := t.start("c")
+	t.network.Settle()
+	c.eng.Do(func() {
+		alice, err := c.users.GetClientInfo("alice")
+		t.Require().NoError(err)
+		t.Require().Equal("team", alice.Room)
+		t.Require().Equal(config.CoordinatesHidden, alice.Privacy.Coordinates)
+		room, ok := c.geo.GetRoom("team")
+		t.Require().True(ok)
+		t.Require().Equal(4, room.Limit)
+		t.Require().Len(c.geo.GetZones(), 1, "A new node takes the zones of the cluster")
+		t.Require().Equal(map[string][]string{"alice": {"bob"}}, c.users.Blocks())
+	})
+}
+
+// TestSharedStatePartitioned tests that blocks and zones reach nodes that hold no copy of the clients involved
+func (t *ClusterTestSuite) TestSharedStatePartitioned() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+	t.join(a, "alice", latitude, boundary-0.5)
+	t.join(b, "bob", latitude, boundary+0.5)
+	t.network.Settle()
+
+	area, err := zones.Parse([]byte(`{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {"id": "square"},
+		"geometry": {"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1], [0, 0]]]}}]}`))
+	t.Require().NoError(err)
+	a.eng.Do(func() {
+		t.Require().NoError(a.users.AddClient(&models.ClientInfo{ID: "dave"}))
+		_, err := a.geo.BlockClient("alice", "dave")
+		t.Require().NoError(err)
+		a.geo.AddZones(area)
+	})
+	t.network.Settle()
+
+	t.Require().NotContains(t.clients(b), "dave")
+	b.eng.Do(func() {
+		t.Require().Equal(map[string][]string{"alice": {"dave"}}, b.users.Blocks())
+		t.Require().Len(b.geo.GetZones(), 1)
+	})
+}
+
+// TestResync tests that a node that missed events of another node gets its clients again
+func (t *ClusterTestSuite) TestResync() {
+	a, b := t.start("a"), t.start("b")
+	t.join(a, "alice", 55.75, 37.61)
+	t.join(a, "dave", 55.70, 37.50)
+	t.join(b, "bob", 55.7501, 37.6101)
+	t.network.Settle()
+
+	t.network.Disconnect("a", "b")
+	t.move(a, "alice", 55.76, 37.62)
+	t.join(a, "carol", 55.7601, 37.6201)
+	a.eng.Do(func() {
+		t.Require().NoError(a.users.RemoveClient("dave"))
+	})
+	t.network.Settle()
+	t.Require().Equal([]string{"alice", "bob", "dave"}, t.clients(b), "The events are lost")
+
+	t.network.Reconnect("a", "b")
+	t.network.Settle()
+	t.Require().Equal([]string{"alice", "bob", "carol"}, t.clients(b))
+	t.Require().Equal("carol", t.nearest(b, "alice"))
+	b.eng.Do(func() {
+		t.Require().True(b.node.Remote("carol"))
+	})
+}
+
+// TestHTTPBackplane tests that nodes exchange events over HTTP and address each other by their node addresses
+func (t *ClusterTestSuite) TestHTTPBackplane() {
+	first, second := httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)
+	addresses := cluster.StaticDiscovery{first.Listener.Addr().String(), second.Listener.Addr().String()}
+
+	backplanes := make([]*cluster.HTTPBackplane, 0, 2)
+	for _, server := range []*httptest.Server{first, second} {
+		backplane := cluster.NewHTTPBackplane(server.Listener.Addr().String(), "secret", addresses, 0)
+		server.Config.Handler = backplane
+		server.Start()
+		defer server.Close()
+		backplanes = append(backplanes, backplane)
+	}
+
+	received := make(chan *cluster.Event, 4)
+	backplanes[1].Subscribe(func(event *cluster.Event) { received <- event })
+	backplanes[0].Subscribe(func(event *cluster.Event) {
+		t.Require().NoError(backplanes[0].Send(event.Node, &cluster.Event{Kind: cluster.EventPush, Node: addresses[0]}))
+	})
+
+	t.Require().NoError(backplanes[0].Publish(&cluster.Event{Kind: cluster.EventHello, Node: addresses[0]}))
+	t.Require().Equal(cluster.EventHello, t.receive(received).Kind)
+
+	t.Require().NoError(backplanes[1].Publish(&cluster.Event{Kind: cluster.EventHello, Node: addresses[1]}))
+	t.Require().Equal(cluster.EventPush, t.receive(received).Kind, "Replies go to the address of the sender")
+
+	for _, backplane := range backplanes {
+		t.Require().NoError(backplane.Close())
+	}
+	t.Require().Error(backplanes[0].Publish(&cluster.Event{Kind: cluster.EventLeave}))
+}
+
+// TestHTTPAuthentication tests that only signed events of discovered nodes are accepted
+func (t *ClusterTestSuite) TestHTTPAuthentication() {
+	discovery := cluster.StaticDiscovery{"10.0.0.1:7946", "10.0.0.2:7946"}
+	receiver := cluster.NewHTTPBackplane("10.0.0.1:7946", "secret", discovery, 0)
+	defer receiver.Close()
+	received := make(chan *cluster.Event, 1)
+	receiver.Subscribe(func(event *cluster.Event) { received <- event })
+
+	signer := cluster.NewHTTPBackplane("10.0.0.2:7946", "secret", discovery, 0)
+	defer signer.Close()
+	forger := cluster.NewHTTPBackplane("10.0.0.2:7946", "guess", discovery, 0)
+	defer forger.Close()
+
+	post := func(signer *cluster.HTTPBackplane, body string) int {
+		request := httptest.NewRequest(http.MethodPost, cluster.Path, strings.NewReader(body))
+		if signer != nil {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			request.Header.Set(cluster.TimestampHeader, timestamp)
+			request.Header.Set(cluster.SignatureHeader, hex.EncodeToString(signer.Sign(timestamp, []byte(body))))
+		}
+		recorder := httptest.NewRecorder()
+		receiver.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	hello := `{"kind": "hello", "node": "10.0.0.2:7946"}`
+	t.Require().Equal(http.StatusUnauthorized, post(nil, hello))
+	t.Require().Equal(http.StatusUnauthorized, post(forger, hello))
+	t.Require().Equal(http.StatusForbidden, post(signer, `{"kind": "hello", "node": "169.254.169.254:80"}`),
+		"A node outside discovery cannot join the cluster")
+	t.Require().Equal(http.StatusBadRequest, post(signer, `{"kind": "lost", "node": "10.0.0.2:7946"}`),
+		"Lost events are produced only by the local transport")
+	t.Require().Equal(http.StatusRequestEntityTooLarge, post(signer, strings.Repeat(" ", cluster.MaxEventSize+1)))
+	t.Require().Empty(received)
+
+	t.Require().Equal(http.StatusNoContent, post(signer, hello))
+	t.Require().Equal("10.0.0.2:7946", t.receive(received).Node)
+}
+
+// TestHTTPRetry tests that an event the receiver could not take yet is delivered once it can
+func (t *ClusterTestSuite) TestHTTPRetry() {
+	first, second := httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)
+	addresses := cluster.StaticDiscovery{first.Listener.Addr().String(), second.Listener.Addr().String()}
+
+	sender := cluster.NewHTTPBackplane(addresses[0], "secret", addresses, 0)
+	receiver := cluster.NewHTTPBackplane(addresses[1], "secret", addresses, 0)
+	first.Config.Handler, second.Config.Handler = sender, receiver
+	for _, server := range []*httptest.Server{first, second} {
+		server.Start()
+		defer server.Close()
+	}
+
+	// The receiver answers 503 until it has a handler
+	t.Require().NoError(sender.Send(addresses[1], &cluster.Event{Kind: cluster.EventHello, Node: addresses[0]}))
+	time.Sleep(50 * time.Millisecond)
+	received := make(chan *cluster.Event, 1)
+	receiver.Subscribe(func(event *cluster.Event) { received <- event })
+	t.Require().Equal(cluster.EventHello, t.receive(received).Kind)
+
+	t.Require().NoError(sender.Close())
+	t.Require().NoError(receiver.Close())
+}
+
+// TestQueueOverflow tests that a full queue drops its events and reports the loss instead of growing
+func (t *ClusterTestSuite) TestQueueOverflow() {
+	release := make(chan struct{})
+	delivered := make([]string, 0)
+	lost := make(chan struct{}, 1)
+	queue := cluster.NewQueue(2, func(data []byte) bool {
+		if string(data) == "first" {
+			<-release
+		}
+		delivered = append(delivered, string(data))
+		return true
+	}, func() { lost <- struct{}{} })
+
+	for _, event := range []string{"first", "second", "third", "fourth"} {
+		t.Require().True(queue.Push([]byte(event)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	select {
+	case <-lost:
+	case <-time.After(2 * time.Second):
+		t.FailNow("The loss is not reported")
+	}
+	queue.Close()
+	t.Require().Equal([]string{"first", "fourth"}, delivered, "Events waiting in the full queue are dropped")
+}
+
+// TestDNSDiscovery tests that every address of the name becomes a node with the common port
+func (t *ClusterTestSuite) TestDNSDiscovery() {
+	peers, err := cluster.NewDNSDiscovery("localhost", 9000).Peers()
+	t.Require().NoError(err)
+	t.Require().Contains(peers, "127.0.0.1:9000")
+}
+
+// TestRing tests that cells are spread over all nodes and that a new node takes cells only from the others
+func (t *ClusterTestSuite) TestRing() {
+	before := cluster.NewRing([]string{"a", "b", "c"}, cluster.RingReplicas)
+	after := cluster.NewRing([]string{"c", "b", "a", "d"}, cluster.RingReplicas)
+
+	counts := make(map[string]int)
+	for i := range 4000 {
+		cell := geohash.Encode(float64(i%80)-40, float64(i/80)*7-175, 4)
+		owner, moved := before.Owner(cell), after.Owner(cell)
+		counts[owner]++
+		if moved != owner {
+			t.Require().Equal("d", moved, "Cell %s moved to an old node", cell)
+		}
+	}
+
+	t.Require().Len(counts, 3)
+	for node, count := range counts {
+		t.Require().Greater(count, 4000/3/2, "Node %s owns too few cells", node)
+	}
+	t.Require().Empty(cluster.NewRing(nil, cluster.RingReplicas).Owner("ucfv"))
+}
+
+// TestPartitionHalo tests that a client near a cell boundary is visible to the node of the neighbouring cell
+// only while it stays within the halo
+func (t *ClusterTestSuite) TestPartitionHalo() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+
+	t.join(a, "alice", latitude, boundary-0.01)
+	t.join(b, "bob", latitude, boundary+0.01)
+	t.join(b, "carol", latitude, boundary+0.025)
+	t.network.Settle()
+
+	for _, node := range []*testNode{a, b} {
+		t.Require().ElementsMatch([]string{"alice", "bob", "carol"}, t.clients(node))
+	}
+	t.Require().Equal("bob", t.nearest(a, "alice"), "The nearest is found across the boundary")
+	t.Require().Equal("carol", t.nearest(b, "bob"))
+
+	t.move(a, "alice", latitude, boundary-0.5)
+	t.network.Settle()
+	t.Require().Equal([]string{"bob", "carol"}, t.clients(b), "The copy is removed outside the halo")
+	t.Require().Equal("bob", t.nearest(a, "alice"), "The copy of bob stays within the halo of the cell of alice")
+}
+
+// TestPartitionFanOut tests that a client without a nearest within the halo finds one in a cell of another node
+// and that the other node keeps the copy only while the search needs it
+func (t *ClusterTestSuite) TestPartitionFanOut() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+
+	t.join(a, "alice", latitude, boundary-0.5)
+	t.join(b, "bob", latitude, boundary+0.5)
+	t.Require().Eventually(func() bool {
+		t.network.Settle()
+		return t.nearest(a, "alice") == "bob" && t.nearest(b, "bob") == "alice"
+	}, 2*time.Second, 10*time.Millisecond, "The nearest is found beyond the halo")
+
+	t.move(b, "bob", latitude, boundary+0.4)
+	t.network.Settle()
+	a.eng.Do(func() {
+		bob, err := a.users.GetClientInfo("bob")
+		t.Require().NoError(err)
+		t.Require().InDelta(boundary+0.4, bob.Position.RawLongitude, 1e-9, "The copy follows the client within the search")
+	})
+
+	t.join(a, "carol", latitude, boundary-0.49)
+	t.move(a, "alice", latitude, boundary-0.501)
+	t.Require().Eventually(func() bool {
+		t.network.Settle()
+		return slices.Equal(t.clients(a), []string{"alice", "carol"})
+	}, 2*time.Second, 10*time.Millisecond, "The copy is released once the nearest is within the halo")
+	t.Require().Equal("carol", t.nearest(a, "alice"))
+}
+
+// TestPartitionHandoff tests that a client crossing into a cell of another node moves to that node
+func (t *ClusterTestSuite) TestPartitionHandoff() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+
+	area, err := zones.Parse([]byte(fmt.Sprintf(`{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {"id": "strip"},
+		"geometry": {"type": "Polygon", "coordinates": [[[%[1]f, %[3]f], [%[2]f, %[3]f], [%[2]f, %[4]f], [%[1]f, %[4]f], [%[1]f, %[3]f]]]}}]}`,
+		boundary-1, boundary+1, latitude-0.3, latitude+0.3)))
+	t.Require().NoError(err)
+	a.eng.Do(func() {
+		a.geo.AddZones(area)
+	})
+	t.network.Settle()
+
+	t.join(a, "alice", latitude, boundary-0.5)
+	t.join(b, "bob", latitude, boundary+0.5)
+	a.eng.Do(func() {
+		t.Require().NoError(a.users.UpdateWindowSettings("alice", &models.WindowSettings{Width: 640}))
+		_, _, err := a.geo.JoinRoom("alice", "hall", &models.RoomOptions{Limit: 4})
+		t.Require().NoError(err)
+	})
+	b.eng.Do(func() {
+		_, _, err := b.geo.JoinRoom("bob", "hall", nil)
+		t.Require().NoError(err)
+	})
+	t.network.Settle()
+	b.mu.Lock()
+	b.entered = nil
+	b.mu.Unlock()
+
+	t.move(a, "alice", latitude, boundary+0.49)
+	t.Require().Eventually(func() bool {
+		t.network.Settle()
+		return slices.Equal(t.clients(a), []string{}) && slices.Equal(t.clients(b), []string{"alice", "bob"})
+	}, 2*time.Second, 10*time.Millisecond)
+
+	b.eng.Do(func() {
+		t.Require().False(b.node.Remote("alice"), "The client belongs to the new node")
+		t.Require().True(b.users.IsDetached("alice"), "The client waits to reconnect")
+
+		alice, err := b.users.GetClientInfo("alice")
+		t.Require().NoError(err)
+		t.Require().Equal(640, alice.WindowSettings.Width)
+		t.Require().Equal("hall", alice.Room, "The client keeps its room")
+		t.Require().Equal([]string{"strip"}, alice.Zones)
+		t.Require().Equal("bob", alice.Position.ClosestClientID)
+	})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t.Require().NotContains(b.entered, "alice", "The client does not enter the zone it already was in")
+}
+
+// TestPartitionHandoffMargin tests that a client just across the boundary stays on its node
+func (t *ClusterTestSuite) TestPartitionHandoffMargin() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+
+	t.join(a, "alice", latitude, boundary-0.01)
+	t.move(a, "alice", latitude, boundary+0.005)
+	t.Require().Never(func() bool {
+		t.network.Settle()
+		return !t.owns(a, "alice")
+	}, 200*time.Millisecond, 10*time.Millisecond, "The client within the margin is not handed off")
+
+	t.move(a, "alice", latitude, boundary+0.05)
+	t.Require().Eventually(func() bool {
+		t.network.Settle()
+		return t.owns(b, "alice") && !t.owns(a, "alice")
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestPartitionHandoffTimeout tests that a client stays on its node until the new node accepts it
+// and is handed off again after an unanswered handoff
+func (t *ClusterTestSuite) TestPartitionHandoffTimeout() {
+	t.cfg.Cluster.Mode = config.ClusterPartitioned
+	t.cfg.Cluster.Partition.HandoffTimeout = 50 * time.Millisecond
+	a, b := t.start("a"), t.start("b")
+	t.network.Settle()
+	latitude, boundary := clustertest.Boundary(t.T(), []string{"a", "b"}, t.cfg.Cluster.Partition.CellPrecision, "a", "b")
+
+	t.join(a, "alice", latitude, boundary-0.5)
+	t.network.Settle()
+	t.network.Disconnect("a", "b")
+	t.move(a, "alice", latitude, boundary+0.49)
+	t.Require().Never(func() bool {
+		t.network.Settle()
+		return !t.owns(a, "alice")
+	}, 200*time.Millisecond, 10*time.Millisecond, "The client stays while the handoff is not accepted")
+
+	t.network.Reconnect("a", "b")
+	t.network.Settle()
+	t.move(a, "alice", latitude, boundary+0.48)
+	t.Require().Eventually(func() bool {
+		t.network.Settle()
+		return t.owns(b, "alice") && !slices.Contains(t.clients(a), "alice")
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestUnknownMode tests that a node is not created with an unknown cluster mode
+func (t *ClusterTestSuite) TestUnknownMode() {
+	t.cfg.Cluster.Mode = "sharded"
+	_, err := cluster.New("a", t.network.Join("a"), nil, nil, t.cfg.Cluster)
+	t.Require().ErrorIs(err, util.ErrUnknownClusterMode)
+}
+
+// start creates a node with a fresh repository and engine and connects it to the network
+func (t *ClusterTestSuite) start(id string) *testNode {
+	repo, err := storage.New(t.cfg.Storage)
+	t.Require().NoError(err)
+
+	node := &testNode{
+		geo:   usecases.NewGeolocationUsecase(repo, t.cfg.Geolocation),
+		users: usecases.NewUsersUsecase(repo, t.cfg.Privacy),
+		eng:   engine.New(),
+	}
+	node.node, err = cluster.New(id, t.network.Join(id), node.geo, node.users, t.cfg.Cluster)
+	t.Require().NoError(err)
+	node.geo.SetJournal(node.node)
+	node.users.SetJournal(node.node)
+
+	go node.eng.Run()
+	node.node.Start(node.eng.Do, node.notify, node.transitions)
+	t.nodes = append(t.nodes, node)
+	return node
+}
+
+// join adds a client to the node and positions it
+func (t *ClusterTestSuite) join(node *testNode, id string, latitude, longitude float64) {
+	node.eng.Do(func() {
+		node.users.AddClient(&models.ClientInfo{ID: id})
+	})
+	t.move(node, id, latitude, longitude)
+}
+
+// move updates the position of a client of the node
+func (t *ClusterTestSuite) move(node *testNode, id string, latitude, longitude float64) {
+	node.eng.Do(func() {
+		_, err := node.geo.UpdatePosition(id, &models.Position{Latitude: latitude, Longitude: longitude})
+		t.Require().NoError(err)
+	})
+}
+
+// clients lists the sorted client IDs of the node replica
+func (t *ClusterTestSuite) clients(node *testNode) []string {
+	ids := make([]string, 0)
+	node.eng.Do(func() {
+		for _, client := range node.users.GetClients() {
+			ids = append(ids, client.ID)
+		}
+	})
+	slices.Sort(ids)
+	return ids
+}
+
+// owns reports whether the client is connected to the node rather than copied from another node
+func (t *ClusterTestSuite) owns(node *testNode, id string) bool {
+	var owns bool
+	node.eng.Do(func() {
+		_, err := node.users.GetClientInfo(id)
+		owns = err == nil && !node.node.Remote(id)
+	})
+	return owns
+}
+
+// nearest returns the nearest of a client in the node replica
+func (t *ClusterTestSuite) nearest(node *testNode, id string) string {
+	var nearest string
+	node.eng.Do(func() {
+		client, err := node.users.GetClientInfo(id)
+		t.Require().NoError(err)
+		nearest = client.Position.ClosestClientID
+	})
+	return nearest
+}
+
+// receive waits for an event delivered by a backplane
+func (t *ClusterTestSuite) receive(events chan *cluster.Event) *cluster.Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.FailNow("No event received")
+		return nil
+	}
+}
+
+// notify collects the clients the node would notify
+func (n *testNode) notify(notify []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notified = append(n.notified, notify...)
+}
+
+// transitions collects the clients the node would notify about entering a zone
+func (n *testNode) transitions(transitions []*models.ZoneTransition) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, transition := range transitions {
+		if transition.Entered {
+			n.entered = append(n.entered, transition.ClientID)
+		}
+	}
+}
+
+// drain returns and forgets the collected notifications
+func (n *testNode) drain() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notified := n.notified
+	n.notified = nil
+	return notified
+}
+
+func TestClusterTestSuite(t *testing.T) {
+	suite.Run(t, new(ClusterTestSuite))
+}
@@ -0,0 +1,187 @@
+// Package clustertest - Кластер из нескольких узлов в одном процессе для тестов. Узлы обмениваются событиями через
+// MemoryNetwork, а клиенты подключаются к ним через httptest и сами переходят на новый узел при передаче сессии.
+package clustertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appxpy/sphere-api/internal/cluster"
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/geohash"
+	"github.com/appxpy/sphere-api/internal/storage"
+	transport "github.com/appxpy/sphere-api/internal/transport/websocket"
+	"github.com/appxpy/sphere-api/internal/usecases"
+)
+
+// Timeout - Сколько клиент ждет сообщения
+const Timeout = 2 * time.Second
+
+// Cluster - Запущенные узлы и их сеть
+type Cluster struct {
+	t       testing.TB
+	cfg     *config.Config
+	network *cluster.MemoryNetwork
+	nodes   map[string]*Node
+}
+
+// Node - Узел со своим хранилищем, обработчиком и сервером
+type Node struct {
+	ID      string
+	Handler *transport.Handler
+	Server  *httptest.Server
+}
+
+// New - Запускает узлы ids с настройками cfg. Узлы останавливаются в конце теста.
+func New(t testing.TB, cfg *config.Config, ids ...string) *Cluster {
+	c := &Cluster{t: t, cfg: cfg, network: cluster.NewMemoryNetwork(), nodes: make(map[string]*Node)}
+	for _, id := range ids {
+		c.Start(id)
+	}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.Stop(id)
+		}
+	})
+	return c
+}
+
+// Start - Запускает узел id на свежем хранилище и подключает его к сети
+func (c *Cluster) Start(id string) *Node {
+	repo, err := storage.New(c.cfg.Storage)
+	require.NoError(c.t, err)
+
+	handler := transport.NewHandler(c.cfg, usecases.NewGeolocationUsecase(repo, c.cfg.Geolocation), usecases.NewUsersUsecase(repo, c.cfg.Privacy))
+	require.NoError(c.t, handler.JoinCluster(id, c.network.Join(id)))
+	handler.Start()
+
+	node := &Node{ID: id, Handler: handler, Server: httptest.NewServer(http.HandlerFunc(handler.HandleWS))}
+	c.nodes[id] = node
+	c.Settle()
+	return node
+}
+
+// Stop - Останавливает узел id
+func (c *Cluster) Stop(id string) {
+	node, ok := c.nodes[id]
+	if !ok {
+		return
+	}
+	delete(c.nodes, id)
+
+	node.Server.Close()
+	node.Handler.Stop()
+}
+
+// Node - Запущенный узел id
+func (c *Cluster) Node(id string) *Node {
+	node, ok := c.nodes[id]
+	require.True(c.t, ok, "Unknown node %s", id)
+	return node
+}
+
+// Settle - Ждет, пока узлы получат все отправленные события
+func (c *Cluster) Settle() {
+	c.network.Settle()
+}
+
+// Dial - Подключает клиента с идентичностью identity к узлу id и ждет, пока о нем узнают остальные узлы
+func (c *Cluster) Dial(id, identity string) *Client {
+	client := &Client{cluster: c, identity: identity}
+	client.connect(id, "")
+
+	client.Send(`{"type": "WhoAmIRequest", "data": {}}`)
+	client.ID, _ = client.Await("WhoAmIResponse")["client_id"].(string)
+	c.Settle()
+	return client
+}
+
+// Client - Клиент, подключенный к одному из узлов
+type Client struct {
+	cluster  *Cluster
+	identity string
+
+	// ID - Идентификатор клиента, который сохраняется при передаче другому узлу
+	ID string
+	// Node - Узел, к которому клиент подключен сейчас
+	Node string
+	Conn *websocket.Conn
+}
+
+// Send - Отправляет сообщение как есть
+func (c *Client) Send(message string) {
+	require.NoError(c.cluster.t, c.Conn.WriteMessage(websocket.TextMessage, []byte(message)))
+}
+
+// Await - Читает сообщения, пока не придет сообщение типа messageType, и возвращает его данные. Получив
+// HandoffResponse, клиент переподключается к указанному узлу с токеном передачи.
+func (c *Client) Await(messageType string) map[string]any {
+	c.Conn.SetReadDeadline(time.Now().Add(Timeout))
+	for {
+		var message struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		}
+		require.NoError(c.cluster.t, c.Conn.ReadJSON(&message), "Client %s is waiting for %s", c.ID, messageType)
+
+		if message.Type == messageType {
+			return message.Data
+		}
+		if message.Type == "HandoffResponse" {
+			node, _ := message.Data["node"].(string)
+			token, _ := message.Data["token"].(string)
+			c.Conn.Close()
+			c.connect(node, token)
+		}
+	}
+}
+
+// Close - Закрывает соединение
+func (c *Client) Close() {
+	c.Conn.Close()
+}
+
+func (c *Client) connect(node, token string) {
+	query := url.Values{}
+	if c.identity != "" {
+		query.Set("identity", c.identity)
+	}
+	if token != "" {
+		query.Set("handoff", token)
+	}
+
+	address := "ws" + strings.TrimPrefix(c.cluster.Node(node).Server.URL, "http") + "?" + query.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(address, nil)
+	require.NoError(c.cluster.t, err)
+
+	c.Conn, c.Node = conn, node
+	c.Conn.SetReadDeadline(time.Now().Add(Timeout))
+}
+
+// Boundary - Точка на границе двух соседних по долготе ячеек точности precision, западная из которых принадлежит
+// узлу west, а восточная узлу east в кластере из nodes. Широта точки - середина ячеек.
+func Boundary(t testing.TB, nodes []string, precision int, west, east string) (latitude, longitude float64) {
+	ring := cluster.NewRing(nodes, cluster.RingReplicas)
+	for _, row := range []float64{55.75, 40.7, -33.9, 0} {
+		for longitude := -179.0; longitude < 179; {
+			box := geohash.Decode(geohash.Encode(row, longitude, precision))
+			latitude, _ := box.Center()
+			next := box.MaxLongitude + (box.MaxLongitude-box.MinLongitude)/2
+
+			if ring.Owner(geohash.Encode(latitude, longitude, precision)) == west && ring.Owner(geohash.Encode(latitude, next, precision)) == east {
+				return latitude, box.MaxLongitude
+			}
+			longitude = next
+		}
+	}
+
+	require.FailNow(t, "No boundary between the cells of the nodes", "%s and %s", west, east)
+	return 0, 0
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// dnsTimeout - Сколько ждать ответа DNS при обновлении списка узлов
+const dnsTimeout = 5 * time.Second
+
+// Discovery - Источник адресов узлов кластера (host:port). Список может включать и сам узел.
+type Discovery interface {
+	Peers() ([]string, error)
+}
+
+// StaticDiscovery - Неизменный список адресов узлов
+type StaticDiscovery []string
+
+func (d StaticDiscovery) Peers() ([]string, error) {
+	return slices.Clone(d), nil
+}
+
+// DNSDiscovery - Узлы по всем адресам имени name с общим портом port, например headless-сервис Kubernetes
+type DNSDiscovery struct {
+	name     string
+	port     int
+	resolver *net.Resolver
+}
+
+func NewDNSDiscovery(name string, port int) *DNSDiscovery {
+	return &DNSDiscovery{name: name, port: port, resolver: net.DefaultResolver}
+}
+
+func (d *DNSDiscovery) Peers() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	addresses, err := d.resolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		peers = append(peers, net.JoinHostPort(address, strconv.Itoa(d.port)))
+	}
+	slices.Sort(peers)
+	return slices.Compact(peers), nil
+}
@@ -0,0 +1,24 @@
+package cluster
+
+// Экспорт подписи событий и очереди отправки для тестов во внешнем тестовом пакете
+const (
+	TimestampHeader = timestampHeader
+	SignatureHeader = signatureHeader
+	MaxEventSize    = maxEventSize
+)
+
+type Queue = queue
+
+var NewQueue = newQueue
+
+func (b *HTTPBackplane) Sign(timestamp string, data []byte) []byte {
+	return b.sign(timestamp, data)
+}
+
+func (q *queue) Push(data []byte) bool {
+	return q.push(data)
+}
+
+func (q *queue) Close() {
+	q.close()
+}
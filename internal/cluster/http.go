@@ -0,0 +1,370 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// Path - Путь, по которому узел принимает события других узлов
+const Path = "/cluster"
+
+const (
+	// httpTimeout - Сколько ждать, пока другой узел примет событие
+	httpTimeout = 5 * time.Second
+	// retryDelay, maxRetryDelay - Первая и наибольшая пауза между попытками доставить событие
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+	// maxEventSize - Наибольший размер события, как и записи журнала
+	maxEventSize = 16 << 20
+	// signatureWindow - Насколько момент подписи события может расходиться с часами получателя
+	signatureWindow = time.Minute
+	// rediscoverInterval - Как часто событие от неизвестного узла может вызвать внеочередной опрос discovery
+	rediscoverInterval = time.Second
+
+	timestampHeader = "X-Sphere-Timestamp"
+	signatureHeader = "X-Sphere-Signature"
+)
+
+// HTTPBackplane - Транспорт поверх HTTP: события отправляются POST-запросами на Path каждого узла, у каждого узла
+// своя очередь, поэтому медленный узел не задерживает остальных. Недоставленное событие повторяется, пока узел
+// есть в discovery; если очередь узла все же отброшена, обработчик получает EventLost.
+//
+// Каждое событие подписывается HMAC-SHA256 общего секрета вместе с моментом отправки, а принимаются только
+// подписанные события от узлов из discovery. Подпись не защищает от повтора перехваченного запроса в пределах
+// signatureWindow, поэтому внутренний слушатель должен быть доступен только узлам.
+type HTTPBackplane struct {
+	node      string
+	secret    []byte
+	discovery Discovery
+	client    *http.Client
+
+	mu sync.Mutex
+	// peers - Адреса узлов из последнего успешного опроса discovery, refreshed - момент этого опроса,
+	// queues - очереди отправки по адресам
+	peers     []string
+	refreshed time.Time
+	queues    map[string]*queue
+	// stale - Узлы, события которых были отброшены, пока их не было в discovery
+	stale   map[string]struct{}
+	handler func(event *Event)
+	closed  bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewHTTPBackplane - Создает транспорт узла с адресом node и общим секретом узлов secret и сразу опрашивает
+// discovery. Если refresh больше нуля, список узлов обновляется с этим периодом.
+func NewHTTPBackplane(node, secret string, discovery Discovery, refresh time.Duration) *HTTPBackplane {
+	b := &HTTPBackplane{
+		node:      node,
+		secret:    []byte(secret),
+		discovery: discovery,
+		client:    &http.Client{Timeout: httpTimeout},
+		queues:    make(map[string]*queue),
+		stale:     make(map[string]struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	b.refresh()
+
+	go b.refreshPeers(refresh)
+	return b
+}
+
+func (b *HTTPBackplane) Publish(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return util.ErrBackplaneClosed
+	}
+	for _, peer := range b.peers {
+		if peer != b.node {
+			b.queue(peer).push(data)
+		}
+	}
+	return nil
+}
+
+func (b *HTTPBackplane) Send(node string, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return util.ErrBackplaneClosed
+	}
+	b.queue(node).push(data)
+	return nil
+}
+
+func (b *HTTPBackplane) Subscribe(handler func(event *Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+}
+
+// Close - Прекращает обновлять список узлов и ждет отправки уже поставленных в очереди событий. Неудачные
+// попытки после закрытия не повторяются.
+func (b *HTTPBackplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	queues := b.queues
+	b.mu.Unlock()
+
+	close(b.done)
+	<-b.stopped
+	for _, q := range queues {
+		q.close()
+	}
+	return nil
+}
+
+// ServeHTTP - Принимает подписанное событие узла из discovery и отвечает после его обработки
+func (b *HTTPBackplane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Cluster event is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid cluster event", http.StatusBadRequest)
+		return
+	}
+	if !b.verify(r.Header, data, time.Now()) {
+		http.Error(w, "Invalid cluster event signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil || event.Kind == EventLost {
+		http.Error(w, "Invalid cluster event", http.StatusBadRequest)
+		return
+	}
+	if !b.known(event.Node) {
+		http.Error(w, "Unknown cluster node", http.StatusForbidden)
+		return
+	}
+
+	b.mu.Lock()
+	handler := b.handler
+	b.mu.Unlock()
+	if handler == nil {
+		http.Error(w, "Cluster node is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	handler(&event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Возвращает очередь отправки узлу peer, создавая ее при первом обращении. Вызывается под мьютексом.
+func (b *HTTPBackplane) queue(peer string) *queue {
+	q, ok := b.queues[peer]
+	if !ok {
+		q = newQueue(queueLimit, func(data []byte) bool { return b.post(peer, data) }, func() { b.lose(peer) })
+		b.queues[peer] = q
+	}
+	return q
+}
+
+// Доставляет событие узлу peer. Неудачные попытки повторяются с растущей паузой, пока узел есть в discovery
+// и транспорт не закрыт. Событие, которое получатель отверг как некорректное, не повторяется.
+func (b *HTTPBackplane) post(peer string, data []byte) bool {
+	delay := retryDelay
+	for {
+		if !b.discovered(peer) {
+			logging.ErrorLogger.Printf("Dropped cluster events for %s: the node is not discovered", peer)
+			return false
+		}
+
+		retry, err := b.attempt(peer, data)
+		if err == nil {
+			return true
+		}
+		logging.ErrorLogger.Printf("Failed to send cluster event to %s: %v", peer, err)
+		if !retry {
+			return false
+		}
+
+		select {
+		case <-b.done:
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// Одна попытка доставки. retry - имеет ли смысл повторить неудачную попытку.
+func (b *HTTPBackplane) attempt(peer string, data []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, "http://"+peer+Path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(timestampHeader, timestamp)
+	request.Header.Set(signatureHeader, hex.EncodeToString(b.sign(timestamp, data)))
+
+	response, err := b.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNoContent:
+		return false, nil
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return false, fmt.Errorf("event rejected with status %s", response.Status)
+	}
+	return true, fmt.Errorf("unexpected status %s", response.Status)
+}
+
+// Подпись тела события вместе с моментом отправки
+func (b *HTTPBackplane) sign(timestamp string, data []byte) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'\n'})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Проверяет подпись события и то, что оно подписано не раньше и не позже signatureWindow от now
+func (b *HTTPBackplane) verify(header http.Header, data []byte, now time.Time) bool {
+	timestamp := header.Get(timestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > signatureWindow || skew < -signatureWindow {
+		return false
+	}
+
+	signature, err := hex.DecodeString(header.Get(signatureHeader))
+	return err == nil && hmac.Equal(signature, b.sign(timestamp, data))
+}
+
+// Проверяет, что событие пришло от другого узла из discovery. Узел, запустившийся после последнего опроса,
+// находится внеочередным опросом, но не чаще rediscoverInterval.
+func (b *HTTPBackplane) known(node string) bool {
+	if node == b.node {
+		return false
+	}
+	if b.discovered(node) {
+		return true
+	}
+
+	b.mu.Lock()
+	due := time.Since(b.refreshed) >= rediscoverInterval
+	b.mu.Unlock()
+	if !due {
+		return false
+	}
+	b.refresh()
+	return b.discovered(node)
+}
+
+func (b *HTTPBackplane) discovered(node string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Contains(b.peers, node)
+}
+
+// Узел peer пропустил события. Узел из discovery сразу получает EventLost, остальные - когда снова появятся в discovery.
+func (b *HTTPBackplane) lose(peer string) {
+	b.mu.Lock()
+	handler, closed := b.handler, b.closed
+	discovered := slices.Contains(b.peers, peer)
+	if !discovered && !closed {
+		b.stale[peer] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	if discovered && !closed && handler != nil {
+		handler(&Event{Kind: EventLost, Node: peer})
+	}
+}
+
+func (b *HTTPBackplane) refreshPeers(interval time.Duration) {
+	defer close(b.stopped)
+	if interval <= 0 {
+		<-b.done
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.refresh()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *HTTPBackplane) refresh() {
+	peers, err := b.discovery.Peers()
+
+	b.mu.Lock()
+	b.refreshed = time.Now()
+	if err != nil {
+		b.mu.Unlock()
+		logging.ErrorLogger.Printf("Failed to discover cluster nodes: %v", err)
+		return
+	}
+	b.peers = peers
+
+	returned := make([]string, 0)
+	for peer := range b.stale {
+		if slices.Contains(peers, peer) {
+			delete(b.stale, peer)
+			returned = append(returned, peer)
+		}
+	}
+	handler, closed := b.handler, b.closed
+	b.mu.Unlock()
+
+	if handler == nil || closed {
+		return
+	}
+	for _, peer := range returned {
+		handler(&Event{Kind: EventLost, Node: peer})
+	}
+}
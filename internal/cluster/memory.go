@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// MemoryNetwork - Сеть узлов в одном процессе. События проходят через JSON, как по сети, и доставляются
+// каждому узлу в его собственной горутине.
+type MemoryNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*MemoryBackplane
+	// cut - Направления от узла к узлу, события по которым теряются
+	cut map[[2]string]struct{}
+
+	// pending - События, отправленные, но еще не обработанные получателем
+	pending int
+	settled *sync.Cond
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	network := &MemoryNetwork{nodes: make(map[string]*MemoryBackplane), cut: make(map[[2]string]struct{})}
+	network.settled = sync.NewCond(&network.mu)
+	return network
+}
+
+// Join - Подключает к сети узел с идентификатором node
+func (n *MemoryNetwork) Join(node string) *MemoryBackplane {
+	backplane := &MemoryBackplane{network: n, node: node}
+	backplane.inbox = newQueue(0, func(data []byte) bool {
+		backplane.receive(data)
+		return true
+	}, func() {})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[node] = backplane
+	return backplane
+}
+
+// Settle - Ждет, пока все отправленные события, включая порожденные их обработкой, будут обработаны
+func (n *MemoryNetwork) Settle() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.pending > 0 {
+		n.settled.Wait()
+	}
+}
+
+// Disconnect - Теряет события, которые узел from отправляет узлу to
+func (n *MemoryNetwork) Disconnect(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[[2]string{from, to}] = struct{}{}
+}
+
+// Reconnect - Снова доставляет события узла from узлу to и сообщает узлу from, что часть событий потеряна
+func (n *MemoryNetwork) Reconnect(from, to string) {
+	data, _ := json.Marshal(&Event{Kind: EventLost, Node: to})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.cut, [2]string{from, to})
+	if source, ok := n.nodes[from]; ok && source.inbox.push(data) {
+		n.pending++
+	}
+}
+
+func (n *MemoryNetwork) send(from, to string, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	target, ok := n.nodes[to]
+	if !ok || to == from {
+		return util.ErrUnknownClusterNode
+	}
+	if _, lost := n.cut[[2]string{from, to}]; lost {
+		return nil
+	}
+	n.pending++
+	if !target.inbox.push(data) {
+		n.pending--
+		return util.ErrUnknownClusterNode
+	}
+	return nil
+}
+
+func (n *MemoryNetwork) broadcast(from string, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for node, target := range n.nodes {
+		if _, lost := n.cut[[2]string{from, node}]; lost {
+			continue
+		}
+		if node != from && target.inbox.push(data) {
+			n.pending++
+		}
+	}
+}
+
+func (n *MemoryNetwork) done() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending--
+	if n.pending == 0 {
+		n.settled.Broadcast()
+	}
+}
+
+func (n *MemoryNetwork) leave(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, node)
+}
+
+// MemoryBackplane - Транспорт узла сети MemoryNetwork
+type MemoryBackplane struct {
+	network *MemoryNetwork
+	node    string
+	inbox   *queue
+
+	mu      sync.Mutex
+	handler func(event *Event)
+	closed  bool
+}
+
+func (b *MemoryBackplane) Publish(event *Event) error {
+	data, err := b.encode(event)
+	if err != nil {
+		return err
+	}
+	b.network.broadcast(b.node, data)
+	return nil
+}
+
+func (b *MemoryBackplane) Send(node string, event *Event) error {
+	data, err := b.encode(event)
+	if err != nil {
+		return err
+	}
+	return b.network.send(b.node, node, data)
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(event *Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+}
+
+// Close - Отключает узел от сети, обработав уже полученные события
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	b.network.leave(b.node)
+	b.inbox.close()
+	return nil
+}
+
+func (b *MemoryBackplane) encode(event *Event) ([]byte, error) {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return nil, util.ErrBackplaneClosed
+	}
+	return json.Marshal(event)
+}
+
+func (b *MemoryBackplane) receive(data []byte) {
+	defer b.network.done()
+
+	b.mu.Lock()
+	handler := b.handler
+	b.mu.Unlock()
+	if handler == nil {
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		logging.ErrorLogger.Printf("Failed to decode cluster event: %v", err)
+		return
+	}
+	handler(&event)
+}
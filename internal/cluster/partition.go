@@ -0,0 +1,538 @@
+package cluster
+
+import (
+	"math"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/geohash"
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// partition - Деление ячеек geohash между узлами кольцом консистентного хеширования
+type partition struct {
+	precision int
+	halo      float64
+	margin    float64
+	timeout   time.Duration
+	grace     time.Duration
+	ring      *Ring
+}
+
+func newPartition(cfg config.Partition) *partition {
+	return &partition{
+		precision: cfg.CellPrecision,
+		halo:      cfg.Halo,
+		margin:    cfg.HandoffMargin,
+		timeout:   cfg.HandoffTimeout,
+		grace:     cfg.HandoffGrace,
+		ring:      NewRing(nil, RingReplicas),
+	}
+}
+
+// owner - Узел ячейки, в которой лежит точка
+func (p *partition) owner(latitude, longitude float64) string {
+	return p.ring.Owner(geohash.Encode(latitude, longitude, p.precision))
+}
+
+// nearby - Узлы ячейки точки и соседних ячеек, до которых от точки не дальше halo
+func (p *partition) nearby(latitude, longitude float64) map[string]struct{} {
+	return p.within(latitude, longitude, p.halo)
+}
+
+// within - Узлы ячейки точки и соседних ячеек, до которых от точки не дальше distance метров
+func (p *partition) within(latitude, longitude, distance float64) map[string]struct{} {
+	point := &models.Position{Latitude: latitude, Longitude: longitude}
+	box := geohash.Decode(geohash.Encode(latitude, longitude, p.precision))
+	height, width := box.MaxLatitude-box.MinLatitude, box.MaxLongitude-box.MinLongitude
+	centerLatitude, centerLongitude := box.Center()
+
+	nodes := make(map[string]struct{})
+	for row := -1; row <= 1; row++ {
+		neighbourLatitude := centerLatitude + float64(row)*height
+		if neighbourLatitude < -90 || neighbourLatitude > 90 {
+			continue
+		}
+
+		for column := -1; column <= 1; column++ {
+			cell := geohash.Encode(neighbourLatitude, normalizeLongitude(centerLongitude+float64(column)*width), p.precision)
+			if row != 0 || column != 0 {
+				if point.GeodesicDistanceTo(closestInBox(geohash.Decode(cell), latitude, longitude)) > distance {
+					continue
+				}
+			}
+			nodes[p.ring.Owner(cell)] = struct{}{}
+		}
+	}
+	return nodes
+}
+
+// covered - Расстояние от точки, ближе которого узел ее ячейки знает всех клиентов: до границы ячейки и еще halo,
+// в пределах которого узлы соседних ячеек присылают копии
+func (p *partition) covered(latitude, longitude float64) float64 {
+	point := &models.Position{Latitude: latitude, Longitude: longitude}
+	box := geohash.Decode(geohash.Encode(latitude, longitude, p.precision))
+
+	distance := math.Inf(1)
+	for _, edge := range []*models.Position{
+		{Latitude: box.MinLatitude, Longitude: longitude},
+		{Latitude: box.MaxLatitude, Longitude: longitude},
+		{Latitude: latitude, Longitude: box.MinLongitude},
+		{Latitude: latitude, Longitude: box.MaxLongitude},
+	} {
+		distance = math.Min(distance, point.GeodesicDistanceTo(edge))
+	}
+	return distance + p.halo
+}
+
+// search - Поиск ближайшего, расширенный на другие узлы: клиенты комнаты room не дальше radius метров от точки point.
+// Поиск с нулевым радиусом ищет кого угодно.
+type search struct {
+	room   string
+	point  *models.Position
+	radius float64
+}
+
+// contains - Лежит ли позиция клиента комнаты room в радиусе поиска
+func (s *search) contains(room string, position *models.Position) bool {
+	return s.radius > 0 && room == s.room && s.point.GeodesicDistanceTo(position) <= s.radius
+}
+
+// covers - Находит ли поиск всех клиентов комнаты room ближе needed метров к точке point (math.Inf - кого угодно).
+// Поиск кого угодно покрывает такой же поиск, пока точка сдвинулась не больше чем на slack.
+func (s *search) covers(room string, point *models.Position, needed, slack float64) bool {
+	if room != s.room {
+		return false
+	}
+	distance := s.point.GeodesicDistanceTo(point)
+	if s.radius <= 0 {
+		return math.IsInf(needed, 1) && distance <= slack
+	}
+	return distance+needed <= s.radius
+}
+
+func (s *search) event(clientID string) *Event {
+	return &Event{Kind: EventNearest, ClientID: clientID, Position: s.point, Radius: s.radius, Room: s.room}
+}
+
+// Перестраивает кольцо по текущему составу кластера
+func (n *Node) updateRing() {
+	if n.partition != nil {
+		n.partition.ring = NewRing(n.nodes(), RingReplicas)
+	}
+}
+
+// Передает операцию своего клиента узлам, которые держат его копию. Новая позиция может добавить узлы
+// соседних ячеек, которым копия стала нужна, убрать копию у тех, от чьих ячеек клиент удалился, и увести
+// клиента в ячейку другого узла.
+func (n *Node) replicate(entry *journal.Entry) {
+	switch entry.Kind {
+	case journal.KindPositionUpdated:
+		if validCoordinates(entry.Position) {
+			n.place(entry)
+			n.scheduleCheck(entry.ClientID)
+			return
+		}
+
+	case journal.KindClientRemoved:
+		n.cancelSearch(entry.ClientID)
+		delete(n.handoffs, entry.ClientID)
+		defer delete(n.holders, entry.ClientID)
+	}
+
+	for node := range n.holders[entry.ClientID] {
+		n.send(node, &Event{Kind: EventEntry, Entry: entry})
+	}
+}
+
+// Рассылает новую позицию клиента узлам по соседству с ней и узлам, в радиус поисков которых она попала. Узел,
+// у которого еще нет копии, сначала получает клиента в состоянии до этой позиции.
+func (n *Node) place(entry *journal.Entry) {
+	client, err := n.usersUsecase.GetClientInfo(entry.ClientID)
+	if err != nil {
+		return
+	}
+
+	targets := n.partition.nearby(entry.Position.Latitude, entry.Position.Longitude)
+	for node := range n.watches {
+		n.narrow(node, client.Room, entry.Position)
+		if n.watched(node, client.Room, entry.Position) {
+			targets[node] = struct{}{}
+		}
+	}
+	delete(targets, n.id)
+
+	holders := n.holders[entry.ClientID]
+	for node := range holders {
+		if _, ok := targets[node]; !ok {
+			n.send(node, &Event{Kind: EventEntry, Entry: &journal.Entry{Time: entry.Time, Kind: journal.KindClientRemoved, ClientID: client.ID}})
+		}
+	}
+	for node := range targets {
+		if _, ok := holders[node]; !ok {
+			for _, introduced := range n.introduction(client, entry.Time) {
+				n.send(node, &Event{Kind: EventEntry, Entry: introduced})
+			}
+		}
+		n.send(node, &Event{Kind: EventEntry, Entry: entry})
+	}
+
+	if len(targets) == 0 {
+		delete(n.holders, client.ID)
+		return
+	}
+	n.holders[client.ID] = targets
+}
+
+// Планирует проверку, не перешел ли клиент в ячейку другого узла и хватает ли для его ближайшего копий соседних
+// ячеек. Проверка выполняется отдельной командой движка, когда юзкейс закончит обработку фикса.
+func (n *Node) scheduleCheck(clientID string) {
+	if _, ok := n.checking[clientID]; ok || n.schedule == nil {
+		return
+	}
+	n.checking[clientID] = struct{}{}
+	go n.schedule(func() {
+		delete(n.checking, clientID)
+		n.handoff(clientID)
+		n.fanOut(clientID)
+	})
+}
+
+// Передает клиента узлу его ячейки, когда клиент отошел от ячеек этого узла дальше margin. Клиент остается
+// на этом узле, пока новый узел не подтвердит прием, и остается совсем, если подтверждение не пришло за timeout.
+func (n *Node) handoff(clientID string) {
+	if _, ok := n.handoffs[clientID]; ok {
+		return
+	}
+	client, err := n.usersUsecase.GetClientInfo(clientID)
+	if err != nil || n.Remote(clientID) || !client.HasPosition() {
+		return
+	}
+	latitude, longitude := client.Position.Latitude, client.Position.Longitude
+	owner := n.partition.owner(latitude, longitude)
+	if owner == n.id {
+		return
+	}
+	if _, near := n.partition.within(latitude, longitude, n.partition.margin)[n.id]; near {
+		return
+	}
+
+	token := uuid.New().String()
+	event := &Event{Kind: EventHandoff, Client: snapshot.FromClient(client), RoomOptions: n.roomOptions(client.Room), Token: token}
+	if err := n.send(owner, event); err != nil {
+		return
+	}
+	n.handoffs[clientID] = token
+	logging.InfoLogger.Printf("Handing off client %s to node %s", clientID, owner)
+
+	time.AfterFunc(n.partition.timeout, func() {
+		n.schedule(func() { n.abandonHandoff(clientID, token) })
+	})
+}
+
+// Оставляет клиента на этом узле, если новый узел так и не подтвердил прием
+func (n *Node) abandonHandoff(clientID, token string) {
+	if n.handoffs[clientID] != token {
+		return
+	}
+	delete(n.handoffs, clientID)
+	logging.ErrorLogger.Printf("Handoff of client %s was not accepted in time", clientID)
+}
+
+// Новый узел принял клиента: клиент получает публичный адрес нового узла и удаляется здесь так же, как при отключении
+func (n *Node) handedOff(clientID, token, address string) {
+	if pending, ok := n.handoffs[clientID]; !ok || pending != token {
+		return
+	}
+	delete(n.handoffs, clientID)
+
+	client, err := n.usersUsecase.GetClientInfo(clientID)
+	if err != nil {
+		return
+	}
+	conn := client.Connection
+	logging.InfoLogger.Printf("Client %s handed off to node %s", clientID, address)
+	n.drop(clientID)
+
+	if conn != nil {
+		conn.WriteJSON(&models.Response[models.HandoffResponse]{
+			Type:     "HandoffResponse",
+			Response: &models.HandoffResponse{Node: address, Token: token},
+		})
+		conn.Close()
+	}
+}
+
+// Принимает клиента от узла from вместе с его комнатой и зонами. Клиент заново добавляется и позиционируется,
+// поэтому его ближайшие и обратные ссылки пересчитываются по клиентам этого узла.
+func (n *Node) adopt(from string, event *Event) {
+	state, token := event.Client, event.Token
+	if n.Remote(state.ID) {
+		// Копию клиента заменяет сам клиент
+		n.apply(n.owners[state.ID], &journal.Entry{Time: time.Now(), Kind: journal.KindClientRemoved, ClientID: state.ID})
+	} else if _, err := n.usersUsecase.GetClientInfo(state.ID); err == nil {
+		logging.ErrorLogger.Printf("Node %s handed off client %s that is connected here", from, state.ID)
+		return
+	}
+
+	// Зоны остаются прежними до позиционирования, чтобы клиент получил только настоящие переходы
+	client := state.ClientInfo()
+	client.Room, client.Position = "", nil
+	if err := n.usersUsecase.AddClient(client); err != nil {
+		logging.ErrorLogger.Printf("Failed to adopt client %s handed off by node %s: %v", client.ID, from, err)
+		return
+	}
+	// Прежний узел удаляет клиента, получив подтверждение, поэтому копию с новой позицией он получит уже после
+	n.send(from, &Event{Kind: EventHandoffAccepted, ClientID: client.ID, Token: token, Address: n.address})
+
+	notify := make([]string, 0)
+	if state.Room != "" && state.Room != models.GlobalRoom {
+		if _, joined, err := n.geoUsecase.JoinRoom(client.ID, state.Room, event.RoomOptions); err != nil {
+			logging.ErrorLogger.Printf("Failed to return client %s handed off by node %s to room %s: %v", client.ID, from, state.Room, err)
+		} else {
+			notify = append(notify, joined...)
+		}
+	}
+	if state.Position != nil {
+		moved, err := n.geoUsecase.UpdatePosition(client.ID, lastFix(state.Position))
+		if err != nil {
+			logging.ErrorLogger.Printf("Failed to position client %s handed off by node %s: %v", client.ID, from, err)
+		}
+		notify = append(notify, moved...)
+	}
+	transitions := usecases.ZoneTransitions(client.ID, state.Zones, n.geoUsecase.ClientZones(client.ID))
+	n.usersUsecase.Detach(client.ID)
+	n.claims[token] = client.ID
+
+	n.transitions(transitions)
+	n.notify(notify)
+
+	time.AfterFunc(n.partition.grace, func() {
+		n.schedule(func() { n.expire(token) })
+	})
+}
+
+// Claim - Передает соединение клиенту, принятому от другого узла с токеном token
+func (n *Node) Claim(token string, conn *websocket.Conn) (*models.ClientInfo, bool) {
+	clientID, ok := n.claims[token]
+	if !ok {
+		return nil, false
+	}
+	delete(n.claims, token)
+	return n.usersUsecase.Adopt(clientID, conn)
+}
+
+// Удаляет принятого клиента, который так и не переподключился
+func (n *Node) expire(token string) {
+	clientID, ok := n.claims[token]
+	if !ok {
+		return
+	}
+	delete(n.claims, token)
+
+	if n.usersUsecase.IsDetached(clientID) {
+		n.drop(clientID)
+	}
+}
+
+// Удаляет своего клиента так же, как при его отключении
+func (n *Node) drop(clientID string) {
+	notify, err := n.replayer.Apply(&journal.Entry{Time: time.Now(), Kind: journal.KindClientRemoved, ClientID: clientID})
+	if err == nil {
+		n.notify(notify)
+	}
+}
+
+// Расширяет поиск ближайшего для своего клиента на другие узлы, если найденный среди своих клиентов и копий
+// ближайший дальше, чем гарантируют копии соседних ячеек. Поиск отправляется заново, только когда прежний
+// перестал его покрывать, и отменяется, когда ближайший снова найден в пределах копий.
+func (n *Node) fanOut(clientID string) {
+	client, err := n.usersUsecase.GetClientInfo(clientID)
+	if err != nil || n.Remote(clientID) || !client.HasPosition() {
+		return
+	}
+
+	point := &models.Position{Latitude: client.Position.Latitude, Longitude: client.Position.Longitude}
+	needed := math.Inf(1)
+	if client.Position.ClosestClientID != "" {
+		needed = client.Position.Distance
+	}
+	if needed <= n.partition.covered(point.Latitude, point.Longitude) {
+		n.cancelSearch(clientID)
+		return
+	}
+	if previous, ok := n.searches[clientID]; ok && previous.covers(client.Room, point, needed, n.partition.halo) {
+		return
+	}
+
+	// Радиус берется с запасом halo, чтобы небольшие перемещения не требовали нового поиска
+	s := &search{room: client.Room, point: point}
+	if !math.IsInf(needed, 1) {
+		s.radius = needed + n.partition.halo
+	}
+	n.searches[clientID] = s
+	n.publish(s.event(clientID))
+}
+
+// Отменяет поиск ближайшего своего клиента на других узлах
+func (n *Node) cancelSearch(clientID string) {
+	if _, ok := n.searches[clientID]; !ok {
+		return
+	}
+	delete(n.searches, clientID)
+	n.publish(&Event{Kind: EventNearestDone, ClientID: clientID})
+}
+
+// Отправляет узлу node поиски ближайших своих клиентов
+func (n *Node) sendSearches(node string) {
+	for clientID, s := range n.searches {
+		if err := n.send(node, s.event(clientID)); err != nil {
+			return
+		}
+	}
+}
+
+// Принимает поиск ближайшего для клиента clientID узла node и копирует ему своих клиентов в радиусе поиска.
+// На поиск кого угодно узел отвечает своим ближайшим к точке клиентом, а если таких клиентов нет - первым, кто
+// появится, и дальше ищет в радиусе до него.
+func (n *Node) watch(node, clientID string, s *search) {
+	clients := make([]*models.ClientInfo, 0)
+	for _, client := range n.usersUsecase.GetClients() {
+		if !n.Remote(client.ID) && client.HasPosition() && client.Room == s.room {
+			clients = append(clients, client)
+		}
+	}
+
+	if s.radius <= 0 {
+		closest := math.Inf(1)
+		for _, client := range clients {
+			closest = math.Min(closest, s.point.GeodesicDistanceTo(lastFix(client.Position)))
+		}
+		if !math.IsInf(closest, 1) {
+			s = &search{room: s.room, point: s.point, radius: closest}
+		}
+	}
+
+	if n.watches[node] == nil {
+		n.watches[node] = make(map[string]*search)
+	}
+	n.watches[node][clientID] = s
+	n.release(node)
+
+	now := time.Now()
+	for _, client := range clients {
+		if s.contains(client.Room, lastFix(client.Position)) {
+			n.hold(node, client, now)
+		}
+	}
+}
+
+// Забывает поиск ближайшего для клиента clientID узла node
+func (n *Node) unwatch(node, clientID string) {
+	if _, ok := n.watches[node][clientID]; !ok {
+		return
+	}
+	delete(n.watches[node], clientID)
+	if len(n.watches[node]) == 0 {
+		delete(n.watches, node)
+	}
+	n.release(node)
+}
+
+// Сужает поиски кого угодно узла node в комнате room до радиуса, в который попадает позиция
+func (n *Node) narrow(node, room string, position *models.Position) {
+	for _, s := range n.watches[node] {
+		if s.radius <= 0 && s.room == room {
+			s.radius = s.point.GeodesicDistanceTo(position)
+		}
+	}
+}
+
+// Проверяет, попадает ли позиция клиента комнаты room в какой-либо поиск узла node
+func (n *Node) watched(node, room string, position *models.Position) bool {
+	for _, s := range n.watches[node] {
+		if s.contains(room, position) {
+			return true
+		}
+	}
+	return false
+}
+
+// Копирует своего клиента узлу node, если у того еще нет копии
+func (n *Node) hold(node string, client *models.ClientInfo, now time.Time) {
+	holders := n.holders[client.ID]
+	if _, ok := holders[node]; ok {
+		return
+	}
+
+	for _, entry := range n.introduction(client, now) {
+		if err := n.send(node, &Event{Kind: EventEntry, Entry: entry}); err != nil {
+			return
+		}
+	}
+	if holders == nil {
+		holders = make(map[string]struct{})
+		n.holders[client.ID] = holders
+	}
+	holders[node] = struct{}{}
+}
+
+// Убирает у узла node копии, которые ему больше не нужны: клиент не у границы его ячеек и не в его поисках
+func (n *Node) release(node string) {
+	now := time.Now()
+	for clientID, holders := range n.holders {
+		if _, ok := holders[node]; !ok {
+			continue
+		}
+		client, err := n.usersUsecase.GetClientInfo(clientID)
+		if err != nil || !client.HasPosition() {
+			continue
+		}
+
+		fix := lastFix(client.Position)
+		if _, near := n.partition.nearby(fix.Latitude, fix.Longitude)[node]; near || n.watched(node, client.Room, fix) {
+			continue
+		}
+		n.send(node, &Event{Kind: EventEntry, Entry: &journal.Entry{Time: now, Kind: journal.KindClientRemoved, ClientID: clientID}})
+		delete(holders, node)
+		if len(holders) == 0 {
+			delete(n.holders, clientID)
+		}
+	}
+}
+
+// Ближайшая к точке точка ячейки
+func closestInBox(box geohash.Box, latitude, longitude float64) *models.Position {
+	closest := &models.Position{
+		Latitude:  math.Max(box.MinLatitude, math.Min(box.MaxLatitude, latitude)),
+		Longitude: longitude,
+	}
+	if longitude < box.MinLongitude || longitude > box.MaxLongitude {
+		// Ближайшая сторона выбирается с учетом перехода через антимеридиан
+		closest.Longitude = box.MinLongitude
+		if math.Abs(normalizeLongitude(box.MaxLongitude-longitude)) < math.Abs(normalizeLongitude(box.MinLongitude-longitude)) {
+			closest.Longitude = box.MaxLongitude
+		}
+	}
+	return closest
+}
+
+func validCoordinates(position *models.Position) bool {
+	return position != nil &&
+		position.Latitude >= -90 && position.Latitude <= 90 &&
+		position.Longitude >= -180 && position.Longitude <= 180
+}
+
+func normalizeLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
@@ -0,0 +1,91 @@
+package cluster
+
+import "sync"
+
+// queueLimit - Сколько событий может ждать доставки одному узлу. Полная очередь сбрасывается: узлу, который так
+// долго не принимает события, проще заново прислать состояние, чем хранить все пропущенное.
+const queueLimit = 1 << 16
+
+// queue - Очередь закодированных событий, которые одна горутина доставляет по порядку. Отправитель никогда
+// не ждет получателя, поэтому команды движка могут публиковать события без блокировки.
+//
+// Если событие доставить не удалось или очередь переполнилась, очередь отбрасывает все ждущие события
+// и вызывает lost из горутины доставки. Следующие события снова ставятся в очередь.
+type queue struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	items  [][]byte
+	limit  int
+	closed bool
+	// dropped - События были отброшены, и горутина доставки еще не вызвала lost
+	dropped bool
+	deliver func(data []byte) bool
+	lost    func()
+	stopped chan struct{}
+}
+
+func newQueue(limit int, deliver func(data []byte) bool, lost func()) *queue {
+	q := &queue{limit: limit, deliver: deliver, lost: lost, stopped: make(chan struct{})}
+	q.ready = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push - Добавляет событие в очередь. Возвращает false, если очередь закрыта.
+func (q *queue) push(data []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	if q.limit > 0 && len(q.items) >= q.limit {
+		q.items, q.dropped = nil, true
+	}
+	q.items = append(q.items, data)
+	q.ready.Signal()
+	return true
+}
+
+// close - Закрывает очередь и ждет доставки уже добавленных событий
+func (q *queue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.ready.Signal()
+	}
+	q.mu.Unlock()
+
+	<-q.stopped
+}
+
+func (q *queue) run() {
+	defer close(q.stopped)
+
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed && !q.dropped {
+			q.ready.Wait()
+		}
+		if q.dropped {
+			q.dropped = false
+			q.mu.Unlock()
+			q.lost()
+			continue
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		data := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.mu.Unlock()
+
+		if !q.deliver(data) {
+			q.mu.Lock()
+			q.items, q.dropped = nil, true
+			q.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RingReplicas - Число точек каждого узла на кольце: чем больше, тем ровнее ячейки делятся между узлами
+const RingReplicas = 64
+
+// Ring - Кольцо консистентного хеширования. Каждый узел занимает несколько точек кольца, а ключ принадлежит узлу
+// первой точки по часовой стрелке от хеша ключа, поэтому при добавлении или удалении узла переезжают только
+// ключи этого узла.
+type Ring struct {
+	hashes []uint64
+	nodes  []string
+}
+
+// NewRing - Создает кольцо, на котором у каждого из узлов nodes по replicas точек
+func NewRing(nodes []string, replicas int) *Ring {
+	ring := &Ring{
+		hashes: make([]uint64, 0, len(nodes)*replicas),
+		nodes:  make([]string, 0, len(nodes)*replicas),
+	}
+
+	type point struct {
+		hash uint64
+		node string
+	}
+	points := make([]point, 0, len(nodes)*replicas)
+	for _, node := range nodes {
+		for replica := range replicas {
+			points = append(points, point{hash: ringHash(node + "#" + strconv.Itoa(replica)), node: node})
+		}
+	}
+	// При совпадении хешей порядок задает имя узла, чтобы кольцо не зависело от порядка nodes
+	slices.SortFunc(points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.node, b.node))
+	})
+
+	for _, p := range points {
+		ring.hashes = append(ring.hashes, p.hash)
+		ring.nodes = append(ring.nodes, p.node)
+	}
+	return ring
+}
+
+// Owner - Узел, которому принадлежит ключ (пустая строка, если в кольце нет узлов)
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// FNV-1a с перемешиванием splitmix64: у коротких похожих ключей (соседних ячеек) сам FNV дает близкие хеши
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,524 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// Config - Конфигурация сервера, собирается из переменных окружения
+type Config struct {
+	Address     string
+	Geolocation Geolocation
+	Privacy     Privacy
+	Zones       Zones
+	Identity    Identity
+	Storage     Storage
+	Snapshot    Snapshot
+	Journal     Journal
+	Cluster     Cluster
+}
+
+// Cluster - Настройки режима нескольких узлов
+type Cluster struct {
+	// Node - Адрес внутреннего слушателя этого узла (host:port), по которому к нему обращаются другие узлы.
+	// Должен совпадать с адресом узла в Peers или DNS. Пустой адрес выключает кластер.
+	Node string
+	// Listen - Адрес внутреннего слушателя, на котором узел принимает события других узлов. Он отделен
+	// от публичного Address и не должен быть доступен клиентам.
+	Listen string
+	// Address - Публичный адрес узла (host:port), к которому переподключаются переданные ему клиенты.
+	// Пустой адрес - хост из Node с портом публичного слушателя.
+	Address string
+	// Secret - Общий секрет узлов, которым подписываются события между ними. Обязателен, если кластер включен.
+	Secret string
+	// Mode - replicated (каждый узел держит всех клиентов) или partitioned (узлы делят ячейки земной поверхности)
+	Mode string
+	// Peers - Статический список адресов узлов, используется, если не задано DNS
+	Peers []string
+	// DNS - Имя, все адреса которого с портом DNSPort считаются узлами кластера
+	DNS     string
+	DNSPort int
+	// RefreshInterval - Период обновления списка узлов (0 - список читается один раз при запуске)
+	RefreshInterval time.Duration
+	// Partition - Деление ячеек в режиме partitioned
+	Partition Partition
+}
+
+// Partition - Настройки режима partitioned
+type Partition struct {
+	// CellPrecision - Длина geohash ячеек, которые распределяются между узлами
+	CellPrecision int
+	// Halo - Расстояние в метрах: клиенты ближе него к чужой ячейке видны и ее узлу. Должно быть меньше ячейки.
+	Halo float64
+	// HandoffMargin - Насколько метров клиент должен углубиться в чужую ячейку, чтобы его передали ее узлу.
+	// Запас не дает передавать туда и обратно клиента, который ходит вдоль границы. Должен быть не больше Halo.
+	HandoffMargin float64
+	// HandoffTimeout - Сколько ждать подтверждения нового узла, прежде чем оставить клиента на прежнем
+	HandoffTimeout time.Duration
+	// HandoffGrace - Сколько принятый от другого узла клиент ждет переподключения, прежде чем будет удален
+	HandoffGrace time.Duration
+}
+
+const (
+	ClusterReplicated  = "replicated"
+	ClusterPartitioned = "partitioned"
+)
+
+// Journal - Настройки журнала операций
+type Journal struct {
+	// Dir - Каталог сегментов журнала, пустой каталог выключает журнал
+	Dir string
+	// SegmentSize - Размер сегмента в байтах, после которого начинается новый
+	SegmentSize int64
+	// Fsync - Сбрасывать ли на диск каждую запись (иначе записи переживают падение процесса, но не отключение питания)
+	Fsync bool
+}
+
+// Snapshot - Настройки снимков состояния на диске
+type Snapshot struct {
+	// Path - Файл снимка, пустой путь выключает снимки и восстановление
+	Path string
+	// Interval - Период снимков (0 - снимок только при остановке)
+	Interval time.Duration
+	// Grace - Сколько восстановленные клиенты ждут переподключения, прежде чем будут удалены
+	Grace time.Duration
+}
+
+// Storage - Настройки хранилища клиентов
+type Storage struct {
+	// Backend - Бэкенд хранилища: memory, sharded, cells или redis
+	Backend string
+	// ShardDivisions - На сколько частей делится каждая сторона грани куба в бэкенде sharded (6 * n * n шардов)
+	ShardDivisions int
+	// CellLevel - Самый мелкий уровень ячеек в бэкенде cells: сторона ячейки 180 / 2^n градусов
+	CellLevel int
+	// Redis - Подключение бэкенда redis
+	Redis Redis
+}
+
+// Redis - Настройки подключения к Redis
+type Redis struct {
+	Address  string
+	Password string
+	DB       int
+	// Prefix - Префикс всех ключей, чтобы несколько развертываний могли делить один Redis
+	Prefix string
+}
+
+const (
+	// StorageMemory - Хранилище в памяти процесса на R-Tree
+	StorageMemory = "memory"
+	// StorageSharded - Хранилище в памяти процесса, индекс которого разбит на шарды по граням куба
+	StorageSharded = "sharded"
+	// StorageCells - Хранилище в памяти процесса с индексом на иерархии ячеек сферы
+	StorageCells = "cells"
+	// StorageRedis - Хранилище в Redis, общее для нескольких экземпляров сервера
+	StorageRedis = "redis"
+)
+
+// Geolocation - Настройки геодвижка
+type Geolocation struct {
+	Smoothing Smoothing
+	Switching Switching
+
+	// Pairing - Режим подбора пар по умолчанию: nearest или exclusive. Комната может задать свой режим при создании.
+	Pairing string
+	// Distance - Допустимые расстояния до ближайшего по умолчанию, клиент может задать свои
+	Distance DistanceBand
+
+	// MinMovement - Минимальное смещение в метрах, при котором позиция переиндексируется
+	MinMovement float64
+	// CoalesceWindow - Окно, в течение которого обновления позиции одного клиента схлопываются в одно (0 - выключено)
+	CoalesceWindow time.Duration
+
+	DeadReckoning DeadReckoning
+
+	Rooms Rooms
+
+	// PositionTTL - Время, через которое не обновлявшаяся позиция убирается из индекса (0 - никогда)
+	PositionTTL time.Duration
+	// StaleSweepInterval - Период проверки позиций на устаревание
+	StaleSweepInterval time.Duration
+}
+
+// DeadReckoning - Настройки счисления пути между обновлениями позиции
+type DeadReckoning struct {
+	// Interval - Период отправки интерполированных азимута и расстояния (0 - выключено)
+	Interval time.Duration
+	// MaxAge - Максимальное время, на которое позиция экстраполируется от последнего фикса
+	MaxAge time.Duration
+}
+
+// Smoothing - Настройки сглаживания позиций клиентов
+type Smoothing struct {
+	// Filter - Тип фильтра: none, exponential или kalman
+	Filter string
+	// Alpha - Коэффициент экспоненциального сглаживания (0 < Alpha <= 1)
+	Alpha float64
+	// ProcessNoise - Ожидаемая скорость изменения позиции для фильтра Калмана в м/с
+	ProcessNoise float64
+	// DefaultAccuracy - Точность в метрах, которая используется если клиент ее не прислал
+	DefaultAccuracy float64
+	// ResetDistance - Расстояние в метрах, при скачке на которое состояние фильтра сбрасывается
+	ResetDistance float64
+}
+
+// Switching - Настройки гистерезиса при смене ближайшего клиента
+type Switching struct {
+	// MarginMeters - Насколько метров кандидат должен быть ближе текущего ближайшего
+	MarginMeters float64
+	// MarginPercent - На сколько процентов от текущего расстояния кандидат должен быть ближе
+	MarginPercent float64
+	// DwellTime - Сколько времени кандидат должен непрерывно оставаться ближе перед сменой
+	DwellTime time.Duration
+}
+
+// DistanceBand - Допустимые расстояния до ближайшего клиента
+type DistanceBand struct {
+	// Min - Минимальное расстояние в метрах, более близкие клиенты пропускаются (0 - без ограничения)
+	Min float64
+	// Max - Максимальное расстояние в метрах, более далекие клиенты не подбираются (0 - без ограничения)
+	Max float64
+}
+
+// Rooms - Настройки комнат
+type Rooms struct {
+	// DefaultLimit - Лимит участников новой комнаты, если создатель его не указал (0 - без лимита)
+	DefaultLimit int
+	// MaxLimit - Максимальный лимит участников комнаты (0 - без ограничения)
+	MaxLimit int
+}
+
+// Privacy - Политика раскрытия позиций клиентов другим клиентам на уровне развертывания
+type Privacy struct {
+	// Coordinates - Раскрытие координат: exact, grid, geohash или hidden
+	Coordinates string
+	// GridSize - Размер ячейки сетки в метрах для режима grid
+	GridSize float64
+	// GeohashPrecision - Длина geohash для режима geohash
+	GeohashPrecision int
+	// SessionOffset - Максимальное случайное смещение в метрах, выбираемое один раз на сессию клиента
+	SessionOffset float64
+	// ExposeNearest - Раскрывать ли, кто ближайший клиент, а также расстояние и азимут до него
+	ExposeNearest bool
+	// DistanceRounding - Шаг округления расстояний до третьих лиц в метрах
+	DistanceRounding float64
+}
+
+// Identity - Настройки выдачи идентичностей клиентов
+type Identity struct {
+	// Secret - Секрет, которым подписываются токены идентичности. Должен совпадать на всех узлах кластера,
+	// пустой секрет заменяется случайным при старте
+	Secret string
+}
+
+// Zones - Настройки геозон
+type Zones struct {
+	// Files - GeoJSON файлы с зонами, загружаемые при старте
+	Files []string
+	// AdminToken - Токен для управления зонами во время работы (пустой - управление выключено)
+	AdminToken string
+}
+
+const (
+	CoordinatesExact   = "exact"
+	CoordinatesGrid    = "grid"
+	CoordinatesGeohash = "geohash"
+	CoordinatesHidden  = "hidden"
+)
+
+const (
+	// PairingNearest - Каждый клиент получает ближайшего, один клиент может быть ближайшим для многих
+	PairingNearest = "nearest"
+	// PairingExclusive - Клиенты разбиваются на взаимные пары, у каждого клиента не больше одного партнера
+	PairingExclusive = "exclusive"
+)
+
+const (
+	SmoothingNone        = "none"
+	SmoothingExponential = "exponential"
+	SmoothingKalman      = "kalman"
+)
+
+// Default - Конфигурация по умолчанию
+func Default() *Config {
+	return &Config{
+		Address: ":8080",
+		Geolocation: Geolocation{
+			Smoothing: Smoothing{
+				Filter:          SmoothingNone,
+				Alpha:           0.3,
+				ProcessNoise:    3,
+				DefaultAccuracy: 20,
+				ResetDistance:   500,
+			},
+			Switching: Switching{
+				MarginMeters:  0,
+				MarginPercent: 0,
+				DwellTime:     0,
+			},
+			Pairing: PairingNearest,
+			Distance: DistanceBand{
+				Min: 0,
+				Max: 0,
+			},
+			MinMovement:    0,
+			CoalesceWindow: 0,
+			DeadReckoning: DeadReckoning{
+				Interval: 0,
+				MaxAge:   10 * time.Second,
+			},
+			Rooms: Rooms{
+				DefaultLimit: 0,
+				MaxLimit:     0,
+			},
+			PositionTTL:        0,
+			StaleSweepInterval: 5 * time.Second,
+		},
+		Storage: Storage{
+			Backend:        StorageMemory,
+			ShardDivisions: 4,
+			CellLevel:      12,
+			Redis: Redis{
+				Address: "localhost:6379",
+				Prefix:  "sphere:",
+			},
+		},
+		Snapshot: Snapshot{
+			Interval: 30 * time.Second,
+			Grace:    2 * time.Minute,
+		},
+		Journal: Journal{
+			SegmentSize: 16 << 20,
+		},
+		Cluster: Cluster{
+			Mode:            ClusterReplicated,
+			Listen:          ":7946",
+			DNSPort:         7946,
+			RefreshInterval: 10 * time.Second,
+			Partition: Partition{
+				CellPrecision:  3,
+				Halo:           5000,
+				HandoffMargin:  1000,
+				HandoffTimeout: 10 * time.Second,
+				HandoffGrace:   30 * time.Second,
+			},
+		},
+		Privacy: Privacy{
+			Coordinates:      CoordinatesGrid,
+			GridSize:         1000,
+			GeohashPrecision: 5,
+			SessionOffset:    500,
+			ExposeNearest:    false,
+			DistanceRounding: 100,
+		},
+	}
+}
+
+// Load - Загружает конфигурацию из переменных окружения поверх значений по умолчанию и проверяет ее
+func Load() (*Config, error) {
+	cfg := Default()
+
+	cfg.Address = getString("SPHERE_ADDRESS", cfg.Address)
+
+	smoothing := &cfg.Geolocation.Smoothing
+	smoothing.Filter = getString("SPHERE_SMOOTHING_FILTER", smoothing.Filter)
+	smoothing.Alpha = getFloat("SPHERE_SMOOTHING_ALPHA", smoothing.Alpha)
+	smoothing.ProcessNoise = getFloat("SPHERE_SMOOTHING_PROCESS_NOISE", smoothing.ProcessNoise)
+	smoothing.DefaultAccuracy = getFloat("SPHERE_SMOOTHING_DEFAULT_ACCURACY", smoothing.DefaultAccuracy)
+	smoothing.ResetDistance = getFloat("SPHERE_SMOOTHING_RESET_DISTANCE", smoothing.ResetDistance)
+
+	switching := &cfg.Geolocation.Switching
+	switching.MarginMeters = getFloat("SPHERE_SWITCHING_MARGIN_METERS", switching.MarginMeters)
+	switching.MarginPercent = getFloat("SPHERE_SWITCHING_MARGIN_PERCENT", switching.MarginPercent)
+	switching.DwellTime = getDuration("SPHERE_SWITCHING_DWELL_TIME", switching.DwellTime)
+
+	cfg.Geolocation.Pairing = getString("SPHERE_PAIRING_MODE", cfg.Geolocation.Pairing)
+	distance := &cfg.Geolocation.Distance
+	distance.Min = getFloat("SPHERE_PAIRING_MIN_DISTANCE", distance.Min)
+	distance.Max = getFloat("SPHERE_PAIRING_MAX_DISTANCE", distance.Max)
+
+	cfg.Geolocation.MinMovement = getFloat("SPHERE_MIN_MOVEMENT", cfg.Geolocation.MinMovement)
+	cfg.Geolocation.CoalesceWindow = getDuration("SPHERE_COALESCE_WINDOW", cfg.Geolocation.CoalesceWindow)
+
+	deadReckoning := &cfg.Geolocation.DeadReckoning
+	deadReckoning.Interval = getDuration("SPHERE_DEAD_RECKONING_INTERVAL", deadReckoning.Interval)
+	deadReckoning.MaxAge = getDuration("SPHERE_DEAD_RECKONING_MAX_AGE", deadReckoning.MaxAge)
+
+	rooms := &cfg.Geolocation.Rooms
+	rooms.DefaultLimit = getInt("SPHERE_ROOMS_DEFAULT_LIMIT", rooms.DefaultLimit)
+	rooms.MaxLimit = getInt("SPHERE_ROOMS_MAX_LIMIT", rooms.MaxLimit)
+
+	cfg.Geolocation.PositionTTL = getDuration("SPHERE_POSITION_TTL", cfg.Geolocation.PositionTTL)
+	cfg.Geolocation.StaleSweepInterval = getDuration("SPHERE_STALE_SWEEP_INTERVAL", cfg.Geolocation.StaleSweepInterval)
+
+	privacy := &cfg.Privacy
+	privacy.Coordinates = getString("SPHERE_PRIVACY_COORDINATES", privacy.Coordinates)
+	privacy.GridSize = getFloat("SPHERE_PRIVACY_GRID_SIZE", privacy.GridSize)
+	privacy.GeohashPrecision = getInt("SPHERE_PRIVACY_GEOHASH_PRECISION", privacy.GeohashPrecision)
+	privacy.SessionOffset = getFloat("SPHERE_PRIVACY_SESSION_OFFSET", privacy.SessionOffset)
+	privacy.ExposeNearest = getBool("SPHERE_PRIVACY_EXPOSE_NEAREST", privacy.ExposeNearest)
+	privacy.DistanceRounding = getFloat("SPHERE_PRIVACY_DISTANCE_ROUNDING", privacy.DistanceRounding)
+
+	cfg.Storage.Backend = getString("SPHERE_STORAGE_BACKEND", cfg.Storage.Backend)
+	cfg.Storage.ShardDivisions = getInt("SPHERE_STORAGE_SHARD_DIVISIONS", cfg.Storage.ShardDivisions)
+	cfg.Storage.CellLevel = getInt("SPHERE_STORAGE_CELL_LEVEL", cfg.Storage.CellLevel)
+
+	redis := &cfg.Storage.Redis
+	redis.Address = getString("SPHERE_REDIS_ADDRESS", redis.Address)
+	redis.Password = getString("SPHERE_REDIS_PASSWORD", redis.Password)
+	redis.DB = getInt("SPHERE_REDIS_DB", redis.DB)
+	redis.Prefix = getString("SPHERE_REDIS_PREFIX", redis.Prefix)
+
+	cfg.Snapshot.Path = getString("SPHERE_SNAPSHOT_PATH", cfg.Snapshot.Path)
+	cfg.Snapshot.Interval = getDuration("SPHERE_SNAPSHOT_INTERVAL", cfg.Snapshot.Interval)
+	cfg.Snapshot.Grace = getDuration("SPHERE_SNAPSHOT_GRACE", cfg.Snapshot.Grace)
+
+	cfg.Journal.Dir = getString("SPHERE_JOURNAL_DIR", cfg.Journal.Dir)
+	cfg.Journal.SegmentSize = int64(getInt("SPHERE_JOURNAL_SEGMENT_SIZE", int(cfg.Journal.SegmentSize)))
+	cfg.Journal.Fsync = getBool("SPHERE_JOURNAL_FSYNC", cfg.Journal.Fsync)
+
+	cluster := &cfg.Cluster
+	cluster.Node = getString("SPHERE_CLUSTER_NODE", cluster.Node)
+	cluster.Mode = getString("SPHERE_CLUSTER_MODE", cluster.Mode)
+	cluster.Listen = getString("SPHERE_CLUSTER_LISTEN", cluster.Listen)
+	cluster.Address = getString("SPHERE_CLUSTER_ADDRESS", cluster.Address)
+	cluster.Secret = getString("SPHERE_CLUSTER_SECRET", cluster.Secret)
+	cluster.Peers = getList("SPHERE_CLUSTER_PEERS", cluster.Peers)
+	cluster.DNS = getString("SPHERE_CLUSTER_DNS", cluster.DNS)
+	cluster.DNSPort = getInt("SPHERE_CLUSTER_DNS_PORT", cluster.DNSPort)
+	cluster.RefreshInterval = getDuration("SPHERE_CLUSTER_REFRESH_INTERVAL", cluster.RefreshInterval)
+
+	partition := &cfg.Cluster.Partition
+	partition.CellPrecision = getInt("SPHERE_CLUSTER_CELL_PRECISION", partition.CellPrecision)
+	partition.Halo = getFloat("SPHERE_CLUSTER_HALO", partition.Halo)
+	partition.HandoffMargin = getFloat("SPHERE_CLUSTER_HANDOFF_MARGIN", partition.HandoffMargin)
+	partition.HandoffTimeout = getDuration("SPHERE_CLUSTER_HANDOFF_TIMEOUT", partition.HandoffTimeout)
+	partition.HandoffGrace = getDuration("SPHERE_CLUSTER_HANDOFF_GRACE", partition.HandoffGrace)
+
+	cfg.Zones.Files = getList("SPHERE_ZONES_FILES", cfg.Zones.Files)
+	cfg.Zones.AdminToken = getString("SPHERE_ZONES_ADMIN_TOKEN", cfg.Zones.AdminToken)
+	cfg.Identity.Secret = getString("SPHERE_IDENTITY_SECRET", cfg.Identity.Secret)
+
+	if err := cfg.Geolocation.Smoothing.Validate(); err != nil {
+		return nil, err
+	}
+	if cluster.Node != "" && cluster.Secret == "" {
+		return nil, util.ErrClusterSecretRequired
+	}
+	return cfg, nil
+}
+
+// Validate - Проверяет тип фильтра и его параметры, чтобы опечатка в конфигурации не выключала сглаживание молча
+func (s Smoothing) Validate() error {
+	switch s.Filter {
+	case SmoothingNone:
+		return nil
+	case SmoothingExponential:
+		if !(s.Alpha > 0 && s.Alpha <= 1) {
+			return util.ErrInvalidSmoothingAlpha
+		}
+	case SmoothingKalman:
+		if !isNonNegative(s.ProcessNoise) || !isNonNegative(s.DefaultAccuracy) {
+			return util.ErrInvalidSmoothingParams
+		}
+	default:
+		return fmt.Errorf("%w: %q", util.ErrInvalidSmoothingFilter, s.Filter)
+	}
+
+	if !isNonNegative(s.ResetDistance) {
+		return util.ErrInvalidSmoothingParams
+	}
+	return nil
+}
+
+// Проверяет, что значение конечное и неотрицательное
+func isNonNegative(value float64) bool {
+	return value >= 0 && !math.IsInf(value, 0)
+}
+
+func getString(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// getList - Читает список значений, разделенных запятыми
+func getList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logging.ErrorLogger.Printf("Invalid value %q for %s, using default %v: %v", value, key, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		logging.ErrorLogger.Printf("Invalid value %q for %s, using default %v: %v", value, key, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		logging.ErrorLogger.Printf("Invalid value %q for %s, using default %v: %v", value, key, fallback, err)
+		return fallback
+	}
+	return parsed
+}
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		logging.ErrorLogger.Printf("Invalid value %q for %s, using default %v: %v", value, key, fallback, err)
+		return fallback
+	}
+	return parsed
+}
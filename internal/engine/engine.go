@@ -0,0 +1,96 @@
+// Package engine - Единственный владелец гео-состояния.
+//
+// Протокол доступа: клиенты, их позиции, ссылки на ближайших, зоны и комнаты читаются и изменяются только
+// командами движка, которые выполняются по очереди в одной горутине. Транспорт оборачивает в команды
+// обработку каждого сообщения, подключение и отключение клиента, фоновые проходы и отложенные таймеры,
+// поэтому юзкейсы работают с состоянием без собственных блокировок. Запись в соединения тоже выполняется
+// командами, так что в одно соединение никогда не пишут две горутины одновременно. Запись лишь ставит сообщение
+// в очередь отправки соединения, поэтому команды не ждут сеть.
+// Блокировки хранилища остаются и защищают только его внутренние структуры.
+package engine
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+)
+
+// commandBuffer - Размер очереди команд, при заполнении отправители ждут
+const commandBuffer = 1024
+
+type Engine struct {
+	commands chan func()
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func New() *Engine {
+	return &Engine{
+		commands: make(chan func(), commandBuffer),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run - Выполняет команды по очереди до остановки движка
+func (e *Engine) Run() {
+	for {
+		select {
+		case command := <-e.commands:
+			e.execute(command)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Do - Ставит команду в очередь и ждет ее выполнения. Возвращает false, если движок остановлен.
+// Нельзя вызывать из команды: движок будет ждать сам себя. Код, уже выполняющийся в команде,
+// вызывает нужные функции напрямую.
+func (e *Engine) Do(command func()) bool {
+	finished := make(chan struct{})
+	if !e.Submit(func() {
+		defer close(finished)
+		command()
+	}) {
+		return false
+	}
+
+	select {
+	case <-finished:
+		return true
+	case <-e.done:
+		return false
+	}
+}
+
+// Submit - Ставит команду в очередь без ожидания. Возвращает false, если движок остановлен.
+func (e *Engine) Submit(command func()) bool {
+	select {
+	case <-e.done:
+		return false
+	default:
+	}
+
+	select {
+	case e.commands <- command:
+		return true
+	case <-e.done:
+		return false
+	}
+}
+
+// Stop - Останавливает движок, команды в очереди отбрасываются
+func (e *Engine) Stop() {
+	e.stopOnce.Do(func() { close(e.done) })
+}
+
+// Выполняет команду, не давая ее панике остановить движок
+func (e *Engine) execute(command func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logging.ErrorLogger.Printf("Engine command panicked: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+	command()
+}
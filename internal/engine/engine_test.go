@@ -0,0 +1,67 @@
+package engine_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/engine"
+)
+
+// EngineTestSuite defines the suite structure
+type EngineTestSuite struct {
+	suite.Suite
+	engine *engine.Engine
+}
+
+// SetupTest starts a fresh engine before each test
+func (t *EngineTestSuite) SetupTest() {
+	t.engine = engine.New()
+	go t.engine.Run()
+}
+
+// TearDownTest stops the engine
+func (t *EngineTestSuite) TearDownTest() {
+	t.engine.Stop()
+}
+
+// TestCommandsRunOneAtATime tests that commands from many goroutines never overlap
+func (t *EngineTestSuite) TestCommandsRunOneAtATime() {
+	counter := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				t.engine.Do(func() { counter++ })
+			}
+		}()
+	}
+	wg.Wait()
+
+	t.Require().Equal(5000, counter)
+}
+
+// TestPanicDoesNotStopEngine tests that a panicking command is logged and the engine keeps running
+func (t *EngineTestSuite) TestPanicDoesNotStopEngine() {
+	t.Require().True(t.engine.Do(func() { panic("boom") }))
+
+	done := false
+	t.Require().True(t.engine.Do(func() { done = true }))
+	t.Require().True(done)
+}
+
+// TestStop tests that commands are refused after the engine stops
+func (t *EngineTestSuite) TestStop() {
+	t.engine.Stop()
+	t.Require().False(t.engine.Do(func() {}))
+	t.Require().False(t.engine.Submit(func() {}))
+}
+
+// TestEngineTestSuite runs the test suite
+func TestEngineTestSuite(t *testing.T) {
+	suite.Run(t, new(EngineTestSuite))
+}
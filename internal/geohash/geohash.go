@@ -0,0 +1,101 @@
+package geohash
+
+import "strings"
+
+// alphabet - Алфавит base32, используемый в geohash
+const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// MaxPrecision - Максимальная длина geohash, точность которой укладывается в float64
+const MaxPrecision = 12
+
+// Encode - Кодирует координаты в geohash заданной длины
+func Encode(latitude, longitude float64, precision int) string {
+	if precision > MaxPrecision {
+		precision = MaxPrecision
+	}
+
+	latMin, latMax := -90.0, 90.0
+	lonMin, lonMax := -180.0, 180.0
+
+	var hash strings.Builder
+	hash.Grow(precision)
+
+	bit, ch := 0, 0
+	even := true
+	for hash.Len() < precision {
+		if even {
+			mid := (lonMin + lonMax) / 2
+			if longitude >= mid {
+				ch |= 1 << (4 - bit)
+				lonMin = mid
+			} else {
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if latitude >= mid {
+				ch |= 1 << (4 - bit)
+				latMin = mid
+			} else {
+				latMax = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+			continue
+		}
+
+		hash.WriteByte(alphabet[ch])
+		bit, ch = 0, 0
+	}
+
+	return hash.String()
+}
+
+// Box - Прямоугольная ячейка geohash в градусах
+type Box struct {
+	MinLatitude, MaxLatitude   float64
+	MinLongitude, MaxLongitude float64
+}
+
+// Center - Центр ячейки
+func (b Box) Center() (latitude, longitude float64) {
+	return (b.MinLatitude + b.MaxLatitude) / 2, (b.MinLongitude + b.MaxLongitude) / 2
+}
+
+// Decode - Возвращает ячейку, соответствующую geohash. Некорректные символы игнорируются.
+func Decode(hash string) Box {
+	box := Box{MinLatitude: -90, MaxLatitude: 90, MinLongitude: -180, MaxLongitude: 180}
+
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(alphabet, hash[i])
+		if ch < 0 {
+			continue
+		}
+
+		for bit := 4; bit >= 0; bit-- {
+			set := ch&(1<<bit) != 0
+			if even {
+				mid := (box.MinLongitude + box.MaxLongitude) / 2
+				if set {
+					box.MinLongitude = mid
+				} else {
+					box.MaxLongitude = mid
+				}
+			} else {
+				mid := (box.MinLatitude + box.MaxLatitude) / 2
+				if set {
+					box.MinLatitude = mid
+				} else {
+					box.MaxLatitude = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	return box
+}
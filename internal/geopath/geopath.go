@@ -0,0 +1,161 @@
+package geopath
+
+import (
+	"math"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/tidwall/geodesic"
+)
+
+const (
+	// MethodGeodesic - Кратчайший путь по эллипсоиду WGS84
+	MethodGeodesic = "geodesic"
+	// MethodRhumb - Локсодромия: путь с постоянным азимутом
+	MethodRhumb = "rhumb"
+)
+
+// IsValidMethod - Проверяет, поддерживается ли способ построения пути
+func IsValidMethod(method string) bool {
+	return method == MethodGeodesic || method == MethodRhumb
+}
+
+// Build - Строит путь из точки 1 в точку 2 указанным способом с waypoints точками, включая концы (не меньше двух)
+func Build(method string, lat1, lon1, lat2, lon2 float64, waypoints int) *models.PairPath {
+	if waypoints < 2 {
+		waypoints = 2
+	}
+
+	if method == MethodRhumb {
+		return rhumb(lat1, lon1, lat2, lon2, waypoints)
+	}
+	return geodesicPath(lat1, lon1, lat2, lon2, waypoints)
+}
+
+func geodesicPath(lat1, lon1, lat2, lon2 float64, waypoints int) *models.PairPath {
+	var distance, initial, final float64
+	geodesic.WGS84.Inverse(lat1, lon1, lat2, lon2, &distance, &initial, &final)
+
+	// Точки вдоль геодезической получаются решением прямой задачи от начала с начальным азимутом
+	at := func(fraction float64) models.PathPoint {
+		var latitude, longitude float64
+		geodesic.WGS84.Direct(lat1, lon1, initial, distance*fraction, &latitude, &longitude, nil)
+		return models.PathPoint{Latitude: latitude, Longitude: longitude}
+	}
+
+	return &models.PairPath{
+		Method:         MethodGeodesic,
+		Distance:       distance,
+		InitialBearing: normalizeBearing(initial),
+		FinalBearing:   normalizeBearing(final),
+		Midpoint:       at(0.5),
+		Waypoints:      sample(at, waypoints),
+	}
+}
+
+func rhumb(lat1, lon1, lat2, lon2 float64, waypoints int) *models.PairPath {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLambda := normalizeLongitude(lon2-lon1) * math.Pi / 180
+	psi1 := isometricLatitude(phi1)
+	bearing := math.Atan2(dLambda, isometricLatitude(phi2)-psi1)
+
+	m1, m2 := meridianArc(phi1), meridianArc(phi2)
+
+	var distance float64
+	var at func(fraction float64) models.PathPoint
+	if math.Abs(m2-m1) < 1e-6 {
+		// Путь вдоль параллели: длина - дуга параллели
+		distance = math.Abs(dLambda) * primeVerticalRadius(phi1) * math.Cos(phi1)
+		at = func(fraction float64) models.PathPoint {
+			return models.PathPoint{Latitude: lat1, Longitude: normalizeLongitude(lon1 + fraction*dLambda*180/math.Pi)}
+		}
+	} else {
+		distance = math.Abs((m2 - m1) / math.Cos(bearing))
+		at = func(fraction float64) models.PathPoint {
+			phi := footpointLatitude(m1 + fraction*(m2-m1))
+			lambda := math.Tan(bearing) * (isometricLatitude(phi) - psi1)
+			return models.PathPoint{Latitude: phi * 180 / math.Pi, Longitude: normalizeLongitude(lon1 + lambda*180/math.Pi)}
+		}
+	}
+
+	bearingDegrees := normalizeBearing(bearing * 180 / math.Pi)
+	return &models.PairPath{
+		Method:         MethodRhumb,
+		Distance:       distance,
+		InitialBearing: bearingDegrees,
+		FinalBearing:   bearingDegrees,
+		Midpoint:       at(0.5),
+		Waypoints:      sample(at, waypoints),
+	}
+}
+
+// Равномерно разбивает путь на count точек, включая начало и конец
+func sample(at func(fraction float64) models.PathPoint, count int) []models.PathPoint {
+	points := make([]models.PathPoint, count)
+	for i := range points {
+		points[i] = at(float64(i) / float64(count-1))
+	}
+	return points
+}
+
+// Эксцентриситет и третье сжатие эллипсоида WGS84
+var (
+	eccentricity    = math.Sqrt(models.WGS84EccentricitySquared)
+	thirdFlattening = models.WGS84Flattening / (2 - models.WGS84Flattening)
+)
+
+// Изометрическая широта, по которой азимут локсодромии постоянен
+func isometricLatitude(phi float64) float64 {
+	return math.Asinh(math.Tan(phi)) - eccentricity*math.Atanh(eccentricity*math.Sin(phi))
+}
+
+// Радиус кривизны первого вертикала
+func primeVerticalRadius(phi float64) float64 {
+	sin := math.Sin(phi)
+	return models.WGS84SemiMajorAxis / math.Sqrt(1-models.WGS84EccentricitySquared*sin*sin)
+}
+
+// Длина дуги меридиана от экватора до широты phi (ряд Гельмерта по третьему сжатию)
+func meridianArc(phi float64) float64 {
+	n := thirdFlattening
+	n2, n3, n4 := n*n, n*n*n, n*n*n*n
+	mu := phi -
+		(3*n/2-9*n3/16)*math.Sin(2*phi) +
+		(15*n2/16-15*n4/32)*math.Sin(4*phi) -
+		(35*n3/48)*math.Sin(6*phi) +
+		(315*n4/512)*math.Sin(8*phi)
+	return rectifyingRadius() * mu
+}
+
+// Широта, на которой длина дуги меридиана равна m
+func footpointLatitude(m float64) float64 {
+	n := thirdFlattening
+	n2, n3, n4 := n*n, n*n*n, n*n*n*n
+	mu := m / rectifyingRadius()
+	return mu +
+		(3*n/2-27*n3/32)*math.Sin(2*mu) +
+		(21*n2/16-55*n4/32)*math.Sin(4*mu) +
+		(151*n3/96)*math.Sin(6*mu) +
+		(1097*n4/512)*math.Sin(8*mu)
+}
+
+// Радиус окружности, длина которой равна длине меридиана
+func rectifyingRadius() float64 {
+	n := thirdFlattening
+	return models.WGS84SemiMajorAxis / (1 + n) * (1 + n*n/4 + n*n*n*n/64)
+}
+
+func normalizeBearing(bearing float64) float64 {
+	bearing = math.Mod(bearing, 360)
+	if bearing < 0 {
+		bearing += 360
+	}
+	return bearing
+}
+
+func normalizeLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
@@ -0,0 +1,69 @@
+// Package identity - Выдача и проверка подписанных токенов идентичности.
+//
+// Идентичность клиента выдает сервер: при первом подключении клиент получает случайную идентичность и токен,
+// подписанный HMAC-SHA256 секретом развертывания, и предъявляет токен при следующих подключениях. Поэтому
+// идентичность нельзя выбрать самому: чужую не занять, а от собственной блокировки не уйти, кроме как
+// начав с новой идентичностью без истории.
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/google/uuid"
+)
+
+// Issuer - Выдает и проверяет токены идентичности
+type Issuer struct {
+	secret []byte
+}
+
+// NewIssuer - Создает выдающего токены с секретом secret. Без секрета используется случайный,
+// и токены не переживают рестарт сервера.
+func NewIssuer(secret string) *Issuer {
+	if secret != "" {
+		return &Issuer{secret: []byte(secret)}
+	}
+
+	logging.InfoLogger.Printf("Identity secret is not configured, identity tokens will not survive a restart")
+	random := make([]byte, sha256.Size)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return &Issuer{secret: random}
+}
+
+// Issue - Создает новую идентичность и ее токен
+func (i *Issuer) Issue() (identity, token string) {
+	identity = uuid.New().String()
+	return identity, i.Sign(identity)
+}
+
+// Sign - Возвращает токен для идентичности identity
+func (i *Issuer) Sign(identity string) string {
+	return identity + "." + base64.RawURLEncoding.EncodeToString(i.mac(identity))
+}
+
+// Verify - Проверяет подпись токена и возвращает идентичность из него
+func (i *Issuer) Verify(token string) (string, bool) {
+	identity, signature, ok := strings.Cut(token, ".")
+	if !ok || identity == "" {
+		return "", false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, i.mac(identity)) {
+		return "", false
+	}
+	return identity, true
+}
+
+func (i *Issuer) mac(identity string) []byte {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(identity))
+	return mac.Sum(nil)
+}
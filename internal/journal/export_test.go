@@ -0,0 +1,11 @@
+package journal
+
+// TearTail - Дописывает в сегмент обрывок записи, как после неудачной записи, которую не удалось отрезать
+func TearTail(w *Writer, garbage []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.torn = true
+	_, err := w.file.Write(garbage)
+	return err
+}
@@ -0,0 +1,414 @@
+// Package journal - Сегментированный журнал операций, меняющих состояние клиентов. Записи только дописываются,
+// каждая защищена контрольной суммой, а сегменты, покрытые снимком состояния, удаляются.
+package journal
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// Kind - Вид операции в записи журнала
+type Kind string
+
+const (
+	KindClientAdded           Kind = "client_added"
+	KindPositionUpdated       Kind = "position_updated"
+	KindWindowSettingsChanged Kind = "window_settings_changed"
+	KindClientRemoved         Kind = "client_removed"
+	KindRoomJoined            Kind = "room_joined"
+	KindClientBlocked         Kind = "client_blocked"
+	KindClientUnblocked       Kind = "client_unblocked"
+	KindPreferencesChanged    Kind = "preferences_changed"
+	KindPrivacyChanged        Kind = "privacy_changed"
+	KindZonesAdded            Kind = "zones_added"
+	KindZoneRemoved           Kind = "zone_removed"
+	KindPositionExpired       Kind = "position_expired"
+)
+
+// Entry - Запись журнала. Seq растет на единицу с каждой записью, Time - момент операции на сервере.
+type Entry struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Kind     Kind      `json:"kind"`
+	ClientID string    `json:"client_id"`
+
+	// Identity, ResumeToken, SphereID, PrivacyOffset - Параметры нового клиента для KindClientAdded
+	Identity      string                `json:"identity,omitempty"`
+	ResumeToken   string                `json:"resume_token,omitempty"`
+	SphereID      int                   `json:"sphere_id,omitempty"`
+	PrivacyOffset *models.PrivacyOffset `json:"privacy_offset,omitempty"`
+	// Position - Фикс в том виде, в котором его прислал клиент, для KindPositionUpdated
+	Position *models.Position `json:"position,omitempty"`
+	// WindowSettings - Новые настройки окна для KindWindowSettingsChanged
+	WindowSettings *models.WindowSettings `json:"window_settings,omitempty"`
+	// Room, RoomOptions - Комната и ее параметры после нормализации для KindRoomJoined
+	Room        string              `json:"room,omitempty"`
+	RoomOptions *models.RoomOptions `json:"room_options,omitempty"`
+	// TargetID - Клиент, идентичность которого блокируется или разблокируется, для KindClientBlocked и KindClientUnblocked.
+	// Identity и TargetIdentity у этих записей - идентичности обоих клиентов: по ним блокировку применяют узлы
+	// кластера, у которых нет копии одного из клиентов.
+	TargetID       string `json:"target_id,omitempty"`
+	TargetIdentity string `json:"target_identity,omitempty"`
+	// Preferences - Новые предпочтения подбора пар для KindPreferencesChanged
+	Preferences *models.PairingPreferences `json:"preferences,omitempty"`
+	// Privacy - Новые настройки приватности для KindPrivacyChanged
+	Privacy *models.PrivacySettings `json:"privacy,omitempty"`
+	// Zones - Добавленные зоны в виде GeoJSON для KindZonesAdded, ZoneID - удаленная зона для KindZoneRemoved.
+	// Операции с зонами не относятся к клиенту, ClientID у них пуст.
+	Zones  json.RawMessage `json:"zones,omitempty"`
+	ZoneID string          `json:"zone_id,omitempty"`
+}
+
+const (
+	// headerSize - Заголовок записи: длина данных и их CRC-32C
+	headerSize = 8
+	// maxRecordSize - Наибольший размер данных записи. Длина больше этой в заголовке считается повреждением,
+	// а не поводом выделить под запись гигабайты памяти.
+	maxRecordSize = 16 << 20
+	// segmentSuffix - Расширение файлов сегментов, имя сегмента - номер его первой записи
+	segmentSuffix = ".journal"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Writer - Дописывает записи в последний сегмент журнала и открывает новый, когда сегмент вырастает до segmentSize
+type Writer struct {
+	dir         string
+	segmentSize int64
+	fsync       bool
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	lastSeq uint64
+	// torn - За последней целой записью сегмента остался обрывок неудачной записи, который не удалось отрезать
+	torn bool
+}
+
+// Open - Открывает журнал в каталоге dir, создавая его при необходимости. Оборванная при сбое последняя запись
+// отрезается, а нумерация продолжается с последней целой записи. fsync - сбрасывать ли каждую запись на диск.
+func Open(dir string, segmentSize int64, fsync bool) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{dir: dir, segmentSize: segmentSize, fsync: fsync}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return w, nil
+	}
+
+	last := segments[len(segments)-1]
+	lastSeq, good, err := scanSegment(last.path, nil)
+	if err != nil && !errors.Is(err, errTornTail) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w.file, w.size = file, good
+	w.lastSeq = max(lastSeq, last.first-1)
+	return w, nil
+}
+
+// Advance - Продолжает нумерацию не раньше, чем с seq + 1. Нужен, когда снимок новее журнала (например,
+// каталог журнала очищен), иначе новые записи получили бы номера, которые повтор после снимка пропустит.
+func (w *Writer) Advance(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq <= w.lastSeq {
+		return nil
+	}
+	w.lastSeq = seq
+
+	// Имя текущего сегмента больше не соответствует нумерации, следующая запись начнет новый
+	if w.file == nil {
+		return nil
+	}
+	err := errors.Join(w.file.Sync(), w.file.Close())
+	w.file = nil
+	return err
+}
+
+// Append - Присваивает записи следующий номер и дописывает ее в журнал
+func (w *Writer) Append(entry *Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry.Seq = w.lastSeq + 1
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("%w: %d bytes", util.ErrJournalRecordTooLarge, len(payload))
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[headerSize:], payload)
+
+	// Обрывок нельзя оставлять перед новыми записями или сегментами: он оказался бы в середине журнала
+	if w.torn {
+		if err := w.truncateTail(); err != nil {
+			return err
+		}
+	}
+
+	if w.file == nil || (w.size > 0 && w.size+int64(len(record)) > w.segmentSize) {
+		if err := w.rotate(entry.Seq); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.file.Write(record); err != nil {
+		return errors.Join(err, w.truncateTail())
+	}
+	if w.fsync {
+		if err := w.file.Sync(); err != nil {
+			return errors.Join(err, w.truncateTail())
+		}
+	}
+
+	w.size += int64(len(record))
+	w.lastSeq = entry.Seq
+	return nil
+}
+
+// Record - Дописывает запись, проставляя время операции, если оно не задано. Ошибки записи логируются:
+// операция уже выполнена, и отказ журнала не должен ее отменять.
+func (w *Writer) Record(entry *Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if err := w.Append(entry); err != nil {
+		logging.ErrorLogger.Printf("Failed to append %s to journal: %v", entry.Kind, err)
+	}
+}
+
+// LastSeq - Номер последней записанной записи (0 - журнал пуст)
+func (w *Writer) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastSeq
+}
+
+// Prune - Удаляет сегменты, все записи которых не новее upTo. Текущий сегмент не удаляется никогда.
+func (w *Writer) Prune(upTo uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	// Сегмент покрыт целиком, если следующий за ним начинается не позже upTo + 1
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i+1].first > upTo+1 {
+			break
+		}
+		if err := os.Remove(segments[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close - Сбрасывает и закрывает текущий сегмент
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := errors.Join(w.file.Sync(), w.file.Close())
+	w.file = nil
+	return err
+}
+
+// Отрезает от сегмента все, что записано после последней целой записи, чтобы следующая запись легла сразу за ней
+func (w *Writer) truncateTail() error {
+	w.torn = true
+	if err := w.file.Truncate(w.size); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		return err
+	}
+	w.torn = false
+	return nil
+}
+
+// Закрывает текущий сегмент и начинает новый с записи first
+func (w *Writer) rotate(first uint64) error {
+	if w.file != nil {
+		if err := errors.Join(w.file.Sync(), w.file.Close()); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(segmentPath(w.dir, first), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = file, 0
+	return nil
+}
+
+// Read - Передает fn записи журнала из каталога dir с номерами больше after по порядку. Оборванная запись в конце
+// последнего сегмента считается следом сбоя и пропускается, повреждение в любом другом месте возвращает
+// util.ErrJournalCorrupted. Отсутствующий каталог читается как пустой журнал.
+func Read(dir string, after uint64, fn func(entry *Entry) error) error {
+	segments, err := listSegments(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, segment := range segments {
+		// Сегмент целиком не новее after, если следующий начинается не позже after + 1
+		if i+1 < len(segments) && segments[i+1].first <= after+1 {
+			continue
+		}
+
+		_, _, err := scanSegment(segment.path, func(entry *Entry) error {
+			if entry.Seq <= after {
+				return nil
+			}
+			return fn(entry)
+		})
+		if errors.Is(err, errTornTail) {
+			if i == len(segments)-1 {
+				return nil
+			}
+			return fmt.Errorf("%w: %s", util.ErrJournalCorrupted, segment.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errTornTail - Запись в сегменте оборвана или не сходится с контрольной суммой
+var errTornTail = errors.New("torn journal record")
+
+// Читает записи сегмента по порядку и возвращает номер последней целой записи и смещение сразу за ней.
+// На первой поврежденной записи, в том числе с длиной больше maxRecordSize, возвращает errTornTail.
+func scanSegment(path string, fn func(entry *Entry) error) (lastSeq uint64, good int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return lastSeq, good, nil
+			}
+			return lastSeq, good, errTornTail
+		}
+
+		size := binary.LittleEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return lastSeq, good, errTornTail
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return lastSeq, good, errTornTail
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return lastSeq, good, errTornTail
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return lastSeq, good, errTornTail
+		}
+		if fn != nil {
+			if err := fn(&entry); err != nil {
+				return lastSeq, good, err
+			}
+		}
+
+		lastSeq = entry.Seq
+		good += int64(headerSize + len(payload))
+	}
+}
+
+// segment - Файл сегмента и номер его первой записи
+type segment struct {
+	path  string
+	first uint64
+}
+
+// Возвращает сегменты каталога в порядке номеров их первых записей
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]segment, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		first, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(dir, entry.Name()), first: first})
+	}
+
+	slices.SortFunc(segments, func(a, b segment) int {
+		return cmp.Compare(a.first, b.first)
+	})
+	return segments, nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
@@ -0,0 +1,205 @@
+package journal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// JournalTestSuite checks writing, reading and recovering journal segments
+type JournalTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+// SetupTest points the journal to a fresh temporary directory
+func (t *JournalTestSuite) SetupTest() {
+	t.dir = t.T().TempDir()
+}
+
+// TestRoundTrip tests that entries are read back in order across segment rotation
+func (t *JournalTestSuite) TestRoundTrip() {
+	writer := t.open(256)
+	written := t.append(writer, 20)
+	t.Require().NoError(writer.Close())
+
+	t.Require().Greater(len(t.segments()), 1, "Small segments rotate")
+	t.Require().Equal(written, t.read(0))
+	t.Require().Equal(written[14:], t.read(14), "Only entries after the given sequence are read")
+}
+
+// TestReopen tests that numbering continues after the journal is reopened
+func (t *JournalTestSuite) TestReopen() {
+	writer := t.open(1 << 20)
+	t.append(writer, 3)
+	t.Require().NoError(writer.Close())
+
+	writer = t.open(1 << 20)
+	defer writer.Close()
+	t.Require().Equal(uint64(3), writer.LastSeq())
+	t.append(writer, 1)
+	t.Require().Len(t.read(0), 4)
+}
+
+// TestTornTail tests that a record cut off by a crash is dropped and overwritten by the next append
+func (t *JournalTestSuite) TestTornTail() {
+	writer := t.open(1 << 20)
+	t.append(writer, 3)
+	t.Require().NoError(writer.Close())
+
+	segments := t.segments()
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	t.Require().NoError(err)
+	t.Require().NoError(os.Truncate(last, info.Size()-5))
+
+	t.Require().Len(t.read(0), 2, "The torn record is skipped")
+
+	writer = t.open(1 << 20)
+	defer writer.Close()
+	t.Require().Equal(uint64(2), writer.LastSeq())
+	t.append(writer, 1)
+
+	entries := t.read(0)
+	t.Require().Len(entries, 3)
+	t.Require().Equal(uint64(3), entries[2].Seq)
+}
+
+// TestFailedAppend tests that a partially written record is cut off before the next append and the next segment
+func (t *JournalTestSuite) TestFailedAppend() {
+	writer := t.open(256)
+	defer writer.Close()
+	written := t.append(writer, 1)
+	t.Require().NoError(journal.TearTail(writer, []byte{40, 0, 0, 0, 1, 2, 3}))
+
+	written = append(written, t.append(writer, 20)...)
+	t.Require().Greater(len(t.segments()), 1)
+	t.Require().Equal(written, t.read(0), "No torn record is left in the middle of the journal")
+}
+
+// TestOversizedLength tests that a garbage length in the last record header is treated as a torn tail
+func (t *JournalTestSuite) TestOversizedLength() {
+	writer := t.open(1 << 20)
+	t.append(writer, 2)
+	t.Require().NoError(writer.Close())
+
+	segments := t.segments()
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0o644)
+	t.Require().NoError(err)
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	t.Require().NoError(err)
+	t.Require().NoError(file.Close())
+
+	t.Require().Len(t.read(0), 2, "The record with an impossible length is skipped")
+
+	writer = t.open(1 << 20)
+	defer writer.Close()
+	t.Require().Equal(uint64(2), writer.LastSeq())
+}
+
+// TestCorruption tests that a damaged record before the last segment fails the read
+func (t *JournalTestSuite) TestCorruption() {
+	writer := t.open(256)
+	t.append(writer, 20)
+	t.Require().NoError(writer.Close())
+
+	first := t.segments()[0]
+	data, err := os.ReadFile(first)
+	t.Require().NoError(err)
+	data[len(data)-2] ^= 0xff
+	t.Require().NoError(os.WriteFile(first, data, 0o644))
+
+	err = journal.Read(t.dir, 0, func(entry *journal.Entry) error { return nil })
+	t.Require().ErrorIs(err, util.ErrJournalCorrupted)
+}
+
+// TestPrune tests that only segments fully covered by a snapshot are removed
+func (t *JournalTestSuite) TestPrune() {
+	writer := t.open(256)
+	defer writer.Close()
+	written := t.append(writer, 20)
+	before := len(t.segments())
+
+	t.Require().NoError(writer.Prune(10))
+	t.Require().Less(len(t.segments()), before)
+
+	entries := t.read(10)
+	t.Require().Equal(written[10:], entries, "Entries after the snapshot survive pruning")
+
+	t.Require().NoError(writer.Prune(writer.LastSeq()))
+	t.Require().Len(t.segments(), 1, "The current segment is never removed")
+}
+
+// TestAdvance tests that numbering skips entries already covered by a newer snapshot
+func (t *JournalTestSuite) TestAdvance() {
+	writer := t.open(1 << 20)
+	defer writer.Close()
+	t.append(writer, 2)
+
+	t.Require().NoError(writer.Advance(10))
+	t.append(writer, 1)
+
+	entries := t.read(10)
+	t.Require().Len(entries, 1)
+	t.Require().Equal(uint64(11), entries[0].Seq)
+}
+
+// TestMissingDirectory tests that a journal that was never written reads as empty
+func (t *JournalTestSuite) TestMissingDirectory() {
+	err := journal.Read(filepath.Join(t.dir, "missing"), 0, func(entry *journal.Entry) error {
+		t.Fail("No entries expected")
+		return nil
+	})
+	t.Require().NoError(err)
+}
+
+// open opens the journal with the given segment size
+func (t *JournalTestSuite) open(segmentSize int64) *journal.Writer {
+	writer, err := journal.Open(t.dir, segmentSize, true)
+	t.Require().NoError(err)
+	return writer
+}
+
+// append writes n position updates and returns them as they are read back
+func (t *JournalTestSuite) append(writer *journal.Writer, n int) []*journal.Entry {
+	entries := make([]*journal.Entry, 0, n)
+	for i := range n {
+		entry := &journal.Entry{
+			Time:     time.Date(2026, 1, 2, 3, 4, i, 0, time.UTC),
+			Kind:     journal.KindPositionUpdated,
+			ClientID: "a",
+			Position: &models.Position{Latitude: 55.75 + float64(i)/1000, Longitude: 37.61},
+		}
+		t.Require().NoError(writer.Append(entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// read reads all entries after the given sequence number
+func (t *JournalTestSuite) read(after uint64) []*journal.Entry {
+	entries := make([]*journal.Entry, 0)
+	t.Require().NoError(journal.Read(t.dir, after, func(entry *journal.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}))
+	return entries
+}
+
+// segments lists segment files in order
+func (t *JournalTestSuite) segments() []string {
+	segments, err := filepath.Glob(filepath.Join(t.dir, "*.journal"))
+	t.Require().NoError(err)
+	return segments
+}
+
+func TestJournalTestSuite(t *testing.T) {
+	suite.Run(t, new(JournalTestSuite))
+}
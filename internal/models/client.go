@@ -2,20 +2,82 @@ package models
 
 import (
 	"math"
+	"time"
 
 	"github.com/dhconnelly/rtreego"
 	"github.com/gorilla/websocket"
+	"github.com/tidwall/geodesic"
 )
 
-// EarthRadius - Радиус Земли в метрах
-const EarthRadius = 6371000
+const (
+	// WGS84SemiMajorAxis - Большая полуось эллипсоида WGS84 в метрах
+	WGS84SemiMajorAxis = 6378137.0
+	// WGS84Flattening - Сжатие эллипсоида WGS84
+	WGS84Flattening = 1 / 298.257223563
+	// WGS84EccentricitySquared - Квадрат первого эксцентриситета эллипсоида WGS84
+	WGS84EccentricitySquared = WGS84Flattening * (2 - WGS84Flattening)
+)
 
 type ClientInfo struct {
-	Connection     *websocket.Conn `json:"-"`
-	ID             string          `json:"client_id"`
+	Connection *websocket.Conn `json:"-"`
+	ID         string          `json:"client_id"`
+	// Identity - Постоянная идентичность клиента между сессиями (по умолчанию совпадает с ID)
+	Identity string `json:"-"`
+	// ResumeToken - Случайный секрет сессии, который клиент предъявляет, чтобы продолжить ее после рестарта сервера
+	ResumeToken    string          `json:"-"`
 	SphereID       int             `json:"sphere_id"`
+	Room           string          `json:"room"`
 	Position       *Position       `json:"position,omitempty"`
 	WindowSettings *WindowSettings `json:"window_settings,omitempty"`
+	// Zones - Идентификаторы зон, в которых находится позиция клиента
+	Zones []string `json:"zones,omitempty"`
+
+	// Privacy - Собственные настройки приватности клиента (могут только ужесточать политику развертывания)
+	Privacy *PrivacySettings `json:"-"`
+	// PrivacyOffset - Случайное смещение координат, выбранное на время сессии
+	PrivacyOffset *PrivacyOffset `json:"-"`
+	// Preferences - Собственные настройки подбора ближайшего клиента
+	Preferences *PairingPreferences `json:"-"`
+}
+
+// PairingPreferences - Допустимые расстояния до ближайшего клиента, nil - значение развертывания (0 - без ограничения)
+type PairingPreferences struct {
+	MinDistance *float64 `json:"min_distance,omitempty"`
+	MaxDistance *float64 `json:"max_distance,omitempty"`
+	// Path - Добавлять ли путь до ближайшего в уведомления о ближайшем (nil - не добавлять)
+	Path *PathOptions `json:"path,omitempty"`
+}
+
+// PrivacySettings - Настройки раскрытия позиции клиента другим клиентам
+type PrivacySettings struct {
+	Coordinates   string `json:"coordinates,omitempty"`
+	ExposeNearest *bool  `json:"expose_nearest,omitempty"`
+}
+
+// PrivacyOffset - Смещение в метрах по заданному азимуту
+type PrivacyOffset struct {
+	Azimuth  float64
+	Distance float64
+}
+
+// PublicClientInfo - Информация о клиенте, которую видят другие клиенты
+type PublicClientInfo struct {
+	ID             string          `json:"client_id"`
+	SphereID       int             `json:"sphere_id"`
+	Position       *PublicPosition `json:"position,omitempty"`
+	WindowSettings *WindowSettings `json:"window_settings,omitempty"`
+}
+
+// PublicPosition - Позиция клиента с пониженной точностью
+type PublicPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Precision - Примерная погрешность раскрытых координат в метрах (0 - точные)
+	Precision float64 `json:"precision"`
+
+	ClosestClientID string  `json:"closest_client_id,omitempty"`
+	Distance        float64 `json:"distance,omitempty"`
+	Azimuth         float64 `json:"azimuth,omitempty"`
 }
 
 func (c *ClientInfo) HasPosition() bool {
@@ -38,10 +100,43 @@ func (c *ClientInfo) Bounds() rtreego.Rect {
 	return rect
 }
 
+// PositionSource - Источник геопозиции клиента
+type PositionSource string
+
+const (
+	PositionSourceGPS     PositionSource = "gps"
+	PositionSourceNetwork PositionSource = "network"
+	PositionSourceManual  PositionSource = "manual"
+)
+
+// IsValid - Метод для проверки является ли источник известным (пустой источник считается неизвестным, но допустимым)
+func (s PositionSource) IsValid() bool {
+	switch s {
+	case "", PositionSourceGPS, PositionSourceNetwork, PositionSourceManual:
+		return true
+	}
+	return false
+}
+
 type Position struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
 
+	// Сырые координаты последнего принятого фикса (Latitude и Longitude могут быть сглажены)
+	RawLatitude  float64 `json:"raw_latitude"`
+	RawLongitude float64 `json:"raw_longitude"`
+
+	// Горизонтальная точность в метрах (0 - неизвестна), время получения фикса и его источник
+	Accuracy  float64        `json:"accuracy,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+	Source    PositionSource `json:"source,omitempty"`
+
+	// ReceivedAt - Время получения фикса по часам сервера, по нему отсчитывается PositionTTL
+	ReceivedAt time.Time `json:"received_at"`
+
+	// Скорость и курс клиента, присланные им или вычисленные по двум последним фиксам (nil - неизвестны)
+	Velocity *Velocity `json:"velocity,omitempty"`
+
 	X float64 `json:"x"`
 	Y float64 `json:"y"`
 	Z float64 `json:"z"`
@@ -49,6 +144,47 @@ type Position struct {
 	ClosestClientID string  `json:"closest_client_id,omitempty"`
 	Distance        float64 `json:"distance,omitempty"`
 	Azimuth         float64 `json:"azimuth,omitempty"`
+
+	// Кандидат на смену ближайшего клиента и момент, с которого он непрерывно ближе текущего
+	PendingClosestClientID string    `json:"-"`
+	PendingSince           time.Time `json:"-"`
+}
+
+// Velocity - Скорость в м/с и курс в градусах от севера по часовой стрелке
+type Velocity struct {
+	Speed  float64 `json:"speed"`
+	Course float64 `json:"course"`
+}
+
+// IsMoving - Метод для проверки движется ли клиент
+func (p *Position) IsMoving() bool {
+	return p.Velocity != nil && p.Velocity.Speed > 0
+}
+
+// Extrapolate - Метод для счисления пути: возвращает координаты, в которых клиент окажется к моменту at,
+// если продолжит двигаться с той же скоростью и курсом. Время отсчитывается от получения фикса сервером, а не от его
+// метки: фикс с меткой в прошлом или с допустимым расхождением часов не должен сразу сдвигаться вперед. Время
+// экстраполяции ограничено maxAge.
+func (p *Position) Extrapolate(at time.Time, maxAge time.Duration) (latitude, longitude float64) {
+	// Позиции из старых снимков не содержат времени получения, для них используется время фикса
+	since := p.ReceivedAt
+	if since.IsZero() {
+		since = p.Timestamp
+	}
+	if !p.IsMoving() || since.IsZero() {
+		return p.Latitude, p.Longitude
+	}
+
+	age := at.Sub(since)
+	if age <= 0 {
+		return p.Latitude, p.Longitude
+	}
+	if age > maxAge {
+		age = maxAge
+	}
+
+	geodesic.WGS84.Direct(p.Latitude, p.Longitude, p.Velocity.Course, p.Velocity.Speed*age.Seconds(), &latitude, &longitude, nil)
+	return latitude, longitude
 }
 
 // SameLocation - Метод для проверки является ли позиция той же самой (не учитывает X, Y, Z и Heading)
@@ -56,14 +192,25 @@ func (p *Position) SameLocation(another *Position) bool {
 	return p.Latitude == another.Latitude && p.Longitude == another.Longitude
 }
 
-// UpdateXYZ - Метод для обновления X, Y, Z координат на основе широты и долготы
+// UpdateXYZ - Метод для обновления X, Y, Z координат (ECEF на эллипсоиде WGS84, высота 0) на основе широты и долготы
 func (p *Position) UpdateXYZ() {
 	latRad := p.Latitude * math.Pi / 180
 	lonRad := p.Longitude * math.Pi / 180
 
-	p.X = EarthRadius * math.Cos(latRad) * math.Cos(lonRad)
-	p.Y = EarthRadius * math.Cos(latRad) * math.Sin(lonRad)
-	p.Z = EarthRadius * math.Sin(latRad)
+	sinLat := math.Sin(latRad)
+	// Радиус кривизны первого вертикала
+	n := WGS84SemiMajorAxis / math.Sqrt(1-WGS84EccentricitySquared*sinLat*sinLat)
+
+	p.X = n * math.Cos(latRad) * math.Cos(lonRad)
+	p.Y = n * math.Cos(latRad) * math.Sin(lonRad)
+	p.Z = n * (1 - WGS84EccentricitySquared) * sinLat
+}
+
+// GeodesicDistanceTo - Метод для вычисления геодезического расстояния (WGS84) до другой позиции в метрах
+func (p *Position) GeodesicDistanceTo(another *Position) float64 {
+	var distance float64
+	geodesic.WGS84.Inverse(p.Latitude, p.Longitude, another.Latitude, another.Longitude, &distance, nil, nil)
+	return distance
 }
 
 type WindowSettings struct {
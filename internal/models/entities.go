@@ -1,5 +1,7 @@
 package models
 
+import "encoding/json"
+
 type Response[ResponseType any] struct {
 	Type     string        `json:"type"`
 	Response *ResponseType `json:"data"`
@@ -10,7 +12,18 @@ type GetClientInfoRequest struct {
 }
 
 type GetClientsResponse struct {
-	Clients []*ClientInfo `json:"clients"`
+	Clients []*PublicClientInfo `json:"clients"`
+}
+
+type SetPrivacyRequest struct {
+	Coordinates   string `json:"coordinates,omitempty"`
+	ExposeNearest *bool  `json:"expose_nearest,omitempty"`
+}
+
+type SetPreferencesRequest struct {
+	MinDistance *float64     `json:"min_distance,omitempty"`
+	MaxDistance *float64     `json:"max_distance,omitempty"`
+	Path        *PathOptions `json:"path,omitempty"`
 }
 
 type WhoAmIResponse struct {
@@ -20,12 +33,82 @@ type WhoAmIResponse struct {
 type UpdatePositionRequest struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
+
+	// Необязательные метаданные фикса: точность в метрах, время в миллисекундах с начала эпохи и источник
+	Accuracy  float64        `json:"accuracy,omitempty"`
+	Timestamp int64          `json:"timestamp,omitempty"`
+	Source    PositionSource `json:"source,omitempty"`
+
+	// Необязательные скорость в м/с и курс в градусах, если не переданы - вычисляются сервером
+	Speed  *float64 `json:"speed,omitempty"`
+	Course *float64 `json:"course,omitempty"`
 }
 
 type GetNearestClientResponse struct {
 	ID       string  `json:"id"`
 	Azimuth  float64 `json:"azimuth"`
 	Distance float64 `json:"distance"`
+	// Path - Путь до ближайшего, если клиент подписался на него в настройках
+	Path *PairPath `json:"path,omitempty"`
+}
+
+type GetPairPathRequest struct {
+	PathOptions
+}
+
+type GetPairPathResponse struct {
+	ClientID string `json:"client_id"`
+	*PairPath
+}
+
+// PathOptions - Параметры построения пути до ближайшего
+type PathOptions struct {
+	// Waypoints - Количество точек пути, включая концы
+	Waypoints int `json:"waypoints,omitempty"`
+	// Method - geodesic (по умолчанию) или rhumb
+	Method string `json:"method,omitempty"`
+}
+
+// PairPath - Путь между клиентом и его ближайшим
+type PairPath struct {
+	Method         string      `json:"method"`
+	Distance       float64     `json:"distance"`
+	InitialBearing float64     `json:"initial_bearing"`
+	FinalBearing   float64     `json:"final_bearing"`
+	Midpoint       PathPoint   `json:"midpoint"`
+	Waypoints      []PathPoint `json:"waypoints"`
+}
+
+type PathPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// NoEligibleNearestResponse - Ни один клиент не подходит в ближайшие с учетом допустимых расстояний и ограничений
+type NoEligibleNearestResponse struct {
+	MinDistance float64 `json:"min_distance,omitempty"`
+	MaxDistance float64 `json:"max_distance,omitempty"`
+}
+
+type PositionStaleResponse struct {
+	// LastUpdate - Время последнего принятого фикса в миллисекундах с начала эпохи
+	LastUpdate int64 `json:"last_update"`
+}
+
+// SessionResponse - Отправляется клиенту сразу после подключения. IdentityToken передается в параметре identity
+// при следующих подключениях, чтобы сохранить идентичность и блокировки, а ResumeToken вместе с ним
+// в параметре resume - чтобы продолжить эту сессию после рестарта сервера
+type SessionResponse struct {
+	ClientID      string `json:"client_id"`
+	IdentityToken string `json:"identity_token"`
+	ResumeToken   string `json:"resume_token"`
+}
+
+// HandoffResponse - Сессию клиента принял другой узел кластера: клиент переподключается к узлу Node с параметром
+// handoff=Token и продолжает сессию с тем же ID
+type HandoffResponse struct {
+	Node  string `json:"node"`
+	Token string `json:"token"`
 }
 
 type SyncStateMessage struct {
@@ -36,3 +119,68 @@ type SyncStateMessage struct {
 	HeartRedness          float64 `json:"heartRedness"`
 	StateVersion          int     `json:"stateVersion"`
 }
+
+type ZoneTransition struct {
+	ClientID string
+	ZoneID   string
+	Entered  bool
+}
+
+type ZoneEventResponse struct {
+	ZoneID string `json:"zone_id"`
+}
+
+type AddZoneRequest struct {
+	Token   string          `json:"token"`
+	GeoJSON json.RawMessage `json:"geojson"`
+}
+
+type RemoveZoneRequest struct {
+	Token  string `json:"token"`
+	ZoneID string `json:"zone_id"`
+}
+
+type ZoneInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Rule string `json:"rule"`
+}
+
+type GetZonesResponse struct {
+	Zones []*ZoneInfo `json:"zones"`
+}
+
+// GlobalRoom - Комната, в которой клиенты находятся по умолчанию
+const GlobalRoom = "global"
+
+type RoomOptions struct {
+	Limit    int               `json:"limit,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Pairing - Режим подбора пар в комнате (пустой - режим развертывания)
+	Pairing string `json:"pairing,omitempty"`
+}
+
+type RoomInfo struct {
+	Name     string            `json:"name"`
+	Limit    int               `json:"limit,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Pairing  string            `json:"pairing,omitempty"`
+	Members  int               `json:"members"`
+}
+
+// JoinRoomRequest - Запрос на вход в комнату. Комнаты не защищены паролем: войти может любой, кто знает название
+type JoinRoomRequest struct {
+	Room string `json:"room"`
+	// Параметры применяются, только если комната создается этим запросом
+	Limit    int               `json:"limit,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Pairing  string            `json:"pairing,omitempty"`
+}
+
+type JoinRoomResponse struct {
+	Room *RoomInfo `json:"room"`
+}
+
+type BlockClientRequest struct {
+	ClientID string `json:"client_id"`
+}
@@ -0,0 +1,181 @@
+package privacy
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/geohash"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/tidwall/geodesic"
+)
+
+// metersPerDegree - Длина градуса широты в метрах (приближенно)
+const metersPerDegree = 111320.0
+
+// Policy - Политика раскрытия позиций клиентов. Внутренние вычисления сервера всегда используют точные значения,
+// политика применяется только к тому, что уходит другим клиентам.
+type Policy struct {
+	cfg config.Privacy
+}
+
+func NewPolicy(cfg config.Privacy) *Policy {
+	return &Policy{cfg: cfg}
+}
+
+// IsValidMode - Проверяет, является ли режим раскрытия координат известным
+func IsValidMode(mode string) bool {
+	return modeStrictness(mode) >= 0
+}
+
+// NewSessionOffset - Выбирает случайное смещение координат на время сессии клиента
+func (p *Policy) NewSessionOffset() *models.PrivacyOffset {
+	return &models.PrivacyOffset{
+		Azimuth: rand.Float64() * 360,
+		// Корень дает равномерное распределение по площади круга
+		Distance: math.Sqrt(rand.Float64()) * p.cfg.SessionOffset,
+	}
+}
+
+// Expose - Возвращает представление subject, которое разрешено видеть клиенту viewerID
+func (p *Policy) Expose(subject *models.ClientInfo, viewerID string) *models.PublicClientInfo {
+	exposed := &models.PublicClientInfo{
+		ID:             subject.ID,
+		SphereID:       subject.SphereID,
+		WindowSettings: subject.WindowSettings,
+	}
+
+	if !subject.HasPosition() {
+		return exposed
+	}
+
+	// Клиент видит свои координаты без огрубления, но расстояние и азимут описывают его ближайшего
+	// и огрубляются так же, как в уведомлениях о ближайшем
+	if subject.ID == viewerID {
+		exposed.Position = &models.PublicPosition{
+			Latitude:        subject.Position.Latitude,
+			Longitude:       subject.Position.Longitude,
+			ClosestClientID: subject.Position.ClosestClientID,
+			Distance:        roundTo(subject.Position.Distance, p.cfg.DistanceRounding),
+			Azimuth:         math.Round(subject.Position.Azimuth),
+		}
+		return exposed
+	}
+
+	mode, exposeNearest := p.effective(subject.Privacy)
+	if mode == config.CoordinatesHidden {
+		return exposed
+	}
+
+	position := &models.PublicPosition{}
+	position.Latitude, position.Longitude, position.Precision = p.coarsen(mode, subject.Position, subject.PrivacyOffset)
+
+	if exposeNearest {
+		position.ClosestClientID = subject.Position.ClosestClientID
+		position.Distance = roundTo(subject.Position.Distance, p.cfg.DistanceRounding)
+		position.Azimuth = math.Round(subject.Position.Azimuth)
+	}
+
+	exposed.Position = position
+	return exposed
+}
+
+// Bearing - Возвращает расстояние и азимут от точки клиента viewerID до subject, которые разрешено видеть клиенту.
+// Они вычисляются до раскрытой политикой позиции subject и округляются, чтобы по ним нельзя было восстановить
+// его точные координаты. Если координаты subject скрыты, округляются расстояние и азимут до его точной позиции.
+func (p *Policy) Bearing(latitude, longitude float64, subject *models.ClientInfo, viewerID string) (distance, azimuth float64) {
+	toLatitude, toLongitude := subject.Position.Latitude, subject.Position.Longitude
+	if exposed := p.Expose(subject, viewerID).Position; exposed != nil {
+		toLatitude, toLongitude = exposed.Latitude, exposed.Longitude
+	}
+
+	geodesic.WGS84.Inverse(latitude, longitude, toLatitude, toLongitude, &distance, &azimuth, nil)
+	if azimuth < 0 {
+		azimuth += 360
+	}
+
+	return roundTo(distance, p.cfg.DistanceRounding), math.Mod(math.Round(azimuth), 360)
+}
+
+// Объединяет политику развертывания с настройками клиента, выбирая более строгий вариант
+func (p *Policy) effective(settings *models.PrivacySettings) (mode string, exposeNearest bool) {
+	mode, exposeNearest = p.cfg.Coordinates, p.cfg.ExposeNearest
+	if settings == nil {
+		return mode, exposeNearest
+	}
+
+	if modeStrictness(settings.Coordinates) > modeStrictness(mode) {
+		mode = settings.Coordinates
+	}
+
+	if settings.ExposeNearest != nil && !*settings.ExposeNearest {
+		exposeNearest = false
+	}
+
+	return mode, exposeNearest
+}
+
+// Огрубляет координаты: смещает на случайное смещение сессии и привязывает к ячейке сетки или geohash
+func (p *Policy) coarsen(mode string, position *models.Position, offset *models.PrivacyOffset) (latitude, longitude, precision float64) {
+	latitude, longitude = position.Latitude, position.Longitude
+	if mode == config.CoordinatesExact {
+		return latitude, longitude, 0
+	}
+
+	if offset != nil && offset.Distance > 0 {
+		geodesic.WGS84.Direct(latitude, longitude, offset.Azimuth, offset.Distance, &latitude, &longitude, nil)
+	}
+
+	switch mode {
+	case config.CoordinatesGeohash:
+		box := geohash.Decode(geohash.Encode(latitude, longitude, p.cfg.GeohashPrecision))
+		latitude, longitude = box.Center()
+
+		// Погрешность - расстояние от центра ячейки до ее угла
+		geodesic.WGS84.Inverse(latitude, longitude, box.MaxLatitude, box.MaxLongitude, &precision, nil, nil)
+		return latitude, longitude, precision
+	default:
+		latitude, longitude = snapToGrid(latitude, longitude, p.cfg.GridSize)
+		return latitude, longitude, p.cfg.GridSize
+	}
+}
+
+// Привязывает координаты к центру ячейки сетки размером gridSize метров
+func snapToGrid(latitude, longitude, gridSize float64) (float64, float64) {
+	if gridSize <= 0 {
+		return latitude, longitude
+	}
+
+	latStep := gridSize / metersPerDegree
+	latitude = math.Min(90, math.Max(-90, (math.Floor(latitude/latStep)+0.5)*latStep))
+
+	// Шаг по долготе растет к полюсам, чтобы ячейка оставалась примерно квадратной
+	lonStep := 360.0
+	if cos := math.Cos(latitude * math.Pi / 180); cos > gridSize/(metersPerDegree*360) {
+		lonStep = math.Min(360, gridSize/(metersPerDegree*cos))
+	}
+	longitude = math.Min(180, (math.Floor((longitude+180)/lonStep)+0.5)*lonStep-180)
+
+	return latitude, longitude
+}
+
+// Строгость режима раскрытия координат, -1 для неизвестного режима
+func modeStrictness(mode string) int {
+	switch mode {
+	case config.CoordinatesExact:
+		return 0
+	case config.CoordinatesGrid, config.CoordinatesGeohash:
+		return 1
+	case config.CoordinatesHidden:
+		return 2
+	default:
+		return -1
+	}
+}
+
+func roundTo(value, step float64) float64 {
+	if step <= 0 {
+		return value
+	}
+	return math.Round(value/step) * step
+}
@@ -0,0 +1,128 @@
+// Package replay - Повтор журнала операций на юзкейсах: восстановление состояния после сбоя и воспроизведение
+// инцидентов. Операции повторяются со временем из записей, поэтому один и тот же журнал всегда дает одно состояние.
+package replay
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
+)
+
+// Replayer - Применяет записи журнала к юзкейсам. Юзкейсы не должны писать в журнал во время повтора.
+type Replayer struct {
+	geoUsecase   *usecases.GeolocationUsecase
+	usersUsecase *usecases.UsersUsecase
+}
+
+func New(geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase) *Replayer {
+	return &Replayer{geoUsecase: geoUsecase, usersUsecase: usersUsecase}
+}
+
+// Apply - Применяет запись так же, как ее применил сервер, и возвращает клиентов, которых операция уведомила бы.
+// Ошибка операции (например, отклоненный фикс) возвращается, но повтор журнала на ней не останавливается.
+func (r *Replayer) Apply(entry *journal.Entry) (notify []string, err error) {
+	r.geoUsecase.SetClock(func() time.Time { return entry.Time })
+	defer r.geoUsecase.SetClock(nil)
+
+	switch entry.Kind {
+	case journal.KindClientAdded:
+		return []string{}, r.usersUsecase.AddClient(&models.ClientInfo{
+			ID:            entry.ClientID,
+			Identity:      entry.Identity,
+			ResumeToken:   entry.ResumeToken,
+			SphereID:      entry.SphereID,
+			PrivacyOffset: entry.PrivacyOffset,
+		})
+
+	case journal.KindPositionUpdated:
+		if entry.Position == nil {
+			return []string{}, nil
+		}
+		// Юзкейс дополняет фикс, поэтому запись остается нетронутой
+		fix := *entry.Position
+		return r.geoUsecase.UpdatePosition(entry.ClientID, &fix)
+
+	case journal.KindWindowSettingsChanged:
+		return []string{}, r.usersUsecase.UpdateWindowSettings(entry.ClientID, entry.WindowSettings)
+
+	case journal.KindClientRemoved:
+		// Повторяет удаление клиента обработчиком соединений
+		if _, err := r.usersUsecase.GetClientInfo(entry.ClientID); err != nil {
+			return []string{}, err
+		}
+		if err := r.usersUsecase.RemoveClient(entry.ClientID); err != nil {
+			return []string{}, err
+		}
+		notify = r.geoUsecase.UpdateRelatedClients(entry.ClientID)
+		r.geoUsecase.DeleteClientFromNearestReferences(entry.ClientID)
+		return notify, nil
+
+	case journal.KindRoomJoined:
+		var options *models.RoomOptions
+		if entry.RoomOptions != nil {
+			copied := *entry.RoomOptions
+			options = &copied
+		}
+		_, notify, err = r.geoUsecase.JoinRoom(entry.ClientID, entry.Room, options)
+		return notify, err
+
+	case journal.KindClientBlocked:
+		return r.geoUsecase.BlockClient(entry.ClientID, entry.TargetID)
+
+	case journal.KindClientUnblocked:
+		return r.geoUsecase.UnblockClient(entry.ClientID, entry.TargetID)
+
+	case journal.KindPreferencesChanged:
+		if entry.Preferences == nil {
+			return []string{}, nil
+		}
+		preferences := *entry.Preferences
+		return r.geoUsecase.SetPreferences(entry.ClientID, &preferences)
+
+	case journal.KindPrivacyChanged:
+		if entry.Privacy == nil {
+			return []string{}, nil
+		}
+		return []string{}, r.usersUsecase.SetPrivacy(entry.ClientID, entry.Privacy)
+
+	case journal.KindZonesAdded:
+		added, err := zones.Parse(entry.Zones)
+		if err != nil {
+			return []string{}, err
+		}
+		_, notify = r.geoUsecase.AddZones(added)
+		return notify, nil
+
+	case journal.KindZoneRemoved:
+		_, notify, err = r.geoUsecase.RemoveZone(entry.ZoneID)
+		return notify, err
+
+	case journal.KindPositionExpired:
+		_, notify, err = r.geoUsecase.ExpirePosition(entry.ClientID)
+		return notify, err
+	}
+
+	return []string{}, fmt.Errorf("%w: %s", util.ErrUnknownJournalEntryKind, entry.Kind)
+}
+
+// Dir - Повторяет записи журнала из каталога dir с номерами больше after и возвращает номер последней повторенной.
+// observe, если задан, получает каждую запись вместе с результатом ее применения.
+func (r *Replayer) Dir(dir string, after uint64, observe func(entry *journal.Entry, notify []string, err error)) (uint64, error) {
+	last := after
+	err := journal.Read(dir, after, func(entry *journal.Entry) error {
+		notify, err := r.Apply(entry)
+		if observe != nil {
+			slices.Sort(notify)
+			observe(entry, notify, err)
+		}
+		last = entry.Seq
+		return nil
+	})
+	return last, err
+}
@@ -0,0 +1,218 @@
+package replay_test
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/replay"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/zones"
+)
+
+// ReplayTestSuite records a session into a journal and replays it on fresh usecases
+type ReplayTestSuite struct {
+	suite.Suite
+	cfg *config.Config
+	dir string
+}
+
+// SetupTest uses the default configuration with a dwell time, so that replay depends on the recorded clock
+func (t *ReplayTestSuite) SetupTest() {
+	t.cfg = config.Default()
+	t.cfg.Geolocation.Switching.DwellTime = 3 * time.Second
+	t.dir = t.T().TempDir()
+}
+
+// TestDeterministic tests that replaying the journal reproduces the recorded state and notifications, every time
+func (t *ReplayTestSuite) TestDeterministic() {
+	geo, users := t.usecases()
+	writer, err := journal.Open(t.dir, 1<<10, false)
+	t.Require().NoError(err)
+	geo.SetJournal(writer)
+	users.SetJournal(writer)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	geo.SetClock(func() time.Time { return now })
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		users.AddClient(&models.ClientInfo{ID: id, Identity: id, SphereID: i + 1})
+	}
+	t.Require().NoError(users.UpdateWindowSettings("a", &models.WindowSettings{Width: 640, Height: 480}))
+
+	recorded := make([]string, 0)
+	move := func(id string, latitude, longitude float64) {
+		now = now.Add(time.Second)
+		notify, err := geo.UpdatePosition(id, &models.Position{Latitude: latitude, Longitude: longitude})
+		recorded = append(recorded, t.describe(id, notify, err))
+	}
+
+	move("a", 55.7500, 37.6100)
+	move("b", 55.7510, 37.6110)
+	move("c", 55.7600, 37.6200)
+	move("d", 55.7400, 37.6000)
+	for step := range 8 {
+		move("c", 55.7600-float64(step)*0.0012, 37.6200-float64(step)*0.0012)
+		move("d", 55.7400+float64(step)*0.0005, 37.6000)
+	}
+	move("a", 200, 37.61)
+
+	users.RemoveClient("b")
+	geo.UpdateRelatedClients("b")
+	geo.DeleteClientFromNearestReferences("b")
+	move("a", 55.7505, 37.6105)
+
+	t.Require().NoError(writer.Close())
+	expected := t.state(users)
+
+	for range 2 {
+		geo, users := t.usecases()
+		replayed := make([]string, 0)
+		last, err := replay.New(geo, users).Dir(t.dir, 0, func(entry *journal.Entry, notify []string, err error) {
+			if entry.Kind == journal.KindPositionUpdated {
+				replayed = append(replayed, t.describe(entry.ClientID, notify, err))
+			}
+		})
+		t.Require().NoError(err)
+		t.Require().Equal(writer.LastSeq(), last)
+
+		t.Require().Equal(recorded, replayed, "Every update notifies the same clients")
+		t.Require().JSONEq(expected, t.state(users))
+	}
+}
+
+// TestStateChanges tests that rooms, blocks, preferences, privacy, zones and expired positions are replayed
+func (t *ReplayTestSuite) TestStateChanges() {
+	t.cfg.Geolocation.PositionTTL = time.Minute
+	geo, users := t.usecases()
+	writer, err := journal.Open(t.dir, 1<<20, false)
+	t.Require().NoError(err)
+	geo.SetJournal(writer)
+	users.SetJournal(writer)
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	geo.SetClock(func() time.Time { return now })
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		users.AddClient(&models.ClientInfo{ID: id, Identity: id, SphereID: i + 1})
+		_, err := geo.UpdatePosition(id, &models.Position{Latitude: 55.75 + float64(i)*0.001, Longitude: 37.61})
+		t.Require().NoError(err)
+	}
+
+	_, _, err = geo.JoinRoom("c", "team", &models.RoomOptions{Pairing: config.PairingExclusive})
+	t.Require().NoError(err)
+	_, err = geo.BlockClient("a", "b")
+	t.Require().NoError(err)
+	_, err = geo.BlockClient("a", "d")
+	t.Require().NoError(err)
+	_, err = geo.UnblockClient("a", "d")
+	t.Require().NoError(err)
+	maximum := 500.0
+	_, err = geo.SetPreferences("d", &models.PairingPreferences{MaxDistance: &maximum})
+	t.Require().NoError(err)
+	t.Require().NoError(users.SetPrivacy("b", &models.PrivacySettings{Coordinates: config.CoordinatesHidden}))
+
+	added, err := zones.Parse([]byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"pairing": "isolated"},
+		 "geometry": {"type": "Polygon", "coordinates": [[[37.6, 55.749], [37.62, 55.749], [37.62, 55.7515], [37.6, 55.7515], [37.6, 55.749]]]}},
+		{"type": "Feature", "properties": {"id": "temporary"},
+		 "geometry": {"type": "Polygon", "coordinates": [[[37.6, 55.7], [37.62, 55.7], [37.62, 55.8], [37.6, 55.7]]]}}]}`))
+	t.Require().NoError(err)
+	geo.AddZones(added)
+	_, _, err = geo.RemoveZone("temporary")
+	t.Require().NoError(err)
+
+	now = now.Add(30 * time.Second)
+	_, err = geo.UpdatePosition("a", &models.Position{Latitude: 55.7501, Longitude: 37.6101})
+	t.Require().NoError(err)
+	now = now.Add(45 * time.Second)
+	expired, _, _ := geo.ExpireStalePositions(now)
+	t.Require().Len(expired, 3, "Only the position updated recently survives")
+
+	t.Require().NoError(writer.Close())
+	expected := t.state(users)
+	expectedBlocks := users.Snapshot(now).Blocks
+	expectedZones, err := zones.Encode(geo.GetZones())
+	t.Require().NoError(err)
+
+	// Expired positions are recorded explicitly, so replay does not depend on the position TTL
+	t.cfg.Geolocation.PositionTTL = 0
+	geo, users = t.usecases()
+	_, err = replay.New(geo, users).Dir(t.dir, 0, func(entry *journal.Entry, notify []string, err error) {
+		t.Require().NoError(err, "Replaying %s", entry.Kind)
+	})
+	t.Require().NoError(err)
+
+	t.Require().JSONEq(expected, t.state(users))
+	t.Require().Equal(expectedBlocks, users.Snapshot(now).Blocks)
+	replayedZones, err := zones.Encode(geo.GetZones())
+	t.Require().NoError(err)
+	t.Require().JSONEq(string(expectedZones), string(replayedZones))
+}
+
+// TestAfter tests that entries covered by a snapshot are not applied again
+func (t *ReplayTestSuite) TestAfter() {
+	geo, users := t.usecases()
+	writer, err := journal.Open(t.dir, 1<<20, false)
+	t.Require().NoError(err)
+	users.SetJournal(writer)
+	geo.SetJournal(writer)
+
+	users.AddClient(&models.ClientInfo{ID: "a", Identity: "a"})
+	saved := users.Snapshot(time.Now())
+	saved.JournalSeq = writer.LastSeq()
+	users.AddClient(&models.ClientInfo{ID: "b", Identity: "b"})
+	t.Require().NoError(writer.Close())
+
+	geo, users = t.usecases()
+	users.Restore(saved)
+	_, err = replay.New(geo, users).Dir(t.dir, saved.JournalSeq, nil)
+	t.Require().NoError(err)
+	t.Require().Len(users.GetClients(), 2)
+}
+
+// usecases creates usecases on a fresh repository
+func (t *ReplayTestSuite) usecases() (*usecases.GeolocationUsecase, *usecases.UsersUsecase) {
+	repo, err := storage.New(t.cfg.Storage)
+	t.Require().NoError(err)
+	return usecases.NewGeolocationUsecase(repo, t.cfg.Geolocation), usecases.NewUsersUsecase(repo, t.cfg.Privacy)
+}
+
+// describe formats the outcome of a position update
+func (t *ReplayTestSuite) describe(id string, notify []string, err error) string {
+	notify = slices.Clone(notify)
+	slices.Sort(notify)
+	outcome := id + ":" + strings.Join(notify, ",")
+	if err != nil {
+		outcome += ":" + err.Error()
+	}
+	return outcome
+}
+
+// state serializes all clients ordered by ID
+func (t *ReplayTestSuite) state(users *usecases.UsersUsecase) string {
+	clients := make([]*snapshot.Client, 0)
+	for _, client := range users.GetClients() {
+		clients = append(clients, snapshot.FromClient(client))
+	}
+	slices.SortFunc(clients, func(a, b *snapshot.Client) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	data, err := json.Marshal(clients)
+	t.Require().NoError(err)
+	return string(data)
+}
+
+func TestReplayTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplayTestSuite))
+}
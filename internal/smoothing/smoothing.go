@@ -0,0 +1,123 @@
+package smoothing
+
+import (
+	"math"
+	"time"
+
+	"github.com/tidwall/geodesic"
+)
+
+// Filter - Фильтр, сглаживающий последовательность фиксов одного клиента.
+// Состояние фильтра живет столько же, сколько сессия клиента.
+type Filter interface {
+	// Update - Принимает сырой фикс и возвращает сглаженные широту и долготу
+	Update(latitude, longitude, accuracy float64, at time.Time) (float64, float64)
+	// Reset - Сбрасывает состояние фильтра
+	Reset()
+}
+
+// ExponentialFilter - Экспоненциальное скользящее среднее по координатам
+type ExponentialFilter struct {
+	alpha         float64
+	resetDistance float64
+
+	initialized bool
+	latitude    float64
+	longitude   float64
+}
+
+// NewExponentialFilter - Создает экспоненциальный фильтр с коэффициентом alpha из (0, 1] и расстоянием сброса в метрах
+func NewExponentialFilter(alpha, resetDistance float64) *ExponentialFilter {
+	return &ExponentialFilter{alpha: alpha, resetDistance: resetDistance}
+}
+
+func (f *ExponentialFilter) Update(latitude, longitude, accuracy float64, at time.Time) (float64, float64) {
+	if !f.initialized || isJump(f.latitude, f.longitude, latitude, longitude, f.resetDistance) {
+		f.initialized = true
+		f.latitude, f.longitude = latitude, longitude
+		return f.latitude, f.longitude
+	}
+
+	f.latitude += f.alpha * (latitude - f.latitude)
+	f.longitude = normalizeLongitude(f.longitude + f.alpha*longitudeDelta(f.longitude, longitude))
+
+	return f.latitude, f.longitude
+}
+
+func (f *ExponentialFilter) Reset() {
+	f.initialized = false
+}
+
+// KalmanFilter - Одномерный фильтр Калмана с постоянной позицией, дисперсия которого хранится в метрах
+type KalmanFilter struct {
+	processNoise    float64
+	defaultAccuracy float64
+	resetDistance   float64
+
+	initialized bool
+	latitude    float64
+	longitude   float64
+	variance    float64
+	updatedAt   time.Time
+}
+
+// NewKalmanFilter - Создает фильтр Калмана с шумом процесса в м/с, точностью по умолчанию и расстоянием сброса в метрах
+func NewKalmanFilter(processNoise, defaultAccuracy, resetDistance float64) *KalmanFilter {
+	return &KalmanFilter{processNoise: processNoise, defaultAccuracy: defaultAccuracy, resetDistance: resetDistance}
+}
+
+func (f *KalmanFilter) Update(latitude, longitude, accuracy float64, at time.Time) (float64, float64) {
+	if accuracy <= 0 {
+		accuracy = f.defaultAccuracy
+	}
+
+	if !f.initialized || isJump(f.latitude, f.longitude, latitude, longitude, f.resetDistance) {
+		f.initialized = true
+		f.latitude, f.longitude = latitude, longitude
+		f.variance = accuracy * accuracy
+		f.updatedAt = at
+		return f.latitude, f.longitude
+	}
+
+	// Неопределенность растет со временем, прошедшим с прошлого фикса
+	if dt := at.Sub(f.updatedAt).Seconds(); dt > 0 {
+		f.variance += dt * f.processNoise * f.processNoise
+		f.updatedAt = at
+	}
+
+	gain := f.variance / (f.variance + accuracy*accuracy)
+	f.latitude += gain * (latitude - f.latitude)
+	f.longitude = normalizeLongitude(f.longitude + gain*longitudeDelta(f.longitude, longitude))
+	f.variance = (1 - gain) * f.variance
+
+	return f.latitude, f.longitude
+}
+
+func (f *KalmanFilter) Reset() {
+	f.initialized = false
+}
+
+// Проверяет, является ли новый фикс скачком, после которого состояние фильтра нужно сбросить
+func isJump(fromLatitude, fromLongitude, toLatitude, toLongitude, resetDistance float64) bool {
+	if resetDistance <= 0 {
+		return false
+	}
+
+	var distance float64
+	geodesic.WGS84.Inverse(fromLatitude, fromLongitude, toLatitude, toLongitude, &distance, nil, nil)
+	return distance > resetDistance
+}
+
+// Разница долгот с учетом перехода через антимеридиан
+func longitudeDelta(from, to float64) float64 {
+	return normalizeLongitude(to - from)
+}
+
+// Приводит долготу к диапазону [-180, 180]
+func normalizeLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
@@ -0,0 +1,146 @@
+// Package snapshot - Снимки состояния клиентов, комнат и блокировок, которые переживают рестарт сервера
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// Version - Версия формата снимка. Меняется при несовместимых изменениях, старые снимки при этом не загружаются.
+const Version = 1
+
+// Snapshot - Состояние хранилища на момент TakenAt
+type Snapshot struct {
+	Version int                 `json:"version"`
+	TakenAt time.Time           `json:"taken_at"`
+	Rooms   []*models.RoomInfo  `json:"rooms"`
+	Clients []*Client           `json:"clients"`
+	Blocks  map[string][]string `json:"blocks,omitempty"`
+	// Zones - Зоны в виде GeoJSON, включая добавленные и удаленные во время работы. Заменяют зоны из файлов конфигурации.
+	Zones json.RawMessage `json:"zones,omitempty"`
+	// JournalSeq - Номер последней записи журнала, вошедшей в снимок: при восстановлении повторяются только более новые
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+}
+
+// Client - Сохраняемое состояние клиента: все, кроме соединения и состояния фильтра сглаживания
+type Client struct {
+	ID             string                     `json:"client_id"`
+	Identity       string                     `json:"identity"`
+	ResumeToken    string                     `json:"resume_token,omitempty"`
+	SphereID       int                        `json:"sphere_id"`
+	Room           string                     `json:"room"`
+	Position       *models.Position           `json:"position,omitempty"`
+	WindowSettings *models.WindowSettings     `json:"window_settings,omitempty"`
+	Zones          []string                   `json:"zones,omitempty"`
+	Privacy        *models.PrivacySettings    `json:"privacy,omitempty"`
+	PrivacyOffset  *models.PrivacyOffset      `json:"privacy_offset,omitempty"`
+	Preferences    *models.PairingPreferences `json:"preferences,omitempty"`
+}
+
+// FromClient - Копирует сохраняемое состояние клиента
+func FromClient(client *models.ClientInfo) *Client {
+	state := &Client{
+		ID:             client.ID,
+		Identity:       client.Identity,
+		ResumeToken:    client.ResumeToken,
+		SphereID:       client.SphereID,
+		Room:           client.Room,
+		WindowSettings: client.WindowSettings,
+		Zones:          client.Zones,
+		Privacy:        client.Privacy,
+		PrivacyOffset:  client.PrivacyOffset,
+		Preferences:    client.Preferences,
+	}
+	if client.Position != nil {
+		position := *client.Position
+		state.Position = &position
+	}
+	return state
+}
+
+// ClientInfo - Создает из сохраненного состояния клиента без соединения
+func (c *Client) ClientInfo() *models.ClientInfo {
+	return &models.ClientInfo{
+		ID:             c.ID,
+		Identity:       c.Identity,
+		ResumeToken:    c.ResumeToken,
+		SphereID:       c.SphereID,
+		Room:           c.Room,
+		Position:       c.Position,
+		WindowSettings: c.WindowSettings,
+		Zones:          c.Zones,
+		Privacy:        c.Privacy,
+		PrivacyOffset:  c.PrivacyOffset,
+		Preferences:    c.Preferences,
+	}
+}
+
+// Encode - Сериализует снимок
+func Encode(snapshot *Snapshot) ([]byte, error) {
+	return json.Marshal(snapshot)
+}
+
+// Save - Сериализует снимок и атомарно записывает его в path
+func Save(path string, snapshot *Snapshot) error {
+	data, err := Encode(snapshot)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, data)
+}
+
+// WriteFile - Атомарно заменяет файл path: данные пишутся во временный файл в том же каталоге,
+// сбрасываются на диск и переименовываются поверх path, поэтому читатель видит либо старый, либо новый снимок целиком
+func WriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Сбрасываем каталог, чтобы переименование пережило отключение питания (не везде поддерживается)
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Load - Читает снимок из path. Отсутствие файла возвращается как ошибка, для которой errors.Is(err, fs.ErrNotExist).
+func Load(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != Version {
+		return nil, fmt.Errorf("%w: %d", util.ErrUnsupportedSnapshotVersion, snapshot.Version)
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,105 @@
+package snapshot_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// SnapshotTestSuite checks writing and reading snapshot files
+type SnapshotTestSuite struct {
+	suite.Suite
+	dir  string
+	path string
+}
+
+// SetupTest points the snapshot to a fresh temporary directory
+func (t *SnapshotTestSuite) SetupTest() {
+	t.dir = t.T().TempDir()
+	t.path = filepath.Join(t.dir, "state.json")
+}
+
+// TestRoundTrip tests that a saved snapshot loads back unchanged
+func (t *SnapshotTestSuite) TestRoundTrip() {
+	position := &models.Position{Latitude: 55.75, Longitude: 37.61, ClosestClientID: "b", Distance: 120, Velocity: &models.Velocity{Speed: 1}}
+	position.UpdateXYZ()
+	minimum := 50.0
+	client := &models.ClientInfo{
+		ID:             "a",
+		Identity:       "alice",
+		SphereID:       7,
+		Room:           "event",
+		Position:       position,
+		WindowSettings: &models.WindowSettings{Width: 640, Height: 480},
+		Zones:          []string{"park"},
+		PrivacyOffset:  &models.PrivacyOffset{Azimuth: 90, Distance: 300},
+		Preferences:    &models.PairingPreferences{MinDistance: &minimum},
+	}
+
+	saved := &snapshot.Snapshot{
+		Version: snapshot.Version,
+		TakenAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Rooms:   []*models.RoomInfo{{Name: "event", Limit: 4, Members: 1}},
+		Clients: []*snapshot.Client{snapshot.FromClient(client)},
+		Blocks:  map[string][]string{"alice": {"bob"}},
+	}
+	t.Require().NoError(snapshot.Save(t.path, saved))
+
+	loaded, err := snapshot.Load(t.path)
+	t.Require().NoError(err)
+	t.Require().Equal(saved, loaded)
+
+	restored := loaded.Clients[0].ClientInfo()
+	t.Require().Nil(restored.Connection)
+	t.Require().Equal(client.Position, restored.Position)
+	t.Require().Equal(client.Preferences, restored.Preferences)
+}
+
+// TestFromClientCopiesPosition tests that later moves of a client do not leak into a taken snapshot
+func (t *SnapshotTestSuite) TestFromClientCopiesPosition() {
+	client := &models.ClientInfo{ID: "a", Position: &models.Position{Latitude: 1}}
+	state := snapshot.FromClient(client)
+	client.Position.Latitude = 2
+	t.Require().Equal(1.0, state.Position.Latitude)
+}
+
+// TestAtomicReplace tests that saving replaces the previous snapshot and leaves no temporary files behind
+func (t *SnapshotTestSuite) TestAtomicReplace() {
+	t.Require().NoError(snapshot.Save(t.path, &snapshot.Snapshot{Version: snapshot.Version}))
+	t.Require().NoError(snapshot.Save(t.path, &snapshot.Snapshot{Version: snapshot.Version, Clients: []*snapshot.Client{{ID: "a"}}}))
+
+	loaded, err := snapshot.Load(t.path)
+	t.Require().NoError(err)
+	t.Require().Len(loaded.Clients, 1)
+
+	entries, err := os.ReadDir(t.dir)
+	t.Require().NoError(err)
+	t.Require().Len(entries, 1)
+}
+
+// TestLoadErrors tests that missing files and unknown versions are reported
+func (t *SnapshotTestSuite) TestLoadErrors() {
+	_, err := snapshot.Load(t.path)
+	t.Require().ErrorIs(err, fs.ErrNotExist)
+
+	t.Require().NoError(snapshot.Save(t.path, &snapshot.Snapshot{Version: snapshot.Version + 1}))
+	_, err = snapshot.Load(t.path)
+	t.Require().ErrorIs(err, util.ErrUnsupportedSnapshotVersion)
+
+	t.Require().NoError(os.WriteFile(t.path, []byte("{"), 0o600))
+	_, err = snapshot.Load(t.path)
+	t.Require().Error(err)
+}
+
+// TestSnapshotTestSuite runs the test suite
+func TestSnapshotTestSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotTestSuite))
+}
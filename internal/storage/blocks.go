@@ -0,0 +1,55 @@
+package storage
+
+// Block - Сохраняет блокировку identity клиентом с идентичностью blocker
+func (r *ClientRepository) Block(blocker, blocked string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.blocks[blocker]; !ok {
+		r.blocks[blocker] = make(map[string]struct{})
+	}
+	r.blocks[blocker][blocked] = struct{}{}
+	return nil
+}
+
+// Unblock - Снимает блокировку
+func (r *ClientRepository) Unblock(blocker, blocked string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.blocks[blocker], blocked)
+	if len(r.blocks[blocker]) == 0 {
+		delete(r.blocks, blocker)
+	}
+	return nil
+}
+
+// IsBlocked - Проверяет, заблокировал ли кто-либо из двух идентичностей другую (блокировка симметрична)
+func (r *ClientRepository) IsBlocked(a, b string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.isBlocked(a, b)
+}
+
+func (r *ClientRepository) isBlocked(a, b string) bool {
+	if _, ok := r.blocks[a][b]; ok {
+		return true
+	}
+	_, ok := r.blocks[b][a]
+	return ok
+}
+
+// Blocks - Возвращает все блокировки: идентичность -> заблокированные ею идентичности
+func (r *ClientRepository) Blocks() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	blocks := make(map[string][]string, len(r.blocks))
+	for blocker, blocked := range r.blocks {
+		for identity := range blocked {
+			blocks[blocker] = append(blocks[blocker], identity)
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/dhconnelly/rtreego"
+)
+
+// polarRadius - Малая полуось WGS84: ни одна точка эллипсоида не ближе к центру Земли
+const polarRadius = models.WGS84SemiMajorAxis * (1 - models.WGS84Flattening)
+
+// cellIndex - Индекс на иерархии ячеек сферы. Ячейка уровня l - клетка сетки 2^l x 2^(l+1) по геоцентрическим
+// широте и долготе, каждая делится на четыре ячейки следующего уровня. Точка лежит в своей ячейке на каждом уровне,
+// поэтому перемещение - это перенос точки между map ячеек без перестройки дерева, а поиск читает ячейки любого уровня сразу.
+type cellIndex struct {
+	level int
+	// cells - Точки в ячейках каждого уровня от 0 до level
+	cells []map[cellKey]map[rtreego.Spatial]struct{}
+	// where - Ячейка самого мелкого уровня, в которую точка попала при вставке
+	where map[rtreego.Spatial]cellKey
+}
+
+// cellKey - Строка и столбец ячейки на ее уровне
+type cellKey struct {
+	row, col int
+}
+
+// Создает индекс ячеек с самым мелким уровнем level
+func newCellIndex(level int) *cellIndex {
+	level = min(max(level, 0), 24)
+
+	cells := make([]map[cellKey]map[rtreego.Spatial]struct{}, level+1)
+	for l := range cells {
+		cells[l] = make(map[cellKey]map[rtreego.Spatial]struct{})
+	}
+	return &cellIndex{
+		level: level,
+		cells: cells,
+		where: make(map[rtreego.Spatial]cellKey),
+	}
+}
+
+// Геоцентрические широта и долгота точки в радианах
+func geocentric(p rtreego.Point) (latitude, longitude float64) {
+	return math.Atan2(p[2], math.Hypot(p[0], p[1])), math.Atan2(p[1], p[0])
+}
+
+// Ячейка уровня level, в которую попадают широта и долгота
+func cellAt(level int, latitude, longitude float64) cellKey {
+	size := math.Pi / float64(int(1)<<level)
+	rows, cols := 1<<level, 2<<level
+	return cellKey{
+		row: min(max(int((latitude+math.Pi/2)/size), 0), rows-1),
+		col: min(max(int((longitude+math.Pi)/size), 0), cols-1),
+	}
+}
+
+// Insert - Кладет объект в ячейки его точки на всех уровнях
+func (c *cellIndex) Insert(obj rtreego.Spatial) {
+	latitude, longitude := geocentric(corner(obj.Bounds()))
+	key := cellAt(c.level, latitude, longitude)
+	c.where[obj] = key
+
+	for l := c.level; l >= 0; l-- {
+		points, ok := c.cells[l][key]
+		if !ok {
+			points = make(map[rtreego.Spatial]struct{})
+			c.cells[l][key] = points
+		}
+		points[obj] = struct{}{}
+		key = cellKey{row: key.row / 2, col: key.col / 2}
+	}
+}
+
+// Delete - Убирает объект из ячеек, в которые он был вставлен, независимо от его текущей позиции
+func (c *cellIndex) Delete(obj rtreego.Spatial) bool {
+	key, ok := c.where[obj]
+	if !ok {
+		return false
+	}
+	delete(c.where, obj)
+
+	for l := c.level; l >= 0; l-- {
+		delete(c.cells[l][key], obj)
+		if len(c.cells[l][key]) == 0 {
+			delete(c.cells[l], key)
+		}
+		key = cellKey{row: key.row / 2, col: key.col / 2}
+	}
+	return true
+}
+
+// Size - Количество объектов в индексе
+func (c *cellIndex) Size() int {
+	return len(c.where)
+}
+
+// NearestNeighbors - Находит k ближайших к p объектов по хордовому расстоянию. Поиск просматривает кольцо ячеек
+// вокруг p на самом мелком уровне и расширяется на уровень крупнее, пока k-й найденный объект не окажется
+// ближе нижней границы расстояния до всего, что лежит за просмотренным кольцом.
+func (c *cellIndex) NearestNeighbors(k int, p rtreego.Point, filters ...rtreego.Filter) []rtreego.Spatial {
+	type candidate struct {
+		obj      rtreego.Spatial
+		distance float64
+	}
+
+	latitude, longitude := geocentric(p)
+	found := make([]candidate, 0, k)
+	seen := make(map[rtreego.Spatial]struct{})
+	results := make([]rtreego.Spatial, 0, k)
+
+	for l := c.level; l >= 0; l-- {
+		ring := newCellRing(l, latitude, longitude)
+		aborted := false
+
+		c.visitRing(ring, func(obj rtreego.Spatial) bool {
+			if _, ok := seen[obj]; ok {
+				return true
+			}
+			seen[obj] = struct{}{}
+
+			for _, filter := range filters {
+				refuse, abort := filter(results, obj)
+				if abort {
+					aborted = true
+					return false
+				}
+				if refuse {
+					return true
+				}
+			}
+
+			found = append(found, candidate{obj: obj, distance: pointDistance(p, corner(obj.Bounds()))})
+			return true
+		})
+
+		slices.SortStableFunc(found, func(a, b candidate) int {
+			return cmp.Compare(a.distance, b.distance)
+		})
+		if len(found) > k {
+			found = found[:k]
+		}
+		results = results[:0]
+		for _, f := range found {
+			results = append(results, f.obj)
+		}
+
+		if aborted || (len(found) == k && found[k-1].distance <= ring.lowerBound()) {
+			break
+		}
+	}
+
+	return results
+}
+
+// cellRing - Кольцо ячеек уровня level вокруг точки: строка ее ячейки и две соседние, в каждой строке
+// столбцы на widths[i] в обе стороны от столбца точки. Ближе к полюсам ячейки сужаются, поэтому кольцо
+// берет там больше столбцов, а строку у самого полюса целиком.
+type cellRing struct {
+	level               int
+	latitude, longitude float64
+	center              cellKey
+	// firstRow - Номер первой строки кольца, widths - полуширина каждой строки в столбцах (-1 - вся строка)
+	firstRow int
+	widths   []int
+}
+
+// Строит кольцо уровня level вокруг точки с геоцентрическими latitude и longitude
+func newCellRing(level int, latitude, longitude float64) *cellRing {
+	size := math.Pi / float64(int(1)<<level)
+	rows, cols := 1<<level, 2<<level
+	center := cellAt(level, latitude, longitude)
+
+	ring := &cellRing{level: level, latitude: latitude, longitude: longitude, center: center}
+	ring.firstRow = max(center.row-1, 0)
+	for row := ring.firstRow; row <= min(center.row+1, rows-1); row++ {
+		// Полуширина подбирается так, чтобы сбоку от кольца было не ближе, чем одна ячейка по широте
+		widest := math.Max(math.Abs(float64(row)*size-math.Pi/2), math.Abs(float64(row+1)*size-math.Pi/2))
+		scale := math.Sqrt(math.Cos(latitude) * math.Cos(math.Min(widest, math.Pi/2)))
+		width := -1
+		if scale > 0 && 1/scale < float64(cols/2-1) {
+			width = int(math.Ceil(1 / scale))
+		}
+		ring.widths = append(ring.widths, width)
+	}
+	return ring
+}
+
+// Обходит точки в ячейках кольца. Долгота замыкается через антимеридиан. visit возвращает false, чтобы прервать обход.
+func (c *cellIndex) visitRing(ring *cellRing, visit func(obj rtreego.Spatial) bool) {
+	cols := 2 << ring.level
+	cells := c.cells[ring.level]
+
+	for i, width := range ring.widths {
+		row := ring.firstRow + i
+		from, to := 0, cols-1
+		if width >= 0 {
+			from, to = ring.center.col-width, ring.center.col+width
+		}
+
+		for col := from; col <= to; col++ {
+			for obj := range cells[cellKey{row: row, col: (col%cols + cols) % cols}] {
+				if !visit(obj) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Нижняя граница хордового расстояния от точки кольца до любой точки эллипсоида вне кольца. По формуле гаверсинусов
+// sin²(θ/2) не меньше sin²(Δφ/2) и не меньше cos φ1 cos φ2 sin²(Δλ/2), а хорда между точками эллипсоида
+// не короче 2 b sin(θ/2).
+func (ring *cellRing) lowerBound() float64 {
+	size := math.Pi / float64(int(1)<<ring.level)
+	rows := 1 << ring.level
+	lastRow := ring.firstRow + len(ring.widths) - 1
+
+	bound := math.Inf(1)
+
+	// Точки выше или ниже кольца отстоят по широте не меньше, чем до его края
+	if ring.firstRow > 0 {
+		south := float64(ring.firstRow)*size - math.Pi/2
+		bound = math.Min(bound, math.Pow(math.Sin((ring.latitude-south)/2), 2))
+	}
+	if lastRow < rows-1 {
+		north := float64(lastRow+1)*size - math.Pi/2
+		bound = math.Min(bound, math.Pow(math.Sin((north-ring.latitude)/2), 2))
+	}
+
+	// Точки сбоку от строки кольца лежат в ее полосе широт и отстоят по долготе не меньше, чем до края строки
+	for i, width := range ring.widths {
+		if width < 0 {
+			continue
+		}
+		row := ring.firstRow + i
+		west := float64(ring.center.col-width)*size - math.Pi
+		east := float64(ring.center.col+width+1)*size - math.Pi
+		gap := math.Min(math.Min(ring.longitude-west, east-ring.longitude), math.Pi)
+		widest := math.Min(math.Max(math.Abs(float64(row)*size-math.Pi/2), math.Abs(float64(row+1)*size-math.Pi/2)), math.Pi/2)
+		bound = math.Min(bound, math.Cos(ring.latitude)*math.Cos(widest)*math.Pow(math.Sin(gap/2), 2))
+	}
+
+	// Небольшой запас на погрешность вычислений
+	return 2 * polarRadius * math.Sqrt(math.Max(bound, 0)) * (1 - 1e-9)
+}
@@ -0,0 +1,122 @@
+package storage_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dhconnelly/rtreego"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+)
+
+// CellIndexTestSuite compares the cell index with the R-tree on randomized data
+type CellIndexTestSuite struct {
+	suite.Suite
+	rnd *rand.Rand
+}
+
+// SetupTest creates a deterministic random source before each test
+func (t *CellIndexTestSuite) SetupTest() {
+	t.rnd = rand.New(rand.NewSource(7))
+}
+
+// TestUniformGlobe compares both indexes on clients spread over the whole globe
+func (t *CellIndexTestSuite) TestUniformGlobe() {
+	t.compare(12, 1000, func() (float64, float64) {
+		return math.Asin(2*t.rnd.Float64()-1) * 180 / math.Pi, t.rnd.Float64()*360 - 180
+	})
+}
+
+// TestDenseCluster compares both indexes on clients packed into one or two cells
+func (t *CellIndexTestSuite) TestDenseCluster() {
+	t.compare(12, 500, func() (float64, float64) {
+		return 55.75 + t.rnd.Float64()*0.05, 37.61 + t.rnd.Float64()*0.05
+	})
+}
+
+// TestPolesAndAntimeridian compares both indexes where cell rings wrap in longitude and get clipped at the poles
+func (t *CellIndexTestSuite) TestPolesAndAntimeridian() {
+	t.compare(10, 600, func() (float64, float64) {
+		switch t.rnd.Intn(3) {
+		case 0:
+			return 89 + t.rnd.Float64(), t.rnd.Float64()*360 - 180
+		case 1:
+			return -89 - t.rnd.Float64(), t.rnd.Float64()*360 - 180
+		}
+		lon := 179 + t.rnd.Float64()
+		if t.rnd.Intn(2) == 0 {
+			lon = -lon
+		}
+		return t.rnd.Float64()*10 - 5, lon
+	})
+}
+
+// TestSparse compares both indexes when there are fewer clients than requested neighbors, so the search reaches level 0
+func (t *CellIndexTestSuite) TestSparse() {
+	t.compare(16, 5, func() (float64, float64) {
+		return math.Asin(2*t.rnd.Float64()-1) * 180 / math.Pi, t.rnd.Float64()*360 - 180
+	})
+}
+
+// compare fills a cell index of the given level and an R-tree with the same clients, moves them around randomly
+// and checks that both return the same nearest neighbors, with and without a filter
+func (t *CellIndexTestSuite) compare(level, count int, generate func() (lat, lon float64)) {
+	cells, tree := storage.NewCellIndex(level), storage.NewTreeIndex()
+
+	place := func(client *models.ClientInfo) {
+		lat, lon := generate()
+		client.Position = &models.Position{Latitude: lat, Longitude: lon}
+		client.Position.UpdateXYZ()
+		cells.Insert(client)
+		tree.Insert(client)
+	}
+
+	clients := make([]*models.ClientInfo, count)
+	for i := range clients {
+		clients[i] = &models.ClientInfo{ID: fmt.Sprintf("client%d", i)}
+		place(clients[i])
+	}
+
+	// Пропускает клиентов с нечетными номерами
+	even := func(_ []rtreego.Spatial, obj rtreego.Spatial) (refuse, abort bool) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(obj.(*models.ClientInfo).ID, "client"))
+		return n%2 == 1, false
+	}
+
+	for round := 0; round < 3*count; round++ {
+		moved := clients[t.rnd.Intn(count)]
+		t.Require().True(cells.Delete(moved))
+		t.Require().True(tree.Delete(moved))
+		place(moved)
+
+		probe := clients[t.rnd.Intn(count)].Position
+		p := rtreego.Point{probe.X, probe.Y, probe.Z}
+
+		t.Require().Equal(ids(tree.NearestNeighbors(8, p)), ids(cells.NearestNeighbors(8, p)), "round %d", round)
+		t.Require().Equal(ids(tree.NearestNeighbors(8, p, even)), ids(cells.NearestNeighbors(8, p, even)), "round %d", round)
+	}
+
+	t.Require().Equal(tree.Size(), cells.Size())
+}
+
+// ids lists the client IDs of the found objects in order, skipping empty slots
+func ids(objs []rtreego.Spatial) []string {
+	result := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		if obj != nil {
+			result = append(result, obj.(*models.ClientInfo).ID)
+		}
+	}
+	return result
+}
+
+// TestCellIndexTestSuite runs the test suite
+func TestCellIndexTestSuite(t *testing.T) {
+	suite.Run(t, new(CellIndexTestSuite))
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"math"
 	"sync"
 
 	"github.com/appxpy/sphere-api/internal/models"
@@ -9,84 +10,197 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-type ClientRepository struct {
-	clients                 map[string]*models.ClientInfo
-	connections             map[*websocket.Conn]string
-	whoReferenceMeAsNearest map[string]map[string]struct{}
+// nearestCandidatesCount - Количество кандидатов, которые запрашиваются из индекса перед
+// переранжированием по геодезическому расстоянию. Порядок хордовых расстояний в ECEF на эллипсоиде лишь
+// приближает геодезический, поэтому это начальное число: поиск расширяется, пока хорда до самого дальнего
+// кандидата не ограничит расстояние до лучшего.
+const nearestCandidatesCount = 8
+
+// CandidateFilter - Условие, которому должен удовлетворять кандидат в ближайшие для клиента client.
+// Фильтр вызывается под блокировкой хранилища и не должен обращаться к хранилищу.
+type CandidateFilter func(client, candidate *models.ClientInfo) bool
 
-	rtree *rtreego.Rtree
+// ClientRepository - Хранилище клиентов в памяти процесса: реестр в map и пространственный индекс на каждую комнату.
+// Записи клиентов в реестре и индексах меняются только под блокировкой записи, а чтения получают их неизменяемые
+// копии, которые публикуются после каждого изменения клиента, поэтому чтения не ждут записей и не видят клиента
+// наполовину измененным.
+type ClientRepository struct {
+	clients     map[string]*models.ClientInfo
+	connections map[*websocket.Conn]string
+	// views - Опубликованные копии клиентов: ID -> *models.ClientInfo
+	views sync.Map
+
+	// rooms - Комнаты со своими пространственными индексами и графами ссылок на ближайших, клиент находится ровно в одной
+	rooms map[string]*room
+	// referenceRooms - Комната, в графе которой хранятся ссылки на клиента: ID -> имя комнаты.
+	// Запись живет до DeleteClientFromNearestReferences, то есть и после удаления самого клиента.
+	referenceRooms map[string]string
+	// blocks - Блокировки между идентичностями клиентов: кто -> кого
+	blocks map[string]map[string]struct{}
+	// newIndex - Создает пространственный индекс комнаты с объектами objs
+	newIndex func(objs ...rtreego.Spatial) pointIndex
 
 	mu sync.RWMutex
 }
 
 func NewClientRepository() *ClientRepository {
+	return newClientRepository(newTreeIndex)
+}
+
+// NewShardedClientRepository - Создает хранилище, в котором индекс каждой комнаты разбит на шарды
+// по граням куба, по divisions x divisions шардов на грань. Обновления по-прежнему выполняются по одному
+// под блокировкой хранилища: шарды уменьшают деревья, но не распараллеливают записи.
+func NewShardedClientRepository(divisions int) *ClientRepository {
+	return newClientRepository(func(objs ...rtreego.Spatial) pointIndex {
+		return fill(newShardedIndex(divisions), objs)
+	})
+}
+
+// NewCellClientRepository - Создает хранилище, в котором индекс каждой комнаты построен на иерархии ячеек сферы
+// с самым мелким уровнем level
+func NewCellClientRepository(level int) *ClientRepository {
+	return newClientRepository(func(objs ...rtreego.Spatial) pointIndex {
+		return fill(newCellIndex(level), objs)
+	})
+}
+
+func newClientRepository(newIndex func(objs ...rtreego.Spatial) pointIndex) *ClientRepository {
 	return &ClientRepository{
-		clients:                 make(map[string]*models.ClientInfo),
-		connections:             make(map[*websocket.Conn]string),
-		rtree:                   rtreego.NewTree(3, 25, 50), // Инициализируем R-Tree
-		whoReferenceMeAsNearest: make(map[string]map[string]struct{}),
+		clients:     make(map[string]*models.ClientInfo),
+		connections: make(map[*websocket.Conn]string),
+		rooms: map[string]*room{
+			models.GlobalRoom: newRoom(models.GlobalRoom, nil, newIndex()),
+		},
+		referenceRooms: make(map[string]string),
+		blocks:         make(map[string]map[string]struct{}),
+		newIndex:       newIndex,
 	}
 }
 
-func (r *ClientRepository) AddClient(client *models.ClientInfo) {
+func (r *ClientRepository) AddClient(added *models.ClientInfo) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+
+	client := ownClient(added)
+	if client.Room == "" {
+		client.Room = models.GlobalRoom
+	}
+	if client.Identity == "" {
+		client.Identity = client.ID
+	}
+
+	room, ok := r.rooms[client.Room]
+	if !ok {
+		room = newRoom(client.Room, nil, r.newIndex())
+		r.rooms[client.Room] = room
+	}
+
 	r.clients[client.ID] = client
-	r.connections[client.Connection] = client.ID
-	r.whoReferenceMeAsNearest[client.ID] = make(map[string]struct{})
+	if client.Connection != nil {
+		r.connections[client.Connection] = client.ID
+	}
+	room.whoReferenceMeAsNearest[client.ID] = make(map[string]struct{})
+	r.referenceRooms[client.ID] = client.Room
+	room.info.Members++
 
-	// Добавляем клиента в R-Tree, если у него есть позиция
+	// Добавляем клиента в индекс комнаты, если у него есть позиция
 	if client.Position != nil {
-		r.rtree.Insert(client)
+		room.index.Insert(client)
 	}
+	room.updateReach(client)
+	r.publish(client)
+	return nil
 }
 
-func (r *ClientRepository) RemoveClient(id string) {
+func (r *ClientRepository) RemoveClient(id string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	client, ok := r.clients[id]
 	if !ok {
-		return
+		return nil
 	}
 
-	// Удаляем из R-Tree, если у клиента есть позиция
+	// Удаляем из индекса комнаты, если у клиента есть позиция.
+	// Ссылки на клиента остаются до DeleteClientFromNearestReferences, чтобы можно было пересчитать ссылавшихся.
+	room := r.rooms[client.Room]
 	if client.Position != nil {
-		r.rtree.Delete(client)
+		room.index.Delete(client)
 	}
+	room.removeReach(id)
+	room.info.Members--
 
 	delete(r.clients, id)
-	delete(r.connections, client.Connection)
+	r.views.Delete(id)
+	if client.Connection != nil {
+		delete(r.connections, client.Connection)
+	}
+	return nil
 }
 
-func (r *ClientRepository) UpdateClientPosition(id string, position *models.Position) {
+// AttachConnection - Привязывает к клиенту новое соединение вместо прежнего
+func (r *ClientRepository) AttachConnection(id string, connection *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.clients[id]
+	if !ok {
+		return false
+	}
+
+	if client.Connection != nil {
+		delete(r.connections, client.Connection)
+	}
+	client.Connection = connection
+	if connection != nil {
+		r.connections[connection] = id
+	}
+	r.publish(client)
+	return true
+}
+
+func (r *ClientRepository) UpdateClientPosition(id string, position *models.Position) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	client, ok := r.clients[id]
 	if !ok {
 		// Обработка ошибки
-		return
+		return nil
 	}
 
-	// Удаляем из R-Tree, если позиция существовала
-	if client.Position != nil {
-		r.rtree.Delete(client)
+	r.setPosition(client, position)
+	r.publish(client)
+	return nil
+}
+
+// Заменяет позицию клиента и переиндексирует его, если сменились координаты
+func (r *ClientRepository) setPosition(client *models.ClientInfo, position *models.Position) {
+	room := r.rooms[client.Room]
+	moved := client.Position == nil || position == nil ||
+		client.Position.X != position.X || client.Position.Y != position.Y || client.Position.Z != position.Z
+
+	// Удаляем из индекса, если позиция существовала
+	if moved && client.Position != nil {
+		room.index.Delete(client)
 	}
 
 	// Обновляем позицию
 	client.Position = position
 
-	// Вставляем в R-Tree с новой позицией
-	if client.Position != nil {
-		r.rtree.Insert(client)
+	// Вставляем в индекс с новой позицией
+	if moved && client.Position != nil {
+		room.index.Insert(client)
 	}
+	room.updateReach(client)
 }
 
+// GetClient - Возвращает опубликованную копию клиента без блокировки
 func (r *ClientRepository) GetClient(id string) (*models.ClientInfo, bool) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	client, exists := r.clients[id]
-	return client, exists
+	view, exists := r.views.Load(id)
+	if !exists {
+		return nil, false
+	}
+	return view.(*models.ClientInfo), true
 }
 
 func (r *ClientRepository) GetClientIDByConnection(connection *websocket.Conn) (string, bool) {
@@ -98,19 +212,20 @@ func (r *ClientRepository) GetClientIDByConnection(connection *websocket.Conn) (
 	return id, exists
 }
 
+// GetAllClients - Возвращает опубликованные копии всех клиентов без блокировки
 func (r *ClientRepository) GetAllClients() []*models.ClientInfo {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	clients := make([]*models.ClientInfo, 0, len(r.clients))
-	for _, client := range r.clients {
-		clients = append(clients, client)
-	}
+	clients := make([]*models.ClientInfo, 0)
+	r.views.Range(func(_, view any) bool {
+		clients = append(clients, view.(*models.ClientInfo))
+		return true
+	})
 
 	return clients
 }
 
-func (r *ClientRepository) FindNearestClient(clientID string) (*models.ClientInfo, error) {
+// FindNearestClient - Находит геодезически ближайшего клиента, удовлетворяющего всем фильтрам
+// и не связанного с клиентом блокировкой
+func (r *ClientRepository) FindNearestClient(clientID string, filters ...CandidateFilter) (*models.ClientInfo, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -125,61 +240,285 @@ func (r *ClientRepository) FindNearestClient(clientID string) (*models.ClientInf
 
 	p := rtreego.Point{client.Position.X, client.Position.Y, client.Position.Z}
 
-	// Получаем ближайших соседей (включая самого клиента)
-	results := r.rtree.NearestNeighbors(2, p)
-
-	oldNearest := client.Position.ClosestClientID
+	// Пропускаем самого клиента и кандидатов, не прошедших фильтры, чтобы они не занимали места среди кандидатов.
+	// Фильтры получают опубликованные копии, как и любое чтение.
+	view := r.view(clientID)
+	filter := func(_ []rtreego.Spatial, obj rtreego.Spatial) (refuse, abort bool) {
+		candidate, ok := obj.(*models.ClientInfo)
+		if !ok || candidate.ID == clientID || r.isBlocked(client.Identity, candidate.Identity) {
+			return true, false
+		}
+		for _, accept := range filters {
+			if !accept(view, r.view(candidate.ID)) {
+				return true, false
+			}
+		}
+		return false, false
+	}
 
+	// Получаем ближайших соседей по хордовому расстоянию среди клиентов той же комнаты и переранжируем их
+	// по геодезическому расстоянию WGS84. Хорда не длиннее геодезической, поэтому клиент вне первых k не ближе
+	// лучшего кандидата, если хорда до самого дальнего из k не меньше расстояния до лучшего. Иначе k удваивается.
 	var nearest *models.ClientInfo
-	for _, obj := range results {
-		otherClient, ok := obj.(*models.ClientInfo)
-		if !ok {
-			continue
+	nearestDistance := math.Inf(1)
+	for k := nearestCandidatesCount; ; k *= 2 {
+		results := r.rooms[client.Room].index.NearestNeighbors(k, p, filter)
+
+		farthestChord := 0.0
+		for _, obj := range results {
+			otherClient := obj.(*models.ClientInfo)
+			if distance := client.Position.GeodesicDistanceTo(otherClient.Position); distance < nearestDistance {
+				nearest = otherClient
+				nearestDistance = distance
+			}
+			farthestChord = math.Max(farthestChord, chordDistance(client.Position, otherClient.Position))
 		}
-		if otherClient.ID == clientID {
-			continue // Пропускаем самого себя
+
+		if len(results) < k || farthestChord >= nearestDistance {
+			break
 		}
-		nearest = otherClient
-		break
 	}
 
 	if nearest == nil {
 		return nil, util.ErrNoClientsAvailable
 	}
 
-	if _, ok := r.whoReferenceMeAsNearest[oldNearest]; ok {
-		delete(r.whoReferenceMeAsNearest[oldNearest], clientID)
+	return r.view(nearest.ID), nil
+}
+
+// UpdateNearestReference - Записывает позицию клиента clientID с новым ближайшим, расстоянием и азимутом и переносит
+// ссылку клиента с прежнего ближайшего на нового (nil позиция или пустой ID - нет ближайшего). По расстоянию
+// до нового ближайшего обновляется область клиента.
+func (r *ClientRepository) UpdateNearestReference(clientID, oldNearestID string, position *models.Position) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	newNearestID := ""
+	if position != nil {
+		newNearestID = position.ClosestClientID
+	}
+
+	if client, ok := r.clients[clientID]; ok {
+		r.setPosition(client, position)
+		r.publish(client)
 	}
 
-	r.whoReferenceMeAsNearest[nearest.ID][clientID] = struct{}{}
+	if refs, ok := r.referencesOf(oldNearestID); ok {
+		delete(refs, clientID)
+	}
 
-	return nearest, nil
+	if refs, ok := r.referencesOf(newNearestID); ok {
+		refs[clientID] = struct{}{}
+	}
+	return nil
 }
 
 func (r *ClientRepository) WhoReferenceMeAsNearest(id string) []string {
-	idsSet, ok := r.whoReferenceMeAsNearest[id]
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idsSet, ok := r.referencesOf(id)
 	if !ok {
 		return []string{}
 	}
 
 	ids := make([]string, 0, len(idsSet))
-	for ref, _ := range idsSet {
+	for ref := range idsSet {
 		ids = append(ids, ref)
 	}
 
 	return ids
 }
 
-func (r *ClientRepository) DeleteClientFromNearestReferences(id string) {
-	delete(r.whoReferenceMeAsNearest, id)
+func (r *ClientRepository) DeleteClientFromNearestReferences(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name, ok := r.referenceRooms[id]
+	if !ok {
+		return nil
+	}
+
+	delete(r.rooms[name].whoReferenceMeAsNearest, id)
+	delete(r.referenceRooms, id)
+	r.dropRoomIfEmpty(name)
+	return nil
+}
+
+func (r *ClientRepository) HeDoesNotReferenceMeAsNearestAnymore(me, him string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if refs, ok := r.referencesOf(me); ok {
+		delete(refs, him)
+	}
+	return nil
+}
+
+// Находит множество клиентов, ссылающихся на id, в комнате, где оно хранится
+func (r *ClientRepository) referencesOf(id string) (map[string]struct{}, bool) {
+	name, ok := r.referenceRooms[id]
+	if !ok {
+		return nil, false
+	}
+	refs, ok := r.rooms[name].whoReferenceMeAsNearest[id]
+	return refs, ok
+}
+
+func (r *ClientRepository) UpdateClientWindowSettings(id string, settings *models.WindowSettings) error {
+	r.updateClient(id, func(client *models.ClientInfo) { client.WindowSettings = settings })
+	return nil
+}
+
+// UpdateClientZones - Заменяет зоны, в которых находится клиент
+func (r *ClientRepository) UpdateClientZones(id string, zones []string) error {
+	r.updateClient(id, func(client *models.ClientInfo) { client.Zones = zones })
+	return nil
+}
+
+// UpdateClientPrivacy - Заменяет собственные настройки приватности клиента
+func (r *ClientRepository) UpdateClientPrivacy(id string, settings *models.PrivacySettings) error {
+	r.updateClient(id, func(client *models.ClientInfo) { client.Privacy = settings })
+	return nil
+}
+
+// UpdateClientPreferences - Заменяет собственные настройки подбора ближайшего клиента
+func (r *ClientRepository) UpdateClientPreferences(id string, preferences *models.PairingPreferences) error {
+	r.updateClient(id, func(client *models.ClientInfo) { client.Preferences = preferences })
+	return nil
 }
 
-func (r *ClientRepository) HeDoesNotReferenceMeAsNearestAnymore(me, him string) {
-	delete(r.whoReferenceMeAsNearest[me], him)
+// Меняет поле клиента, которое не влияет на индексы, и публикует клиента
+func (r *ClientRepository) updateClient(id string, update func(client *models.ClientInfo)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client, ok := r.clients[id]; ok {
+		update(client)
+		r.publish(client)
+	}
 }
 
-func (r *ClientRepository) UpdateClientWindowSettings(id string, settings *models.WindowSettings) {
+// MoveClientToRoom - Переносит клиента в комнату name, создавая ее с параметрами options, если ее еще нет.
+// Ссылки на клиента в прежней комнате отбрасываются, пересчет ссылавшихся клиентов лежит на вызывающем.
+func (r *ClientRepository) MoveClientToRoom(clientID string, name string, options *models.RoomOptions) (*models.RoomInfo, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.clients[id].WindowSettings = settings
+
+	client, ok := r.clients[clientID]
+	if !ok {
+		return nil, util.ErrClientNotFound
+	}
+
+	target, exists := r.rooms[name]
+	if client.Room == name {
+		return target.snapshot(), nil
+	}
+
+	if !exists {
+		target = newRoom(name, options, r.newIndex())
+	}
+
+	if target.info.Limit > 0 && target.info.Members >= target.info.Limit {
+		return nil, util.ErrRoomFull
+	}
+	r.rooms[name] = target
+
+	source := r.rooms[client.Room]
+	if client.Position != nil {
+		source.index.Delete(client)
+	}
+	source.removeReach(clientID)
+	delete(source.whoReferenceMeAsNearest, clientID)
+	source.info.Members--
+	r.dropRoomIfEmpty(client.Room)
+
+	client.Room = name
+	target.whoReferenceMeAsNearest[clientID] = make(map[string]struct{})
+	r.referenceRooms[clientID] = name
+	target.info.Members++
+	if client.Position != nil {
+		target.index.Insert(client)
+	}
+	target.updateReach(client)
+	r.publish(client)
+
+	return target.snapshot(), nil
+}
+
+// GetRoom - Возвращает копию информации о комнате
+func (r *ClientRepository) GetRoom(name string) (*models.RoomInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room, ok := r.rooms[name]
+	if !ok {
+		return nil, false
+	}
+	return room.snapshot(), true
+}
+
+// GetRoomClients - Возвращает клиентов комнаты
+func (r *ClientRepository) GetRoomClients(name string) []*models.ClientInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*models.ClientInfo, 0)
+	for _, client := range r.clients {
+		if client.Room == name {
+			clients = append(clients, r.view(client.ID))
+		}
+	}
+
+	return clients
+}
+
+// Удаляет пустую комнату, когда в ней не осталось ни участников, ни ожидающих пересчета ссылок
+func (r *ClientRepository) dropRoomIfEmpty(name string) {
+	room := r.rooms[name]
+	if name != models.GlobalRoom && room.info.Members == 0 && len(room.whoReferenceMeAsNearest) == 0 {
+		delete(r.rooms, name)
+	}
+}
+
+// Публикует копию клиента для чтений. Вызывается под блокировкой записи после каждого изменения клиента. Вложенные
+// объекты записи (позиция, настройки, зоны) не меняются на месте, а заменяются целиком, поэтому копии достаточно
+// быть неглубокой.
+func (r *ClientRepository) publish(client *models.ClientInfo) {
+	r.views.Store(client.ID, copyClient(client))
+}
+
+// Опубликованная копия клиента, который есть в реестре
+func (r *ClientRepository) view(id string) *models.ClientInfo {
+	view, _ := r.views.Load(id)
+	return view.(*models.ClientInfo)
+}
+
+// Расстояние по прямой между точками позиций в ECEF
+func chordDistance(a, b *models.Position) float64 {
+	return math.Sqrt((a.X-b.X)*(a.X-b.X) + (a.Y-b.Y)*(a.Y-b.Y) + (a.Z-b.Z)*(a.Z-b.Z))
+}
+
+func copyClient(client *models.ClientInfo) *models.ClientInfo {
+	copied := *client
+	return &copied
+}
+
+func copyClients(clients []*models.ClientInfo) []*models.ClientInfo {
+	copies := make([]*models.ClientInfo, 0, len(clients))
+	for _, client := range clients {
+		copies = append(copies, copyClient(client))
+	}
+	return copies
+}
+
+// Запись, которую хранилище заводит для переданного ему клиента. Позиция копируется, чтобы вызывающий не мог
+// изменить запись в обход блокировки.
+func ownClient(client *models.ClientInfo) *models.ClientInfo {
+	owned := copyClient(client)
+	if client.Position != nil {
+		position := *client.Position
+		owned.Position = &position
+	}
+	return owned
 }
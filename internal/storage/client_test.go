@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+)
+
+// NearestClientTestSuite checks FindNearestClient against a brute-force geodesic search
+type NearestClientTestSuite struct {
+	suite.Suite
+	repo *storage.ClientRepository
+	rnd  *rand.Rand
+}
+
+// SetupTest creates a fresh repository and a deterministic random source before each test
+func (t *NearestClientTestSuite) SetupTest() {
+	t.repo = storage.NewClientRepository()
+	t.rnd = rand.New(rand.NewSource(42))
+}
+
+// TestUniformGlobe places clients uniformly over the whole globe
+func (t *NearestClientTestSuite) TestUniformGlobe() {
+	t.checkAgainstBruteForce(500, func() (float64, float64) {
+		lat := math.Asin(2*t.rnd.Float64()-1) * 180 / math.Pi
+		lon := t.rnd.Float64()*360 - 180
+		return lat, lon
+	})
+}
+
+// TestDenseCluster places clients within a few hundred meters of each other, where near-ties are common
+func (t *NearestClientTestSuite) TestDenseCluster() {
+	t.checkAgainstBruteForce(300, func() (float64, float64) {
+		return 55.75 + t.rnd.Float64()*0.005, 37.61 + t.rnd.Float64()*0.005
+	})
+}
+
+// TestAntimeridian places clients on both sides of the 180th meridian
+func (t *NearestClientTestSuite) TestAntimeridian() {
+	t.checkAgainstBruteForce(300, func() (float64, float64) {
+		lon := 179.5 + t.rnd.Float64()*0.5
+		if t.rnd.Intn(2) == 0 {
+			lon = -lon
+		}
+		return t.rnd.Float64()*20 - 10, lon
+	})
+}
+
+// TestNorthPole places clients around the north pole
+func (t *NearestClientTestSuite) TestNorthPole() {
+	t.checkAgainstBruteForce(300, func() (float64, float64) {
+		return 89.5 + t.rnd.Float64()*0.5, t.rnd.Float64()*360 - 180
+	})
+}
+
+// TestSouthPole places clients around the south pole
+func (t *NearestClientTestSuite) TestSouthPole() {
+	t.checkAgainstBruteForce(300, func() (float64, float64) {
+		return -89.5 - t.rnd.Float64()*0.5, t.rnd.Float64()*360 - 180
+	})
+}
+
+// TestCubeCorner places clients around a corner of the cube, where three faces of the sharded index meet
+func (t *NearestClientTestSuite) TestCubeCorner() {
+	t.checkAgainstBruteForce(300, func() (float64, float64) {
+		return 35.26 + t.rnd.Float64()*0.1 - 0.05, 45 + t.rnd.Float64()*0.1 - 0.05
+	})
+}
+
+// checkAgainstBruteForce adds count clients at generated positions and compares the chosen nearest with brute force
+func (t *NearestClientTestSuite) checkAgainstBruteForce(count int, generate func() (lat, lon float64)) {
+	clients := make([]*models.ClientInfo, 0, count)
+	for i := 0; i < count; i++ {
+		lat, lon := generate()
+		position := &models.Position{Latitude: lat, Longitude: lon}
+		position.UpdateXYZ()
+
+		id := fmt.Sprintf("client%d", i)
+		t.repo.AddClient(&models.ClientInfo{ID: id})
+		t.repo.UpdateClientPosition(id, position)
+		client, _ := t.repo.GetClient(id)
+		clients = append(clients, client)
+	}
+
+	for _, client := range clients {
+		nearest, err := t.repo.FindNearestClient(client.ID)
+		t.Require().NoError(err)
+
+		expected := math.Inf(1)
+		for _, other := range clients {
+			if other.ID == client.ID {
+				continue
+			}
+			expected = math.Min(expected, client.Position.GeodesicDistanceTo(other.Position))
+		}
+
+		t.Require().Equal(expected, client.Position.GeodesicDistanceTo(nearest.Position),
+			"Nearest client for %s (%f, %f) is not the geodesically closest one", client.ID, client.Position.Latitude, client.Position.Longitude)
+	}
+}
+
+// TestNearestClientTestSuite runs the test suite
+func TestNearestClientTestSuite(t *testing.T) {
+	suite.Run(t, new(NearestClientTestSuite))
+}
+
+// ShardedNearestClientTestSuite runs the same checks against the sharded index, where nearest searches cross shards
+type ShardedNearestClientTestSuite struct {
+	NearestClientTestSuite
+}
+
+// SetupTest creates a fresh sharded repository and a deterministic random source before each test
+func (t *ShardedNearestClientTestSuite) SetupTest() {
+	t.repo = storage.NewShardedClientRepository(16)
+	t.rnd = rand.New(rand.NewSource(42))
+}
+
+// TestShardedNearestClientTestSuite runs the test suite
+func TestShardedNearestClientTestSuite(t *testing.T) {
+	suite.Run(t, new(ShardedNearestClientTestSuite))
+}
+
+// CellNearestClientTestSuite runs the same checks against the cell index, where nearest searches expand over cell rings
+type CellNearestClientTestSuite struct {
+	NearestClientTestSuite
+}
+
+// SetupTest creates a fresh cell repository and a deterministic random source before each test
+func (t *CellNearestClientTestSuite) SetupTest() {
+	t.repo = storage.NewCellClientRepository(12)
+	t.rnd = rand.New(rand.NewSource(42))
+}
+
+// TestCellNearestClientTestSuite runs the test suite
+func TestCellNearestClientTestSuite(t *testing.T) {
+	suite.Run(t, new(CellNearestClientTestSuite))
+}
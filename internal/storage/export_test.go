@@ -0,0 +1,17 @@
+package storage
+
+// Экспорт индексов комнат для тестов и бенчмарков во внешнем тестовом пакете
+type PointIndex = pointIndex
+
+var (
+	NewTreeIndex    = newTreeIndex
+	NewShardedIndex = func(divisions int) PointIndex { return newShardedIndex(divisions) }
+	NewCellIndex    = func(level int) PointIndex { return newCellIndex(level) }
+)
+
+// Cached - Число записей клиентов, которые хранилище Redis держит в процессе
+func (r *RedisClientRepository) Cached() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/dhconnelly/rtreego"
+)
+
+// LoadClients - Разом добавляет комнаты и клиентов. Комнаты создаются с параметрами из rooms (число участников
+// пересчитывается), индексы затронутых комнат строятся заново пакетной загрузкой, а граф ссылок и области
+// восстанавливаются по ближайшим, записанным в позициях клиентов. Ближайший, которого нет в той же комнате, сбрасывается,
+// а клиенты с уже занятыми ID пропускаются.
+func (r *ClientRepository) LoadClients(rooms []*models.RoomInfo, clients []*models.ClientInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, info := range rooms {
+		if _, ok := r.rooms[info.Name]; !ok {
+			options := &models.RoomOptions{Limit: info.Limit, Metadata: info.Metadata, Pairing: info.Pairing}
+			r.rooms[info.Name] = newRoom(info.Name, options, r.newIndex())
+		}
+	}
+
+	loaded := make([]*models.ClientInfo, 0, len(clients))
+	touched := make(map[string]*room)
+	for _, added := range clients {
+		if _, exists := r.clients[added.ID]; exists {
+			continue
+		}
+		client := ownClient(added)
+		loaded = append(loaded, client)
+
+		if client.Room == "" {
+			client.Room = models.GlobalRoom
+		}
+		if client.Identity == "" {
+			client.Identity = client.ID
+		}
+
+		target, ok := r.rooms[client.Room]
+		if !ok {
+			target = newRoom(client.Room, nil, r.newIndex())
+			r.rooms[client.Room] = target
+		}
+		touched[client.Room] = target
+
+		r.clients[client.ID] = client
+		if client.Connection != nil {
+			r.connections[client.Connection] = client.ID
+		}
+		target.whoReferenceMeAsNearest[client.ID] = make(map[string]struct{})
+		r.referenceRooms[client.ID] = client.Room
+		target.info.Members++
+	}
+
+	// Пересобираем индексы затронутых комнат вместе с клиентами, которые были в них до загрузки
+	objs := make(map[string][]rtreego.Spatial, len(touched))
+	for _, client := range r.clients {
+		if _, ok := touched[client.Room]; ok && client.Position != nil {
+			objs[client.Room] = append(objs[client.Room], client)
+		}
+	}
+	for name, target := range touched {
+		target.index = r.newIndex(objs[name]...)
+	}
+
+	for _, client := range loaded {
+		if client.Position != nil {
+			position := client.Position
+			target := r.rooms[client.Room]
+			if nearest, ok := r.clients[position.ClosestClientID]; ok && nearest.Room == client.Room && nearest.Position != nil {
+				target.whoReferenceMeAsNearest[nearest.ID][client.ID] = struct{}{}
+			} else {
+				position.ClosestClientID = ""
+				position.Distance = 0
+				position.Azimuth = 0
+			}
+			target.updateReach(client)
+		}
+		r.publish(client)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"math"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/dhconnelly/rtreego"
+)
+
+// reach - Область, в которой появление другого клиента может сменить ближайшего для client:
+// куб в ECEF вокруг клиента с полуребром, равным расстоянию до его текущего ближайшего.
+// Хорда не длиннее геодезической, поэтому куб содержит всех, кто геодезически ближе текущего ближайшего.
+type reach struct {
+	client *models.ClientInfo
+	bounds rtreego.Rect
+}
+
+func (r *reach) Bounds() rtreego.Rect {
+	return r.bounds
+}
+
+// reachTolerance - Запас в метрах, чтобы клиенты на границе области не терялись из-за погрешности
+const reachTolerance = 0.001
+
+// Обновляет область клиента в комнате по его текущей позиции и расстоянию до ближайшего.
+// Клиенты без ближайшего могут сменить его при появлении кого угодно, поэтому хранятся отдельно.
+func (room *room) updateReach(client *models.ClientInfo) {
+	room.removeReach(client.ID)
+
+	if client.Position == nil {
+		return
+	}
+
+	if client.Position.ClosestClientID == "" {
+		room.unbounded[client.ID] = client
+		return
+	}
+
+	radius := client.Position.Distance + reachTolerance
+	corner := rtreego.Point{client.Position.X - radius, client.Position.Y - radius, client.Position.Z - radius}
+	bounds, err := rtreego.NewRect(corner, []float64{2 * radius, 2 * radius, 2 * radius})
+	if err != nil || math.IsInf(radius, 0) || math.IsNaN(radius) {
+		room.unbounded[client.ID] = client
+		return
+	}
+
+	entry := &reach{client: client, bounds: bounds}
+	room.reaches[client.ID] = entry
+	room.reachTree.Insert(entry)
+}
+
+func (room *room) removeReach(clientID string) {
+	delete(room.unbounded, clientID)
+	if entry, ok := room.reaches[clientID]; ok {
+		room.reachTree.Delete(entry)
+		delete(room.reaches, clientID)
+	}
+}
+
+// FindReverseNearest - Находит клиентов комнаты, для которых clientID в своей текущей позиции может оказаться
+// ближе их текущего ближайшего: их область содержит позицию клиента или у них нет ближайшего.
+// Точная проверка расстояния и остальных условий остается на вызывающем.
+func (r *ClientRepository) FindReverseNearest(clientID string) []*models.ClientInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, ok := r.clients[clientID]
+	if !ok || client.Position == nil {
+		return []*models.ClientInfo{}
+	}
+
+	room := r.rooms[client.Room]
+	found := make([]*models.ClientInfo, 0, len(room.unbounded))
+	for id := range room.unbounded {
+		if id != clientID {
+			found = append(found, r.view(id))
+		}
+	}
+
+	for _, obj := range room.reachTree.SearchIntersect(client.Bounds()) {
+		if entry := obj.(*reach); entry.client.ID != clientID {
+			found = append(found, r.view(entry.client.ID))
+		}
+	}
+
+	return found
+}
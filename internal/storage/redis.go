@@ -0,0 +1,832 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisMaxLatitude - Предел широты, которую принимает GEOADD. Клиенты ближе к полюсам хранятся отдельно.
+	redisMaxLatitude = 85.05112878
+	// redisEarthRadius - Радиус сферы, на которой Redis считает расстояния GEO
+	redisEarthRadius = 6372797.560856
+	// redisDistortion, redisSlack - Во сколько раз сферическое расстояние Redis может превышать геодезическое WGS84
+	// и сколько метров добавляет округление координат в GEO
+	redisDistortion = 1.01
+	redisSlack      = 2.0
+	// redisInitialRadius - Радиус первого поиска ближайшего в метрах, дальше он растет в четыре раза
+	redisInitialRadius = 1000.0
+)
+
+// redisMaxRadius - Радиус, который покрывает всю сферу Redis
+var redisMaxRadius = math.Pi * redisEarthRadius
+
+// RedisClientRepository - Хранилище клиентов в Redis, общее для нескольких экземпляров сервера. Реестр, позиции,
+// индексы комнат и граф ссылок живут в Redis и меняются атомарными Lua-скриптами, а в процессе остаются только
+// соединения и записи собственных клиентов. Наружу выдаются копии записей. Блокировка защищает только записи
+// в процессе, запросы к Redis выполняются без нее; записи одного клиента, как и в остальном сервере, должен
+// выполнять один поток.
+//
+// Клиенты, подключенные к этому экземпляру, - его собственные: их профиль (настройки окна, зоны, приватность,
+// предпочтения) хранится в процессе и записывается в Redis вместе с каждой записью клиента. Запись в процессе
+// меняется только после успешной записи в Redis. Остальные клиенты, как и позиции всех клиентов, читаются
+// из Redis при каждом обращении и в процессе не остаются.
+type RedisClientRepository struct {
+	rdb    *redis.Client
+	prefix string
+	ctx    context.Context
+
+	// clients - Записи собственных клиентов экземпляра
+	clients     map[string]*models.ClientInfo
+	connections map[*websocket.Conn]string
+
+	mu sync.Mutex
+}
+
+// redisPosition - Позиция в Redis вместе с состоянием гистерезиса, которое не попадает в JSON позиции
+type redisPosition struct {
+	*models.Position
+	PendingClosestClientID string    `json:"pending_closest_client_id,omitempty"`
+	PendingSince           time.Time `json:"pending_since"`
+}
+
+// redisProfile - Настройки клиента, которые меняет только экземпляр, к которому он подключен
+type redisProfile struct {
+	WindowSettings *models.WindowSettings     `json:"window_settings,omitempty"`
+	Zones          []string                   `json:"zones,omitempty"`
+	Privacy        *models.PrivacySettings    `json:"privacy,omitempty"`
+	PrivacyOffset  *models.PrivacyOffset      `json:"privacy_offset,omitempty"`
+	Preferences    *models.PairingPreferences `json:"preferences,omitempty"`
+	ResumeToken    string                     `json:"resume_token,omitempty"`
+}
+
+// NewRedisClientRepository - Создает хранилище поверх rdb. Все ключи начинаются с prefix, поэтому несколько
+// независимых развертываний могут делить один Redis.
+func NewRedisClientRepository(rdb *redis.Client, prefix string) *RedisClientRepository {
+	r := &RedisClientRepository{
+		rdb:         rdb,
+		prefix:      prefix,
+		ctx:         context.Background(),
+		clients:     make(map[string]*models.ClientInfo),
+		connections: make(map[*websocket.Conn]string),
+	}
+
+	// Глобальная комната существует всегда
+	info, _ := json.Marshal(&models.RoomInfo{Name: models.GlobalRoom})
+	_, err := rdb.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(r.ctx, r.key("room", models.GlobalRoom), "info", info)
+		pipe.HSetNX(r.ctx, r.key("room", models.GlobalRoom), "members", 0)
+		return nil
+	})
+	r.logError("create the global room", err)
+	return r
+}
+
+func (r *RedisClientRepository) AddClient(client *models.ClientInfo) error {
+	return r.add(ownClient(client))
+}
+
+func (r *RedisClientRepository) RemoveClient(id string) error {
+	if err := redisRemoveScript.Run(r.ctx, r.rdb, nil, r.args(id)...).Err(); err != nil {
+		return r.failed("remove client "+id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forget(id)
+	return nil
+}
+
+// AttachConnection - Привязывает к клиенту новое соединение. Клиент становится собственным клиентом экземпляра.
+func (r *RedisClientRepository) AttachConnection(id string, connection *websocket.Conn) bool {
+	loaded, err := r.load(id)
+	if loaded == nil {
+		r.logError("load client "+id, err)
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, owned := r.clients[id]
+	if !owned {
+		client = loaded
+		r.clients[id] = client
+	}
+	if client.Connection != nil {
+		delete(r.connections, client.Connection)
+	}
+	client.Connection = connection
+	if connection != nil {
+		r.connections[connection] = id
+	}
+	return true
+}
+
+func (r *RedisClientRepository) UpdateClientPosition(id string, position *models.Position) error {
+	client, err := r.load(id)
+	if err != nil {
+		return r.failed("load client "+id, err)
+	}
+	if client == nil {
+		return nil
+	}
+
+	longitude, latitude, reach := redisGeoArgs(position)
+	err = redisPositionScript.Run(r.ctx, r.rdb, nil,
+		r.args(id, encodePosition(position), r.ownProfile(client), longitude, latitude, reach)...).Err()
+	if err != nil {
+		return r.failed("update position of "+id, err)
+	}
+	r.update(id, func(client *models.ClientInfo) { client.Position = position })
+	return nil
+}
+
+func (r *RedisClientRepository) GetClient(id string) (*models.ClientInfo, bool) {
+	client, err := r.load(id)
+	r.logError("load client "+id, err)
+	return client, client != nil
+}
+
+func (r *RedisClientRepository) GetClientIDByConnection(connection *websocket.Conn) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, exists := r.connections[connection]
+	return id, exists
+}
+
+func (r *RedisClientRepository) GetAllClients() []*models.ClientInfo {
+	ids, err := r.rdb.SMembers(r.ctx, r.key("clients")).Result()
+	r.logError("list clients", err)
+
+	clients, err := r.loadAll(ids)
+	r.logError("load clients", err)
+	return clients
+}
+
+func (r *RedisClientRepository) UpdateClientWindowSettings(id string, settings *models.WindowSettings) error {
+	return r.updateProfile(id, "update window settings of ", func(client *models.ClientInfo) { client.WindowSettings = settings })
+}
+
+// UpdateClientZones - Заменяет зоны клиента. Профиль меняется только у собственных клиентов.
+func (r *RedisClientRepository) UpdateClientZones(id string, zones []string) error {
+	return r.updateProfile(id, "update zones of ", func(client *models.ClientInfo) { client.Zones = zones })
+}
+
+// UpdateClientPrivacy - Заменяет настройки приватности клиента
+func (r *RedisClientRepository) UpdateClientPrivacy(id string, settings *models.PrivacySettings) error {
+	return r.updateProfile(id, "update privacy of ", func(client *models.ClientInfo) { client.Privacy = settings })
+}
+
+// UpdateClientPreferences - Заменяет настройки подбора ближайшего клиента
+func (r *RedisClientRepository) UpdateClientPreferences(id string, preferences *models.PairingPreferences) error {
+	return r.updateProfile(id, "update preferences of ", func(client *models.ClientInfo) { client.Preferences = preferences })
+}
+
+// Записывает измененный профиль собственного клиента. Профиль чужого клиента хранит и меняет его экземпляр,
+// поэтому для чужих клиентов изменение ничего не делает.
+func (r *RedisClientRepository) updateProfile(id, action string, change func(client *models.ClientInfo)) error {
+	r.mu.Lock()
+	client, owned := r.clients[id]
+	if owned {
+		client = copyClient(client)
+		change(client)
+	}
+	r.mu.Unlock()
+	if !owned {
+		return nil
+	}
+
+	if err := r.rdb.HSet(r.ctx, r.key("client", id), "profile", encodeProfile(client)).Err(); err != nil {
+		return r.failed(action+id, err)
+	}
+	r.update(id, change)
+	return nil
+}
+
+// MoveClientToRoom - Переносит клиента в комнату name, создавая ее с параметрами options, если ее еще нет
+func (r *RedisClientRepository) MoveClientToRoom(clientID string, name string, options *models.RoomOptions) (*models.RoomInfo, error) {
+	client, err := r.load(clientID)
+	if err != nil {
+		return nil, r.failed("load client "+clientID, err)
+	}
+	if client == nil {
+		return nil, util.ErrClientNotFound
+	}
+
+	longitude, latitude, reach := redisGeoArgs(client.Position)
+	result, err := redisMoveScript.Run(r.ctx, r.rdb, nil, r.args(clientID, name, encodeRoom(name, options),
+		encodePosition(client.Position), r.ownProfile(client), longitude, latitude, reach)...).Slice()
+	if err != nil {
+		return nil, r.failed("move client "+clientID, err)
+	}
+
+	switch result[0].(int64) {
+	case 0:
+		r.mu.Lock()
+		r.forget(clientID)
+		r.mu.Unlock()
+		return nil, util.ErrClientNotFound
+	case 2:
+		return nil, util.ErrRoomFull
+	}
+
+	r.update(clientID, func(client *models.ClientInfo) { client.Room = name })
+	return decodeRoom(result[1], result[2])
+}
+
+// GetRoom - Возвращает информацию о комнате
+func (r *RedisClientRepository) GetRoom(name string) (*models.RoomInfo, bool) {
+	values, err := r.rdb.HMGet(r.ctx, r.key("room", name), "info", "members").Result()
+	if err != nil || values[0] == nil {
+		r.logError("get room "+name, err)
+		return nil, false
+	}
+
+	room, err := decodeRoom(values[0], values[1])
+	if err != nil {
+		r.logError("decode room "+name, err)
+		return nil, false
+	}
+	return room, true
+}
+
+// GetRoomClients - Возвращает клиентов комнаты
+func (r *RedisClientRepository) GetRoomClients(name string) []*models.ClientInfo {
+	ids, err := r.rdb.SMembers(r.ctx, r.key("room-clients", name)).Result()
+	r.logError("list clients of room "+name, err)
+
+	clients, err := r.loadAll(ids)
+	r.logError("load clients of room "+name, err)
+	return clients
+}
+
+// FindNearestClient - Находит геодезически ближайшего клиента, удовлетворяющего всем фильтрам. Поиск по GEO
+// расширяет радиус, пока лучший принятый кандидат не окажется ближе всего, что лежит за радиусом, с запасом на
+// разницу между сферой Redis и эллипсоидом WGS84. Клиенты у полюсов проверяются все. Связанные с клиентом
+// блокировкой кандидаты пропускаются.
+func (r *RedisClientRepository) FindNearestClient(clientID string, filters ...CandidateFilter) (*models.ClientInfo, error) {
+	client, err := r.load(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, util.ErrClientNotFound
+	}
+	if client.Position == nil {
+		return nil, util.ErrNoPositionProvided
+	}
+
+	var nearest *models.ClientInfo
+	nearestDistance := math.Inf(1)
+	seen := map[string]struct{}{clientID: {}}
+	consider := func(ids []string) {
+		fresh := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				fresh = append(fresh, id)
+			}
+		}
+
+		loaded, err := r.loadAll(fresh)
+		r.logError("load candidates for "+clientID, err)
+
+	candidates:
+		for _, candidate := range loaded {
+			if candidate.Position == nil || candidate.Room != client.Room || r.IsBlocked(client.Identity, candidate.Identity) {
+				continue
+			}
+			for _, accept := range filters {
+				if !accept(client, candidate) {
+					continue candidates
+				}
+			}
+			if distance := client.Position.GeodesicDistanceTo(candidate.Position); distance < nearestDistance {
+				nearest, nearestDistance = candidate, distance
+			}
+		}
+	}
+
+	polar, err := r.rdb.SMembers(r.ctx, r.key("polar", client.Room)).Result()
+	if err != nil {
+		return nil, err
+	}
+	consider(polar)
+
+	geoKey := r.key("geo", client.Room)
+	radius, count := redisInitialRadius, nearestCandidatesCount
+	for {
+		if math.Abs(client.Position.Latitude) > redisMaxLatitude || radius >= redisMaxRadius {
+			all, err := r.rdb.ZRange(r.ctx, geoKey, 0, -1).Result()
+			if err != nil {
+				return nil, err
+			}
+			consider(all)
+			break
+		}
+
+		found, err := r.rdb.GeoRadius(r.ctx, geoKey, client.Position.Longitude, client.Position.Latitude, &redis.GeoRadiusQuery{
+			Radius: radius, Unit: "m", WithDist: true, Count: count, Sort: "ASC",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, 0, len(found))
+		for _, location := range found {
+			ids = append(ids, location.Name)
+		}
+		consider(ids)
+
+		// Все, что не вернулось, дальше радиуса, а при обрезке по count - дальше последнего вернувшегося
+		bound, truncated := radius, len(found) == count
+		if truncated {
+			bound = found[len(found)-1].Dist
+		}
+		if nearest != nil && nearestDistance <= (bound-redisSlack)/redisDistortion {
+			break
+		}
+		if truncated {
+			count *= 4
+		} else {
+			radius *= 4
+		}
+	}
+
+	if nearest == nil {
+		return nil, util.ErrNoClientsAvailable
+	}
+	return nearest, nil
+}
+
+// FindReverseNearest - Находит клиентов комнаты, для которых clientID может оказаться ближе их текущего ближайшего:
+// у них нет ближайшего или clientID находится в пределах расстояния до него. Клиенты у полюсов с ближайшим
+// возвращаются всегда, точная проверка остается на вызывающем.
+func (r *RedisClientRepository) FindReverseNearest(clientID string) []*models.ClientInfo {
+	client, err := r.load(clientID)
+	if client == nil || client.Position == nil {
+		r.logError("load client "+clientID, err)
+		return []*models.ClientInfo{}
+	}
+
+	room := client.Room
+	ids, err := r.rdb.SMembers(r.ctx, r.key("unbounded", room)).Result()
+	if err != nil {
+		r.logError("list unbounded clients", err)
+		return []*models.ClientInfo{}
+	}
+
+	widest, err := r.rdb.ZRevRangeWithScores(r.ctx, r.key("reach", room), 0, 0).Result()
+	if err == nil && len(widest) > 0 {
+		ids = append(ids, r.reaching(client, widest[0].Score*redisDistortion+redisSlack)...)
+	}
+	r.logError("find reverse nearest of "+clientID, err)
+
+	others, err := r.loadAll(ids)
+	r.logError("load reverse nearest of "+clientID, err)
+
+	found := make([]*models.ClientInfo, 0, len(others))
+	for _, other := range others {
+		if other.ID != clientID {
+			found = append(found, other)
+		}
+	}
+	return found
+}
+
+// Возвращает клиентов с ближайшим, в область которых может попадать позиция client. radius - радиус самой широкой области.
+func (r *RedisClientRepository) reaching(client *models.ClientInfo, radius float64) []string {
+	room := client.Room
+	polar, err := r.rdb.SMembers(r.ctx, r.key("polar", room)).Result()
+	r.logError("list polar clients", err)
+
+	if math.Abs(client.Position.Latitude) > redisMaxLatitude || radius >= redisMaxRadius {
+		all, err := r.rdb.ZRange(r.ctx, r.key("reach", room), 0, -1).Result()
+		r.logError("list reaches", err)
+		return all
+	}
+
+	found, err := r.rdb.GeoRadius(r.ctx, r.key("geo", room), client.Position.Longitude, client.Position.Latitude, &redis.GeoRadiusQuery{
+		Radius: radius, Unit: "m", WithDist: true,
+	}).Result()
+	if err != nil {
+		r.logError("search reaches", err)
+		return []string{}
+	}
+
+	ids := make([]string, 0, len(found)+len(polar))
+	for _, location := range found {
+		ids = append(ids, location.Name)
+	}
+	ids = append(ids, polar...)
+
+	scores, err := r.rdb.ZMScore(r.ctx, r.key("reach", room), ids...).Result()
+	if err != nil {
+		r.logError("read reaches", err)
+		return []string{}
+	}
+
+	reaching := make([]string, 0, len(ids))
+	for i, id := range ids {
+		// ZMSCORE возвращает 0 для клиентов без области
+		if scores[i] == 0 {
+			continue
+		}
+		if i >= len(found) || found[i].Dist <= scores[i]*redisDistortion+redisSlack {
+			reaching = append(reaching, id)
+		}
+	}
+	return reaching
+}
+
+// UpdateNearestReference - Записывает позицию клиента с новым ближайшим и переносит ссылку с прежнего ближайшего на нового
+func (r *RedisClientRepository) UpdateNearestReference(clientID, oldNearestID string, position *models.Position) error {
+	newNearestID, profile := "", ""
+	if position != nil {
+		newNearestID = position.ClosestClientID
+	}
+	r.mu.Lock()
+	if client, ok := r.clients[clientID]; ok {
+		profile = encodeProfile(client)
+	}
+	r.mu.Unlock()
+
+	longitude, latitude, reach := redisGeoArgs(position)
+	err := redisNearestScript.Run(r.ctx, r.rdb, nil, r.args(clientID, oldNearestID, newNearestID,
+		encodePosition(position), profile, longitude, latitude, reach)...).Err()
+	if err != nil {
+		return r.failed("update nearest reference of "+clientID, err)
+	}
+	r.update(clientID, func(client *models.ClientInfo) { client.Position = position })
+	return nil
+}
+
+func (r *RedisClientRepository) WhoReferenceMeAsNearest(id string) []string {
+	ids, err := r.rdb.SMembers(r.ctx, r.key("refs", id)).Result()
+	if err != nil {
+		r.logError("list references to "+id, err)
+		return []string{}
+	}
+	return ids
+}
+
+func (r *RedisClientRepository) HeDoesNotReferenceMeAsNearestAnymore(me, him string) error {
+	err := r.rdb.SRem(r.ctx, r.key("refs", me), him).Err()
+	return r.failed("remove reference to "+me, err)
+}
+
+func (r *RedisClientRepository) DeleteClientFromNearestReferences(id string) error {
+	err := redisDropNodeScript.Run(r.ctx, r.rdb, nil, r.args(id)...).Err()
+	return r.failed("delete references to "+id, err)
+}
+
+// Block - Сохраняет блокировку identity клиентом с идентичностью blocker
+func (r *RedisClientRepository) Block(blocker, blocked string) error {
+	_, err := r.rdb.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(r.ctx, r.key("blocks", blocker), blocked)
+		pipe.SAdd(r.ctx, r.key("blockers"), blocker)
+		return nil
+	})
+	return r.failed("block", err)
+}
+
+// Unblock - Снимает блокировку
+func (r *RedisClientRepository) Unblock(blocker, blocked string) error {
+	err := redisUnblockScript.Run(r.ctx, r.rdb, nil, r.args(blocker, blocked)...).Err()
+	return r.failed("unblock", err)
+}
+
+// IsBlocked - Проверяет, заблокировал ли кто-либо из двух идентичностей другую (блокировка симметрична)
+func (r *RedisClientRepository) IsBlocked(a, b string) bool {
+	var forward, backward *redis.BoolCmd
+	_, err := r.rdb.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		forward = pipe.SIsMember(r.ctx, r.key("blocks", a), b)
+		backward = pipe.SIsMember(r.ctx, r.key("blocks", b), a)
+		return nil
+	})
+	r.logError("check block", err)
+	return forward.Val() || backward.Val()
+}
+
+// Blocks - Возвращает все блокировки: идентичность -> заблокированные ею идентичности
+func (r *RedisClientRepository) Blocks() map[string][]string {
+	blockers, err := r.rdb.SMembers(r.ctx, r.key("blockers")).Result()
+	r.logError("list blockers", err)
+
+	blocks := make(map[string][]string, len(blockers))
+	for _, blocker := range blockers {
+		blocked, err := r.rdb.SMembers(r.ctx, r.key("blocks", blocker)).Result()
+		r.logError("list blocks", err)
+		if len(blocked) > 0 {
+			blocks[blocker] = blocked
+		}
+	}
+	return blocks
+}
+
+// LoadClients - Добавляет комнаты и клиентов, например из снимка. Каждый клиент добавляется атомарно, но загрузка
+// целиком - нет: при ошибке часть клиентов может остаться загруженной. Ближайший, которого нет в той же комнате,
+// сбрасывается, клиенты с занятыми ID пропускаются.
+func (r *RedisClientRepository) LoadClients(rooms []*models.RoomInfo, clients []*models.ClientInfo) error {
+	for _, info := range rooms {
+		options := &models.RoomOptions{Limit: info.Limit, Metadata: info.Metadata, Pairing: info.Pairing}
+		_, err := r.rdb.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSetNX(r.ctx, r.key("room", info.Name), "info", encodeRoom(info.Name, options))
+			pipe.HSetNX(r.ctx, r.key("room", info.Name), "members", 0)
+			return nil
+		})
+		if err != nil {
+			return r.failed("load room "+info.Name, err)
+		}
+	}
+
+	loaded := make([]*models.ClientInfo, 0, len(clients))
+	for _, added := range clients {
+		exists, err := r.rdb.Exists(r.ctx, r.key("client", added.ID)).Result()
+		if err != nil {
+			return r.failed("check client "+added.ID, err)
+		}
+		if exists > 0 {
+			continue
+		}
+		client := ownClient(added)
+		if err := r.add(client); err != nil {
+			return err
+		}
+		loaded = append(loaded, client)
+	}
+
+	for _, client := range loaded {
+		if client.Position == nil {
+			continue
+		}
+		position := *client.Position
+
+		nearest, err := r.load(position.ClosestClientID)
+		if err != nil {
+			return r.failed("load nearest of "+client.ID, err)
+		}
+		if nearest == nil || nearest.Room != client.Room || nearest.Position == nil {
+			position.ClosestClientID = ""
+			position.Distance = 0
+			position.Azimuth = 0
+		}
+
+		longitude, latitude, reach := redisGeoArgs(&position)
+		err = redisNearestScript.Run(r.ctx, r.rdb, nil, r.args(client.ID, "", position.ClosestClientID,
+			encodePosition(&position), "", longitude, latitude, reach)...).Err()
+		if err != nil {
+			return r.failed("load nearest of "+client.ID, err)
+		}
+		r.update(client.ID, func(client *models.ClientInfo) { client.Position = &position })
+	}
+	return nil
+}
+
+// Регистрирует клиента в Redis и делает его собственным клиентом экземпляра
+func (r *RedisClientRepository) add(client *models.ClientInfo) error {
+	if client.Room == "" {
+		client.Room = models.GlobalRoom
+	}
+	if client.Identity == "" {
+		client.Identity = client.ID
+	}
+
+	longitude, latitude, reach := redisGeoArgs(client.Position)
+	err := redisAddScript.Run(r.ctx, r.rdb, nil, r.args(client.ID, client.Room, encodeRoom(client.Room, nil),
+		client.Identity, client.SphereID, encodePosition(client.Position), encodeProfile(client),
+		longitude, latitude, reach)...).Err()
+	if err != nil {
+		return r.failed("add client "+client.ID, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if previous, ok := r.clients[client.ID]; ok && previous.Connection != nil {
+		delete(r.connections, previous.Connection)
+	}
+	r.clients[client.ID] = client
+	if client.Connection != nil {
+		r.connections[client.Connection] = client.ID
+	}
+	return nil
+}
+
+// Читает клиента из Redis. Возвращает nil без ошибки, если клиента нет.
+func (r *RedisClientRepository) load(id string) (*models.ClientInfo, error) {
+	if id == "" {
+		return nil, nil
+	}
+	clients, err := r.loadAll([]string{id})
+	if len(clients) == 0 {
+		return nil, err
+	}
+	return clients[0], nil
+}
+
+// Читает клиентов ids одним конвейером, пропуская отсутствующих. Собственные клиенты обновляются в своих
+// записях, и возвращаются их копии; чужие читаются вместе с профилем в новые объекты, которые не сохраняются.
+func (r *RedisClientRepository) loadAll(ids []string) ([]*models.ClientInfo, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err := r.rdb.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(r.ctx, r.key("client", id))
+		}
+		return nil
+	})
+	if err != nil {
+		return []*models.ClientInfo{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make([]*models.ClientInfo, 0, len(ids))
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			r.forget(id)
+			continue
+		}
+
+		client, owned := r.clients[id]
+		if !owned {
+			client = &models.ClientInfo{ID: id}
+		}
+		if err := decodeClient(fields, client, !owned); err != nil {
+			r.logError("decode client "+id, err)
+			continue
+		}
+		if owned {
+			client = copyClient(client)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// Применяет изменение, уже записанное в Redis, к записи собственного клиента
+func (r *RedisClientRepository) update(id string, change func(client *models.ClientInfo)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client, ok := r.clients[id]; ok {
+		change(client)
+	}
+}
+
+// Забывает запись и соединение удаленного клиента. Вызывается под блокировкой.
+func (r *RedisClientRepository) forget(id string) {
+	if client, ok := r.clients[id]; ok && client.Connection != nil {
+		delete(r.connections, client.Connection)
+	}
+	delete(r.clients, id)
+}
+
+// Профиль клиента для записи в Redis: пустой для чужих клиентов, чтобы не затереть профиль их экземпляра
+func (r *RedisClientRepository) ownProfile(client *models.ClientInfo) string {
+	r.mu.Lock()
+	_, owned := r.clients[client.ID]
+	r.mu.Unlock()
+
+	if !owned {
+		return ""
+	}
+	return encodeProfile(client)
+}
+
+func (r *RedisClientRepository) key(kind string, name ...string) string {
+	if len(name) == 0 {
+		return r.prefix + kind
+	}
+	return r.prefix + kind + ":" + name[0]
+}
+
+// Аргументы скрипта: префикс ключей, глобальная комната и args
+func (r *RedisClientRepository) args(args ...any) []any {
+	return append([]any{r.prefix, models.GlobalRoom}, args...)
+}
+
+func (r *RedisClientRepository) logError(action string, err error) {
+	if err != nil {
+		logging.ErrorLogger.Printf("Redis storage failed to %s: %v", action, err)
+	}
+}
+
+// Оборачивает ошибку записи действием, которое не удалось (nil остается nil)
+func (r *RedisClientRepository) failed(action string, err error) error {
+	if err != nil {
+		return fmt.Errorf("redis storage failed to %s: %w", action, err)
+	}
+	return nil
+}
+
+// Долгота, широта и область клиента для индексов комнаты: пустые без позиции, "unbounded" - позиция без ближайшего
+func redisGeoArgs(position *models.Position) (longitude, latitude, reach string) {
+	if position == nil {
+		return "", "", ""
+	}
+
+	longitude = strconv.FormatFloat(position.Longitude, 'f', -1, 64)
+	latitude = strconv.FormatFloat(position.Latitude, 'f', -1, 64)
+	reach = "unbounded"
+	if radius := position.Distance + reachTolerance; position.ClosestClientID != "" && !math.IsInf(radius, 0) && !math.IsNaN(radius) {
+		reach = strconv.FormatFloat(radius, 'f', -1, 64)
+	}
+	return longitude, latitude, reach
+}
+
+func encodePosition(position *models.Position) string {
+	if position == nil {
+		return ""
+	}
+	data, _ := json.Marshal(&redisPosition{
+		Position:               position,
+		PendingClosestClientID: position.PendingClosestClientID,
+		PendingSince:           position.PendingSince,
+	})
+	return string(data)
+}
+
+func encodeProfile(client *models.ClientInfo) string {
+	data, _ := json.Marshal(&redisProfile{
+		WindowSettings: client.WindowSettings,
+		Zones:          client.Zones,
+		Privacy:        client.Privacy,
+		PrivacyOffset:  client.PrivacyOffset,
+		Preferences:    client.Preferences,
+		ResumeToken:    client.ResumeToken,
+	})
+	return string(data)
+}
+
+func encodeRoom(name string, options *models.RoomOptions) string {
+	info := &models.RoomInfo{Name: name}
+	if options != nil {
+		info.Limit, info.Metadata, info.Pairing = options.Limit, options.Metadata, options.Pairing
+	}
+	data, _ := json.Marshal(info)
+	return string(data)
+}
+
+// Собирает информацию о комнате из JSON и числа участников, как их возвращает Redis
+func decodeRoom(info, members any) (*models.RoomInfo, error) {
+	room := &models.RoomInfo{}
+	if data, ok := info.(string); ok {
+		if err := json.Unmarshal([]byte(data), room); err != nil {
+			return nil, err
+		}
+	}
+	if count, ok := members.(string); ok {
+		room.Members, _ = strconv.Atoi(count)
+	}
+	return room, nil
+}
+
+// Переносит поля hash клиента в client. Позиция заменяется новым объектом, так что копии, выданные раньше,
+// не меняются; профиль переносится, только если withProfile.
+func decodeClient(fields map[string]string, client *models.ClientInfo, withProfile bool) error {
+	client.Identity = fields["identity"]
+	client.Room = fields["room"]
+	client.SphereID, _ = strconv.Atoi(fields["sphere_id"])
+
+	if fields["position"] == "" {
+		client.Position = nil
+	} else {
+		stored := &redisPosition{Position: &models.Position{}}
+		if err := json.Unmarshal([]byte(fields["position"]), stored); err != nil {
+			return err
+		}
+		stored.Position.PendingClosestClientID = stored.PendingClosestClientID
+		stored.Position.PendingSince = stored.PendingSince
+		client.Position = stored.Position
+	}
+
+	if !withProfile || fields["profile"] == "" {
+		return nil
+	}
+	var profile redisProfile
+	if err := json.Unmarshal([]byte(fields["profile"]), &profile); err != nil {
+		return err
+	}
+	client.WindowSettings = profile.WindowSettings
+	client.Zones = profile.Zones
+	client.Privacy = profile.Privacy
+	client.PrivacyOffset = profile.PrivacyOffset
+	client.Preferences = profile.Preferences
+	client.ResumeToken = profile.ResumeToken
+	return nil
+}
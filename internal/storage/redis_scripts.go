@@ -0,0 +1,233 @@
+package storage
+
+import "github.com/redis/go-redis/v9"
+
+// Скрипты меняют реестр, индексы комнат и граф ссылок одной атомарной операцией. Ключи строятся внутри скриптов
+// по префиксу и именам из аргументов, поэтому бэкенд рассчитан на одиночный Redis, а не на Redis Cluster.
+//
+// Раскладка ключей (вид идет перед именем, поэтому двоеточия в именах комнат и ID не дают коллизий):
+//
+//	client:<id>        hash  id, identity, sphere_id, room, position (JSON), profile (JSON)
+//	clients            set   ID всех клиентов
+//	room:<name>        hash  info (JSON RoomInfo без числа участников), members
+//	room-clients:<name> set  клиенты комнаты
+//	geo:<name>         GEO   позиции клиентов комнаты (широта до ±85.05112878)
+//	polar:<name>       set   клиенты комнаты с позицией ближе к полюсу, чем допускает GEO
+//	reach:<name>       zset  радиус области каждого клиента, у которого есть ближайший
+//	unbounded:<name>   set   клиенты с позицией, но без ближайшего
+//	room-nodes:<name>  set   клиенты, чьи ссылки хранятся в комнате (остаются после удаления клиента)
+//	nodes              hash  клиент -> комната его ссылок
+//	refs:<id>          set   клиенты, считающие id своим ближайшим
+//	blockers           set   идентичности, которые кого-либо заблокировали
+//	blocks:<identity>  set   заблокированные идентичностью identity
+//
+// Первые два аргумента каждого скрипта - префикс ключей и имя глобальной комнаты.
+const redisPrelude = `
+local prefix, global = ARGV[1], ARGV[2]
+
+local function key(kind, name)
+	if name == nil then
+		return prefix .. kind
+	end
+	return prefix .. kind .. ':' .. name
+end
+
+local function unindex(room, id)
+	redis.call('ZREM', key('geo', room), id)
+	redis.call('SREM', key('polar', room), id)
+	redis.call('ZREM', key('reach', room), id)
+	redis.call('SREM', key('unbounded', room), id)
+end
+
+local function index(room, id, longitude, latitude, reach)
+	if longitude == '' then
+		return
+	end
+	if math.abs(tonumber(latitude)) <= 85.05112878 then
+		redis.call('GEOADD', key('geo', room), longitude, latitude, id)
+	else
+		redis.call('SADD', key('polar', room), id)
+	end
+	if reach == 'unbounded' then
+		redis.call('SADD', key('unbounded', room), id)
+	elseif reach ~= '' then
+		redis.call('ZADD', key('reach', room), reach, id)
+	end
+end
+
+local function addNode(room, id)
+	redis.call('HSET', key('nodes'), id, room)
+	redis.call('SADD', key('room-nodes', room), id)
+	redis.call('DEL', key('refs', id))
+end
+
+local function dropNode(id)
+	local room = redis.call('HGET', key('nodes'), id)
+	if not room then
+		return false
+	end
+	redis.call('HDEL', key('nodes'), id)
+	redis.call('SREM', key('room-nodes', room), id)
+	redis.call('DEL', key('refs', id))
+	return room
+end
+
+local function ensureRoom(room, info)
+	if redis.call('EXISTS', key('room', room)) == 0 then
+		redis.call('HSET', key('room', room), 'info', info, 'members', 0)
+	end
+end
+
+local function dropRoomIfEmpty(room)
+	if room == global then
+		return
+	end
+	if tonumber(redis.call('HGET', key('room', room), 'members') or 0) > 0 then
+		return
+	end
+	if redis.call('SCARD', key('room-nodes', room)) > 0 then
+		return
+	end
+	redis.call('DEL', key('room', room), key('room-clients', room), key('geo', room), key('polar', room),
+		key('reach', room), key('unbounded', room))
+end
+`
+
+// redisAddScript - Регистрирует клиента в комнате, создавая ее при необходимости, и индексирует его позицию.
+// ARGV: id, room, info новой комнаты, identity, sphere_id, position, profile, longitude, latitude, reach.
+var redisAddScript = redis.NewScript(redisPrelude + `
+local id, room = ARGV[3], ARGV[4]
+
+local previous = redis.call('HGET', key('client', id), 'room')
+if previous then
+	unindex(previous, id)
+	redis.call('SREM', key('room-clients', previous), id)
+	redis.call('HINCRBY', key('room', previous), 'members', -1)
+end
+
+ensureRoom(room, ARGV[5])
+redis.call('HSET', key('client', id), 'id', id, 'identity', ARGV[6], 'sphere_id', ARGV[7], 'room', room,
+	'position', ARGV[8], 'profile', ARGV[9])
+redis.call('SADD', key('clients'), id)
+redis.call('SADD', key('room-clients', room), id)
+redis.call('HINCRBY', key('room', room), 'members', 1)
+
+dropNode(id)
+addNode(room, id)
+index(room, id, ARGV[10], ARGV[11], ARGV[12])
+return 1
+`)
+
+// redisRemoveScript - Удаляет клиента из реестра и индексов комнаты. Ссылки на него остаются до удаления из графа.
+// ARGV: id.
+var redisRemoveScript = redis.NewScript(redisPrelude + `
+local id = ARGV[3]
+local room = redis.call('HGET', key('client', id), 'room')
+if not room then
+	return 0
+end
+
+unindex(room, id)
+redis.call('SREM', key('room-clients', room), id)
+redis.call('HINCRBY', key('room', room), 'members', -1)
+redis.call('DEL', key('client', id))
+redis.call('SREM', key('clients'), id)
+return 1
+`)
+
+// redisPositionScript - Заменяет позицию клиента и переиндексирует его. Пустой profile оставляет профиль как есть.
+// ARGV: id, position, profile, longitude, latitude, reach.
+var redisPositionScript = redis.NewScript(redisPrelude + `
+local id = ARGV[3]
+local room = redis.call('HGET', key('client', id), 'room')
+if not room then
+	return 0
+end
+
+redis.call('HSET', key('client', id), 'position', ARGV[4])
+if ARGV[5] ~= '' then
+	redis.call('HSET', key('client', id), 'profile', ARGV[5])
+end
+unindex(room, id)
+index(room, id, ARGV[6], ARGV[7], ARGV[8])
+return 1
+`)
+
+// redisNearestScript - Записывает позицию клиента с новым ближайшим и переносит ссылку с прежнего ближайшего на нового.
+// ARGV: id, old, new, position, profile, longitude, latitude, reach.
+var redisNearestScript = redis.NewScript(redisPrelude + `
+local id, old, new = ARGV[3], ARGV[4], ARGV[5]
+local room = redis.call('HGET', key('client', id), 'room')
+if room then
+	redis.call('HSET', key('client', id), 'position', ARGV[6])
+	if ARGV[7] ~= '' then
+		redis.call('HSET', key('client', id), 'profile', ARGV[7])
+	end
+	unindex(room, id)
+	index(room, id, ARGV[8], ARGV[9], ARGV[10])
+end
+
+if old ~= '' and redis.call('HEXISTS', key('nodes'), old) == 1 then
+	redis.call('SREM', key('refs', old), id)
+end
+if new ~= '' and redis.call('HEXISTS', key('nodes'), new) == 1 then
+	redis.call('SADD', key('refs', new), id)
+end
+return 1
+`)
+
+// redisMoveScript - Переносит клиента в комнату target, создавая ее с info, если ее нет. Возвращает {0} - клиента нет,
+// {2} - комната заполнена, {1, info, members} - комната после переноса.
+// ARGV: id, target, info новой комнаты, position, profile, longitude, latitude, reach.
+var redisMoveScript = redis.NewScript(redisPrelude + `
+local id, target = ARGV[3], ARGV[4]
+local source = redis.call('HGET', key('client', id), 'room')
+if not source then
+	return {0}
+end
+
+if source ~= target then
+	local info = cjson.decode(redis.call('HGET', key('room', target), 'info') or ARGV[5])
+	local members = tonumber(redis.call('HGET', key('room', target), 'members') or 0)
+	local limit = tonumber(info.limit or 0)
+	if limit > 0 and members >= limit then
+		return {2}
+	end
+	ensureRoom(target, ARGV[5])
+
+	unindex(source, id)
+	redis.call('SREM', key('room-clients', source), id)
+	redis.call('HINCRBY', key('room', source), 'members', -1)
+	dropNode(id)
+	dropRoomIfEmpty(source)
+
+	redis.call('HSET', key('client', id), 'room', target, 'position', ARGV[6])
+	if ARGV[7] ~= '' then
+		redis.call('HSET', key('client', id), 'profile', ARGV[7])
+	end
+	redis.call('SADD', key('room-clients', target), id)
+	redis.call('HINCRBY', key('room', target), 'members', 1)
+	addNode(target, id)
+	index(target, id, ARGV[8], ARGV[9], ARGV[10])
+end
+
+return {1, redis.call('HGET', key('room', target), 'info'), redis.call('HGET', key('room', target), 'members')}
+`)
+
+// redisDropNodeScript - Окончательно удаляет клиента из графа ссылок и пустую комнату вместе с ним. ARGV: id.
+var redisDropNodeScript = redis.NewScript(redisPrelude + `
+local room = dropNode(ARGV[3])
+if room then
+	dropRoomIfEmpty(room)
+end
+return 1
+`)
+
+// redisUnblockScript - Снимает блокировку. ARGV: blocker, blocked.
+var redisUnblockScript = redis.NewScript(redisPrelude + `
+redis.call('SREM', key('blocks', ARGV[3]), ARGV[4])
+if redis.call('SCARD', key('blocks', ARGV[3])) == 0 then
+	redis.call('SREM', key('blockers'), ARGV[3])
+end
+return 1
+`)
@@ -0,0 +1,185 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/usecases"
+)
+
+// RedisSharedTestSuite runs two repositories, as two server instances would, over one Redis
+type RedisSharedTestSuite struct {
+	suite.Suite
+	server        *miniredis.Miniredis
+	first, second *storage.RedisClientRepository
+}
+
+// SetupTest starts an in-process Redis and connects both repositories to it
+func (t *RedisSharedTestSuite) SetupTest() {
+	t.server = miniredis.RunT(t.T())
+	t.first = storage.NewRedisClientRepository(redis.NewClient(&redis.Options{Addr: t.server.Addr()}), "sphere:")
+	t.second = storage.NewRedisClientRepository(redis.NewClient(&redis.Options{Addr: t.server.Addr()}), "sphere:")
+}
+
+// TestSharedRegistry tests that clients added on one instance are visible and searchable on the other
+func (t *RedisSharedTestSuite) TestSharedRegistry() {
+	conn := &websocket.Conn{}
+	alice := &models.ClientInfo{ID: "alice", Connection: conn, Privacy: &models.PrivacySettings{Coordinates: "hidden"}}
+	t.first.AddClient(alice)
+	t.at(t.first, "alice", 55.75, 37.61)
+	t.second.AddClient(&models.ClientInfo{ID: "bob", Connection: &websocket.Conn{}})
+	t.at(t.second, "bob", 55.76, 37.62)
+
+	remote, ok := t.second.GetClient("alice")
+	t.Require().True(ok)
+	t.Require().Nil(remote.Connection, "Connections stay on the instance that owns them")
+	t.Require().Equal("hidden", remote.Privacy.Coordinates, "The profile is shared")
+	_, ok = t.second.GetClientIDByConnection(conn)
+	t.Require().False(ok)
+
+	nearest, err := t.first.FindNearestClient("alice")
+	t.Require().NoError(err)
+	t.Require().Equal("bob", nearest.ID)
+	t.Require().Len(t.second.GetAllClients(), 2)
+
+	t.first.RemoveClient("alice")
+	_, ok = t.second.GetClient("alice")
+	t.Require().False(ok)
+	_, ok = t.first.GetClientIDByConnection(conn)
+	t.Require().False(ok)
+}
+
+// TestRemoteMutations tests that changes made through one instance are seen by the other without changing earlier views
+func (t *RedisSharedTestSuite) TestRemoteMutations() {
+	t.first.AddClient(&models.ClientInfo{ID: "alice"})
+	t.at(t.first, "alice", 0, 0)
+	t.second.AddClient(&models.ClientInfo{ID: "bob"})
+	t.at(t.second, "bob", 0, 0.01)
+	before, _ := t.first.GetClient("alice")
+
+	// The second instance picks bob as the nearest of alice with a pending switch
+	remote, _ := t.second.GetClient("alice")
+	position := *remote.Position
+	position.ClosestClientID = "bob"
+	position.Distance = 1113
+	position.PendingClosestClientID = "carol"
+	position.PendingSince = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.second.UpdateNearestReference("alice", "", &position)
+
+	local, _ := t.first.GetClient("alice")
+	t.Require().Equal("bob", local.Position.ClosestClientID)
+	t.Require().Equal("carol", local.Position.PendingClosestClientID, "Hysteresis state is shared too")
+	t.Require().Empty(before.Position.ClosestClientID, "Earlier views do not change")
+	t.Require().Equal([]string{"alice"}, t.first.WhoReferenceMeAsNearest("bob"))
+
+	settings := &models.WindowSettings{Width: 800}
+	t.first.UpdateClientWindowSettings("alice", settings)
+	remote, _ = t.second.GetClient("alice")
+	t.Require().Equal(settings, remote.WindowSettings)
+
+	t.first.UpdateClientPrivacy("alice", &models.PrivacySettings{Coordinates: "hidden"})
+	remote, _ = t.second.GetClient("alice")
+	t.Require().Equal("hidden", remote.Privacy.Coordinates, "Profile changes of own clients are written through")
+}
+
+// TestPolar tests clients beyond the latitudes that Redis GEO accepts
+func (t *RedisSharedTestSuite) TestPolar() {
+	t.first.AddClient(&models.ClientInfo{ID: "pole"})
+	t.at(t.first, "pole", 89.9, 0)
+	t.first.AddClient(&models.ClientInfo{ID: "near"})
+	t.at(t.first, "near", 89.5, 180)
+	t.first.AddClient(&models.ClientInfo{ID: "far"})
+	t.at(t.first, "far", 84, 0)
+
+	nearest, err := t.first.FindNearestClient("pole")
+	t.Require().NoError(err)
+	t.Require().Equal("near", nearest.ID)
+
+	nearest, err = t.first.FindNearestClient("far")
+	t.Require().NoError(err)
+	t.Require().Equal("pole", nearest.ID, "Polar clients are candidates for everyone")
+
+	t.Require().ElementsMatch([]string{"near", "far"}, clientIDs(t.first.FindReverseNearest("pole")))
+}
+
+// TestUsecases tests that a move handled by one instance updates the nearest of a client owned by the other
+func (t *RedisSharedTestSuite) TestUsecases() {
+	cfg := config.Default()
+	first := usecases.NewGeolocationUsecase(t.first, cfg.Geolocation)
+	second := usecases.NewGeolocationUsecase(t.second, cfg.Geolocation)
+	usecases.NewUsersUsecase(t.first, cfg.Privacy).AddClient(&models.ClientInfo{ID: "alice"})
+	usecases.NewUsersUsecase(t.second, cfg.Privacy).AddClient(&models.ClientInfo{ID: "bob"})
+	usecases.NewUsersUsecase(t.second, cfg.Privacy).AddClient(&models.ClientInfo{ID: "carol"})
+
+	_, err := second.UpdatePosition("bob", &models.Position{Latitude: 55.75, Longitude: 37.61})
+	t.Require().NoError(err)
+	_, err = second.UpdatePosition("carol", &models.Position{Latitude: 55.80, Longitude: 37.70})
+	t.Require().NoError(err)
+
+	notify, err := first.UpdatePosition("alice", &models.Position{Latitude: 55.7501, Longitude: 37.6101})
+	t.Require().NoError(err)
+	t.Require().Contains(notify, "bob")
+
+	bob, _ := t.second.GetClient("bob")
+	t.Require().Equal("alice", bob.Position.ClosestClientID, "The nearest of bob changed through the first instance")
+	t.Require().ElementsMatch([]string{"bob", "carol"}, t.second.WhoReferenceMeAsNearest("alice"))
+}
+
+// TestWriteErrors tests that writes report an unavailable Redis instead of pretending to succeed
+func (t *RedisSharedTestSuite) TestWriteErrors() {
+	t.Require().NoError(t.first.AddClient(&models.ClientInfo{ID: "alice"}))
+	t.server.Close()
+
+	position := &models.Position{Latitude: 55.75, Longitude: 37.61}
+	position.UpdateXYZ()
+	t.Require().Error(t.first.UpdateClientPosition("alice", position))
+	t.Require().Error(t.first.AddClient(&models.ClientInfo{ID: "bob"}))
+	t.Require().Error(t.first.RemoveClient("alice"))
+}
+
+// TestOwnedCache tests that only the clients connected to an instance stay in its memory
+func (t *RedisSharedTestSuite) TestOwnedCache() {
+	for _, id := range []string{"alice", "bob", "carol"} {
+		t.Require().NoError(t.first.AddClient(&models.ClientInfo{ID: id}))
+		t.at(t.first, id, 55.75, 37.61)
+	}
+	t.Require().NoError(t.second.AddClient(&models.ClientInfo{ID: "dave"}))
+	t.at(t.second, "dave", 55.7501, 37.6101)
+
+	t.Require().Len(t.second.GetAllClients(), 4)
+	_, err := t.second.FindNearestClient("dave")
+	t.Require().NoError(err)
+	t.Require().Equal(1, t.second.Cached(), "Remote clients are not kept after they are read")
+
+	t.Require().True(t.second.AttachConnection("alice", &websocket.Conn{}))
+	t.Require().Equal(2, t.second.Cached())
+	t.Require().NoError(t.second.RemoveClient("alice"))
+	t.Require().Equal(1, t.second.Cached())
+}
+
+// at positions a client through the given repository
+func (t *RedisSharedTestSuite) at(repo *storage.RedisClientRepository, id string, latitude, longitude float64) {
+	position := &models.Position{Latitude: latitude, Longitude: longitude}
+	position.UpdateXYZ()
+	repo.UpdateClientPosition(id, position)
+}
+
+func TestRedisSharedTestSuite(t *testing.T) {
+	suite.Run(t, new(RedisSharedTestSuite))
+}
+
+func clientIDs(clients []*models.ClientInfo) []string {
+	result := make([]string, 0, len(clients))
+	for _, client := range clients {
+		result = append(result, client.ID)
+	}
+	return result
+}
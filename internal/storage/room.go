@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"maps"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/dhconnelly/rtreego"
+)
+
+// room - Изолированная сфера: свой пространственный индекс и свой граф ссылок на ближайших
+type room struct {
+	info                    *models.RoomInfo
+	index                   pointIndex
+	whoReferenceMeAsNearest map[string]map[string]struct{}
+
+	// reachTree, reaches, unbounded - Индекс областей, в которых клиенты могут сменить ближайшего
+	reachTree *rtreego.Rtree
+	reaches   map[string]*reach
+	unbounded map[string]*models.ClientInfo
+}
+
+func newRoom(name string, options *models.RoomOptions, index pointIndex) *room {
+	info := &models.RoomInfo{Name: name}
+	if options != nil {
+		info.Limit = options.Limit
+		info.Metadata = maps.Clone(options.Metadata)
+		info.Pairing = options.Pairing
+	}
+
+	return &room{
+		info:                    info,
+		index:                   index,
+		whoReferenceMeAsNearest: make(map[string]map[string]struct{}),
+		reachTree:               rtreego.NewTree(3, 25, 50),
+		reaches:                 make(map[string]*reach),
+		unbounded:               make(map[string]*models.ClientInfo),
+	}
+}
+
+func (r *room) snapshot() *models.RoomInfo {
+	info := *r.info
+	info.Metadata = maps.Clone(r.info.Metadata)
+	return &info
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/dhconnelly/rtreego"
+)
+
+// pointIndex - Индекс точек комнаты по ECEF-координатам, которым пользуется репозиторий.
+// Ему удовлетворяют и одиночное R-Tree, и шардированный индекс.
+type pointIndex interface {
+	Insert(obj rtreego.Spatial)
+	Delete(obj rtreego.Spatial) bool
+	NearestNeighbors(k int, p rtreego.Point, filters ...rtreego.Filter) []rtreego.Spatial
+	Size() int
+}
+
+// Создает одиночное R-Tree комнаты, пакетно загружая в него objs
+func newTreeIndex(objs ...rtreego.Spatial) pointIndex {
+	return rtreego.NewTree(3, 25, 50, objs...)
+}
+
+// Вставляет objs в index по одному для индексов без пакетной загрузки
+func fill(index pointIndex, objs []rtreego.Spatial) pointIndex {
+	for _, obj := range objs {
+		index.Insert(obj)
+	}
+	return index
+}
+
+// shardedIndex - Индекс, разбитый на шарды по граням описанного вокруг Земли куба. Каждая грань
+// делится на divisions x divisions ячеек в гномонической проекции, у каждого шарда свое R-Tree. Своих блокировок
+// у индекса нет: ClientRepository обращается к нему под своей блокировкой, а все записи сервера идут из одной
+// горутины движка. Шарды ускоряют обновления и поиски только за счет меньших деревьев (см. BenchmarkRepositoryUpdate).
+type shardedIndex struct {
+	divisions int
+	shards    []*shard
+}
+
+// shard - Одна ячейка грани куба. bounds - объемлющий прямоугольник точек шарда: при удалении он не сжимается,
+// поэтому всегда покрывает точки шарда и годится как нижняя граница расстояния до них.
+type shard struct {
+	tree   *rtreego.Rtree
+	bounds [2][3]float64
+}
+
+// Создает шардированный индекс с divisions x divisions шардами на каждую грань куба
+func newShardedIndex(divisions int) *shardedIndex {
+	if divisions < 1 {
+		divisions = 1
+	}
+
+	shards := make([]*shard, 6*divisions*divisions)
+	for i := range shards {
+		shards[i] = &shard{tree: rtreego.NewTree(3, 25, 50)}
+	}
+	return &shardedIndex{divisions: divisions, shards: shards}
+}
+
+// Возвращает шард, в ячейку которого попадает точка p
+func (s *shardedIndex) shardOf(p rtreego.Point) *shard {
+	ax, ay, az := math.Abs(p[0]), math.Abs(p[1]), math.Abs(p[2])
+
+	// Грань выбирается по наибольшей по модулю координате, u и v - координаты на грани в [-1, 1]
+	var face int
+	var major, u, v float64
+	switch {
+	case ax >= ay && ax >= az:
+		face, major, u, v = 0, p[0], p[1], p[2]
+	case ay >= az:
+		face, major, u, v = 2, p[1], p[0], p[2]
+	default:
+		face, major, u, v = 4, p[2], p[0], p[1]
+	}
+	if major == 0 {
+		return s.shards[0]
+	}
+	if major < 0 {
+		face++
+	}
+
+	i, j := s.cell(u/math.Abs(major)), s.cell(v/math.Abs(major))
+	return s.shards[(face*s.divisions+i)*s.divisions+j]
+}
+
+// Номер ячейки для координаты на грани
+func (s *shardedIndex) cell(t float64) int {
+	return min(max(int((t+1)/2*float64(s.divisions)), 0), s.divisions-1)
+}
+
+// Insert - Добавляет объект в шард его точки
+func (s *shardedIndex) Insert(obj rtreego.Spatial) {
+	bounds := obj.Bounds()
+	sh := s.shardOf(corner(bounds))
+	if sh.tree.Size() == 0 {
+		sh.bounds = [2][3]float64{{math.Inf(1), math.Inf(1), math.Inf(1)}, {math.Inf(-1), math.Inf(-1), math.Inf(-1)}}
+	}
+	for axis := range 3 {
+		sh.bounds[0][axis] = math.Min(sh.bounds[0][axis], bounds.PointCoord(axis))
+		sh.bounds[1][axis] = math.Max(sh.bounds[1][axis], bounds.PointCoord(axis)+bounds.LengthsCoord(axis))
+	}
+	sh.tree.Insert(obj)
+}
+
+// Delete - Удаляет объект из шарда. Объект должен лежать там же, где был при вставке.
+func (s *shardedIndex) Delete(obj rtreego.Spatial) bool {
+	return s.shardOf(corner(obj.Bounds())).tree.Delete(obj)
+}
+
+// Size - Количество объектов во всех шардах
+func (s *shardedIndex) Size() int {
+	size := 0
+	for _, sh := range s.shards {
+		size += sh.tree.Size()
+	}
+	return size
+}
+
+// NearestNeighbors - Находит k ближайших к p объектов. Шарды обходятся по возрастанию расстояния до их
+// объемлющих прямоугольников, и обход останавливается, когда следующий шард заведомо дальше k-го найденного.
+func (s *shardedIndex) NearestNeighbors(k int, p rtreego.Point, filters ...rtreego.Filter) []rtreego.Spatial {
+	type candidate struct {
+		obj      rtreego.Spatial
+		distance float64
+	}
+	type reachable struct {
+		shard    *shard
+		distance float64
+	}
+
+	order := make([]reachable, 0, len(s.shards))
+	for _, sh := range s.shards {
+		if sh.tree.Size() > 0 {
+			order = append(order, reachable{shard: sh, distance: sh.minDistance(p)})
+		}
+	}
+	slices.SortFunc(order, func(a, b reachable) int {
+		return cmp.Compare(a.distance, b.distance)
+	})
+
+	found := make([]candidate, 0, k)
+	for _, next := range order {
+		if len(found) == k && next.distance > found[k-1].distance {
+			break
+		}
+
+		for _, obj := range next.shard.tree.NearestNeighbors(k, p, filters...) {
+			if obj == nil {
+				continue
+			}
+			found = append(found, candidate{obj: obj, distance: pointDistance(p, corner(obj.Bounds()))})
+		}
+		slices.SortStableFunc(found, func(a, b candidate) int {
+			return cmp.Compare(a.distance, b.distance)
+		})
+		if len(found) > k {
+			found = found[:k]
+		}
+	}
+
+	result := make([]rtreego.Spatial, len(found))
+	for i, c := range found {
+		result[i] = c.obj
+	}
+	return result
+}
+
+// Нижняя граница расстояния от p до точек шарда
+func (sh *shard) minDistance(p rtreego.Point) float64 {
+	sum := 0.0
+	for axis := range 3 {
+		d := math.Max(math.Max(sh.bounds[0][axis]-p[axis], p[axis]-sh.bounds[1][axis]), 0)
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// Нижний угол прямоугольника: точка, которой клиент представлен в индексе
+func corner(rect rtreego.Rect) rtreego.Point {
+	return rtreego.Point{rect.PointCoord(0), rect.PointCoord(1), rect.PointCoord(2)}
+}
+
+// Евклидово расстояние между двумя точками
+func pointDistance(a, b rtreego.Point) float64 {
+	sum := 0.0
+	for axis := range a {
+		d := a[axis] - b[axis]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,180 @@
+package storage_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dhconnelly/rtreego"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+)
+
+// benchmarkSizes lists the client counts the indexes are compared at
+var benchmarkSizes = []struct {
+	name  string
+	count int
+}{
+	{"10k", 10_000},
+	{"100k", 100_000},
+	{"1M", 1_000_000},
+}
+
+// benchmarkIndexes lists the compared indexes: the single tree, the sharded index and the cell index.
+// The indexes have no locks of their own, so they are benchmarked from one goroutine.
+var benchmarkIndexes = []struct {
+	name string
+	new  func() storage.PointIndex
+}{
+	{"single", func() storage.PointIndex { return storage.NewTreeIndex() }},
+	{"sharded", func() storage.PointIndex { return storage.NewShardedIndex(4) }},
+	{"cells", func() storage.PointIndex { return storage.NewCellIndex(12) }},
+}
+
+// BenchmarkIndexUpdate measures position updates of random clients
+func BenchmarkIndexUpdate(b *testing.B) {
+	forEachIndex(b, func(b *testing.B, index storage.PointIndex, clients []*models.ClientInfo) {
+		rnd := rand.New(rand.NewSource(1))
+		for range b.N {
+			client := clients[rnd.Intn(len(clients))]
+			index.Delete(client)
+			client.Position = jitter(rnd, client.Position)
+			index.Insert(client)
+		}
+	})
+}
+
+// BenchmarkIndexNearest measures nearest neighbor searches at random client positions
+func BenchmarkIndexNearest(b *testing.B) {
+	forEachIndex(b, func(b *testing.B, index storage.PointIndex, clients []*models.ClientInfo) {
+		rnd := rand.New(rand.NewSource(1))
+		for range b.N {
+			position := clients[rnd.Intn(len(clients))].Position
+			index.NearestNeighbors(8, rtreego.Point{position.X, position.Y, position.Z})
+		}
+	})
+}
+
+// benchmarkRepositories lists the compared repositories. Every repository method takes the repository-wide lock,
+// so these benchmarks show what the indexes give behind it rather than on their own.
+var benchmarkRepositories = []struct {
+	name string
+	new  func() *storage.ClientRepository
+}{
+	{"single", storage.NewClientRepository},
+	{"sharded", func() *storage.ClientRepository { return storage.NewShardedClientRepository(4) }},
+	{"cells", func() *storage.ClientRepository { return storage.NewCellClientRepository(12) }},
+}
+
+// BenchmarkRepositoryUpdate measures parallel position updates through the repository, each worker moving its own clients
+func BenchmarkRepositoryUpdate(b *testing.B) {
+	forEachRepository(b, func(b *testing.B, repo *storage.ClientRepository, clients []*models.ClientInfo) {
+		block := len(clients) / runtime.GOMAXPROCS(0)
+		var workers atomic.Int64
+
+		b.RunParallel(func(pb *testing.PB) {
+			worker := int(workers.Add(1) - 1)
+			rnd := rand.New(rand.NewSource(int64(worker)))
+			own := clients[worker*block : (worker+1)*block]
+
+			for i := 0; pb.Next(); i++ {
+				client := own[i%len(own)]
+				client.Position = jitter(rnd, client.Position)
+				repo.UpdateClientPosition(client.ID, client.Position)
+			}
+		})
+	})
+}
+
+// BenchmarkRepositoryNearest measures parallel nearest client searches through the repository
+func BenchmarkRepositoryNearest(b *testing.B) {
+	forEachRepository(b, func(b *testing.B, repo *storage.ClientRepository, clients []*models.ClientInfo) {
+		var workers atomic.Int64
+
+		b.RunParallel(func(pb *testing.PB) {
+			rnd := rand.New(rand.NewSource(workers.Add(1)))
+			for pb.Next() {
+				repo.FindNearestClient(clients[rnd.Intn(len(clients))].ID)
+			}
+		})
+	})
+}
+
+// forEachRepository fills every compared repository with every benchmark size and runs bench on it,
+// the same way forEachIndex does for the bare indexes
+func forEachRepository(b *testing.B, bench func(b *testing.B, repo *storage.ClientRepository, clients []*models.ClientInfo)) {
+	for _, size := range benchmarkSizes {
+		if testing.Short() && size.count > 100_000 {
+			continue
+		}
+		for _, kind := range benchmarkRepositories {
+			var repo *storage.ClientRepository
+			var clients []*models.ClientInfo
+
+			b.Run(fmt.Sprintf("%s/%s", size.name, kind.name), func(b *testing.B) {
+				if repo == nil {
+					repo, clients = kind.new(), uniformClients(size.count)
+					repo.LoadClients(nil, clients)
+				}
+
+				b.ResetTimer()
+				bench(b, repo, clients)
+			})
+		}
+	}
+}
+
+// forEachIndex fills every compared index with every benchmark size and runs bench on it.
+// The index is filled once per sub-benchmark, outside of the measured loop, and only if the sub-benchmark is selected.
+func forEachIndex(b *testing.B, bench func(b *testing.B, index storage.PointIndex, clients []*models.ClientInfo)) {
+	for _, size := range benchmarkSizes {
+		if testing.Short() && size.count > 100_000 {
+			continue
+		}
+		for _, kind := range benchmarkIndexes {
+			var index storage.PointIndex
+			var clients []*models.ClientInfo
+
+			b.Run(fmt.Sprintf("%s/%s", size.name, kind.name), func(b *testing.B) {
+				if index == nil {
+					index, clients = kind.new(), uniformClients(size.count)
+					for _, client := range clients {
+						index.Insert(client)
+					}
+				}
+
+				b.ResetTimer()
+				bench(b, index, clients)
+			})
+		}
+	}
+}
+
+// uniformClients generates count clients spread uniformly over the globe
+func uniformClients(count int) []*models.ClientInfo {
+	rnd := rand.New(rand.NewSource(42))
+	clients := make([]*models.ClientInfo, count)
+	for i := range clients {
+		position := &models.Position{
+			Latitude:  math.Asin(2*rnd.Float64()-1) * 180 / math.Pi,
+			Longitude: rnd.Float64()*360 - 180,
+		}
+		position.UpdateXYZ()
+		clients[i] = &models.ClientInfo{ID: fmt.Sprintf("client%d", i), Position: position}
+	}
+	return clients
+}
+
+// jitter moves a position by up to about a kilometer, the way a walking or driving client moves between updates
+func jitter(rnd *rand.Rand, position *models.Position) *models.Position {
+	moved := &models.Position{
+		Latitude:  math.Max(-90, math.Min(90, position.Latitude+(rnd.Float64()-0.5)*0.01)),
+		Longitude: math.Mod(position.Longitude+(rnd.Float64()-0.5)*0.01+540, 360) - 180,
+	}
+	moved.UpdateXYZ()
+	return moved
+}
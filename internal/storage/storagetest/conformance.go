@@ -0,0 +1,408 @@
+// Package storagetest - Общий набор тестов, которому должен соответствовать каждый бэкенд storage.ClientStore
+package storagetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// ConformanceSuite checks the behavior shared by all client store backends
+type ConformanceSuite struct {
+	suite.Suite
+
+	// NewStore creates an empty store of the backend under test
+	NewStore func() storage.ClientStore
+
+	store storage.ClientStore
+	rnd   *rand.Rand
+}
+
+// Run runs the conformance suite against the backend created by newStore
+func Run(t *testing.T, newStore func() storage.ClientStore) {
+	suite.Run(t, &ConformanceSuite{NewStore: newStore})
+}
+
+// SetupTest creates a fresh store and a deterministic random source before each test
+func (t *ConformanceSuite) SetupTest() {
+	t.store = t.NewStore()
+	t.rnd = rand.New(rand.NewSource(42))
+}
+
+// TestRegistry tests adding, looking up and removing clients
+func (t *ConformanceSuite) TestRegistry() {
+	conn := &websocket.Conn{}
+	client := &models.ClientInfo{ID: "client1", Connection: conn}
+	t.store.AddClient(client)
+	t.store.AddClient(&models.ClientInfo{ID: "client2", Connection: &websocket.Conn{}})
+
+	stored, ok := t.store.GetClient("client1")
+	t.Require().True(ok)
+	t.Require().Equal("client1", stored.ID)
+	t.Require().Equal(models.GlobalRoom, stored.Room, "Clients join the global room by default")
+	t.Require().Equal("client1", stored.Identity, "Identity defaults to the client ID")
+
+	id, ok := t.store.GetClientIDByConnection(conn)
+	t.Require().True(ok)
+	t.Require().Equal("client1", id)
+	t.Require().Len(t.store.GetAllClients(), 2)
+
+	settings := &models.WindowSettings{}
+	t.store.UpdateClientWindowSettings("client1", settings)
+	stored, _ = t.store.GetClient("client1")
+	t.Require().Same(settings, stored.WindowSettings)
+
+	t.store.RemoveClient("client1")
+	_, ok = t.store.GetClient("client1")
+	t.Require().False(ok)
+	_, ok = t.store.GetClientIDByConnection(conn)
+	t.Require().False(ok)
+	t.Require().Len(t.store.GetAllClients(), 1)
+}
+
+// TestNearestClient tests nearest search, re-indexing on moves and removal from the index
+func (t *ConformanceSuite) TestNearestClient() {
+	a := t.addAt("a", 55.75, 37.61)
+	t.addAt("b", 55.76, 37.62)
+	t.addAt("c", 55.80, 37.70)
+	t.store.AddClient(&models.ClientInfo{ID: "unpositioned"})
+
+	_, err := t.store.FindNearestClient("unpositioned")
+	t.Require().ErrorIs(err, util.ErrNoPositionProvided)
+	_, err = t.store.FindNearestClient("missing")
+	t.Require().ErrorIs(err, util.ErrClientNotFound)
+
+	nearest, err := t.store.FindNearestClient(a.ID)
+	t.Require().NoError(err)
+	t.Require().Equal("b", nearest.ID)
+
+	// Filters skip candidates and the search continues past them
+	nearest, err = t.store.FindNearestClient(a.ID, func(_, candidate *models.ClientInfo) bool { return candidate.ID != "b" })
+	t.Require().NoError(err)
+	t.Require().Equal("c", nearest.ID)
+
+	// Clients whose identities blocked each other are never paired
+	t.store.Block("b", "a")
+	nearest, err = t.store.FindNearestClient(a.ID)
+	t.Require().NoError(err)
+	t.Require().Equal("c", nearest.ID)
+	t.store.Unblock("b", "a")
+
+	// Moving b away re-indexes it under the new position
+	t.moveTo("b", -33.86, 151.20)
+	nearest, _ = t.store.FindNearestClient(a.ID)
+	t.Require().Equal("c", nearest.ID)
+
+	// A nil position removes the client from the index
+	t.store.UpdateClientPosition("c", nil)
+	nearest, _ = t.store.FindNearestClient(a.ID)
+	t.Require().Equal("b", nearest.ID)
+
+	t.store.RemoveClient("b")
+	_, err = t.store.FindNearestClient(a.ID)
+	t.Require().ErrorIs(err, util.ErrNoClientsAvailable)
+}
+
+// TestNearestAgainstBruteForce tests that the nearest client is the geodesically closest one
+func (t *ConformanceSuite) TestNearestAgainstBruteForce() {
+	clients := make([]*models.ClientInfo, 0, 300)
+	for i := 0; i < cap(clients); i++ {
+		// Half of the clients are spread over the globe, the other half are packed into a dense cluster
+		lat, lon := math.Asin(2*t.rnd.Float64()-1)*180/math.Pi, t.rnd.Float64()*360-180
+		if i%2 == 0 {
+			lat, lon = 55.75+t.rnd.Float64()*0.005, 37.61+t.rnd.Float64()*0.005
+		}
+		clients = append(clients, t.addAt(fmt.Sprintf("client%d", i), lat, lon))
+	}
+
+	for _, client := range clients {
+		nearest, err := t.store.FindNearestClient(client.ID)
+		t.Require().NoError(err)
+
+		expected := math.Inf(1)
+		for _, other := range clients {
+			if other.ID != client.ID {
+				expected = math.Min(expected, client.Position.GeodesicDistanceTo(other.Position))
+			}
+		}
+		t.Require().Equal(expected, client.Position.GeodesicDistanceTo(nearest.Position), "Nearest client for %s", client.ID)
+	}
+}
+
+// TestNearestReferences tests the reverse reference graph
+func (t *ConformanceSuite) TestNearestReferences() {
+	a := t.addAt("a", 0, 0)
+	b := t.addAt("b", 0, 1)
+	c := t.addAt("c", 0, 2)
+
+	t.setNearest(a, b)
+	t.setNearest(c, b)
+	t.Require().ElementsMatch([]string{"a", "c"}, t.store.WhoReferenceMeAsNearest("b"))
+
+	t.setNearest(c, a)
+	stored, _ := t.store.GetClient("c")
+	t.Require().Equal("a", stored.Position.ClosestClientID, "The position with the new nearest is stored")
+	t.Require().Equal([]string{"a"}, t.store.WhoReferenceMeAsNearest("b"))
+	t.Require().Equal([]string{"c"}, t.store.WhoReferenceMeAsNearest("a"))
+
+	t.store.HeDoesNotReferenceMeAsNearestAnymore("a", "c")
+	t.Require().Empty(t.store.WhoReferenceMeAsNearest("a"))
+
+	// References to a removed client stay until it is deleted from the graph
+	t.store.RemoveClient("b")
+	t.Require().Equal([]string{"a"}, t.store.WhoReferenceMeAsNearest("b"))
+	t.store.DeleteClientFromNearestReferences("b")
+	t.Require().Empty(t.store.WhoReferenceMeAsNearest("b"))
+}
+
+// TestReverseNearest tests that clients whose nearest could be beaten by a mover are found
+func (t *ConformanceSuite) TestReverseNearest() {
+	a := t.addAt("a", 0, 0)
+	b := t.addAt("b", 0, 1)
+	t.addAt("mover", 0, 50)
+	lonely := t.addAt("lonely", 40, 40)
+
+	t.setNearest(a, b)
+	t.setNearest(b, a)
+	t.Require().ElementsMatch([]string{"lonely"}, ids(t.store.FindReverseNearest("mover")), "Clients without a nearest are always candidates")
+
+	t.moveTo("mover", 0, 0.5)
+	t.Require().ElementsMatch([]string{"a", "b", "lonely"}, ids(t.store.FindReverseNearest("mover")))
+
+	// Once lonely pairs with a client next to it, the mover is out of its reach
+	friend := t.addAt("friend", 40, 40.01)
+	t.setNearest(lonely, friend)
+	t.setNearest(friend, lonely)
+	t.Require().ElementsMatch([]string{"a", "b"}, ids(t.store.FindReverseNearest("mover")))
+}
+
+// TestRooms tests room membership, limits and index isolation
+func (t *ConformanceSuite) TestRooms() {
+	t.addAt("a", 0, 0)
+	t.addAt("b", 0, 0.001)
+	t.addAt("c", 0, 1)
+
+	room, err := t.store.MoveClientToRoom("a", "event", &models.RoomOptions{Limit: 2, Metadata: map[string]string{"title": "Party"}})
+	t.Require().NoError(err)
+	t.Require().Equal(&models.RoomInfo{Name: "event", Limit: 2, Metadata: map[string]string{"title": "Party"}, Members: 1}, room)
+
+	_, err = t.store.FindNearestClient("a")
+	t.Require().ErrorIs(err, util.ErrNoClientsAvailable, "Clients of other rooms are not candidates")
+	nearest, _ := t.store.FindNearestClient("b")
+	t.Require().Equal("c", nearest.ID)
+
+	_, err = t.store.MoveClientToRoom("c", "event", nil)
+	t.Require().NoError(err)
+	_, err = t.store.MoveClientToRoom("b", "event", nil)
+	t.Require().ErrorIs(err, util.ErrRoomFull)
+
+	t.Require().ElementsMatch([]string{"a", "c"}, ids(t.store.GetRoomClients("event")))
+	global, ok := t.store.GetRoom(models.GlobalRoom)
+	t.Require().True(ok)
+	t.Require().Equal(1, global.Members)
+
+	// An empty room is dropped, the global room always exists
+	t.store.MoveClientToRoom("a", models.GlobalRoom, nil)
+	t.store.MoveClientToRoom("c", models.GlobalRoom, nil)
+	_, ok = t.store.GetRoom("event")
+	t.Require().False(ok)
+}
+
+// TestBlocks tests that blocks are symmetric and can be lifted
+func (t *ConformanceSuite) TestBlocks() {
+	t.store.Block("alice", "bob")
+	t.Require().True(t.store.IsBlocked("alice", "bob"))
+	t.Require().True(t.store.IsBlocked("bob", "alice"))
+	t.Require().False(t.store.IsBlocked("alice", "carol"))
+
+	t.store.Unblock("bob", "alice")
+	t.Require().True(t.store.IsBlocked("alice", "bob"), "Only the blocker can lift the block")
+	t.store.Unblock("alice", "bob")
+	t.Require().False(t.store.IsBlocked("alice", "bob"))
+
+	t.store.Block("alice", "bob")
+	t.store.Block("alice", "carol")
+	t.Require().Len(t.store.Blocks(), 1)
+	t.Require().ElementsMatch([]string{"bob", "carol"}, t.store.Blocks()["alice"])
+}
+
+// TestAttachConnection tests that a detached client keeps its state and can take a new connection
+func (t *ConformanceSuite) TestAttachConnection() {
+	t.store.AddClient(&models.ClientInfo{ID: "detached"})
+	t.store.AddClient(&models.ClientInfo{ID: "other"})
+	_, ok := t.store.GetClientIDByConnection(nil)
+	t.Require().False(ok, "Detached clients are not registered under a nil connection")
+
+	conn := &websocket.Conn{}
+	t.Require().True(t.store.AttachConnection("detached", conn))
+	id, ok := t.store.GetClientIDByConnection(conn)
+	t.Require().True(ok)
+	t.Require().Equal("detached", id)
+
+	replacement := &websocket.Conn{}
+	t.Require().True(t.store.AttachConnection("detached", replacement))
+	_, ok = t.store.GetClientIDByConnection(conn)
+	t.Require().False(ok, "The previous connection is forgotten")
+	t.Require().False(t.store.AttachConnection("missing", conn))
+
+	t.store.RemoveClient("other")
+	_, ok = t.store.GetClient("detached")
+	t.Require().True(ok)
+}
+
+// TestLoadClients tests that bulk loaded clients are indexed and keep their rooms and nearest references
+func (t *ConformanceSuite) TestLoadClients() {
+	t.addAt("live", 0, 3)
+
+	at := func(id, room string, latitude, longitude float64) *models.ClientInfo {
+		position := &models.Position{Latitude: latitude, Longitude: longitude}
+		position.UpdateXYZ()
+		return &models.ClientInfo{ID: id, Room: room, Position: position}
+	}
+	a, b := at("a", "", 0, 0), at("b", "", 0, 1)
+	a.Position.ClosestClientID, a.Position.Distance = "b", a.Position.GeodesicDistanceTo(b.Position)
+	lost := at("lost", "event", 10, 10)
+	lost.Position.ClosestClientID = "gone"
+
+	rooms := []*models.RoomInfo{{Name: "event", Limit: 5, Pairing: "exclusive", Members: 42}}
+	t.store.LoadClients(rooms, []*models.ClientInfo{a, b, lost, at("live", "", 50, 50)})
+
+	t.Require().Len(t.store.GetAllClients(), 4, "Clients with taken IDs are skipped")
+	live, _ := t.store.GetClient("live")
+	t.Require().Equal(3.0, live.Position.Longitude)
+
+	nearest, err := t.store.FindNearestClient("a")
+	t.Require().NoError(err)
+	t.Require().Equal("b", nearest.ID)
+	nearest, _ = t.store.FindNearestClient("live")
+	t.Require().Equal("b", nearest.ID, "Loaded clients share the index with live ones")
+
+	t.Require().Equal([]string{"a"}, t.store.WhoReferenceMeAsNearest("b"))
+	lost, _ = t.store.GetClient("lost")
+	t.Require().Empty(lost.Position.ClosestClientID, "A nearest missing from the room is dropped")
+
+	room, ok := t.store.GetRoom("event")
+	t.Require().True(ok)
+	t.Require().Equal(&models.RoomInfo{Name: "event", Limit: 5, Pairing: "exclusive", Members: 1}, room)
+	t.Require().Equal([]string{"lost"}, ids(t.store.GetRoomClients("event")))
+
+	// The reach of a is restored, so a is a reverse nearest candidate only once live comes closer than b
+	t.Require().NotContains(ids(t.store.FindReverseNearest("live")), "a")
+	t.moveTo("live", 0, 0.5)
+	t.Require().Contains(ids(t.store.FindReverseNearest("live")), "a")
+}
+
+// TestViews tests that clients read from the store are snapshots unaffected by later writes
+func (t *ConformanceSuite) TestViews() {
+	added := &models.ClientInfo{ID: "a", Connection: &websocket.Conn{}, Position: &models.Position{Latitude: 1, Longitude: 2}}
+	added.Position.UpdateXYZ()
+	t.store.AddClient(added)
+	added.Position.Latitude, added.Room = 50, "elsewhere"
+
+	view, ok := t.store.GetClient("a")
+	t.Require().True(ok)
+	t.Require().Equal(1.0, view.Position.Latitude, "The store keeps its own copy of an added client")
+	t.Require().Equal(models.GlobalRoom, view.Room)
+
+	b := t.addAt("b", 1, 3)
+	t.setNearest(view, b)
+	t.moveTo("a", 10, 20)
+	t.store.UpdateClientWindowSettings("a", &models.WindowSettings{})
+	t.store.UpdateClientZones("a", []string{"zone"})
+	_, err := t.store.MoveClientToRoom("a", "event", nil)
+	t.Require().NoError(err)
+
+	t.Require().Equal(1.0, view.Position.Latitude, "Earlier views do not change")
+	t.Require().Empty(view.Position.ClosestClientID)
+	t.Require().Nil(view.WindowSettings)
+	t.Require().Empty(view.Zones)
+	t.Require().Equal(models.GlobalRoom, view.Room)
+
+	fresh, _ := t.store.GetClient("a")
+	t.Require().Equal(10.0, fresh.Position.Latitude)
+	t.Require().Equal("b", fresh.Position.ClosestClientID)
+	t.Require().NotNil(fresh.WindowSettings)
+	t.Require().Equal([]string{"zone"}, fresh.Zones)
+	t.Require().Equal("event", fresh.Room)
+}
+
+// TestConcurrentReads tests that reads running alongside writes see every client either before or after a write
+func (t *ConformanceSuite) TestConcurrentReads() {
+	for _, id := range []string{"a", "b", "c"} {
+		t.addAt(id, 0, 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for step := 1; step <= 200; step++ {
+			// Every write keeps the latitude equal to the longitude
+			id := []string{"a", "b", "c"}[step%3]
+			t.moveTo(id, float64(step%80), float64(step%80))
+			nearest, _ := t.store.FindNearestClient(id)
+			if nearest != nil {
+				client, _ := t.store.GetClient(id)
+				t.setNearest(client, nearest)
+			}
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		for _, client := range t.store.GetAllClients() {
+			_, err := json.Marshal(client)
+			t.Require().NoError(err)
+			t.Require().Equal(client.Position.Latitude, client.Position.Longitude, "Positions are never seen half-updated")
+		}
+	}
+}
+
+// addAt registers a client, positions it and returns its view
+func (t *ConformanceSuite) addAt(id string, latitude, longitude float64) *models.ClientInfo {
+	t.store.AddClient(&models.ClientInfo{ID: id, Connection: &websocket.Conn{}})
+	t.moveTo(id, latitude, longitude)
+	client, _ := t.store.GetClient(id)
+	return client
+}
+
+// moveTo replaces the position of a client
+func (t *ConformanceSuite) moveTo(id string, latitude, longitude float64) {
+	position := &models.Position{Latitude: latitude, Longitude: longitude}
+	if client, ok := t.store.GetClient(id); ok && client.Position != nil {
+		position.ClosestClientID = client.Position.ClosestClientID
+		position.Distance = client.Position.Distance
+	}
+	position.UpdateXYZ()
+	t.store.UpdateClientPosition(id, position)
+}
+
+// setNearest records nearest as the nearest client of client
+func (t *ConformanceSuite) setNearest(client, nearest *models.ClientInfo) {
+	client, _ = t.store.GetClient(client.ID)
+	position := *client.Position
+	position.ClosestClientID = nearest.ID
+	position.Distance = position.GeodesicDistanceTo(nearest.Position)
+	t.store.UpdateNearestReference(client.ID, client.Position.ClosestClientID, &position)
+}
+
+func ids(clients []*models.ClientInfo) []string {
+	result := make([]string, 0, len(clients))
+	for _, client := range clients {
+		result = append(result, client.ID)
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// ClientRegistry - Реестр подключенных клиентов, их комнат и блокировок.
+//
+// Клиенты, которые возвращает хранилище, - неизменяемые снимки их состояния на момент чтения: их нельзя менять,
+// а следующие изменения клиента в них не попадают. Клиент меняется только методами хранилища, после чего его
+// нужно прочитать заново. Вложенные объекты (позиция, настройки) хранилище тоже не меняет на месте, а заменяет.
+//
+// Методы записи возвращают ошибку, если хранилище не смогло сохранить изменение (например, Redis недоступен).
+// Изменение отсутствующего клиента ошибкой не считается и ничего не делает.
+type ClientRegistry interface {
+	// AddClient - Регистрирует копию клиента в его комнате (глобальной, если комната не задана)
+	AddClient(client *models.ClientInfo) error
+	// RemoveClient - Удаляет клиента. Ссылки на него сохраняются до DeleteClientFromNearestReferences.
+	RemoveClient(id string) error
+	GetClient(id string) (*models.ClientInfo, bool)
+	GetClientIDByConnection(connection *websocket.Conn) (string, bool)
+	// AttachConnection - Привязывает к клиенту новое соединение (nil - клиент отключен, но его состояние сохраняется)
+	AttachConnection(id string, connection *websocket.Conn) bool
+	GetAllClients() []*models.ClientInfo
+	UpdateClientWindowSettings(id string, settings *models.WindowSettings) error
+	// UpdateClientZones, UpdateClientPrivacy, UpdateClientPreferences - Заменяют зоны клиента и его собственные настройки
+	UpdateClientZones(id string, zones []string) error
+	UpdateClientPrivacy(id string, settings *models.PrivacySettings) error
+	UpdateClientPreferences(id string, preferences *models.PairingPreferences) error
+
+	// MoveClientToRoom - Переносит клиента в комнату, создавая ее с параметрами options, если ее еще нет
+	MoveClientToRoom(clientID string, name string, options *models.RoomOptions) (*models.RoomInfo, error)
+	GetRoom(name string) (*models.RoomInfo, bool)
+	GetRoomClients(name string) []*models.ClientInfo
+
+	// Block, Unblock, IsBlocked - Блокировки между идентичностями клиентов, IsBlocked симметрична
+	Block(blocker, blocked string) error
+	Unblock(blocker, blocked string) error
+	IsBlocked(a, b string) bool
+	// Blocks - Все блокировки: идентичность -> заблокированные ею идентичности
+	Blocks() map[string][]string
+}
+
+// SpatialIndex - Пространственный индекс позиций клиентов внутри комнат
+type SpatialIndex interface {
+	// UpdateClientPosition - Заменяет позицию клиента и переиндексирует его (nil убирает клиента из индекса)
+	UpdateClientPosition(id string, position *models.Position) error
+	// FindNearestClient - Находит геодезически ближайшего клиента той же комнаты, удовлетворяющего всем фильтрам.
+	// Клиенты, идентичности которых заблокировали друг друга, не подбираются.
+	FindNearestClient(clientID string, filters ...CandidateFilter) (*models.ClientInfo, error)
+	// FindReverseNearest - Находит клиентов, для которых clientID может оказаться ближе их текущего ближайшего
+	FindReverseNearest(clientID string) []*models.ClientInfo
+}
+
+// NearestReferenceGraph - Обратный граф ссылок: кто считает клиента своим ближайшим
+type NearestReferenceGraph interface {
+	// UpdateNearestReference - Записывает позицию клиента с новым ближайшим и переносит ссылку клиента с прежнего
+	// ближайшего на position.ClosestClientID (nil позиция или пустой ID - нет ближайшего)
+	UpdateNearestReference(clientID, oldNearestID string, position *models.Position) error
+	WhoReferenceMeAsNearest(id string) []string
+	HeDoesNotReferenceMeAsNearestAnymore(me, him string) error
+	// DeleteClientFromNearestReferences - Окончательно удаляет клиента из графа после его удаления из реестра
+	DeleteClientFromNearestReferences(id string) error
+}
+
+// ClientStore - Хранилище клиентов, которое используют юзкейсы
+type ClientStore interface {
+	ClientRegistry
+	SpatialIndex
+	NearestReferenceGraph
+
+	// LoadClients - Разом добавляет комнаты и клиентов вместе с позициями и ближайшими, например из снимка состояния
+	LoadClients(rooms []*models.RoomInfo, clients []*models.ClientInfo) error
+}
+
+var (
+	_ ClientStore = (*ClientRepository)(nil)
+	_ ClientStore = (*RedisClientRepository)(nil)
+)
+
+// redisConnectTimeout - Сколько ждать ответа Redis при создании хранилища
+const redisConnectTimeout = 5 * time.Second
+
+// New - Создает хранилище выбранного в конфигурации бэкенда
+func New(cfg config.Storage) (ClientStore, error) {
+	switch cfg.Backend {
+	case config.StorageMemory, "":
+		return NewClientRepository(), nil
+	case config.StorageSharded:
+		return NewShardedClientRepository(cfg.ShardDivisions), nil
+	case config.StorageCells:
+		return NewCellClientRepository(cfg.CellLevel), nil
+	case config.StorageRedis:
+		rdb := redis.NewClient(&redis.Options{Addr: cfg.Redis.Address, Password: cfg.Redis.Password, DB: cfg.Redis.DB})
+		ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+		defer cancel()
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			rdb.Close()
+			return nil, err
+		}
+		return NewRedisClientRepository(rdb, cfg.Redis.Prefix), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", util.ErrUnknownStorageBackend, cfg.Backend)
+	}
+}
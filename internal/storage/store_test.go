@@ -0,0 +1,59 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/storage/storagetest"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// backends lists every storage backend that must pass the conformance suite
+var backends = []string{
+	config.StorageMemory,
+	config.StorageSharded,
+	config.StorageCells,
+}
+
+// TestConformance runs the conformance suite against every backend
+func TestConformance(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			storagetest.Run(t, func() storage.ClientStore {
+				store, err := storage.New(config.Storage{Backend: backend, ShardDivisions: 4, CellLevel: 12})
+				require.NoError(t, err)
+				return store
+			})
+		})
+	}
+}
+
+// TestRedisConformance runs the conformance suite against the redis backend on an in-process Redis
+func TestRedisConformance(t *testing.T) {
+	storagetest.Run(t, func() storage.ClientStore {
+		server := miniredis.RunT(t)
+		store, err := storage.New(config.Storage{Backend: config.StorageRedis, Redis: config.Redis{Address: server.Addr(), Prefix: "sphere:"}})
+		require.NoError(t, err)
+		return store
+	})
+}
+
+// TestRedisUnreachable tests that the redis backend fails fast when Redis is down
+func TestRedisUnreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	address := server.Addr()
+	server.Close()
+
+	_, err := storage.New(config.Storage{Backend: config.StorageRedis, Redis: config.Redis{Address: address}})
+	require.Error(t, err)
+}
+
+// TestUnknownBackend tests that an unknown backend is rejected
+func TestUnknownBackend(t *testing.T) {
+	_, err := storage.New(config.Storage{Backend: "floppy"})
+	require.ErrorIs(t, err, util.ErrUnknownStorageBackend)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/gorilla/websocket"
+)
+
+func (api *GeolocationWebsocketAPI) HandleBlockClient(conn *websocket.Conn, data json.RawMessage) {
+	api.handleBlock(conn, data, "BlockClientResponse", api.geoUsecase.BlockClient)
+}
+
+func (api *GeolocationWebsocketAPI) HandleUnblockClient(conn *websocket.Conn, data json.RawMessage) {
+	api.handleBlock(conn, data, "UnblockClientResponse", api.geoUsecase.UnblockClient)
+}
+
+func (api *GeolocationWebsocketAPI) handleBlock(conn *websocket.Conn, data json.RawMessage, responseType string, apply func(clientID, targetID string) ([]string, error)) {
+	var request models.BlockClientRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	notify, err := apply(clientID, request.ClientID)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[map[string]interface{}]{
+		Type:     responseType,
+		Response: &util.OK,
+	})
+	api.NotifyAboutChangedNearestClient(notify)
+}
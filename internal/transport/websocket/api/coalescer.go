@@ -0,0 +1,59 @@
+package api
+
+import (
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/models"
+)
+
+// positionCoalescer - Схлопывает серии обновлений позиции одного клиента. Первое обновление применяется сразу,
+// а все пришедшие в течение окна заменяют друг друга и применяются одним пересчетом по окончании окна.
+// Submit вызывается из команд движка, а окончание окна ставится в движок через schedule, поэтому блокировки не нужны.
+type positionCoalescer struct {
+	window   time.Duration
+	apply    func(clientID string, fix *models.Position)
+	schedule func(command func()) bool
+
+	// pending - Открытые окна клиентов и последнее отложенное обновление в каждом (nil - отложенных нет)
+	pending map[string]*models.Position
+}
+
+func newPositionCoalescer(window time.Duration, apply func(clientID string, fix *models.Position), schedule func(command func()) bool) *positionCoalescer {
+	return &positionCoalescer{
+		window:   window,
+		apply:    apply,
+		schedule: schedule,
+		pending:  make(map[string]*models.Position),
+	}
+}
+
+func (c *positionCoalescer) Submit(clientID string, fix *models.Position) {
+	if _, open := c.pending[clientID]; open {
+		// Окно уже открыто, запоминаем только последнее обновление
+		c.pending[clientID] = fix
+		return
+	}
+	c.pending[clientID] = nil
+
+	c.apply(clientID, fix)
+	c.closeWindowLater(clientID)
+}
+
+func (c *positionCoalescer) flush(clientID string) {
+	fix := c.pending[clientID]
+	if fix == nil {
+		// За окно обновлений не было, закрываем его
+		delete(c.pending, clientID)
+		return
+	}
+	c.pending[clientID] = nil
+
+	c.apply(clientID, fix)
+	c.closeWindowLater(clientID)
+}
+
+func (c *positionCoalescer) closeWindowLater(clientID string) {
+	time.AfterFunc(c.window, func() {
+		c.schedule(func() { c.flush(clientID) })
+	})
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"time"
 
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/engine"
 	"github.com/appxpy/sphere-api/internal/logging"
 	"github.com/appxpy/sphere-api/internal/models"
 	"github.com/appxpy/sphere-api/internal/usecases"
@@ -13,10 +16,19 @@ import (
 type GeolocationWebsocketAPI struct {
 	usersUsecase *usecases.UsersUsecase
 	geoUsecase   *usecases.GeolocationUsecase
+
+	// coalescer - Схлопывание серий обновлений позиции, nil если выключено
+	coalescer *positionCoalescer
+	// zonesAdminToken - Токен для управления зонами, пустой если управление выключено
+	zonesAdminToken string
 }
 
-func NewGeolocationWebsocketAPI(geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase) *GeolocationWebsocketAPI {
-	return &GeolocationWebsocketAPI{geoUsecase: geoUsecase, usersUsecase: usersUsecase}
+func NewGeolocationWebsocketAPI(cfg *config.Config, engine *engine.Engine, geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase) *GeolocationWebsocketAPI {
+	api := &GeolocationWebsocketAPI{geoUsecase: geoUsecase, usersUsecase: usersUsecase, zonesAdminToken: cfg.Zones.AdminToken}
+	if cfg.Geolocation.CoalesceWindow > 0 {
+		api.coalescer = newPositionCoalescer(cfg.Geolocation.CoalesceWindow, api.applyPositionUpdate, engine.Submit)
+	}
+	return api
 }
 
 func (api *GeolocationWebsocketAPI) HandleUpdatePosition(conn *websocket.Conn, data json.RawMessage) {
@@ -26,33 +38,131 @@ func (api *GeolocationWebsocketAPI) HandleUpdatePosition(conn *websocket.Conn, d
 		return
 	}
 
-	clientID, err := api.usersUsecase.GetClientIDByConnection(conn) // Implement this function to retrieve the client ID
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
 	if err != nil {
 		conn.WriteJSON(util.ErrorToInterface(err))
+		return
 	}
 
 	position := &models.Position{
 		Latitude:  request.Latitude,
 		Longitude: request.Longitude,
+		Accuracy:  request.Accuracy,
+		Source:    request.Source,
+	}
+
+	if request.Timestamp != 0 {
+		position.Timestamp = time.UnixMilli(request.Timestamp)
+	}
+
+	// Скорость без курса имеет смысл только для неподвижного клиента
+	if request.Speed != nil && (request.Course != nil || *request.Speed == 0) {
+		position.Velocity = &models.Velocity{Speed: *request.Speed}
+		if request.Course != nil {
+			position.Velocity.Course = *request.Course
+		}
+	}
+
+	if api.coalescer != nil {
+		api.coalescer.Submit(clientID, position)
+		return
+	}
+
+	api.applyPositionUpdate(clientID, position)
+}
+
+func (api *GeolocationWebsocketAPI) applyPositionUpdate(clientID string, position *models.Position) {
+	zonesBefore := api.geoUsecase.ClientZones(clientID)
+
+	notify, err := api.geoUsecase.UpdatePosition(clientID, position)
+	if err != nil {
+		if client, errInner := api.usersUsecase.GetClientInfo(clientID); errInner == nil {
+			client.Connection.WriteJSON(util.ErrorToInterface(err))
+		}
+		return
 	}
 
-	notify := api.geoUsecase.UpdatePosition(clientID, position.Latitude, position.Longitude)
 	logging.InfoLogger.Printf("Client %s updated position to %f, %f, notifying %v", clientID, position.Latitude, position.Longitude, notify)
+	api.NotifyAboutZoneTransitions(usecases.ZoneTransitions(clientID, zonesBefore, api.geoUsecase.ClientZones(clientID)))
+	api.NotifyAboutChangedNearestClient(notify)
+}
+
+func (api *GeolocationWebsocketAPI) HandleSetPreferences(conn *websocket.Conn, data json.RawMessage) {
+	var request models.SetPreferencesRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	notify, err := api.geoUsecase.SetPreferences(clientID, &models.PairingPreferences{
+		MinDistance: request.MinDistance,
+		MaxDistance: request.MaxDistance,
+		Path:        request.Path,
+	})
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[map[string]interface{}]{
+		Type:     "SetPreferencesResponse",
+		Response: &util.OK,
+	})
 	api.NotifyAboutChangedNearestClient(notify)
 }
 
+func (api *GeolocationWebsocketAPI) HandleGetPairPath(conn *websocket.Conn, data json.RawMessage) {
+	var request models.GetPairPathRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	nearestID, path, err := api.geoUsecase.GetPairPath(clientID, &request.PathOptions)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[models.GetPairPathResponse]{
+		Type:     "GetPairPathResponse",
+		Response: &models.GetPairPathResponse{ClientID: nearestID, PairPath: path},
+	})
+}
+
 func (api *GeolocationWebsocketAPI) NotifyAboutChangedNearestClient(notify []string) {
 	// Notify clients that their target position changed
 	for _, recieverID := range notify {
+		// Восстановленные из снимка клиенты без соединения получат свое состояние при переподключении
 		reciever, err := api.usersUsecase.GetClientInfo(recieverID)
-		if err != nil {
+		if err != nil || reciever.Connection == nil || !reciever.HasPosition() {
+			continue
+		}
+
+		if reciever.Position.ClosestClientID == "" {
+			minimum, maximum := api.geoUsecase.DistanceBand(reciever)
+			reciever.Connection.WriteJSON(&models.Response[models.NoEligibleNearestResponse]{
+				Type:     "NoEligibleNearestResponse",
+				Response: &models.NoEligibleNearestResponse{MinDistance: minimum, MaxDistance: maximum},
+			})
 			continue
 		}
 
-		response := &models.GetNearestClientResponse{
-			ID:       reciever.Position.ClosestClientID,
-			Azimuth:  reciever.Position.Azimuth,
-			Distance: reciever.Position.Distance,
+		response := api.geoUsecase.NearestResponse(reciever)
+		if response == nil {
+			continue
 		}
 
 		logging.InfoLogger.Printf("Sending new target position to client %s", recieverID)
@@ -62,3 +172,38 @@ func (api *GeolocationWebsocketAPI) NotifyAboutChangedNearestClient(notify []str
 		})
 	}
 }
+
+// PushInterpolatedNearest - Отправляет клиентам интерполированные азимут и расстояние до движущихся ближайших
+func (api *GeolocationWebsocketAPI) PushInterpolatedNearest() {
+	for recieverID, response := range api.geoUsecase.InterpolateNearest(time.Now()) {
+		reciever, err := api.usersUsecase.GetClientInfo(recieverID)
+		if err != nil || reciever.Connection == nil {
+			continue
+		}
+
+		reciever.Connection.WriteJSON(&models.Response[models.GetNearestClientResponse]{
+			Type:     "GetNearestClientResponse",
+			Response: response,
+		})
+	}
+}
+
+// ExpireStalePositions - Убирает устаревшие позиции из индекса, сообщает их владельцам и уведомляет затронутых клиентов
+func (api *GeolocationWebsocketAPI) ExpireStalePositions() {
+	expired, transitions, notify := api.geoUsecase.ExpireStalePositions(time.Now())
+
+	for clientID, lastUpdate := range expired {
+		client, err := api.usersUsecase.GetClientInfo(clientID)
+		if err != nil || client.Connection == nil {
+			continue
+		}
+
+		client.Connection.WriteJSON(&models.Response[models.PositionStaleResponse]{
+			Type:     "PositionStaleResponse",
+			Response: &models.PositionStaleResponse{LastUpdate: lastUpdate.UnixMilli()},
+		})
+	}
+
+	api.NotifyAboutZoneTransitions(transitions)
+	api.NotifyAboutChangedNearestClient(notify)
+}
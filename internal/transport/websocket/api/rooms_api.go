@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/gorilla/websocket"
+)
+
+func (api *GeolocationWebsocketAPI) HandleJoinRoom(conn *websocket.Conn, data json.RawMessage) {
+	var request models.JoinRoomRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	room, notify, err := api.geoUsecase.JoinRoom(clientID, request.Room, &models.RoomOptions{
+		Limit:    request.Limit,
+		Metadata: request.Metadata,
+		Pairing:  request.Pairing,
+	})
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[models.JoinRoomResponse]{
+		Type:     "JoinRoomResponse",
+		Response: &models.JoinRoomResponse{Room: room},
+	})
+	api.NotifyAboutChangedNearestClient(notify)
+}
+
+func (api *GeolocationWebsocketAPI) HandleLeaveRoom(conn *websocket.Conn, data json.RawMessage) {
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	room, notify, err := api.geoUsecase.LeaveRoom(clientID)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[models.JoinRoomResponse]{
+		Type:     "LeaveRoomResponse",
+		Response: &models.JoinRoomResponse{Room: room},
+	})
+	api.NotifyAboutChangedNearestClient(notify)
+}
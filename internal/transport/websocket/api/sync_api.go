@@ -10,9 +10,17 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Forwarder - Пересылает сообщение клиенту, подключенному к другому узлу кластера
+type Forwarder interface {
+	Forward(from, clientID string, message any) bool
+}
+
 type SyncWebsocketAPI struct {
 	usersUsecase *usecases.UsersUsecase
 	geoUsecase   *usecases.GeolocationUsecase
+
+	// forwarder - Пересылка клиентам других узлов, nil вне кластера
+	forwarder Forwarder
 }
 
 func NewSyncWebsocketAPI(usersUsecase *usecases.UsersUsecase, geoUsecase *usecases.GeolocationUsecase) *SyncWebsocketAPI {
@@ -22,6 +30,11 @@ func NewSyncWebsocketAPI(usersUsecase *usecases.UsersUsecase, geoUsecase *usecas
 	}
 }
 
+// SetForwarder - Включает пересылку сообщений клиентам других узлов кластера
+func (api *SyncWebsocketAPI) SetForwarder(forwarder Forwarder) {
+	api.forwarder = forwarder
+}
+
 func (api *SyncWebsocketAPI) HandleSyncStateMessage(conn *websocket.Conn, data json.RawMessage) {
 	// Parse SyncStateMessage
 	var message models.SyncStateMessage
@@ -37,6 +50,12 @@ func (api *SyncWebsocketAPI) HandleSyncStateMessage(conn *websocket.Conn, data j
 		return
 	}
 
+	sender, err := api.usersUsecase.GetClientInfo(senderID)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
 	// Prepare SyncStateMessage to be sent
 	response := &models.Response[models.SyncStateMessage]{
 		Type:     "SyncStateResponse",
@@ -47,10 +66,19 @@ func (api *SyncWebsocketAPI) HandleSyncStateMessage(conn *websocket.Conn, data j
 	clientsReferencingSender := api.geoUsecase.GetClientsWhoReferenceClientAsNearest(senderID)
 	for _, clientID := range clientsReferencingSender {
 		client, err := api.usersUsecase.GetClientInfo(clientID)
-		if err == nil && client.Connection != nil {
-			if err := client.Connection.WriteJSON(response); err != nil {
-				logging.ErrorLogger.Printf("Error sending SyncStateResponse to client %s: %v", client.ID, err)
+		if err != nil || api.usersUsecase.IsBlocked(sender, client) {
+			continue
+		}
+
+		if client.Connection == nil {
+			// Клиент подключен к другому узлу кластера (или восстановлен из снимка и еще не переподключился)
+			if api.forwarder != nil {
+				api.forwarder.Forward(senderID, client.ID, response)
 			}
+			continue
+		}
+		if err := client.Connection.WriteJSON(response); err != nil {
+			logging.ErrorLogger.Printf("Error sending SyncStateResponse to client %s: %v", client.ID, err)
 		}
 	}
 }
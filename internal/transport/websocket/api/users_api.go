@@ -40,7 +40,13 @@ func (api *UsersWebsocketAPI) HandleWhoAmI(conn *websocket.Conn, data json.RawMe
 }
 
 func (api *UsersWebsocketAPI) HandleGetClients(conn *websocket.Conn, data json.RawMessage) {
-	clients := api.usersUsecase.GetClients()
+	viewerID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clients := api.usersUsecase.GetExposedClients(viewerID)
 
 	response, err := json.Marshal(&models.Response[models.GetClientsResponse]{
 		Type:     "GetClientsResponse",
@@ -64,13 +70,19 @@ func (api *UsersWebsocketAPI) HandleGetClientInfo(conn *websocket.Conn, data jso
 		return
 	}
 
-	clientInfo, err := api.usersUsecase.GetClientInfo(request.ClientID)
+	viewerID, err := api.usersUsecase.GetClientIDByConnection(conn)
 	if err != nil {
 		conn.WriteJSON(util.ErrorToInterface(err))
 		return
 	}
 
-	response, err := json.Marshal(&models.Response[models.ClientInfo]{
+	clientInfo, err := api.usersUsecase.GetExposedClientInfo(viewerID, request.ClientID)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	response, err := json.Marshal(&models.Response[models.PublicClientInfo]{
 		Type:     "GetClientInfoResponse",
 		Response: clientInfo,
 	})
@@ -84,3 +96,32 @@ func (api *UsersWebsocketAPI) HandleGetClientInfo(conn *websocket.Conn, data jso
 		conn.WriteJSON(util.ErrorToInterface(err))
 	}
 }
+
+func (api *UsersWebsocketAPI) HandleSetPrivacy(conn *websocket.Conn, data json.RawMessage) {
+	var request models.SetPrivacyRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	clientID, err := api.usersUsecase.GetClientIDByConnection(conn)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	settings := &models.PrivacySettings{
+		Coordinates:   request.Coordinates,
+		ExposeNearest: request.ExposeNearest,
+	}
+
+	if err := api.usersUsecase.SetPrivacy(clientID, settings); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[map[string]interface{}]{
+		Type:     "SetPrivacyResponse",
+		Response: &util.OK,
+	})
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
+	"github.com/gorilla/websocket"
+)
+
+func (api *GeolocationWebsocketAPI) HandleGetZones(conn *websocket.Conn, data json.RawMessage) {
+	list := api.geoUsecase.GetZones()
+
+	response := &models.GetZonesResponse{Zones: make([]*models.ZoneInfo, 0, len(list))}
+	for _, zone := range list {
+		response.Zones = append(response.Zones, &models.ZoneInfo{ID: zone.ID, Name: zone.Name, Rule: string(zone.Rule)})
+	}
+
+	conn.WriteJSON(&models.Response[models.GetZonesResponse]{
+		Type:     "GetZonesResponse",
+		Response: response,
+	})
+}
+
+func (api *GeolocationWebsocketAPI) HandleAddZone(conn *websocket.Conn, data json.RawMessage) {
+	var request models.AddZoneRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	if !api.canManageZones(request.Token) {
+		conn.WriteJSON(util.ErrorToInterface(util.ErrZonesManagement))
+		return
+	}
+
+	parsed, err := zones.Parse(request.GeoJSON)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	transitions, notify := api.geoUsecase.AddZones(parsed)
+	conn.WriteJSON(&models.Response[map[string]interface{}]{
+		Type:     "AddZoneResponse",
+		Response: &util.OK,
+	})
+
+	api.NotifyAboutZoneTransitions(transitions)
+	api.NotifyAboutChangedNearestClient(notify)
+}
+
+func (api *GeolocationWebsocketAPI) HandleRemoveZone(conn *websocket.Conn, data json.RawMessage) {
+	var request models.RemoveZoneRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	if !api.canManageZones(request.Token) {
+		conn.WriteJSON(util.ErrorToInterface(util.ErrZonesManagement))
+		return
+	}
+
+	transitions, notify, err := api.geoUsecase.RemoveZone(request.ZoneID)
+	if err != nil {
+		conn.WriteJSON(util.ErrorToInterface(err))
+		return
+	}
+
+	conn.WriteJSON(&models.Response[map[string]interface{}]{
+		Type:     "RemoveZoneResponse",
+		Response: &util.OK,
+	})
+
+	api.NotifyAboutZoneTransitions(transitions)
+	api.NotifyAboutChangedNearestClient(notify)
+}
+
+// NotifyAboutZoneTransitions - Отправляет клиентам события EnteredZone и LeftZone
+func (api *GeolocationWebsocketAPI) NotifyAboutZoneTransitions(transitions []*models.ZoneTransition) {
+	for _, transition := range transitions {
+		reciever, err := api.usersUsecase.GetClientInfo(transition.ClientID)
+		if err != nil || reciever.Connection == nil {
+			continue
+		}
+
+		eventType := "LeftZone"
+		if transition.Entered {
+			eventType = "EnteredZone"
+		}
+
+		reciever.Connection.WriteJSON(&models.Response[models.ZoneEventResponse]{
+			Type:     eventType,
+			Response: &models.ZoneEventResponse{ZoneID: transition.ZoneID},
+		})
+	}
+}
+
+func (api *GeolocationWebsocketAPI) canManageZones(token string) bool {
+	return api.zonesAdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.zonesAdminToken)) == 1
+}
@@ -0,0 +1,137 @@
+package websocket_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/cluster"
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/storage"
+	transport "github.com/appxpy/sphere-api/internal/transport/websocket"
+	"github.com/appxpy/sphere-api/internal/usecases"
+)
+
+// ClusterTestSuite runs two handlers joined over the in-memory transport, with clients connected to different nodes
+type ClusterTestSuite struct {
+	suite.Suite
+	network  *cluster.MemoryNetwork
+	handlers []*transport.Handler
+	servers  []*httptest.Server
+}
+
+// SetupTest starts two nodes
+func (t *ClusterTestSuite) SetupTest() {
+	t.network = cluster.NewMemoryNetwork()
+	t.handlers, t.servers = nil, nil
+	for _, id := range []string{"a", "b"} {
+		t.start(id)
+	}
+}
+
+// TearDownTest stops the servers and the handlers that are still running
+func (t *ClusterTestSuite) TearDownTest() {
+	for _, server := range t.servers {
+		server.Close()
+	}
+	for _, handler := range t.handlers {
+		if handler != nil {
+			handler.Stop()
+		}
+	}
+}
+
+// TestPairing tests that clients of different nodes pair with each other and exchange their state
+func (t *ClusterTestSuite) TestPairing() {
+	alice, _ := t.dial(0)
+	bob, bobID := t.dial(1)
+	defer alice.Close()
+	defer bob.Close()
+
+	t.send(alice, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.75, "longitude": 37.61}}`)
+	t.network.Settle()
+	t.send(bob, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.7501, "longitude": 37.6101}}`)
+
+	t.Require().Equal(bobID, t.await(alice, "GetNearestClientResponse")["id"], "The node of alice pushes her new nearest")
+	t.await(bob, "GetNearestClientResponse")
+
+	t.send(bob, `{"type": "SyncStateMessage", "data": {"transitionProgress": 0.5, "stateVersion": 3}}`)
+	state := t.await(alice, "SyncStateResponse")
+	t.Require().EqualValues(3, state["stateVersion"], "The state is forwarded to the node of alice")
+
+	bob.Close()
+	t.await(alice, "NoEligibleNearestResponse")
+}
+
+// TestNodeStops tests that clients lose their nearest when the node of that nearest stops
+func (t *ClusterTestSuite) TestNodeStops() {
+	alice, _ := t.dial(0)
+	bob, _ := t.dial(1)
+	defer alice.Close()
+	defer bob.Close()
+
+	t.send(alice, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.75, "longitude": 37.61}}`)
+	t.network.Settle()
+	t.send(bob, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.7501, "longitude": 37.6101}}`)
+	t.await(alice, "GetNearestClientResponse")
+
+	t.servers[1].Close()
+	t.handlers[1].Stop()
+	t.handlers[1] = nil
+
+	t.await(alice, "NoEligibleNearestResponse")
+}
+
+// start creates a handler on a fresh repository and joins it to the network
+func (t *ClusterTestSuite) start(id string) {
+	cfg := config.Default()
+	repo := storage.NewClientRepository()
+	handler := transport.NewHandler(cfg, usecases.NewGeolocationUsecase(repo, cfg.Geolocation), usecases.NewUsersUsecase(repo, cfg.Privacy))
+	t.Require().NoError(handler.JoinCluster(id, t.network.Join(id)))
+	handler.Start()
+
+	t.handlers = append(t.handlers, handler)
+	t.servers = append(t.servers, httptest.NewServer(http.HandlerFunc(handler.HandleWS)))
+}
+
+// dial connects a client to the node with the given index, waits until the other nodes know it and returns its ID
+func (t *ClusterTestSuite) dial(node int) (*websocket.Conn, any) {
+	url := "ws" + strings.TrimPrefix(t.servers[node].URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	t.Require().NoError(err)
+
+	t.send(conn, `{"type": "WhoAmIRequest", "data": {}}`)
+	id := t.await(conn, "WhoAmIResponse")["client_id"]
+	t.network.Settle()
+	return conn, id
+}
+
+// send writes a raw message
+func (t *ClusterTestSuite) send(conn *websocket.Conn, message string) {
+	t.Require().NoError(conn.WriteMessage(websocket.TextMessage, []byte(message)))
+}
+
+// await reads messages until one of the given type arrives and returns its data
+func (t *ClusterTestSuite) await(conn *websocket.Conn, messageType string) map[string]any {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		}
+		t.Require().NoError(conn.ReadJSON(&message), "Waiting for %s", messageType)
+		if message.Type == messageType {
+			return message.Data
+		}
+	}
+}
+
+// TestClusterTestSuite runs the test suite
+func TestClusterTestSuite(t *testing.T) {
+	suite.Run(t, new(ClusterTestSuite))
+}
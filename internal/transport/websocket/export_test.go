@@ -0,0 +1,9 @@
+package websocket
+
+import "net"
+
+// Экспорт очереди отправки для тестов во внешнем тестовом пакете
+var (
+	NewQueuedConn = func(conn net.Conn) net.Conn { return newQueuedConn(conn) }
+	SendQueueSize = sendQueueSize
+)
@@ -1,35 +1,72 @@
 package websocket
 
 import (
+	"errors"
+	"io/fs"
 	"math/rand"
+	"net"
 	"net/http"
+	"slices"
 	"time"
 
+	"github.com/appxpy/sphere-api/internal/cluster"
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/engine"
+	"github.com/appxpy/sphere-api/internal/identity"
+	"github.com/appxpy/sphere-api/internal/journal"
 	"github.com/appxpy/sphere-api/internal/logging"
 	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/replay"
+	"github.com/appxpy/sphere-api/internal/snapshot"
 	"github.com/appxpy/sphere-api/internal/transport/websocket/api"
 	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// removeRetryDelay - Наименьшая задержка повторного удаления клиента, которого не удалось удалить из хранилища
+const removeRetryDelay = time.Second
+
 type Handler struct {
 	geoUsecase   *usecases.GeolocationUsecase
 	usersUsecase *usecases.UsersUsecase
 	upgrader     websocket.Upgrader
 
+	// engine - Единственный владелец гео-состояния, все обращения к юзкейсам выполняются его командами
+	engine *engine.Engine
+	done   chan struct{}
+
 	geolocationAPI *api.GeolocationWebsocketAPI
+	syncAPI        *api.SyncWebsocketAPI
+	// identities - Выдает и проверяет токены идентичности клиентов
+	identities *identity.Issuer
 
 	state        int
 	router       *Router
 	pingInterval time.Duration
 	pingTimeout  time.Duration
+
+	deadReckoningInterval time.Duration
+	staleSweepInterval    time.Duration
+
+	snapshots config.Snapshot
+	// journal - Журнал операций, открывается после повтора при старте (nil - журнал выключен)
+	journalCfg config.Journal
+	journal    *journal.Writer
+	// cluster - Узел кластера, nil - сервер работает один
+	clusterCfg config.Cluster
+	cluster    *cluster.Node
 }
 
-func NewHandler(geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase) *Handler {
+func NewHandler(cfg *config.Config, geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.UsersUsecase) *Handler {
+	eng := engine.New()
 	handler := &Handler{
 		geoUsecase:   geoUsecase,
 		usersUsecase: usersUsecase,
+		engine:       eng,
+		done:         make(chan struct{}),
 		state:        0,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
@@ -38,31 +75,61 @@ func NewHandler(geoUsecase *usecases.GeolocationUsecase, usersUsecase *usecases.
 				return true
 			},
 		},
-		geolocationAPI: api.NewGeolocationWebsocketAPI(geoUsecase, usersUsecase),
+		geolocationAPI: api.NewGeolocationWebsocketAPI(cfg, eng, geoUsecase, usersUsecase),
+		identities:     identity.NewIssuer(cfg.Identity.Secret),
 		router:         NewRouter(),
 		pingInterval:   10 * time.Second,
 		pingTimeout:    5 * time.Second,
+
+		deadReckoningInterval: cfg.Geolocation.DeadReckoning.Interval,
+		snapshots:             cfg.Snapshot,
+		journalCfg:            cfg.Journal,
+		clusterCfg:            cfg.Cluster,
+	}
+
+	if cfg.Geolocation.PositionTTL > 0 {
+		handler.staleSweepInterval = cfg.Geolocation.StaleSweepInterval
+	}
+	if handler.clusterCfg.Address == "" {
+		handler.clusterCfg.Address = publicAddress(cfg.Cluster.Node, cfg.Address)
 	}
 
 	users := api.NewUsersWebsocketAPI(usersUsecase)
-	sync := api.NewSyncWebsocketAPI(usersUsecase, geoUsecase)
+	handler.syncAPI = api.NewSyncWebsocketAPI(usersUsecase, geoUsecase)
 
 	// Users API
 	handler.router.Handle("WhoAmIRequest", users.HandleWhoAmI)
 	handler.router.Handle("GetClientsRequest", users.HandleGetClients)
 	handler.router.Handle("GetClientInfoRequest", users.HandleGetClientInfo)
+	handler.router.Handle("SetPrivacyRequest", users.HandleSetPrivacy)
 
 	// Geolocation API
 	handler.router.Handle("UpdatePositionRequest", handler.geolocationAPI.HandleUpdatePosition)
+	handler.router.Handle("SetPreferencesRequest", handler.geolocationAPI.HandleSetPreferences)
+	handler.router.Handle("GetPairPathRequest", handler.geolocationAPI.HandleGetPairPath)
+
+	// Rooms API
+	handler.router.Handle("JoinRoomRequest", handler.geolocationAPI.HandleJoinRoom)
+	handler.router.Handle("LeaveRoomRequest", handler.geolocationAPI.HandleLeaveRoom)
+
+	// Zones API
+	handler.router.Handle("GetZonesRequest", handler.geolocationAPI.HandleGetZones)
+	handler.router.Handle("AddZoneRequest", handler.geolocationAPI.HandleAddZone)
+	handler.router.Handle("RemoveZoneRequest", handler.geolocationAPI.HandleRemoveZone)
+
+	// Blocks API
+	handler.router.Handle("BlockClientRequest", handler.geolocationAPI.HandleBlockClient)
+	handler.router.Handle("UnblockClientRequest", handler.geolocationAPI.HandleUnblockClient)
 
 	// Sync API
-	handler.router.Handle("SyncStateMessage", sync.HandleSyncStateMessage)
+	handler.router.Handle("SyncStateMessage", handler.syncAPI.HandleSyncStateMessage)
 
 	return handler
 }
 
 func (h *Handler) HandleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	// Записи в соединение только ставятся в его очередь отправки, поэтому медленный клиент не задерживает движок
+	conn, err := h.upgrader.Upgrade(queuedResponseWriter{w}, r, nil)
 	if err != nil {
 		logging.ErrorLogger.Printf("Failed to upgrade connection: %v", err)
 		http.Error(w, "Failed to upgrade connection", http.StatusInternalServerError)
@@ -73,8 +140,51 @@ func (h *Handler) HandleWS(w http.ResponseWriter, r *http.Request) {
 	clientID := uuid.New().String()
 	sphereID := rand.Intn(511) + 1
 
-	client := &models.ClientInfo{Connection: conn, ID: clientID, SphereID: sphereID}
-	h.usersUsecase.AddClient(client)
+	// Идентичность сохраняется между сессиями, чтобы блокировки переживали переподключение. Ее выдает сервер:
+	// клиент предъявляет подписанный токен из SessionResponse, а без действительного токена получает новую идентичность
+	clientIdentity, ok := h.identities.Verify(r.URL.Query().Get("identity"))
+	if !ok {
+		clientIdentity, _ = h.identities.Issue()
+	}
+	// Токен, с которым клиент переподключается к узлу кластера, принявшему его сессию
+	handoff := r.URL.Query().Get("handoff")
+	// Токен возобновления из SessionResponse прежней сессии: без него восстановленная сессия не продолжается
+	resumeToken := r.URL.Query().Get("resume")
+
+	client := &models.ClientInfo{
+		Connection:  conn,
+		ID:          clientID,
+		Identity:    clientIdentity,
+		ResumeToken: uuid.New().String(),
+		SphereID:    sphereID,
+	}
+	if !h.engine.Do(func() {
+		// Клиент, восстановленный из снимка или переданный другим узлом, продолжает прежнюю сессию
+		// и сразу получает своего ближайшего
+		restored, resumed := h.resume(clientIdentity, resumeToken, handoff, conn)
+		if resumed {
+			client = restored
+		} else if err = h.usersUsecase.AddClient(client); err != nil {
+			logging.ErrorLogger.Printf("Failed to add client %s: %v", clientID, err)
+			conn.WriteJSON(util.ErrorToInterface(err))
+			return
+		}
+
+		conn.WriteJSON(&models.Response[models.SessionResponse]{
+			Type: "SessionResponse",
+			Response: &models.SessionResponse{
+				ClientID:      client.ID,
+				IdentityToken: h.identities.Sign(client.Identity),
+				ResumeToken:   client.ResumeToken,
+			},
+		})
+		if resumed {
+			h.geolocationAPI.NotifyAboutChangedNearestClient([]string{client.ID})
+		}
+	}) || err != nil {
+		return
+	}
+	clientID = client.ID
 
 	go h.pingClients(client)
 
@@ -85,19 +195,276 @@ func (h *Handler) HandleWS(w http.ResponseWriter, r *http.Request) {
 			h.removeClient(clientID)
 			break
 		}
-		if err := h.router.Route(conn, msg); err != nil {
-			logging.ErrorLogger.Printf("Error routing message: %v\nMessage: %v", err, string(msg))
+
+		// Сообщения одного клиента обрабатываются движком в порядке получения. Остановленный движок
+		// сообщения больше не обрабатывает, и соединение закрывается.
+		var routeErr error
+		if !h.engine.Do(func() { routeErr = h.router.Route(conn, msg) }) {
+			break
+		}
+		if routeErr != nil {
+			logging.ErrorLogger.Printf("Error routing message: %v\nMessage: %v", routeErr, string(msg))
 		}
 	}
 }
 
+// Находит ожидающую переподключения сессию по токену передачи или по идентичности и токену возобновления.
+// Вызывается только из команды движка.
+func (h *Handler) resume(identity, resumeToken, handoff string, conn *websocket.Conn) (*models.ClientInfo, bool) {
+	if h.cluster != nil && handoff != "" {
+		if client, ok := h.cluster.Claim(handoff, conn); ok {
+			return client, true
+		}
+	}
+	return h.usersUsecase.Resume(identity, resumeToken, conn)
+}
+
 func (h *Handler) removeClient(clientID string) {
-	h.usersUsecase.RemoveClient(clientID)
+	h.engine.Do(func() { h.dropClient(clientID) })
+}
+
+// Удаляет клиента и пересчитывает ближайших у ссылавшихся на него. Вызывается только из команды движка.
+func (h *Handler) dropClient(clientID string) {
+	if _, err := h.usersUsecase.GetClientInfo(clientID); err != nil {
+		// Клиент уже удален при предыдущей ошибке соединения
+		return
+	}
+	if h.cluster != nil && h.cluster.Remote(clientID) {
+		// Клиент передан другому узлу, а здесь осталась только его копия
+		return
+	}
+
+	if err := h.usersUsecase.RemoveClient(clientID); err != nil {
+		// Клиент остается в хранилище без соединения и может переподключиться, иначе удаление повторяется
+		logging.ErrorLogger.Printf("Failed to remove client %s: %v", clientID, err)
+		h.usersUsecase.Detach(clientID)
+		h.dropDetachedAfter(max(h.snapshots.Grace, removeRetryDelay), clientID)
+		return
+	}
 	notify := h.geoUsecase.UpdateRelatedClients(clientID)
 	h.geoUsecase.DeleteClientFromNearestReferences(clientID)
 	h.geolocationAPI.NotifyAboutChangedNearestClient(notify)
 }
 
+// Публичный адрес узла: хост его внутреннего адреса node с портом публичного слушателя listen. Если адреса
+// не разбираются как host:port, клиенты переподключаются по node.
+func publicAddress(node, listen string) string {
+	host, _, err := net.SplitHostPort(node)
+	if err != nil {
+		return node
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return node
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// JoinCluster - Включает режим кластера: узел id обменивается операциями клиентов и сообщениями с другими узлами
+// через backplane. Вызывается до Start.
+func (h *Handler) JoinCluster(id string, backplane cluster.Backplane) error {
+	node, err := cluster.New(id, backplane, h.geoUsecase, h.usersUsecase, h.clusterCfg)
+	if err != nil {
+		return err
+	}
+
+	h.cluster = node
+	h.syncAPI.SetForwarder(node)
+	return nil
+}
+
+// Start - Восстанавливает состояние из снимка и журнала, запускает движок, подключается к кластеру
+// и запускает фоновые проходы по клиентам
+func (h *Handler) Start() {
+	h.restoreState()
+
+	go h.engine.Run()
+	if h.cluster != nil {
+		h.cluster.Start(h.engine.Do, h.geolocationAPI.NotifyAboutChangedNearestClient, h.geolocationAPI.NotifyAboutZoneTransitions)
+	}
+	go h.pushInterpolatedPositions()
+	go h.expireStalePositions()
+	go h.takeSnapshots()
+}
+
+// Stop - Останавливает фоновые проходы, сохраняет последний снимок и останавливает движок
+func (h *Handler) Stop() {
+	close(h.done)
+	h.saveSnapshot()
+	if h.cluster != nil {
+		h.cluster.Stop()
+	}
+	h.engine.Stop()
+
+	if h.journal != nil {
+		if err := h.journal.Close(); err != nil {
+			logging.ErrorLogger.Printf("Failed to close journal: %v", err)
+		}
+	}
+}
+
+// Восстанавливает состояние до запуска движка: загружает снимок, повторяет более новые записи журнала
+// и начинает писать журнал. Восстановленные клиенты, не переподключившиеся за время ожидания, удаляются.
+func (h *Handler) restoreState() {
+	h.replayJournal(h.restoreSnapshot())
+	h.attachJournal()
+
+	h.usersUsecase.DetachDisconnected()
+	if detached := h.usersUsecase.DetachedClients(); len(detached) > 0 {
+		h.dropDetachedAfter(h.snapshots.Grace, detached...)
+	}
+}
+
+// Удаляет клиентов clientIDs, которые через delay все еще ожидают переподключения
+func (h *Handler) dropDetachedAfter(delay time.Duration, clientIDs ...string) {
+	time.AfterFunc(delay, func() {
+		h.engine.Submit(func() {
+			for _, clientID := range clientIDs {
+				if h.usersUsecase.IsDetached(clientID) {
+					h.dropClient(clientID)
+				}
+			}
+		})
+	})
+}
+
+// Загружает снимок и возвращает номер последней вошедшей в него записи журнала
+func (h *Handler) restoreSnapshot() uint64 {
+	if h.snapshots.Path == "" {
+		return 0
+	}
+
+	saved, err := snapshot.Load(h.snapshots.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to restore snapshot from %s: %v", h.snapshots.Path, err)
+		return 0
+	}
+
+	if saved.Zones != nil {
+		restored, err := zones.Parse(saved.Zones)
+		if err != nil {
+			logging.ErrorLogger.Printf("Failed to restore zones from snapshot: %v", err)
+		} else {
+			h.geoUsecase.RestoreZones(restored)
+		}
+	}
+	if err := h.usersUsecase.Restore(saved); err != nil {
+		logging.ErrorLogger.Printf("Failed to restore snapshot from %s: %v", h.snapshots.Path, err)
+	}
+	return saved.JournalSeq
+}
+
+// Повторяет записи журнала новее after и открывает журнал для записи. Юзкейсы подключаются к журналу
+// только после повтора, чтобы повторенные операции не записывались второй раз.
+func (h *Handler) replayJournal(after uint64) {
+	if h.journalCfg.Dir == "" {
+		return
+	}
+
+	last, err := replay.New(h.geoUsecase, h.usersUsecase).Dir(h.journalCfg.Dir, after, nil)
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to replay journal from %s: %v", h.journalCfg.Dir, err)
+	} else if last > after {
+		logging.InfoLogger.Printf("Replayed journal entries %d-%d", after+1, last)
+	}
+
+	writer, err := journal.Open(h.journalCfg.Dir, h.journalCfg.SegmentSize, h.journalCfg.Fsync)
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to open journal in %s: %v", h.journalCfg.Dir, err)
+		return
+	}
+	// Журнал мог отстать от снимка, если его каталог очистили: новые записи должны идти после снимка
+	if err := writer.Advance(after); err != nil {
+		logging.ErrorLogger.Printf("Failed to advance journal: %v", err)
+	}
+
+	h.journal = writer
+}
+
+// Подключает юзкейсы к журналу. Узел кластера стоит перед журналом: он пишет в журнал операции своих клиентов
+// и публикует их другим узлам, а операции других узлов не попадают никуда.
+func (h *Handler) attachJournal() {
+	var recorder usecases.Journal
+	if h.journal != nil {
+		recorder = h.journal
+	}
+	if h.cluster != nil {
+		h.cluster.SetJournal(recorder)
+		recorder = h.cluster
+	}
+	if recorder == nil {
+		return
+	}
+
+	h.geoUsecase.SetJournal(recorder)
+	h.usersUsecase.SetJournal(recorder)
+}
+
+// Снимает состояние командой движка и записывает его на диск вне движка
+func (h *Handler) saveSnapshot() {
+	if h.snapshots.Path == "" {
+		return
+	}
+
+	var data []byte
+	var seq uint64
+	var err error
+	if !h.engine.Do(func() {
+		saved := h.usersUsecase.Snapshot(time.Now())
+		if h.cluster != nil {
+			// Клиентов других узлов восстановят их собственные узлы
+			saved.Clients = slices.DeleteFunc(saved.Clients, func(client *snapshot.Client) bool {
+				return h.cluster.Remote(client.ID)
+			})
+		}
+		if h.journal != nil {
+			seq = h.journal.LastSeq()
+			saved.JournalSeq = seq
+		}
+		if saved.Zones, err = zones.Encode(h.geoUsecase.GetZones()); err != nil {
+			return
+		}
+		data, err = snapshot.Encode(saved)
+	}) {
+		return
+	}
+	if err == nil {
+		err = snapshot.WriteFile(h.snapshots.Path, data)
+	}
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to save snapshot to %s: %v", h.snapshots.Path, err)
+		return
+	}
+
+	// Записи, вошедшие в сохраненный снимок, больше не нужны
+	if h.journal != nil {
+		if err := h.journal.Prune(seq); err != nil {
+			logging.ErrorLogger.Printf("Failed to prune journal: %v", err)
+		}
+	}
+}
+
+func (h *Handler) takeSnapshots() {
+	if h.snapshots.Path == "" || h.snapshots.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.snapshots.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.saveSnapshot()
+		case <-h.done:
+			return
+		}
+	}
+}
+
 func (h *Handler) pingClients(client *models.ClientInfo) {
 	ticker := time.NewTicker(h.pingInterval)
 	defer ticker.Stop()
@@ -105,11 +472,50 @@ func (h *Handler) pingClients(client *models.ClientInfo) {
 	for {
 		select {
 		case <-ticker.C:
+			// WriteControl можно вызывать параллельно с записью движка
 			if err := client.Connection.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(h.pingTimeout)); err != nil {
 				logging.ErrorLogger.Printf("Error sending ping to client %s: %v", client.ID, err)
 				h.removeClient(client.ID)
 				return
 			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *Handler) pushInterpolatedPositions() {
+	if h.deadReckoningInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.deadReckoningInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.engine.Do(h.geolocationAPI.PushInterpolatedNearest)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *Handler) expireStalePositions() {
+	if h.staleSweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.staleSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.engine.Do(h.geolocationAPI.ExpireStalePositions)
+		case <-h.done:
+			return
 		}
 	}
 }
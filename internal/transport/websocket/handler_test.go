@@ -0,0 +1,127 @@
+package websocket_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/storage"
+	transport "github.com/appxpy/sphere-api/internal/transport/websocket"
+	"github.com/appxpy/sphere-api/internal/usecases"
+)
+
+// HandlerTestSuite runs real websocket clients against the handler
+type HandlerTestSuite struct {
+	suite.Suite
+	repo    *storage.ClientRepository
+	handler *transport.Handler
+	server  *httptest.Server
+}
+
+// SetupTest starts a handler with every background pass enabled and short intervals
+func (t *HandlerTestSuite) SetupTest() {
+	cfg := config.Default()
+	cfg.Geolocation.CoalesceWindow = 2 * time.Millisecond
+	cfg.Geolocation.DeadReckoning.Interval = 5 * time.Millisecond
+	cfg.Geolocation.PositionTTL = 30 * time.Millisecond
+	cfg.Geolocation.StaleSweepInterval = 5 * time.Millisecond
+
+	t.repo = storage.NewClientRepository()
+	geoUsecase := usecases.NewGeolocationUsecase(t.repo, cfg.Geolocation)
+	usersUsecase := usecases.NewUsersUsecase(t.repo, cfg.Privacy)
+
+	t.handler = transport.NewHandler(cfg, geoUsecase, usersUsecase)
+	t.handler.Start()
+	t.server = httptest.NewServer(http.HandlerFunc(t.handler.HandleWS))
+}
+
+// TearDownTest stops the server and the handler
+func (t *HandlerTestSuite) TearDownTest() {
+	t.server.Close()
+	t.handler.Stop()
+}
+
+// TestConcurrentClients moves, regroups and disconnects many clients at once. Run with -race.
+func (t *HandlerTestSuite) TestConcurrentClients() {
+	const clients, messages = 24, 150
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t.runClient(i, messages)
+		}(i)
+	}
+	wg.Wait()
+
+	t.Require().Eventually(func() bool {
+		return len(t.repo.GetAllClients()) == 0
+	}, time.Second, 5*time.Millisecond, "All clients should be removed after disconnecting")
+}
+
+// runClient connects a client, sends a random mix of requests while draining responses and disconnects
+func (t *HandlerTestSuite) runClient(i int, messages int) {
+	url := "ws" + strings.TrimPrefix(t.server.URL, "http") + "/"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !t.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	random := rand.New(rand.NewSource(int64(i)))
+	for n := 0; n < messages; n++ {
+		var message string
+		switch random.Intn(10) {
+		case 0:
+			message = fmt.Sprintf(`{"type": "JoinRoomRequest", "data": {"room": "room-%d", "pairing": "exclusive"}}`, random.Intn(3))
+		case 1:
+			message = `{"type": "LeaveRoomRequest", "data": {}}`
+		case 2:
+			message = `{"type": "GetClientsRequest", "data": {}}`
+		case 3:
+			message = `{"type": "SyncStateMessage", "data": {"transitionProgress": 0.5}}`
+		case 4:
+			message = `{"type": "SetPreferencesRequest", "data": {"min_distance": 10, "path": {"waypoints": 4}}}`
+		default:
+			message = fmt.Sprintf(`{"type": "UpdatePositionRequest", "data": {"latitude": %f, "longitude": %f, "speed": 1.5, "course": 90}}`,
+				55.7+random.Float64()*0.1, 37.6+random.Float64()*0.1)
+		}
+
+		if !t.NoError(conn.WriteMessage(websocket.TextMessage, []byte(message))) {
+			return
+		}
+	}
+
+	// Some clients linger long enough for their positions to expire
+	if i%3 == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	<-received
+}
+
+// TestHandlerTestSuite runs the test suite
+func TestHandlerTestSuite(t *testing.T) {
+	suite.Run(t, new(HandlerTestSuite))
+}
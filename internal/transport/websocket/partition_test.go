@@ -0,0 +1,82 @@
+package websocket_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/cluster/clustertest"
+	"github.com/appxpy/sphere-api/internal/config"
+)
+
+// PartitionTestSuite runs two nodes in partitioned mode whose cells meet at a known boundary
+type PartitionTestSuite struct {
+	suite.Suite
+	cluster  *clustertest.Cluster
+	latitude float64
+	boundary float64
+}
+
+// SetupTest starts the nodes and finds the boundary between their cells
+func (t *PartitionTestSuite) SetupTest() {
+	cfg := config.Default()
+	cfg.Cluster.Mode = config.ClusterPartitioned
+	t.cluster = clustertest.New(t.T(), cfg, "a", "b")
+	t.latitude, t.boundary = clustertest.Boundary(t.T(), []string{"a", "b"}, cfg.Cluster.Partition.CellPrecision, "a", "b")
+}
+
+// TestHandoff tests that a client crossing the boundary is redirected to the other node and keeps its session
+func (t *PartitionTestSuite) TestHandoff() {
+	alice := t.cluster.Dial("a", "alice")
+	bob := t.cluster.Dial("b", "bob")
+	defer alice.Close()
+	defer bob.Close()
+
+	t.move(alice, -0.5)
+	t.move(bob, 0.5)
+	t.cluster.Settle()
+
+	t.move(alice, 0.49)
+	nearest := alice.Await("GetNearestClientResponse")
+	for alice.Node != "b" {
+		// The client stays on its node until the other node accepts it
+		nearest = alice.Await("GetNearestClientResponse")
+	}
+	t.Require().Equal(bob.ID, nearest["id"], "After the handoff alice pairs with bob")
+	t.Require().Equal(alice.ID, bob.Await("GetNearestClientResponse")["id"])
+
+	alice.Send(`{"type": "WhoAmIRequest", "data": {}}`)
+	t.Require().Equal(alice.ID, alice.Await("WhoAmIResponse")["client_id"], "The session keeps its ID")
+
+	alice.Send(`{"type": "SyncStateMessage", "data": {"transitionProgress": 0.5, "stateVersion": 7}}`)
+	t.Require().EqualValues(7, bob.Await("SyncStateResponse")["stateVersion"])
+}
+
+// TestBoundary tests that clients of different nodes near the boundary pair with each other
+func (t *PartitionTestSuite) TestBoundary() {
+	alice := t.cluster.Dial("a", "alice")
+	bob := t.cluster.Dial("b", "bob")
+	defer alice.Close()
+	defer bob.Close()
+
+	t.move(alice, -0.01)
+	t.cluster.Settle()
+	t.move(bob, 0.01)
+
+	t.Require().Equal(bob.ID, alice.Await("GetNearestClientResponse")["id"])
+	t.Require().Equal("a", alice.Node, "Clients near the boundary stay on their nodes")
+
+	bob.Send(`{"type": "SyncStateMessage", "data": {"transitionProgress": 0.5, "stateVersion": 3}}`)
+	t.Require().EqualValues(3, alice.Await("SyncStateResponse")["stateVersion"], "The state is forwarded across the boundary")
+}
+
+// move sends a position at the given longitude offset from the boundary
+func (t *PartitionTestSuite) move(client *clustertest.Client, offset float64) {
+	client.Send(fmt.Sprintf(`{"type": "UpdatePositionRequest", "data": {"latitude": %f, "longitude": %f}}`, t.latitude, t.boundary+offset))
+}
+
+// TestPartitionTestSuite runs the test suite
+func TestPartitionTestSuite(t *testing.T) {
+	suite.Run(t, new(PartitionTestSuite))
+}
@@ -0,0 +1,283 @@
+package websocket_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/storage"
+	transport "github.com/appxpy/sphere-api/internal/transport/websocket"
+	"github.com/appxpy/sphere-api/internal/usecases"
+)
+
+// RestartTestSuite restarts the handler on a fresh repository over the same snapshot file
+type RestartTestSuite struct {
+	suite.Suite
+	cfg *config.Config
+}
+
+// SetupTest points snapshots and the journal to a temporary directory with a short grace period
+func (t *RestartTestSuite) SetupTest() {
+	dir := t.T().TempDir()
+	t.cfg = config.Default()
+	t.cfg.Identity.Secret = "restart-test"
+	t.cfg.Journal.Dir = filepath.Join(dir, "journal")
+	t.cfg.Snapshot.Path = filepath.Join(dir, "state.json")
+	t.cfg.Snapshot.Interval = 0
+	t.cfg.Snapshot.Grace = 300 * time.Millisecond
+}
+
+// TestResume tests that a client resumes its session after a restart and that clients who never come back are dropped
+func (t *RestartTestSuite) TestResume() {
+	handler, server := t.start()
+	alice, aliceSession := t.dial(server, session{})
+	bob, _ := t.dial(server, session{})
+
+	t.send(alice, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.75, "longitude": 37.61}}`)
+	t.send(bob, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.76, "longitude": 37.62}}`)
+	nearest := t.await(alice, "GetNearestClientResponse")
+	t.send(alice, `{"type": "WhoAmIRequest", "data": {}}`)
+	aliceID := t.await(alice, "WhoAmIResponse")["client_id"]
+
+	// Stopping the handler saves the snapshot while both clients are still connected
+	handler.Stop()
+	alice.Close()
+	bob.Close()
+	server.Close()
+
+	handler, server = t.start()
+	defer server.Close()
+	defer handler.Stop()
+
+	alice, _ = t.dial(server, aliceSession)
+	defer alice.Close()
+	resumed := t.await(alice, "GetNearestClientResponse")
+	t.Require().Equal(nearest["id"], resumed["id"], "The pairing survives the restart")
+
+	t.send(alice, `{"type": "WhoAmIRequest", "data": {}}`)
+	t.Require().Equal(aliceID, t.await(alice, "WhoAmIResponse")["client_id"], "The client keeps its ID")
+
+	// Bob never comes back, so after the grace period alice loses her nearest
+	t.await(alice, "NoEligibleNearestResponse")
+}
+
+// TestJournalOnly tests that sessions are recovered from the journal alone when no snapshot was saved
+func (t *RestartTestSuite) TestJournalOnly() {
+	t.cfg.Snapshot.Path = ""
+
+	handler, server := t.start()
+	alice, aliceSession := t.dial(server, session{})
+	bob, _ := t.dial(server, session{})
+
+	t.send(bob, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.76, "longitude": 37.62}}`)
+	t.send(alice, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.75, "longitude": 37.61}}`)
+	nearest := t.await(alice, "GetNearestClientResponse")
+
+	handler.Stop()
+	alice.Close()
+	bob.Close()
+	server.Close()
+
+	handler, server = t.start()
+	defer server.Close()
+	defer handler.Stop()
+
+	alice, _ = t.dial(server, aliceSession)
+	defer alice.Close()
+	resumed := t.await(alice, "GetNearestClientResponse")
+	t.Require().Equal(nearest["id"], resumed["id"], "Replaying the journal restores the pairing")
+	t.Require().Equal(nearest["distance"], resumed["distance"])
+}
+
+// TestUnknownIdentity tests that a client without a restored session starts a new one
+func (t *RestartTestSuite) TestUnknownIdentity() {
+	handler, server := t.start()
+	defer server.Close()
+	defer handler.Stop()
+
+	carol, _ := t.dial(server, session{})
+	defer carol.Close()
+	t.send(carol, `{"type": "WhoAmIRequest", "data": {}}`)
+	t.Require().NotEmpty(t.await(carol, "WhoAmIResponse")["client_id"])
+}
+
+// TestZones tests that zones added at runtime survive a restart from the snapshot and from the journal
+func (t *RestartTestSuite) TestZones() {
+	t.cfg.Zones.AdminToken = "zones"
+
+	for _, snapshotPath := range []string{t.cfg.Snapshot.Path, ""} {
+		t.cfg.Snapshot.Path = snapshotPath
+		t.cfg.Journal.Dir = filepath.Join(t.T().TempDir(), "journal")
+
+		handler, server := t.start()
+		admin, _ := t.dial(server, session{})
+		t.send(admin, `{"type": "AddZoneRequest", "data": {"token": "zones", "geojson": {"type": "Feature",
+			"properties": {"id": "park", "pairing": "isolated"}, "geometry": {"type": "Polygon",
+			"coordinates": [[[37.6, 55.7], [37.7, 55.7], [37.7, 55.8], [37.6, 55.7]]]}}}}`)
+		t.await(admin, "AddZoneResponse")
+		handler.Stop()
+		admin.Close()
+		server.Close()
+
+		handler, server = t.start()
+		admin, _ = t.dial(server, session{})
+		t.send(admin, `{"type": "GetZonesRequest", "data": {}}`)
+		zones := t.await(admin, "GetZonesResponse")["zones"].([]any)
+		t.Require().Len(zones, 1, "Snapshot path %q", snapshotPath)
+		t.Require().Equal("park", zones[0].(map[string]any)["id"])
+		handler.Stop()
+		admin.Close()
+		server.Close()
+	}
+}
+
+// TestForgedIdentity tests that an identity token signed with another secret is replaced by a fresh identity
+func (t *RestartTestSuite) TestForgedIdentity() {
+	handler, server := t.start()
+	alice, aliceSession := t.dial(server, session{})
+	alice.Close()
+	handler.Stop()
+	server.Close()
+
+	t.cfg.Identity.Secret = "another-secret"
+	handler, server = t.start()
+	defer server.Close()
+	defer handler.Stop()
+
+	mallory, mallorySession := t.dial(server, session{identity: aliceSession.identity})
+	defer mallory.Close()
+	t.Require().NotEqual(aliceSession.identity, mallorySession.identity, "A token with an invalid signature should not be accepted")
+
+	// The identity part of a token cannot be swapped without the signature
+	identity, _, _ := strings.Cut(aliceSession.identity, ".")
+	_, signature, _ := strings.Cut(mallorySession.identity, ".")
+	eve, forged := t.dial(server, session{identity: identity + "." + signature})
+	defer eve.Close()
+	t.Require().NotContains(forged.identity, identity)
+}
+
+// TestResumeToken tests that a restored session is resumed only with its resume token, not by the identity alone
+func (t *RestartTestSuite) TestResumeToken() {
+	handler, server := t.start()
+	alice, aliceSession := t.dial(server, session{})
+	t.send(alice, `{"type": "WhoAmIRequest", "data": {}}`)
+	aliceID := t.await(alice, "WhoAmIResponse")["client_id"]
+	handler.Stop()
+	alice.Close()
+	server.Close()
+
+	handler, server = t.start()
+	defer server.Close()
+	defer handler.Stop()
+
+	for _, forged := range []session{
+		{identity: aliceSession.identity},
+		{identity: aliceSession.identity, resume: "not-the-token"},
+	} {
+		mallory, _ := t.dial(server, forged)
+		t.send(mallory, `{"type": "WhoAmIRequest", "data": {}}`)
+		t.Require().NotEqual(aliceID, t.await(mallory, "WhoAmIResponse")["client_id"], "The session should not be resumed")
+		mallory.Close()
+	}
+
+	alice, _ = t.dial(server, aliceSession)
+	defer alice.Close()
+	t.send(alice, `{"type": "WhoAmIRequest", "data": {}}`)
+	t.Require().Equal(aliceID, t.await(alice, "WhoAmIResponse")["client_id"])
+}
+
+// TestRemoveRetry tests that a client whose removal failed is removed again once the store recovers
+func (t *RestartTestSuite) TestRemoveRetry() {
+	repo := &failingStore{ClientStore: storage.NewClientRepository()}
+	handler := transport.NewHandler(t.cfg, usecases.NewGeolocationUsecase(repo, t.cfg.Geolocation), usecases.NewUsersUsecase(repo, t.cfg.Privacy))
+	handler.Start()
+	defer handler.Stop()
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleWS))
+	defer server.Close()
+
+	alice, _ := t.dial(server, session{})
+	defer alice.Close()
+	bob, _ := t.dial(server, session{})
+	t.send(alice, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.75, "longitude": 37.61}}`)
+	t.send(bob, `{"type": "UpdatePositionRequest", "data": {"latitude": 55.76, "longitude": 37.62}}`)
+	t.await(alice, "GetNearestClientResponse")
+
+	// Bob disconnects while the store fails, so his removal is retried after the store recovers
+	repo.failing.Store(true)
+	bob.Close()
+	time.Sleep(100 * time.Millisecond)
+	repo.failing.Store(false)
+
+	t.await(alice, "NoEligibleNearestResponse")
+}
+
+// failingStore fails client removals while failing is set
+type failingStore struct {
+	storage.ClientStore
+	failing atomic.Bool
+}
+
+func (s *failingStore) RemoveClient(id string) error {
+	if s.failing.Load() {
+		return errors.New("store unavailable")
+	}
+	return s.ClientStore.RemoveClient(id)
+}
+
+// start creates and starts a handler on a fresh repository
+func (t *RestartTestSuite) start() (*transport.Handler, *httptest.Server) {
+	repo := storage.NewClientRepository()
+	handler := transport.NewHandler(t.cfg, usecases.NewGeolocationUsecase(repo, t.cfg.Geolocation), usecases.NewUsersUsecase(repo, t.cfg.Privacy))
+	handler.Start()
+	return handler, httptest.NewServer(http.HandlerFunc(handler.HandleWS))
+}
+
+// session holds the tokens a client presents when it reconnects
+type session struct {
+	identity string
+	resume   string
+}
+
+// dial connects a client with the given tokens and returns the tokens issued for the session
+func (t *RestartTestSuite) dial(server *httptest.Server, tokens session) (*websocket.Conn, session) {
+	query := url.Values{"identity": {tokens.identity}, "resume": {tokens.resume}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?"+query.Encode(), nil)
+	t.Require().NoError(err)
+	response := t.await(conn, "SessionResponse")
+	return conn, session{identity: response["identity_token"].(string), resume: response["resume_token"].(string)}
+}
+
+// send writes a raw message
+func (t *RestartTestSuite) send(conn *websocket.Conn, message string) {
+	t.Require().NoError(conn.WriteMessage(websocket.TextMessage, []byte(message)))
+}
+
+// await reads messages until one of the given type arrives and returns its data
+func (t *RestartTestSuite) await(conn *websocket.Conn, messageType string) map[string]any {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		}
+		t.Require().NoError(conn.ReadJSON(&message), "Waiting for %s", messageType)
+		if message.Type == messageType {
+			return message.Data
+		}
+	}
+}
+
+// TestRestartTestSuite runs the test suite
+func TestRestartTestSuite(t *testing.T) {
+	suite.Run(t, new(RestartTestSuite))
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+)
+
+const (
+	// sendQueueSize - Сколько записей может ждать отправки в одно соединение. Клиент, который не успевает
+	// читать и переполняет очередь, отключается.
+	sendQueueSize = 256
+	// sendTimeout - Сколько может длиться одна запись в сеть, после этого соединение закрывается
+	sendTimeout = 5 * time.Second
+)
+
+var errSendQueueFull = errors.New("send queue is full")
+
+// queuedConn - Соединение, запись в которое только ставит байты в очередь. Очередь отправляет в сеть
+// собственная горутина, поэтому движок, пишущий клиентам из команд, не ждет медленных клиентов.
+// Записи websocket.Conn последовательны, так что кадры попадают в очередь целиком и по порядку.
+type queuedConn struct {
+	net.Conn
+
+	queue  chan []byte
+	closed bool
+	mu     sync.Mutex
+}
+
+func newQueuedConn(conn net.Conn) *queuedConn {
+	c := &queuedConn{Conn: conn, queue: make(chan []byte, sendQueueSize)}
+	go c.drain()
+	return c
+}
+
+// Write - Ставит копию p в очередь. Если очередь полна, соединение закрывается.
+func (c *queuedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case c.queue <- bytes.Clone(p):
+		return len(p), nil
+	default:
+		logging.ErrorLogger.Printf("Send queue to %s is full, closing the connection", c.RemoteAddr())
+		c.closed = true
+		close(c.queue)
+		c.Conn.Close()
+		return 0, errSendQueueFull
+	}
+}
+
+// Close - Закрывает очередь. Соединение закрывается после отправки уже поставленных записей,
+// чтобы последнее сообщение перед закрытием (например, о передаче клиента) дошло до клиента.
+func (c *queuedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	return nil
+}
+
+// SetDeadline - Задает только срок чтения: сроки записи назначает очередь
+func (c *queuedConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline - Срок записи websocket.Conn относится к постановке в очередь, которая не блокируется
+func (c *queuedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Отправляет записи очереди в сеть, каждую не дольше sendTimeout. После ошибки записи остаток очереди отбрасывается.
+func (c *queuedConn) drain() {
+	defer c.Conn.Close()
+
+	failed := false
+	for p := range c.queue {
+		if failed {
+			continue
+		}
+
+		c.Conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+		if _, err := c.Conn.Write(p); err != nil {
+			logging.ErrorLogger.Printf("Failed to send to %s: %v", c.RemoteAddr(), err)
+			failed = true
+			// Закрытие прерывает чтение, и обработчик соединения удаляет клиента
+			c.Conn.Close()
+		}
+	}
+}
+
+// queuedResponseWriter - Подменяет соединение, которое websocket.Upgrader получает при перехвате, на queuedConn
+type queuedResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w queuedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newQueuedConn(conn), rw, nil
+}
@@ -0,0 +1,68 @@
+package websocket_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	transport "github.com/appxpy/sphere-api/internal/transport/websocket"
+)
+
+// SendQueueTestSuite tests the per-connection send queue over an in-memory pipe
+type SendQueueTestSuite struct {
+	suite.Suite
+}
+
+// TestStalledReader tests that writes to a client that never reads do not block and overflow closes the connection
+func (t *SendQueueTestSuite) TestStalledReader() {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := transport.NewQueuedConn(server)
+
+	finished := make(chan error)
+	go func() {
+		// The drain goroutine holds one write on the pipe, the rest wait in the queue
+		for i := 0; i <= transport.SendQueueSize+1; i++ {
+			if _, err := conn.Write([]byte("message")); err != nil {
+				finished <- err
+				return
+			}
+		}
+		finished <- nil
+	}()
+
+	select {
+	case err := <-finished:
+		t.Require().Error(err, "Overflowing the queue should fail the write")
+	case <-time.After(time.Second):
+		t.FailNow("Writes blocked on a client that does not read")
+	}
+
+	_, err := conn.Write([]byte("message"))
+	t.Require().ErrorIs(err, net.ErrClosed)
+}
+
+// TestCloseFlushes tests that messages queued before Close still reach the client
+func (t *SendQueueTestSuite) TestCloseFlushes() {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := transport.NewQueuedConn(server)
+
+	_, err := conn.Write([]byte("first "))
+	t.Require().NoError(err)
+	_, err = conn.Write([]byte("last"))
+	t.Require().NoError(err)
+	t.Require().NoError(conn.Close())
+
+	received, err := io.ReadAll(client)
+	t.Require().NoError(err)
+	t.Require().Equal("first last", string(received))
+}
+
+// TestSendQueueTestSuite runs the test suite
+func TestSendQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(SendQueueTestSuite))
+}
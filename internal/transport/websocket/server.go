@@ -1,29 +1,107 @@
 package websocket
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"time"
 
+	"github.com/appxpy/sphere-api/internal/cluster"
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/logging"
 	"github.com/appxpy/sphere-api/internal/storage"
 	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/zones"
 )
 
 type Server struct {
 	handler *Handler
+	http    *http.Server
+	// internal - Слушатель событий других узлов кластера (nil - кластер выключен)
+	internal *http.Server
 }
 
-func NewServer() *Server {
-	repo := storage.NewClientRepository()
-	geoUsecase := usecases.NewGeolocationUsecase(repo)
-	usersUsecase := usecases.NewUsersUsecase(repo)
-	handler := NewHandler(geoUsecase, usersUsecase)
-	return &Server{handler: handler}
+func NewServer(cfg *config.Config) *Server {
+	repo, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+
+	geoUsecase := usecases.NewGeolocationUsecase(repo, cfg.Geolocation)
+	geoUsecase.SetPrivacy(cfg.Privacy)
+	for _, path := range cfg.Zones.Files {
+		loaded, err := zones.LoadFile(path)
+		if err != nil {
+			logging.ErrorLogger.Printf("Failed to load zones from %s: %v", path, err)
+			continue
+		}
+		geoUsecase.AddZones(loaded)
+	}
+
+	usersUsecase := usecases.NewUsersUsecase(repo, cfg.Privacy)
+	handler := NewHandler(cfg, geoUsecase, usersUsecase)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handler.HandleWS)
+	server := &Server{handler: handler, http: &http.Server{Addr: cfg.Address, Handler: mux}}
+
+	// События узлов принимаются только на внутреннем слушателе, публичный порт их не обслуживает
+	if cfg.Cluster.Node != "" {
+		var discovery cluster.Discovery = cluster.StaticDiscovery(cfg.Cluster.Peers)
+		if cfg.Cluster.DNS != "" {
+			discovery = cluster.NewDNSDiscovery(cfg.Cluster.DNS, cfg.Cluster.DNSPort)
+		}
+		backplane := cluster.NewHTTPBackplane(cfg.Cluster.Node, cfg.Cluster.Secret, discovery, cfg.Cluster.RefreshInterval)
+		if err := handler.JoinCluster(cfg.Cluster.Node, backplane); err != nil {
+			panic(err)
+		}
+
+		internal := http.NewServeMux()
+		internal.Handle(cluster.Path, backplane)
+		server.internal = &http.Server{Addr: cfg.Cluster.Listen, Handler: internal}
+	}
+	return server
 }
 
+// Start - Открывает порты до запуска обработчика, чтобы ответы узлов кластера на приветствие не потерялись
 func (s *Server) Start() {
-	http.HandleFunc("/ws", s.handler.HandleWS)
-
-	err := http.ListenAndServe(":8080", nil)
+	listener, err := net.Listen("tcp", s.http.Addr)
 	if err != nil {
 		panic(err)
 	}
+	if s.internal != nil {
+		internal, err := net.Listen("tcp", s.internal.Addr)
+		if err != nil {
+			panic(err)
+		}
+		go serve(s.internal, internal)
+	}
+	s.handler.Start()
+
+	serve(s.http, listener)
+}
+
+// Stop - Перестает принимать соединения и останавливает обработчик, сохраняя снимок состояния
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		logging.ErrorLogger.Printf("Failed to shut down HTTP server: %v", err)
+	}
+	// Внутренний слушатель работает, пока обработчик не попрощается с другими узлами
+	s.handler.Stop()
+	if s.internal != nil {
+		if err := s.internal.Shutdown(ctx); err != nil {
+			logging.ErrorLogger.Printf("Failed to shut down cluster listener: %v", err)
+		}
+	}
+}
+
+func serve(server *http.Server, listener net.Listener) {
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
 }
@@ -0,0 +1,138 @@
+package usecases
+
+import (
+	"slices"
+
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// BlockClient - Блокирует идентичность клиента targetID для идентичности клиента clientID. Блокировка действует
+// в обе стороны: сессии этих идентичностей больше не подбираются друг другу в ближайшие.
+// Возвращает клиентов, которых нужно уведомить о смене ближайшего.
+func (u *GeolocationUsecase) BlockClient(clientID string, targetID string) ([]string, error) {
+	client, target, err := u.blockParties(clientID, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repo.Block(client.Identity, target.Identity); err != nil {
+		return nil, err
+	}
+	logging.InfoLogger.Printf("Client %s blocked client %s", clientID, targetID)
+	u.record(&journal.Entry{
+		Kind:           journal.KindClientBlocked,
+		ClientID:       clientID,
+		Identity:       client.Identity,
+		TargetID:       targetID,
+		TargetIdentity: target.Identity,
+	})
+
+	return u.refreshIdentities(client.Identity, target.Identity), nil
+}
+
+// UnblockClient - Снимает блокировку идентичности клиента targetID идентичностью клиента clientID
+func (u *GeolocationUsecase) UnblockClient(clientID string, targetID string) ([]string, error) {
+	client, target, err := u.blockParties(clientID, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repo.Unblock(client.Identity, target.Identity); err != nil {
+		return nil, err
+	}
+	logging.InfoLogger.Printf("Client %s unblocked client %s", clientID, targetID)
+	u.record(&journal.Entry{
+		Kind:           journal.KindClientUnblocked,
+		ClientID:       clientID,
+		Identity:       client.Identity,
+		TargetID:       targetID,
+		TargetIdentity: target.Identity,
+	})
+
+	return u.refreshIdentities(client.Identity, target.Identity), nil
+}
+
+// SetIdentityBlock - Сохраняет (blocked) или снимает блокировку идентичности target идентичностью blocker
+// без проверки их клиентов, например когда блокировку сделал клиент другого узла. Операция не записывается
+// в журнал. Возвращает клиентов, которых нужно уведомить о смене ближайшего.
+func (u *GeolocationUsecase) SetIdentityBlock(blocker, target string, blocked bool) ([]string, error) {
+	if blocker == "" || target == "" {
+		return nil, util.ErrClientNotFound
+	}
+	if blocker == target {
+		return nil, util.ErrCannotBlockSelf
+	}
+
+	var err error
+	if blocked {
+		err = u.repo.Block(blocker, target)
+	} else {
+		err = u.repo.Unblock(blocker, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.refreshIdentities(blocker, target), nil
+}
+
+// MergeBlocks - Добавляет блокировки blocks (идентичность -> заблокированные ею идентичности), например
+// известные другому узлу, и пересчитывает ближайших для сессий идентичностей, которых они коснулись
+func (u *GeolocationUsecase) MergeBlocks(blocks map[string][]string) ([]string, error) {
+	identities := make([]string, 0)
+	for blocker, blocked := range blocks {
+		for _, target := range blocked {
+			if blocker == target {
+				continue
+			}
+			if !u.repo.IsBlocked(blocker, target) {
+				identities = append(identities, blocker, target)
+			}
+			if err := u.repo.Block(blocker, target); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(identities) == 0 {
+		return []string{}, nil
+	}
+	return u.refreshIdentities(identities...), nil
+}
+
+// Находит обоих участников блокировки и проверяет, что клиент не блокирует сам себя
+func (u *GeolocationUsecase) blockParties(clientID string, targetID string) (client, target *models.ClientInfo, err error) {
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil, nil, util.ErrClientNotFound
+	}
+
+	target, exists = u.repo.GetClient(targetID)
+	if !exists {
+		return nil, nil, util.ErrClientNotFound
+	}
+
+	if client.Identity == target.Identity {
+		return nil, nil, util.ErrCannotBlockSelf
+	}
+
+	return client, target, nil
+}
+
+// Пересчитывает ближайших для всех сессий указанных идентичностей
+func (u *GeolocationUsecase) refreshIdentities(identities ...string) []string {
+	notify := make([]string, 0)
+	for _, client := range u.repo.GetAllClients() {
+		// Пересчет предыдущих клиентов мог сменить ближайшего этого клиента
+		if client = u.reload(client); !client.HasPosition() || !slices.Contains(identities, client.Identity) {
+			continue
+		}
+
+		notify = append(notify, u.refreshNearest(client)...)
+	}
+
+	slices.Sort(notify)
+	return slices.Compact(notify)
+}
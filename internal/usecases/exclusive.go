@@ -0,0 +1,145 @@
+package usecases
+
+import (
+	"slices"
+
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+)
+
+// maxRepairSteps - Предел шагов одной починки пар. Каждый шаг разрывает пару только ради более близкой,
+// поэтому починка сходится, а предел лишь страхует от зацикливания на устаревших расстояниях.
+const maxRepairSteps = 256
+
+// Пересчитывает пару переместившегося клиента в режиме взаимных пар.
+// Возвращает клиентов, которых нужно уведомить о смене партнера или расстояния до него.
+func (u *GeolocationUsecase) propagateExclusiveMove(client *models.ClientInfo) []string {
+	seeds := []*models.ClientInfo{client}
+	if partner := u.partnerOf(client); partner != nil {
+		seeds = append(seeds, partner)
+	}
+
+	// Клиент всегда получает свое состояние, даже если партнера для него нет
+	notify := append(u.repairPairs(seeds...), client.ID)
+	client = u.reload(client)
+	if partnerID := client.Position.ClosestClientID; partnerID != "" {
+		notify = append(notify, partnerID)
+	}
+
+	slices.Sort(notify)
+	return slices.Compact(notify)
+}
+
+// Чинит взаимные пары, начиная с клиентов seeds. Клиент уходит к кандидату, только если они оба ближе
+// друг к другу, чем к своим текущим партнерам, поэтому из жадных шагов получается устойчивое разбиение на пары:
+// нет двух клиентов, которые предпочли бы друг друга своим партнерам. Брошенные партнеры подбирают пару заново.
+// Гистерезис в этом режиме не применяется. Возвращает клиентов, у которых сменился партнер.
+func (u *GeolocationUsecase) repairPairs(seeds ...*models.ClientInfo) []string {
+	changed := make([]string, 0)
+	queue := slices.Clone(seeds)
+	// Пара взаимна, поэтому кандидат тоже должен быть не ближе своего минимального расстояния
+	filters := append(u.candidateFilters(), prefersOverPartner, func(client, candidate *models.ClientInfo) bool {
+		return u.farEnough(candidate, client)
+	})
+
+	for steps := 0; len(queue) > 0 && steps < maxRepairSteps; steps++ {
+		// Клиент в очереди мог измениться с момента постановки, поэтому перечитывается
+		client, exists := u.repo.GetClient(queue[0].ID)
+		queue = queue[1:]
+
+		if !exists || !client.HasPosition() {
+			continue
+		}
+
+		// Разрываем пару, если партнер отключился, потерял позицию или перестал подходить по условиям
+		partner := u.partnerOf(client)
+		if partner == nil && client.Position.ClosestClientID != "" {
+			if former, ok := u.repo.GetClient(client.Position.ClosestClientID); ok && former.HasPosition() &&
+				former.Position.ClosestClientID == client.ID {
+				u.unpair(former)
+				queue = append(queue, former)
+				changed = append(changed, former.ID)
+			}
+			u.unpair(client)
+			changed = append(changed, client.ID)
+		}
+
+		candidate, _ := u.repo.FindNearestClient(client.ID, filters...)
+		if candidate != nil && (!u.closeEnough(client, candidate) || !u.closeEnough(candidate, client)) {
+			candidate = nil
+		}
+		if candidate == nil || (partner != nil && (candidate.ID == partner.ID ||
+			client.Position.GeodesicDistanceTo(partner.Position) <= client.Position.GeodesicDistanceTo(candidate.Position))) {
+			// Текущий партнер остается лучшим, обновляем расстояние и азимут
+			if partner != nil {
+				u.pair(client, partner)
+			}
+			continue
+		}
+
+		if partner != nil {
+			u.unpair(partner)
+			queue = append(queue, partner)
+			changed = append(changed, partner.ID)
+		}
+
+		if rival := u.partnerOf(candidate); rival != nil {
+			u.unpair(rival)
+			queue = append(queue, rival)
+			changed = append(changed, rival.ID)
+		}
+
+		u.pair(client, candidate)
+		changed = append(changed, client.ID, candidate.ID)
+	}
+
+	slices.Sort(changed)
+	return slices.Compact(changed)
+}
+
+// Кандидат согласен на пару с client, если он свободен или client ближе к нему, чем его текущий партнер
+var prefersOverPartner storage.CandidateFilter = func(client, candidate *models.ClientInfo) bool {
+	position := candidate.Position
+	return position.ClosestClientID == "" || position.ClosestClientID == client.ID ||
+		position.GeodesicDistanceTo(client.Position) < position.Distance
+}
+
+// Возвращает партнера клиента, если пара взаимна и все еще допустима
+func (u *GeolocationUsecase) partnerOf(client *models.ClientInfo) *models.ClientInfo {
+	partner, exists := u.repo.GetClient(client.Position.ClosestClientID)
+	if !exists || !partner.HasPosition() || partner.Position.ClosestClientID != client.ID ||
+		!u.isEligible(client, partner) || !u.isEligible(partner, client) {
+		return nil
+	}
+	return partner
+}
+
+// Связывает двух клиентов во взаимную пару
+func (u *GeolocationUsecase) pair(a, b *models.ClientInfo) {
+	a, b = u.reload(a), u.reload(b)
+	distance, azimuthAtoB, azimuthBtoA := calculateAzimuthAndDistanceBetweenPositions(a, b)
+
+	positionA, positionB := *a.Position, *b.Position
+
+	positionA.ClosestClientID = b.ID
+	positionA.Distance = distance
+	positionA.Azimuth = azimuthAtoB
+	positionA.PendingClosestClientID = ""
+	logStoreError(u.repo.UpdateNearestReference(a.ID, a.Position.ClosestClientID, &positionA), "pair %s", a.ID)
+
+	positionB.ClosestClientID = a.ID
+	positionB.Distance = distance
+	positionB.Azimuth = azimuthBtoA
+	positionB.PendingClosestClientID = ""
+	logStoreError(u.repo.UpdateNearestReference(b.ID, b.Position.ClosestClientID, &positionB), "pair %s", b.ID)
+}
+
+// Оставляет клиента без партнера
+func (u *GeolocationUsecase) unpair(client *models.ClientInfo) {
+	client = u.reload(client)
+	position := *client.Position
+	position.ClosestClientID = ""
+	position.Distance = 0
+	position.Azimuth = 0
+	logStoreError(u.repo.UpdateNearestReference(client.ID, client.Position.ClosestClientID, &position), "unpair %s", client.ID)
+}
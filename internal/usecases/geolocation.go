@@ -1,20 +1,65 @@
 package usecases
 
 import (
+	"math"
 	"slices"
+	"time"
 
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
 	"github.com/appxpy/sphere-api/internal/logging"
 	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/privacy"
+	"github.com/appxpy/sphere-api/internal/smoothing"
 	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
 	"github.com/tidwall/geodesic"
 )
 
 type GeolocationUsecase struct {
-	repo *storage.ClientRepository
+	repo  storage.ClientStore
+	cfg   config.Geolocation
+	zones *zones.Registry
+	// privacy - Политика раскрытия координат для данных о других клиентах, которые строит юзкейс (например, путей)
+	privacy *privacy.Policy
+
+	// now - Часы сервера. При повторе журнала подменяются временем записей, чтобы результат не зависел от момента повтора.
+	now     func() time.Time
+	journal Journal
+
+	// smoothers - Фильтры сглаживания позиций клиентов. Фильтр создается при первом фиксе и живет всю сессию,
+	// nil если сглаживание выключено.
+	smoothers map[string]smoothing.Filter
 }
 
-func NewGeolocationUsecase(repo *storage.ClientRepository) *GeolocationUsecase {
-	return &GeolocationUsecase{repo: repo}
+func NewGeolocationUsecase(repo storage.ClientStore, cfg config.Geolocation) *GeolocationUsecase {
+	return &GeolocationUsecase{
+		repo:      repo,
+		cfg:       cfg,
+		zones:     zones.NewRegistry(),
+		privacy:   privacy.NewPolicy(config.Default().Privacy),
+		now:       time.Now,
+		smoothers: make(map[string]smoothing.Filter),
+	}
+}
+
+// SetClock - Подменяет часы сервера (nil - системные часы)
+func (u *GeolocationUsecase) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	u.now = now
+}
+
+// SetPrivacy - Задает политику раскрытия координат развертывания (по умолчанию - политика конфигурации по умолчанию)
+func (u *GeolocationUsecase) SetPrivacy(cfg config.Privacy) {
+	u.privacy = privacy.NewPolicy(cfg)
+}
+
+// SetJournal - Включает запись операций в журнал (nil - выключает)
+func (u *GeolocationUsecase) SetJournal(journal Journal) {
+	u.journal = journal
 }
 
 //func (u *GeolocationUsecase) UpdateHeading(clientID string, heading float64) {
@@ -46,40 +91,24 @@ func (u *GeolocationUsecase) UpdateRelatedClients(clientID string) []string {
 	for _, referencingID := range u.repo.WhoReferenceMeAsNearest(clientID) {
 		logging.InfoLogger.Printf("Client %s references me as nearest", referencingID)
 		referencingClient, exists := u.repo.GetClient(referencingID)
-		if !exists {
-			u.repo.HeDoesNotReferenceMeAsNearestAnymore(clientID, referencingID)
+		if !exists || !referencingClient.HasPosition() {
+			logStoreError(u.repo.HeDoesNotReferenceMeAsNearestAnymore(clientID, referencingID), "drop reference of %s to %s", referencingID, clientID)
 			continue
 		}
 
-		nearestForRef, _ := u.GetClosestClient(referencingID)
-		if nearestForRef == nil {
-			referencingClient.Position.ClosestClientID = ""
-			referencingClient.Position.Distance = 0
-			referencingClient.Position.Azimuth = 0
-
-			notify = append(notify, referencingID)
-			continue
-		}
-
-		// Вычисляем расстояние и азимут от клиента который на нас ссылается до ближайшего до него
-		distance, azimuth, _ := calculateAzimuthAndDistanceBetweenPositions(referencingClient, nearestForRef)
-		if referencingClient.Position.ClosestClientID != nearestForRef.ID {
-			notify = append(notify, referencingID)
-		}
-
-		referencingClient.Position.ClosestClientID = nearestForRef.ID
-		referencingClient.Position.Distance = distance
-		referencingClient.Position.Azimuth = azimuth
+		notify = append(notify, u.refreshNearest(referencingClient)...)
 	}
 
-	return notify
+	slices.Sort(notify)
+	return slices.Compact(notify)
 }
 
 func (u *GeolocationUsecase) DeleteClientFromNearestReferences(clientID string) {
-	u.repo.DeleteClientFromNearestReferences(clientID)
+	logStoreError(u.repo.DeleteClientFromNearestReferences(clientID), "delete references to %s", clientID)
+	delete(u.smoothers, clientID)
 }
 
-func (u *GeolocationUsecase) UpdatePosition(clientID string, lat float64, lon float64) (notify []string) {
+func (u *GeolocationUsecase) UpdatePosition(clientID string, fix *models.Position) (notify []string, err error) {
 	// Проверяем существует ли клиент
 	var client *models.ClientInfo
 	var exists bool
@@ -87,59 +116,233 @@ func (u *GeolocationUsecase) UpdatePosition(clientID string, lat float64, lon fl
 
 	if client, exists = u.repo.GetClient(clientID); !exists {
 		logging.ErrorLogger.Printf("Client %s tried to update position, but it does not exist anymore.", clientID)
-		return
+		return notify, util.ErrClientNotFound
 	}
 
-	if !client.HasPosition() {
-		client.Position = &models.Position{}
+	now := u.now()
+	if u.journal != nil {
+		// В журнал попадает фикс в том виде, в котором его прислал клиент: повтор проходит ту же проверку и сглаживание
+		raw := *fix
+		u.record(&journal.Entry{Time: now, Kind: journal.KindPositionUpdated, ClientID: clientID, Position: &raw})
+	}
+
+	if fix.Timestamp.IsZero() {
+		fix.Timestamp = now
+	}
+
+	if err = validateFix(fix, now); err != nil {
+		return notify, err
+	}
+
+	if client.HasPosition() {
+		if err = acceptFix(client.Position, fix); err != nil {
+			logging.InfoLogger.Printf("Client %s position fix rejected: %v", clientID, err)
+			return notify, err
+		}
+
+		// Если клиент не прислал скорость и курс, вычисляем их по предыдущему и текущему фиксам
+		if fix.Velocity == nil {
+			fix.Velocity = deriveVelocity(client.Position, fix)
+		}
+	}
+
+	// Сглаживаем фикс фильтром клиента, фильтр создается при первом фиксе и живет всю сессию
+	latitude, longitude := fix.Latitude, fix.Longitude
+	smoother, ok := u.smoothers[clientID]
+	if !ok {
+		smoother = newSmoother(u.cfg.Smoothing)
+		u.smoothers[clientID] = smoother
+	}
+	if smoother != nil {
+		latitude, longitude = smoother.Update(fix.Latitude, fix.Longitude, fix.Accuracy, fix.Timestamp)
+	}
+
+	// Позиция из хранилища не меняется на месте: новая позиция собирается в копии и записывается целиком
+	position := &models.Position{}
+	if client.HasPosition() {
+		*position = *client.Position
+	}
+	applyFixMetadata(position, fix)
+	position.ReceivedAt = now
+
+	// Если клиент сместился меньше чем на порог, только обновляем метаданные фикса без переиндексации и пересчета ближайших
+	if client.HasPosition() && u.cfg.MinMovement > 0 &&
+		client.Position.GeodesicDistanceTo(&models.Position{Latitude: latitude, Longitude: longitude}) < u.cfg.MinMovement {
+		return notify, u.repo.UpdateClientPosition(clientID, position)
 	}
 
 	// Обновляем X, Y, Z координаты позиции и позицию клиента в репозитории (также обновляет R-Tree) если его геопозиция изменилась
-	if client.Position.Latitude != lat || client.Position.Longitude != lon {
-		client.Position.Latitude = lat
-		client.Position.Longitude = lon
+	if !client.HasPosition() || client.Position.Latitude != latitude || client.Position.Longitude != longitude {
+		position.Latitude = latitude
+		position.Longitude = longitude
+		position.UpdateXYZ()
 
-		client.Position.UpdateXYZ()
+		if err = u.repo.UpdateClientPosition(clientID, position); err != nil {
+			return notify, err
+		}
+		if err = u.repo.UpdateClientZones(clientID, u.zones.ZonesAt(position.Latitude, position.Longitude)); err != nil {
+			return notify, err
+		}
+	} else if err = u.repo.UpdateClientPosition(clientID, position); err != nil {
+		return notify, err
+	}
+
+	return u.propagateMove(u.reload(client)), nil
+}
 
-		u.repo.UpdateClientPosition(clientID, client.Position)
+// Пересчитывает ближайшего для переместившегося клиента, ближайшего для его нового ближайшего
+// и клиентов, ссылавшихся на него. Возвращает клиентов, которых нужно уведомить.
+func (u *GeolocationUsecase) propagateMove(client *models.ClientInfo) []string {
+	if u.pairingMode(client) == config.PairingExclusive {
+		return u.propagateExclusiveMove(client)
 	}
 
+	notify := make([]string, 0)
+
 	// Находим нового ближайшего клиента к обновленному клиенту
-	nearest, err := u.GetClosestClient(clientID)
+	u.refreshNearest(client)
+	client = u.reload(client)
+	notify = append(notify, client.ID)
 
-	if err != nil {
-		// Ближайший клиент не найден
-		client.Position.ClosestClientID = ""
-		return
+	// Клиенты, для которых переместившийся клиент теперь ближе их ближайшего
+	notify = append(notify, u.updateReverseNearest(client)...)
+
+	if client.Position.ClosestClientID == "" {
+		// Подходящий ближайший клиент не найден, клиент получит явное состояние без ближайшего
+		slices.Sort(notify)
+		return slices.Compact(notify)
 	}
 
-	// Вычисляем расстояние и азимут от клиента до его ближайшего клиента
-	distanceToNearest, azimuthToNearest, _ := calculateAzimuthAndDistanceBetweenPositions(client, nearest)
+	// Пересчитываем ближайшего для ближайшего клиента
+	nearestID := client.Position.ClosestClientID
+	if nearest, ok := u.repo.GetClient(nearestID); ok && nearest.HasPosition() {
+		u.refreshNearest(nearest)
+	}
 
-	// Обновляем информацию о ближайшем клиенте для текущего клиента
-	client.Position.Azimuth = azimuthToNearest
-	client.Position.Distance = distanceToNearest
-	client.Position.ClosestClientID = nearest.ID
-	notify = append(notify, clientID)
+	notify = append(notify, u.UpdateRelatedClients(client.ID)...)
+	notify = append(notify, nearestID)
 
-	nearestForNearest, _ := u.GetClosestClient(nearest.ID)
+	slices.Sort(notify)
+	return slices.Compact(notify)
+}
 
-	// Вычисляем расстояние и азимут от ближайшего клиента до его ближайшего клиента
-	distance, azimuth, _ := calculateAzimuthAndDistanceBetweenPositions(nearest, nearestForNearest)
+// Пересчитывает ближайших для клиентов, у которых client в новой позиции ближе их текущего ближайшего.
+// Кандидаты находятся поиском по областям клиентов, ограниченным расстоянием до их ближайших.
+func (u *GeolocationUsecase) updateReverseNearest(client *models.ClientInfo) []string {
+	notify := make([]string, 0)
+	for _, other := range u.repo.FindReverseNearest(client.ID) {
+		if !other.HasPosition() || other.Position.ClosestClientID == client.ID {
+			continue
+		}
 
-	nearest.Position.ClosestClientID = nearestForNearest.ID
-	nearest.Position.Distance = distance
-	nearest.Position.Azimuth = azimuth
+		if other.Position.ClosestClientID != "" && other.Position.GeodesicDistanceTo(client.Position) >= other.Position.Distance {
+			continue
+		}
 
-	notify = append(notify, u.UpdateRelatedClients(clientID)...)
+		if !u.isEligible(other, client) {
+			continue
+		}
 
-	if !slices.Contains(notify, nearest.ID) {
-		notify = append(notify, nearest.ID)
+		notify = append(notify, u.refreshNearest(other)...)
 	}
-
 	return notify
 }
 
+// ExpireStalePositions - Убирает из пространственного индекса позиции, не обновлявшиеся дольше PositionTTL.
+// Возраст позиции считается по часам сервера от получения последнего фикса, время фикса клиента не учитывается.
+// Клиенты остаются подключенными, но покидают свои зоны, а клиенты, считавшие их ближайшими, пересчитываются.
+// Возвращает время последнего фикса клиентов с истекшими позициями, их выходы из зон
+// и клиентов, которых нужно уведомить о смене ближайшего.
+func (u *GeolocationUsecase) ExpireStalePositions(now time.Time) (expired map[string]time.Time, transitions []*models.ZoneTransition, notify []string) {
+	expired = make(map[string]time.Time)
+	transitions = make([]*models.ZoneTransition, 0)
+	notify = make([]string, 0)
+
+	if u.cfg.PositionTTL <= 0 {
+		return expired, transitions, notify
+	}
+
+	for _, client := range u.repo.GetAllClients() {
+		// Пересчет ближайших предыдущих клиентов мог изменить этого клиента
+		client = u.reload(client)
+		if !client.HasPosition() || now.Sub(receivedAt(client.Position)) < u.cfg.PositionTTL {
+			continue
+		}
+
+		logging.InfoLogger.Printf("Client %s position is stale since %v, removing it from the index", client.ID, receivedAt(client.Position))
+
+		expired[client.ID] = client.Position.Timestamp
+		left, related := u.expirePosition(client)
+		transitions = append(transitions, left...)
+		notify = append(notify, related...)
+	}
+
+	// Клиентам с истекшей позицией отправляется отдельное уведомление
+	notify = slices.DeleteFunc(notify, func(id string) bool {
+		_, ok := expired[id]
+		return ok
+	})
+	slices.Sort(notify)
+
+	return expired, transitions, slices.Compact(notify)
+}
+
+// ExpirePosition - Убирает позицию клиента так же, как ExpireStalePositions, независимо от ее возраста.
+// Повторяет записи журнала об истечении позиций, которые не должны зависеть от PositionTTL при повторе.
+func (u *GeolocationUsecase) ExpirePosition(clientID string) ([]*models.ZoneTransition, []string, error) {
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil, nil, util.ErrClientNotFound
+	}
+	if !client.HasPosition() {
+		return []*models.ZoneTransition{}, []string{}, nil
+	}
+
+	transitions, notify := u.expirePosition(client)
+	slices.Sort(notify)
+	return transitions, slices.Compact(notify), nil
+}
+
+// Убирает позицию клиента из индекса и зон и пересчитывает ссылавшихся на него.
+// Возвращает выходы клиента из зон и клиентов, у которых сменился ближайший.
+func (u *GeolocationUsecase) expirePosition(client *models.ClientInfo) ([]*models.ZoneTransition, []string) {
+	u.record(&journal.Entry{Kind: journal.KindPositionExpired, ClientID: client.ID})
+
+	transitions := ZoneTransitions(client.ID, client.Zones, nil)
+	logStoreError(u.repo.UpdateClientPosition(client.ID, nil), "expire position of %s", client.ID)
+	logStoreError(u.repo.UpdateClientZones(client.ID, nil), "clear zones of %s", client.ID)
+	logStoreError(u.repo.UpdateNearestReference(client.ID, client.Position.ClosestClientID, nil), "drop nearest of %s", client.ID)
+	if smoother := u.smoothers[client.ID]; smoother != nil {
+		smoother.Reset()
+	}
+
+	return transitions, u.UpdateRelatedClients(client.ID)
+}
+
+// Логирует ошибку записи в хранилище, которая случилась посреди пересчета: изменения, сделанные до нее,
+// не откатываются, а пересчет продолжается с тем, что сохранилось
+func logStoreError(err error, format string, args ...any) {
+	if err != nil {
+		logging.ErrorLogger.Printf("Failed to "+format+": %v", append(args, err)...)
+	}
+}
+
+// Возвращает время получения позиции сервером. Позиции из старых снимков его не содержат, для них используется время фикса
+func receivedAt(position *models.Position) time.Time {
+	if position.ReceivedAt.IsZero() {
+		return position.Timestamp
+	}
+	return position.ReceivedAt
+}
+
+// Перечитывает клиента из хранилища: прочитанные раньше копии не видят последующих изменений клиента
+func (u *GeolocationUsecase) reload(client *models.ClientInfo) *models.ClientInfo {
+	if fresh, exists := u.repo.GetClient(client.ID); exists {
+		return fresh
+	}
+	return client
+}
+
 func (u *GeolocationUsecase) GetClosestClient(clientID string) (*models.ClientInfo, error) {
 	return u.repo.FindNearestClient(clientID)
 }
@@ -148,6 +351,116 @@ func (u *GeolocationUsecase) GetClientsWhoReferenceClientAsNearest(clientID stri
 	return u.repo.WhoReferenceMeAsNearest(clientID)
 }
 
+// lessAccurateFixWindow - Период, в течение которого менее точный фикс не может заменить более точный
+const lessAccurateFixWindow = 30 * time.Second
+
+// maxFixClockSkew - Допустимое опережение времени фикса относительно часов сервера
+const maxFixClockSkew = time.Minute
+
+// minVelocityInterval - Минимальный интервал между фиксами, по которому вычисляется скорость
+const minVelocityInterval = time.Second
+
+// maxDerivedSpeed - Скорость в м/с, выше которой вычисленная скорость считается скачком фикса, а не движением
+const maxDerivedSpeed = 300.0
+
+// Проверяет, что координаты и метаданные фикса допустимы и фикс не из будущего относительно now
+func validateFix(fix *models.Position, now time.Time) error {
+	if math.IsNaN(fix.Latitude) || fix.Latitude < -90 || fix.Latitude > 90 {
+		return util.ErrInvalidLatitude
+	}
+
+	if math.IsNaN(fix.Longitude) || fix.Longitude < -180 || fix.Longitude > 180 {
+		return util.ErrInvalidLongitude
+	}
+
+	if math.IsNaN(fix.Accuracy) || math.IsInf(fix.Accuracy, 0) || fix.Accuracy < 0 {
+		return util.ErrInvalidAccuracy
+	}
+
+	if !fix.Source.IsValid() {
+		return util.ErrInvalidSource
+	}
+
+	if fix.Velocity != nil {
+		speed, course := fix.Velocity.Speed, fix.Velocity.Course
+		if math.IsNaN(speed) || math.IsInf(speed, 0) || speed < 0 {
+			return util.ErrInvalidSpeed
+		}
+
+		if math.IsNaN(course) || course < 0 || course > 360 {
+			return util.ErrInvalidCourse
+		}
+	}
+
+	if fix.Timestamp.After(now.Add(maxFixClockSkew)) {
+		return util.ErrFixFromFuture
+	}
+
+	return nil
+}
+
+// Проверяет, что фикс не старее и не хуже по точности последнего принятого
+func acceptFix(last *models.Position, fix *models.Position) error {
+	if fix.Timestamp.Before(last.Timestamp) {
+		return util.ErrStaleFix
+	}
+
+	// Менее точный фикс принимаем только если с последнего принятого прошло достаточно времени
+	if last.Accuracy > 0 && fix.Accuracy > last.Accuracy && fix.Timestamp.Sub(last.Timestamp) < lessAccurateFixWindow {
+		return util.ErrLessAccurateFix
+	}
+
+	return nil
+}
+
+// Создает фильтр сглаживания по конфигурации, возвращает nil если сглаживание выключено
+func newSmoother(cfg config.Smoothing) smoothing.Filter {
+	switch cfg.Filter {
+	case config.SmoothingExponential:
+		return smoothing.NewExponentialFilter(cfg.Alpha, cfg.ResetDistance)
+	case config.SmoothingKalman:
+		return smoothing.NewKalmanFilter(cfg.ProcessNoise, cfg.DefaultAccuracy, cfg.ResetDistance)
+	default:
+		return nil
+	}
+}
+
+// Переносит в позицию сырые координаты и метаданные принятого фикса
+func applyFixMetadata(position *models.Position, fix *models.Position) {
+	position.RawLatitude = fix.Latitude
+	position.RawLongitude = fix.Longitude
+	position.Accuracy = fix.Accuracy
+	position.Timestamp = fix.Timestamp
+	position.Source = fix.Source
+	position.Velocity = fix.Velocity
+}
+
+// Вычисляет скорость и курс по двум последовательным сырым фиксам. Если фиксы слишком близки по времени,
+// смещение не превышает их точности или скорость неправдоподобна, возвращает nil: такой шум не экстраполируется
+func deriveVelocity(last *models.Position, fix *models.Position) *models.Velocity {
+	dt := fix.Timestamp.Sub(last.Timestamp)
+	if dt < minVelocityInterval {
+		return nil
+	}
+
+	var distance, course float64
+	geodesic.WGS84.Inverse(last.RawLatitude, last.RawLongitude, fix.Latitude, fix.Longitude, &distance, &course, nil)
+	if distance <= math.Max(last.Accuracy, fix.Accuracy) {
+		return nil
+	}
+
+	speed := distance / dt.Seconds()
+	if speed > maxDerivedSpeed {
+		return nil
+	}
+
+	if course < 0 {
+		course += 360
+	}
+
+	return &models.Velocity{Speed: speed, Course: course}
+}
+
 // Пересчитывает азимут и расстояние между двумя клиентами
 func calculateAzimuthAndDistanceBetweenPositions(clientA *models.ClientInfo, clientB *models.ClientInfo) (distance, azimuthAtoB, azimuthBtoA float64) {
 	geodesic.WGS84.Inverse(clientA.Position.Latitude, clientA.Position.Longitude,
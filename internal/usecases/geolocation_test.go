@@ -1,13 +1,20 @@
 package usecases_test
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
+	"github.com/appxpy/sphere-api/internal/config"
 	"github.com/appxpy/sphere-api/internal/models"
 	"github.com/appxpy/sphere-api/internal/storage"
 	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+	"github.com/appxpy/sphere-api/internal/zones"
 	"github.com/tidwall/geodesic"
 )
 
@@ -35,7 +42,7 @@ type GeolocationUsecaseTestSuite struct {
 func (t *GeolocationUsecaseTestSuite) SetupTest() {
 	// Initialize the repository and usecase
 	t.repo = storage.NewClientRepository()
-	t.usecase = usecases.NewGeolocationUsecase(t.repo)
+	t.usecase = usecases.NewGeolocationUsecase(t.repo, config.Default().Geolocation)
 
 	// Initialize test variables
 	t.client1ID = "client1"
@@ -65,17 +72,17 @@ func (t *GeolocationUsecaseTestSuite) TestClientsUpdatingPositions() {
 	t.repo.AddClient(t.client2)
 	t.repo.AddClient(t.client3)
 
-	t.usecase.UpdatePosition(t.client1ID, t.pos1.Latitude, t.pos1.Longitude)
-	t.usecase.UpdatePosition(t.client2ID, t.pos2.Latitude, t.pos2.Longitude)
-	t.usecase.UpdatePosition(t.client3ID, t.pos3.Latitude, t.pos3.Longitude)
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude})
 
-	t.Require().Equal(t.client1.Position.ClosestClientID, t.client2ID, "Moscow should be closest to Kiev than to Amsterdam")
-	t.Require().Equal(t.client2.Position.ClosestClientID, t.client1ID, "Kiev should be closest to Moscow than to Amsterdam")
-	t.Require().Equal(t.client3.Position.ClosestClientID, t.client2ID, "Amsterdam should be closest to Kiev than to Moscow")
+	t.Require().Equal(t.stored(t.client1ID).Position.ClosestClientID, t.client2ID, "Moscow should be closest to Kiev than to Amsterdam")
+	t.Require().Equal(t.stored(t.client2ID).Position.ClosestClientID, t.client1ID, "Kiev should be closest to Moscow than to Amsterdam")
+	t.Require().Equal(t.stored(t.client3ID).Position.ClosestClientID, t.client2ID, "Amsterdam should be closest to Kiev than to Moscow")
 
 	// Let's simulate client1 (Moscow) moving to a new location (Las Vegas)
 	newPos1 := &models.Position{Latitude: 36.1699, Longitude: -115.1398} // Las Vegas
-	t.usecase.UpdatePosition(t.client1ID, newPos1.Latitude, newPos1.Longitude)
+	t.usecase.UpdatePosition(t.client1ID, newPos1)
 
 	client1, _ := t.repo.GetClient(t.client1ID)
 	client2, _ := t.repo.GetClient(t.client2ID)
@@ -90,11 +97,656 @@ func (t *GeolocationUsecaseTestSuite) TestClientsUpdatingPositions() {
 	t.Require().Equal(client3.Position.Distance, calculateDistance(client2, client3), "Distance between client3 (Amsterdam) and client2 (Kiev) calculated incorrectly!")
 
 	// Return Las Vegas back to Moscow
-	t.usecase.UpdatePosition(t.client1ID, t.pos1.Latitude, t.pos1.Longitude)
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
 
-	t.Require().Equal(t.client1.Position.ClosestClientID, t.client2ID, "Moscow should be closest to Kiev than to Amsterdam")
-	t.Require().Equal(t.client2.Position.ClosestClientID, t.client1ID, "Kiev should be closest to Moscow than to Amsterdam")
-	t.Require().Equal(t.client3.Position.ClosestClientID, t.client2ID, "Amsterdam should be closest to Kiev than to Moscow")
+	t.Require().Equal(t.stored(t.client1ID).Position.ClosestClientID, t.client2ID, "Moscow should be closest to Kiev than to Amsterdam")
+	t.Require().Equal(t.stored(t.client2ID).Position.ClosestClientID, t.client1ID, "Kiev should be closest to Moscow than to Amsterdam")
+	t.Require().Equal(t.stored(t.client3ID).Position.ClosestClientID, t.client2ID, "Amsterdam should be closest to Kiev than to Moscow")
+}
+
+// TestPositionValidation tests that invalid, stale and less accurate fixes are rejected
+func (t *GeolocationUsecaseTestSuite) TestPositionValidation() {
+	t.repo.AddClient(t.client1)
+
+	_, err := t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 91, Longitude: 0})
+	t.Require().ErrorIs(err, util.ErrInvalidLatitude)
+
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 0, Longitude: math.Inf(1)})
+	t.Require().ErrorIs(err, util.ErrInvalidLongitude)
+
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 0, Longitude: 0, Accuracy: math.NaN()})
+	t.Require().ErrorIs(err, util.ErrInvalidAccuracy)
+
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 0, Longitude: 0, Source: "satellite"})
+	t.Require().ErrorIs(err, util.ErrInvalidSource)
+
+	t.Require().Nil(t.stored(t.client1ID).Position, "Rejected fixes must not be stored")
+
+	now := time.Now()
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{
+		Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude, Accuracy: 10, Timestamp: now, Source: models.PositionSourceGPS,
+	})
+	t.Require().NoError(err)
+	t.Require().Equal(10.0, t.stored(t.client1ID).Position.Accuracy)
+	t.Require().Equal(models.PositionSourceGPS, t.stored(t.client1ID).Position.Source)
+
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{
+		Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude, Timestamp: now.Add(-time.Second),
+	})
+	t.Require().ErrorIs(err, util.ErrStaleFix)
+
+	_, err = t.usecase.UpdatePosition(t.client1ID, &models.Position{
+		Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude, Accuracy: 500, Timestamp: now.Add(time.Second), Source: models.PositionSourceNetwork,
+	})
+	t.Require().ErrorIs(err, util.ErrLessAccurateFix)
+	t.Require().Equal(t.pos1.Latitude, t.stored(t.client1ID).Position.Latitude)
+}
+
+// TestPositionSmoothing tests that the smoothing filter keeps raw values and resets on large jumps
+func (t *GeolocationUsecaseTestSuite) TestPositionSmoothing() {
+	cfg := config.Default().Geolocation
+	cfg.Smoothing.Filter = config.SmoothingExponential
+	cfg.Smoothing.Alpha = 0.5
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	t.repo.AddClient(t.client1)
+	now := time.Now()
+
+	_, err := usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0, Timestamp: now})
+	t.Require().NoError(err)
+
+	_, err = usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.001, Longitude: 37.001, Timestamp: now.Add(time.Second)})
+	t.Require().NoError(err)
+	t.Require().InDelta(55.0005, t.stored(t.client1ID).Position.Latitude, 1e-9, "Latitude should be smoothed")
+	t.Require().InDelta(37.0005, t.stored(t.client1ID).Position.Longitude, 1e-9, "Longitude should be smoothed")
+	t.Require().Equal(55.001, t.stored(t.client1ID).Position.RawLatitude, "Raw latitude should be kept")
+	t.Require().Equal(37.001, t.stored(t.client1ID).Position.RawLongitude, "Raw longitude should be kept")
+
+	// Jump from Moscow to Kiev resets the filter
+	_, err = usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude, Timestamp: now.Add(2 * time.Second)})
+	t.Require().NoError(err)
+	t.Require().Equal(t.pos2.Latitude, t.stored(t.client1ID).Position.Latitude)
+	t.Require().Equal(t.pos2.Longitude, t.stored(t.client1ID).Position.Longitude)
+}
+
+// TestNearestSwitchingHysteresis tests that the nearest client switches only after the margin and dwell time
+func (t *GeolocationUsecaseTestSuite) TestNearestSwitchingHysteresis() {
+	cfg := config.Default().Geolocation
+	cfg.Switching.MarginPercent = 20
+	cfg.Switching.DwellTime = 50 * time.Millisecond
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+
+	// client2 is ~1000 m north of client1, client3 is ~1100 m south of it
+	usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.009, Longitude: 37.0})
+	usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 54.9901, Longitude: 37.0})
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+
+	// client3 is now closer, but by less than 20%
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 54.9991, Longitude: 37.0})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID, "Switch must wait for the margin")
+	t.Require().Equal(t.stored(t.client1ID).Position.GeodesicDistanceTo(t.stored(t.client2ID).Position), t.stored(t.client1ID).Position.Distance, "Distance must follow the kept nearest")
+
+	// client3 is now closer by more than 20%, but the dwell time has not passed yet
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 54.9964, Longitude: 37.0})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID, "Switch must wait for the dwell time")
+
+	time.Sleep(60 * time.Millisecond)
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 54.9964, Longitude: 37.0})
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID, "Switch must happen after the dwell time")
+
+	// The current nearest disconnecting switches immediately
+	t.repo.RemoveClient(t.client3ID)
+	usecase.UpdateRelatedClients(t.client3ID)
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID, "Departure of the nearest must switch immediately")
+}
+
+// TestMinimumMovement tests that moves below the threshold only refresh the fix metadata
+func (t *GeolocationUsecaseTestSuite) TestMinimumMovement() {
+	cfg := config.Default().Geolocation
+	cfg.MinMovement = 5
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0})
+	indexed := t.stored(t.client1ID).Position
+
+	// ~1 m north
+	notify, err := usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.00001, Longitude: 37.0, Accuracy: 3})
+	t.Require().NoError(err)
+	t.Require().Empty(notify, "Nobody should be notified about a move below the threshold")
+	position := t.stored(t.client1ID).Position
+	t.Require().Equal([]float64{indexed.X, indexed.Y, indexed.Z}, []float64{position.X, position.Y, position.Z}, "Position should not be re-indexed")
+	t.Require().Equal(55.0, t.stored(t.client1ID).Position.Latitude)
+	t.Require().Equal(3.0, t.stored(t.client1ID).Position.Accuracy, "Fix metadata should be refreshed")
+
+	// ~11 m north
+	notify, err = usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0001, Longitude: 37.0})
+	t.Require().NoError(err)
+	t.Require().NotEmpty(notify)
+	t.Require().Equal(55.0001, t.stored(t.client1ID).Position.Latitude)
+}
+
+// TestDeadReckoningFromReceipt tests that a fix stamped in the past is extrapolated from the moment the server received it
+func (t *GeolocationUsecaseTestSuite) TestDeadReckoningFromReceipt() {
+	cfg := config.Default().Geolocation
+	cfg.DeadReckoning.MaxAge = 10 * time.Second
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+	usecase.SetPrivacy(exactPrivacy())
+	now := time.Now()
+	usecase.SetClock(func() time.Time { return now })
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0, Timestamp: now})
+	_, err := usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.01, Longitude: 37.0, Timestamp: now.Add(-30 * time.Second),
+		Velocity: &models.Velocity{Speed: 10}})
+	t.Require().NoError(err)
+
+	interpolated := usecase.InterpolateNearest(now)
+	t.Require().Contains(interpolated, t.client1ID)
+	t.Require().InDelta(t.stored(t.client1ID).Position.Distance, interpolated[t.client1ID].Distance, 0.01, "The fix does not jump forward")
+	t.Require().InDelta(t.stored(t.client1ID).Position.Distance+50, usecase.InterpolateNearest(now.Add(5 * time.Second))[t.client1ID].Distance, 0.01)
+}
+
+// TestDeadReckoning tests velocity derivation and extrapolation of the nearest client between updates
+func (t *GeolocationUsecaseTestSuite) TestDeadReckoning() {
+	cfg := config.Default().Geolocation
+	cfg.DeadReckoning.MaxAge = 10 * time.Second
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+	usecase.SetPrivacy(exactPrivacy())
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	now := time.Now()
+
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0, Timestamp: now})
+	usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.01, Longitude: 37.0, Timestamp: now.Add(-2 * time.Second)})
+
+	// Velocity is derived from two consecutive fixes: client2 is moving north
+	_, err := usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.0101, Longitude: 37.0, Timestamp: now})
+	t.Require().NoError(err)
+	t.Require().NotNil(t.stored(t.client2ID).Position.Velocity)
+	t.Require().InDelta(0.0, t.stored(t.client2ID).Position.Velocity.Course, 1e-6)
+	speed := t.stored(t.client2ID).Position.Velocity.Speed
+	t.Require().Greater(speed, 0.0)
+
+	interpolated := usecase.InterpolateNearest(now.Add(5 * time.Second))
+	t.Require().Contains(interpolated, t.client1ID)
+	t.Require().Equal(t.client2ID, interpolated[t.client1ID].ID)
+	t.Require().InDelta(t.stored(t.client1ID).Position.Distance+speed*5, interpolated[t.client1ID].Distance, 0.01)
+
+	// Extrapolation stops at the maximum age
+	capped := usecase.InterpolateNearest(now.Add(time.Minute))
+	t.Require().InDelta(t.stored(t.client1ID).Position.Distance+speed*10, capped[t.client1ID].Distance, 0.01)
+
+	// A client reporting zero speed is not extrapolated
+	_, err = usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.0101, Longitude: 37.0, Timestamp: now.Add(time.Second), Velocity: &models.Velocity{}})
+	t.Require().NoError(err)
+	t.Require().NotContains(usecase.InterpolateNearest(now.Add(5*time.Second)), t.client1ID)
+
+	// Jitter within the fix accuracy does not produce a velocity
+	_, err = usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.0102, Longitude: 37.0, Accuracy: 50, Timestamp: now.Add(3 * time.Second)})
+	t.Require().NoError(err)
+	t.Require().Nil(t.stored(t.client2ID).Position.Velocity)
+
+	// Fixes closer than a second apart do not produce a velocity
+	_, err = usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.02, Longitude: 37.0, Accuracy: 50, Timestamp: now.Add(3*time.Second + 500*time.Millisecond)})
+	t.Require().NoError(err)
+	t.Require().Nil(t.stored(t.client2ID).Position.Velocity)
+
+	// An implausible jump is not turned into a speed
+	_, err = usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 56.0, Longitude: 37.0, Accuracy: 50, Timestamp: now.Add(5 * time.Second)})
+	t.Require().NoError(err)
+	t.Require().Nil(t.stored(t.client2ID).Position.Velocity)
+}
+
+// TestStalePositionExpiry tests that positions expire by server receipt time and fresh updates re-admit them
+func (t *GeolocationUsecaseTestSuite) TestStalePositionExpiry() {
+	cfg := config.Default().Geolocation
+	cfg.PositionTTL = time.Minute
+	usecase := usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+	now := time.Now()
+
+	// client2 is received two minutes ago, client1 reports an old fix timestamp but is received just now
+	usecase.SetClock(func() time.Time { return now.Add(-2 * time.Minute) })
+	usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude, Timestamp: now.Add(-2 * time.Minute)})
+	usecase.SetClock(func() time.Time { return now })
+	usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude, Timestamp: now.Add(-5 * time.Minute)})
+	usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude, Timestamp: now})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+
+	venue, err := zones.Parse([]byte(`{"type": "Feature", "properties": {"id": "kiev"},
+		"geometry": {"type": "Polygon", "coordinates": [[[30, 50], [31, 50], [31, 51], [30, 51], [30, 50]]]}}`))
+	t.Require().NoError(err)
+	usecase.AddZones(venue)
+	t.Require().Equal([]string{"kiev"}, t.stored(t.client2ID).Zones)
+
+	expired, transitions, notify := usecase.ExpireStalePositions(now)
+	t.Require().Equal(map[string]time.Time{t.client2ID: now.Add(-2 * time.Minute)}, expired)
+	t.Require().Equal([]*models.ZoneTransition{{ClientID: t.client2ID, ZoneID: "kiev"}}, transitions)
+	t.Require().Empty(t.stored(t.client2ID).Zones, "Expired client should leave its zones")
+	t.Require().ElementsMatch([]string{t.client1ID, t.client3ID}, notify)
+	t.Require().Nil(t.stored(t.client2ID).Position, "Stale position should be removed")
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID, "Referencing clients should be recalculated")
+
+	_, err = t.usecase.GetClosestClient(t.client2ID)
+	t.Require().ErrorIs(err, util.ErrNoPositionProvided)
+
+	// A fresh update re-admits the client
+	_, err = usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude, Timestamp: now})
+	t.Require().NoError(err)
+	t.Require().Equal(t.client1ID, t.stored(t.client2ID).Position.ClosestClientID)
+
+	expired, _, _ = usecase.ExpireStalePositions(now)
+	t.Require().Empty(expired)
+}
+
+// TestIsolatedZone tests that isolated zones tag clients and scope pairing to their side of the border
+func (t *GeolocationUsecaseTestSuite) TestIsolatedZone() {
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+
+	// client2 is just outside the venue and is the closest one to client1
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.5, Longitude: 37.9})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.5, Longitude: 38.01})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 55.9, Longitude: 37.1})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+
+	venue, err := zones.Parse([]byte(`{"type": "Feature", "properties": {"id": "venue", "pairing": "isolated"},
+		"geometry": {"type": "Polygon", "coordinates": [[[37, 55], [38, 55], [38, 56], [37, 56], [37, 55]]]}}`))
+	t.Require().NoError(err)
+
+	transitions, notify := t.usecase.AddZones(venue)
+	t.Require().ElementsMatch([]*models.ZoneTransition{
+		{ClientID: t.client1ID, ZoneID: "venue", Entered: true},
+		{ClientID: t.client3ID, ZoneID: "venue", Entered: true},
+	}, transitions)
+	t.Require().Contains(notify, t.client1ID)
+	t.Require().Contains(notify, t.client2ID)
+
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID, "Clients inside the venue pair only with each other")
+	t.Require().Empty(t.stored(t.client2ID).Position.ClosestClientID, "Clients outside the venue cannot pair across the border")
+
+	// Leaving the venue lifts the restriction for client1
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.5, Longitude: 38.02})
+	t.Require().Empty(t.stored(t.client1ID).Zones)
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+}
+
+// TestZoneValidation tests that unnamed zones get registry-unique IDs and malformed documents are rejected
+func (t *GeolocationUsecaseTestSuite) TestZoneValidation() {
+	unnamed := `{"type": "Polygon", "coordinates": [[[37, 55], [38, 55], [38, 56], [37, 56], [37, 55]]]}`
+
+	first, err := zones.Parse([]byte(unnamed))
+	t.Require().NoError(err)
+	second, err := zones.Parse([]byte(unnamed))
+	t.Require().NoError(err)
+	t.usecase.AddZones(first)
+	t.usecase.AddZones(second)
+	t.Require().Len(t.usecase.GetZones(), 2, "Unnamed zones from different documents should not replace each other")
+
+	_, err = zones.Parse([]byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "id": "venue", "geometry": ` + unnamed + `},
+		{"type": "Feature", "properties": {"id": "venue"}, "geometry": ` + unnamed + `}]}`))
+	t.Require().ErrorIs(err, util.ErrDuplicateZoneID)
+
+	_, err = zones.Parse([]byte(`{"type": "Polygon", "coordinates": [[[37, 55], [38, 55], [38, 56], [37, 56]]]}`))
+	t.Require().ErrorIs(err, util.ErrInvalidGeoJSON, "Open rings should be rejected")
+
+	_, err = zones.Parse([]byte(`{"type": "Polygon", "coordinates": [[[37, 55], [38, 55], [37, 55]]]}`))
+	t.Require().ErrorIs(err, util.ErrInvalidGeoJSON, "Rings with fewer than four points should be rejected")
+}
+
+// TestRooms tests that rooms have isolated pairing, limits and listings
+func (t *GeolocationUsecaseTestSuite) TestRooms() {
+	users := usecases.NewUsersUsecase(t.repo, config.Default().Privacy)
+	users.AddClient(t.client1)
+	users.AddClient(t.client2)
+	users.AddClient(t.client3)
+
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude})
+	t.Require().Equal(models.GlobalRoom, t.stored(t.client1ID).Room)
+	t.Require().Equal(t.client1ID, t.stored(t.client2ID).Position.ClosestClientID)
+
+	room, notify, err := t.usecase.JoinRoom(t.client1ID, "event", &models.RoomOptions{Limit: 2, Metadata: map[string]string{"title": "Party"}})
+	t.Require().NoError(err)
+	t.Require().Equal(&models.RoomInfo{Name: "event", Limit: 2, Metadata: map[string]string{"title": "Party"}, Members: 1}, room)
+	t.Require().Contains(notify, t.client2ID)
+	t.Require().Equal(t.client3ID, t.stored(t.client2ID).Position.ClosestClientID, "Clients of the global room should not pair with the event room")
+	t.Require().Empty(t.stored(t.client1ID).Position.ClosestClientID, "client1 is alone in the event room")
+
+	_, _, err = t.usecase.JoinRoom(t.client3ID, "event", nil)
+	t.Require().NoError(err)
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Empty(t.stored(t.client2ID).Position.ClosestClientID, "client2 is alone in the global room")
+
+	_, _, err = t.usecase.JoinRoom(t.client2ID, "event", nil)
+	t.Require().ErrorIs(err, util.ErrRoomFull)
+
+	t.Require().Len(users.GetExposedClients(t.client1ID), 2, "Listings should contain only the viewer's room")
+	_, err = users.GetExposedClientInfo(t.client2ID, t.client1ID)
+	t.Require().ErrorIs(err, util.ErrClientNotFound)
+
+	_, notify, err = t.usecase.LeaveRoom(t.client1ID)
+	t.Require().NoError(err)
+	t.Require().ElementsMatch([]string{t.client1ID, t.client2ID, t.client3ID}, notify)
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Empty(t.stored(t.client3ID).Position.ClosestClientID)
+}
+
+// TestBlockList tests that blocked clients are skipped by pairing and listings in both directions
+func (t *GeolocationUsecaseTestSuite) TestBlockList() {
+	users := usecases.NewUsersUsecase(t.repo, config.Default().Privacy)
+	users.AddClient(t.client1)
+	users.AddClient(t.client2)
+	users.AddClient(t.client3)
+
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude})
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Equal(t.client1ID, t.stored(t.client2ID).Position.ClosestClientID)
+
+	_, err := t.usecase.BlockClient(t.client1ID, t.client1ID)
+	t.Require().ErrorIs(err, util.ErrCannotBlockSelf)
+
+	notify, err := t.usecase.BlockClient(t.client1ID, t.client2ID)
+	t.Require().NoError(err)
+	t.Require().ElementsMatch([]string{t.client1ID, t.client2ID}, notify)
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID, "Blocked client should be skipped")
+	t.Require().Equal(t.client3ID, t.stored(t.client2ID).Position.ClosestClientID, "Block should be honored symmetrically")
+
+	t.Require().Len(users.GetExposedClients(t.client2ID), 2, "Blocked client should not be listed")
+	_, err = users.GetExposedClientInfo(t.client2ID, t.client1ID)
+	t.Require().ErrorIs(err, util.ErrClientNotFound)
+
+	// The block is stored per identity and survives a reconnect
+	reconnected := &models.ClientInfo{ID: "client2-reconnected", Identity: t.stored(t.client2ID).Identity}
+	users.AddClient(reconnected)
+	t.usecase.UpdatePosition(reconnected.ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().NotEqual(t.client1ID, t.stored(reconnected.ID).Position.ClosestClientID)
+
+	_, err = t.usecase.UnblockClient(t.client1ID, t.client2ID)
+	t.Require().NoError(err)
+	t.Require().Contains([]string{t.client2ID, reconnected.ID}, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Len(users.GetExposedClients(t.client2ID), 4)
+}
+
+// TestExclusivePairing tests that exclusive mode forms mutual pairs and repairs them when clients move or leave
+func (t *GeolocationUsecaseTestSuite) TestExclusivePairing() {
+	cfg := config.Default().Geolocation
+	cfg.Pairing = config.PairingExclusive
+	t.usecase = usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	client4 := &models.ClientInfo{ID: "client4"}
+	for _, client := range []*models.ClientInfo{t.client1, t.client2, t.client3, client4} {
+		t.repo.AddClient(client)
+	}
+
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 0, Longitude: 0})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 0, Longitude: 0.01})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 0, Longitude: 0.025})
+	notify, err := t.usecase.UpdatePosition(client4.ID, &models.Position{Latitude: 0, Longitude: 0.1})
+	t.Require().NoError(err)
+	t.Require().ElementsMatch([]string{t.client3ID, client4.ID}, notify)
+
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Equal(t.client1ID, t.stored(t.client2ID).Position.ClosestClientID)
+	t.Require().Equal(client4.ID, t.stored(t.client3ID).Position.ClosestClientID, "client2 is already paired, so client3 pairs with client4")
+	t.Require().Equal(t.client3ID, t.stored(client4.ID).Position.ClosestClientID)
+	t.Require().Len(t.repo.WhoReferenceMeAsNearest(t.client2ID), 1, "Each client is referenced by its partner only")
+
+	// client3 moves next to client1, who leaves client2 for it
+	notify, _ = t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 0, Longitude: -0.005})
+	t.Require().ElementsMatch([]string{t.client1ID, t.client2ID, t.client3ID, client4.ID}, notify)
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Equal(client4.ID, t.stored(t.client2ID).Position.ClosestClientID, "Abandoned partners pair with each other")
+
+	// When client1 leaves, client3 takes client2 from the farther client4
+	t.repo.RemoveClient(t.client1ID)
+	notify = t.usecase.UpdateRelatedClients(t.client1ID)
+	t.usecase.DeleteClientFromNearestReferences(t.client1ID)
+	t.Require().Equal([]string{t.client2ID, t.client3ID, client4.ID}, notify)
+	t.Require().Equal(t.client2ID, t.stored(t.client3ID).Position.ClosestClientID)
+	t.Require().Equal(t.client3ID, t.stored(t.client2ID).Position.ClosestClientID)
+	t.Require().Empty(t.stored(client4.ID).Position.ClosestClientID)
+}
+
+// TestRoomPairingMode tests that a room can choose its own pairing mode
+func (t *GeolocationUsecaseTestSuite) TestRoomPairingMode() {
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+
+	_, _, err := t.usecase.JoinRoom(t.client1ID, "dance", &models.RoomOptions{Pairing: "triples"})
+	t.Require().ErrorIs(err, util.ErrInvalidPairingMode)
+
+	room, _, err := t.usecase.JoinRoom(t.client1ID, "dance", &models.RoomOptions{Pairing: config.PairingExclusive})
+	t.Require().NoError(err)
+	t.Require().Equal(config.PairingExclusive, room.Pairing)
+	t.usecase.JoinRoom(t.client2ID, "dance", nil)
+	t.usecase.JoinRoom(t.client3ID, "dance", nil)
+
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude})
+
+	t.Require().Equal(t.client2ID, t.stored(t.client1ID).Position.ClosestClientID)
+	t.Require().Equal(t.client1ID, t.stored(t.client2ID).Position.ClosestClientID)
+	t.Require().Empty(t.stored(t.client3ID).Position.ClosestClientID, "The odd client out has no partner in exclusive mode")
+}
+
+// TestDistanceBand tests that too close candidates are skipped and too far ones leave the client without a nearest
+func (t *GeolocationUsecaseTestSuite) TestDistanceBand() {
+	cfg := config.Default().Geolocation
+	cfg.Distance.Min = 50
+	t.usecase = usecases.NewGeolocationUsecase(t.repo, cfg)
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+
+	// client2 is a second phone next to client1, client3 is about a kilometer away
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 0, Longitude: 0.01})
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 0, Longitude: 0})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 0, Longitude: 0.0001})
+	t.Require().Equal(t.client3ID, t.stored(t.client1ID).Position.ClosestClientID, "Too close candidates should be skipped")
+	t.Require().Equal(t.client3ID, t.stored(t.client2ID).Position.ClosestClientID)
+
+	negative, minimum, maximum := -1.0, 2000.0, 500.0
+	_, err := t.usecase.SetPreferences(t.client3ID, &models.PairingPreferences{MaxDistance: &negative})
+	t.Require().ErrorIs(err, util.ErrInvalidDistanceBand)
+	_, err = t.usecase.SetPreferences(t.client3ID, &models.PairingPreferences{MinDistance: &minimum, MaxDistance: &maximum})
+	t.Require().ErrorIs(err, util.ErrInvalidDistanceBand)
+
+	notify, err := t.usecase.SetPreferences(t.client3ID, &models.PairingPreferences{MaxDistance: &maximum})
+	t.Require().NoError(err)
+	t.Require().Contains(notify, t.client3ID)
+	t.Require().Empty(t.stored(t.client3ID).Position.ClosestClientID, "Nobody is within the maximum distance")
+
+	band, _ := t.usecase.DistanceBand(t.stored(t.client3ID))
+	t.Require().Equal(50.0, band, "Unset preferences fall back to the deployment")
+
+	// A move of the client without eligible candidates still reports its state
+	notify, _ = t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: 0, Longitude: 0.011})
+	t.Require().Equal([]string{t.client3ID}, notify)
+}
+
+// TestNearestResponsePrivacy tests that distance and azimuth pushed to a client are rounded and point to the exposed position of its nearest
+func (t *GeolocationUsecaseTestSuite) TestNearestResponsePrivacy() {
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.Require().Nil(t.usecase.NearestResponse(t.client1))
+
+	now := time.Now()
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 55.0, Longitude: 37.0, Timestamp: now})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: 55.0123, Longitude: 37.0071, Timestamp: now, Velocity: &models.Velocity{Speed: 3}})
+
+	coarse := config.Default().Privacy
+	coarse.SessionOffset = 0
+	t.usecase.SetPrivacy(coarse)
+	stored := t.stored(t.client1ID).Position
+
+	response := t.usecase.NearestResponse(t.stored(t.client1ID))
+	t.Require().Equal(t.client2ID, response.ID)
+	t.Require().Zero(math.Mod(response.Distance, coarse.DistanceRounding), "Distance should be rounded")
+	t.Require().Equal(math.Round(response.Azimuth), response.Azimuth, "Azimuth should be rounded")
+	t.Require().NotEqual(stored.Distance, response.Distance)
+	t.Require().InDelta(stored.Distance, response.Distance, coarse.GridSize+coarse.DistanceRounding)
+
+	interpolated := t.usecase.InterpolateNearest(now.Add(time.Second))[t.client1ID]
+	t.Require().Zero(math.Mod(interpolated.Distance, coarse.DistanceRounding), "Interpolated distance should be rounded")
+	t.Require().Equal(math.Round(interpolated.Azimuth), interpolated.Azimuth)
+
+	// Without coarsening the pushed values follow the exact positions
+	t.usecase.SetPrivacy(exactPrivacy())
+	response = t.usecase.NearestResponse(t.stored(t.client1ID))
+	t.Require().InDelta(stored.Distance, response.Distance, 1e-6)
+	t.Require().InDelta(stored.Azimuth, response.Azimuth, 0.5)
+}
+
+// TestPairPath tests geodesic and rhumb paths between a client and its nearest
+func (t *GeolocationUsecaseTestSuite) TestPairPath() {
+	t.usecase.SetPrivacy(exactPrivacy())
+
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+
+	_, _, err := t.usecase.GetPairPath(t.client1ID, nil)
+	t.Require().ErrorIs(err, util.ErrNoPositionProvided)
+
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: t.pos1.Latitude, Longitude: t.pos1.Longitude})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+
+	_, _, err = t.usecase.GetPairPath(t.client1ID, &models.PathOptions{Method: "straight"})
+	t.Require().ErrorIs(err, util.ErrInvalidPathMethod)
+
+	nearestID, path, err := t.usecase.GetPairPath(t.client1ID, &models.PathOptions{Waypoints: 5})
+	t.Require().NoError(err)
+	t.Require().Equal(t.client2ID, nearestID)
+	t.Require().InDelta(t.stored(t.client1ID).Position.Distance, path.Distance, 1e-6)
+	t.Require().InDelta(t.stored(t.client1ID).Position.Azimuth, path.InitialBearing, 1e-9)
+	t.Require().Len(path.Waypoints, 5)
+	t.Require().InDelta(t.pos1.Latitude, path.Waypoints[0].Latitude, 1e-9)
+	t.Require().InDelta(t.pos2.Longitude, path.Waypoints[4].Longitude, 1e-9)
+	t.Require().Equal(path.Midpoint, path.Waypoints[2])
+
+	midpoint := &models.ClientInfo{Position: &models.Position{Latitude: path.Midpoint.Latitude, Longitude: path.Midpoint.Longitude}}
+	t.Require().InDelta(calculateDistance(t.stored(t.client1ID), midpoint), calculateDistance(midpoint, t.stored(t.client2ID)), 1e-3, "Midpoint should be equidistant")
+
+	_, rhumb, err := t.usecase.GetPairPath(t.client1ID, &models.PathOptions{Method: "rhumb", Waypoints: 9})
+	t.Require().NoError(err)
+	t.Require().Equal(rhumb.InitialBearing, rhumb.FinalBearing, "Rhumb line keeps a constant bearing")
+	t.Require().Greater(rhumb.Distance, path.Distance, "Rhumb line is longer than the geodesic")
+	t.Require().Less(rhumb.Distance, path.Distance*1.01)
+	t.Require().InDelta(t.pos2.Latitude, rhumb.Waypoints[8].Latitude, 1e-7)
+	t.Require().InDelta(t.pos2.Longitude, rhumb.Waypoints[8].Longitude, 1e-7)
+
+	// The path is attached to nearest pushes once the client opts in
+	t.Require().Nil(t.usecase.NearestPath(t.stored(t.client1ID)))
+	_, err = t.usecase.SetPreferences(t.client1ID, &models.PairingPreferences{Path: &models.PathOptions{Method: "rhumb"}})
+	t.Require().NoError(err)
+	t.Require().Len(t.usecase.NearestPath(t.stored(t.client1ID)).Waypoints, 16)
+
+	// The endpoint is the nearest's position as the deployment privacy policy exposes it
+	coarse := config.Default().Privacy
+	coarse.SessionOffset = 0
+	t.usecase.SetPrivacy(coarse)
+	_, coarsened, err := t.usecase.GetPairPath(t.client1ID, &models.PathOptions{Waypoints: 2})
+	t.Require().NoError(err)
+	end := &models.ClientInfo{Position: &models.Position{Latitude: coarsened.Waypoints[1].Latitude, Longitude: coarsened.Waypoints[1].Longitude}}
+	t.Require().NotEqual(t.pos2.Latitude, end.Position.Latitude, "The exact position should not be exposed")
+	t.Require().Less(calculateDistance(end, t.stored(t.client2ID)), coarse.GridSize)
+
+	// No path leads to a nearest that hides its coordinates
+	t.repo.UpdateClientPrivacy(t.client2ID, &models.PrivacySettings{Coordinates: config.CoordinatesHidden})
+	_, _, err = t.usecase.GetPairPath(t.client1ID, nil)
+	t.Require().ErrorIs(err, util.ErrNearestPositionHidden)
+	t.Require().Nil(t.usecase.NearestPath(t.stored(t.client1ID)))
+}
+
+// TestReverseNearest tests that a client is told when someone moves closer than its current nearest
+func (t *GeolocationUsecaseTestSuite) TestReverseNearest() {
+	t.repo.AddClient(t.client1)
+	t.repo.AddClient(t.client2)
+	t.repo.AddClient(t.client3)
+
+	// client3 in Amsterdam pairs with client2 in Kiev, client1 is far away in Las Vegas
+	t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 36.1699, Longitude: -115.1398})
+	t.usecase.UpdatePosition(t.client2ID, &models.Position{Latitude: t.pos2.Latitude, Longitude: t.pos2.Longitude})
+	t.usecase.UpdatePosition(t.client3ID, &models.Position{Latitude: t.pos3.Latitude, Longitude: t.pos3.Longitude})
+	t.Require().Equal(t.client2ID, t.stored(t.client3ID).Position.ClosestClientID)
+
+	// client1 moves next to client3 without being referenced by it
+	notify, err := t.usecase.UpdatePosition(t.client1ID, &models.Position{Latitude: 52.37, Longitude: 4.9})
+	t.Require().NoError(err)
+	t.Require().Contains(notify, t.client3ID)
+	t.Require().Equal(t.client1ID, t.stored(t.client3ID).Position.ClosestClientID)
+	t.Require().InDelta(calculateDistance(t.stored(t.client3ID), t.stored(t.client1ID)), t.stored(t.client3ID).Position.Distance, 1e-6)
+}
+
+// TestNearestConsistency tests that incremental updates match a brute-force search after random moves
+func (t *GeolocationUsecaseTestSuite) TestNearestConsistency() {
+	random := rand.New(rand.NewSource(42))
+	clients := make([]*models.ClientInfo, 60)
+	for i := range clients {
+		clients[i] = &models.ClientInfo{ID: fmt.Sprintf("client-%d", i)}
+		t.repo.AddClient(clients[i])
+	}
+
+	// Clients move inside a small region, so that moves often change someone else's nearest
+	for step := 0; step < 2000; step++ {
+		client := clients[random.Intn(len(clients))]
+		_, err := t.usecase.UpdatePosition(client.ID, &models.Position{
+			Latitude:  50 + random.Float64(),
+			Longitude: 30 + random.Float64(),
+		})
+		t.Require().NoError(err)
+	}
+
+	for i := range clients {
+		clients[i] = t.stored(clients[i].ID)
+	}
+	for _, client := range clients {
+		var expected *models.ClientInfo
+		for _, other := range clients {
+			if other != client && (expected == nil || calculateDistance(client, other) < calculateDistance(client, expected)) {
+				expected = other
+			}
+		}
+		t.Require().Equal(expected.ID, client.Position.ClosestClientID, "Nearest of %s", client.ID)
+		t.Require().InDelta(calculateDistance(client, expected), client.Position.Distance, 1e-6)
+	}
+}
+
+// stored returns the current view of a client from the repository
+func (t *GeolocationUsecaseTestSuite) stored(id string) *models.ClientInfo {
+	client, ok := t.repo.GetClient(id)
+	t.Require().True(ok, "Client %s is not stored", id)
+	return client
+}
+
+// exactPrivacy returns a privacy policy that neither coarsens coordinates nor rounds distances
+func exactPrivacy() config.Privacy {
+	exact := config.Default().Privacy
+	exact.Coordinates = config.CoordinatesExact
+	exact.DistanceRounding = 0
+	return exact
 }
 
 // calculateDistance is a helper function to compute the geodesic distance between two points
@@ -0,0 +1,32 @@
+package usecases
+
+import (
+	"github.com/appxpy/sphere-api/internal/journal"
+)
+
+// Journal - Журнал, в который юзкейсы записывают операции, меняющие состояние клиентов
+type Journal interface {
+	Record(entry *journal.Entry)
+}
+
+// SetJournal - Включает запись операций в журнал (nil - выключает)
+func (u *UsersUsecase) SetJournal(journal Journal) {
+	u.journal = journal
+}
+
+func (u *UsersUsecase) record(entry *journal.Entry) {
+	if u.journal != nil {
+		u.journal.Record(entry)
+	}
+}
+
+// Записывает операцию со временем по часам юзкейса, чтобы при повторе она получила то же время
+func (u *GeolocationUsecase) record(entry *journal.Entry) {
+	if u.journal == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = u.now()
+	}
+	u.journal.Record(entry)
+}
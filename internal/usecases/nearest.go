@@ -0,0 +1,196 @@
+package usecases
+
+import (
+	"math"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+)
+
+// Пересчитывает ближайшего клиента для client с учетом гистерезиса, обновляет расстояние, азимут
+// и граф ссылок на ближайших. Возвращает клиентов, у которых сменился ближайший.
+func (u *GeolocationUsecase) refreshNearest(client *models.ClientInfo) []string {
+	if u.pairingMode(client) == config.PairingExclusive {
+		return u.repairPairs(client)
+	}
+
+	oldNearestID := client.Position.ClosestClientID
+
+	candidate, _ := u.repo.FindNearestClient(client.ID, u.candidateFilters()...)
+	if candidate != nil && !u.closeEnough(client, candidate) {
+		candidate = nil
+	}
+
+	// Новый ближайший записывается в копию позиции, которая целиком заменяет позицию в хранилище
+	position := *client.Position
+	nearest := u.applyHysteresis(client, &position, candidate, u.now())
+
+	if nearest == nil {
+		position.ClosestClientID = ""
+		position.Distance = 0
+		position.Azimuth = 0
+	} else {
+		// Вычисляем расстояние и азимут от клиента до его ближайшего клиента
+		position.ClosestClientID = nearest.ID
+		position.Distance, position.Azimuth, _ = calculateAzimuthAndDistanceBetweenPositions(client, nearest)
+	}
+	logStoreError(u.repo.UpdateNearestReference(client.ID, oldNearestID, &position), "update nearest of %s", client.ID)
+
+	return changedNearest(client.ID, position.ClosestClientID, oldNearestID)
+}
+
+// Возвращает клиента в виде списка для уведомления, если его ближайший nearestID отличается от oldNearestID
+func changedNearest(clientID, nearestID, oldNearestID string) []string {
+	if nearestID == oldNearestID {
+		return nil
+	}
+	return []string{clientID}
+}
+
+// Режим подбора пар в комнате клиента
+func (u *GeolocationUsecase) pairingMode(client *models.ClientInfo) string {
+	if room, ok := u.repo.GetRoom(client.Room); ok && room.Pairing != "" {
+		return room.Pairing
+	}
+	return u.cfg.Pairing
+}
+
+// Условия, которым должен удовлетворять кандидат в ближайшие. Фильтры вызываются под блокировкой хранилища,
+// поэтому не читают из него: заблокировавших друг друга клиентов хранилище пропускает само.
+func (u *GeolocationUsecase) candidateFilters() []storage.CandidateFilter {
+	return []storage.CandidateFilter{
+		// Пары образуются только внутри одной комнаты
+		func(client, candidate *models.ClientInfo) bool {
+			return client.Room == candidate.Room
+		},
+		// Изолирующие зоны не допускают пар через свою границу
+		func(client, candidate *models.ClientInfo) bool {
+			return u.zones.CanPair(client.Zones, candidate.Zones)
+		},
+		// Слишком близкие клиенты пропускаются
+		u.farEnough,
+	}
+}
+
+// Проверяет, может ли candidate быть ближайшим для client
+func (u *GeolocationUsecase) isEligible(client, candidate *models.ClientInfo) bool {
+	if u.repo.IsBlocked(client.Identity, candidate.Identity) {
+		return false
+	}
+	for _, accept := range u.candidateFilters() {
+		if !accept(client, candidate) {
+			return false
+		}
+	}
+	return u.closeEnough(client, candidate)
+}
+
+// Решает, переключаться ли с текущего ближайшего клиента на кандидата. Кандидат должен быть ближе
+// на заданный запас и оставаться ближе в течение времени удержания. Если текущий ближайший
+// отключился, потерял позицию или перестал подходить по условиям, переключение происходит сразу.
+// Ожидающий кандидат записывается в position - копию позиции клиента.
+func (u *GeolocationUsecase) applyHysteresis(client *models.ClientInfo, position *models.Position, candidate *models.ClientInfo, now time.Time) *models.ClientInfo {
+	currentID := position.ClosestClientID
+
+	if candidate == nil || currentID == "" || candidate.ID == currentID {
+		position.PendingClosestClientID = ""
+		return candidate
+	}
+
+	current, exists := u.repo.GetClient(currentID)
+	if !exists || !current.HasPosition() || !u.isEligible(client, current) {
+		position.PendingClosestClientID = ""
+		return candidate
+	}
+
+	currentDistance := position.GeodesicDistanceTo(current.Position)
+	candidateDistance := position.GeodesicDistanceTo(candidate.Position)
+
+	// Требуемый выигрыш - наибольший из абсолютного и относительного запаса
+	switching := u.cfg.Switching
+	margin := math.Max(switching.MarginMeters, currentDistance*switching.MarginPercent/100)
+	if improvement := currentDistance - candidateDistance; improvement <= 0 || improvement < margin {
+		position.PendingClosestClientID = ""
+		return current
+	}
+
+	if switching.DwellTime <= 0 {
+		position.PendingClosestClientID = ""
+		return candidate
+	}
+
+	if position.PendingClosestClientID != candidate.ID {
+		position.PendingClosestClientID = candidate.ID
+		position.PendingSince = now
+		return current
+	}
+
+	if now.Sub(position.PendingSince) < switching.DwellTime {
+		return current
+	}
+
+	position.PendingClosestClientID = ""
+	return candidate
+}
+
+// NearestResponse - Возвращает данные о ближайшем клиента в том виде, в котором их разрешено отправить клиенту.
+// Возвращает nil, если у клиента нет ближайшего.
+func (u *GeolocationUsecase) NearestResponse(client *models.ClientInfo) *models.GetNearestClientResponse {
+	if !client.HasPosition() || client.Position.ClosestClientID == "" {
+		return nil
+	}
+
+	nearest, exists := u.repo.GetClient(client.Position.ClosestClientID)
+	if !exists || !nearest.HasPosition() {
+		return nil
+	}
+
+	return u.nearestResponse(client.ID, client.Position, nearest, client.Preferences)
+}
+
+// Строит ответ с азимутом, расстоянием и путем от позиции from клиента viewerID до ближайшего,
+// раскрытые клиенту политикой приватности
+func (u *GeolocationUsecase) nearestResponse(viewerID string, from *models.Position, nearest *models.ClientInfo, preferences *models.PairingPreferences) *models.GetNearestClientResponse {
+	response := &models.GetNearestClientResponse{ID: nearest.ID}
+	response.Distance, response.Azimuth = u.privacy.Bearing(from.Latitude, from.Longitude, nearest, viewerID)
+	if preferences != nil && preferences.Path != nil {
+		response.Path = u.pairPath(viewerID, from, nearest, preferences.Path)
+	}
+	return response
+}
+
+// InterpolateNearest - Экстраполирует позиции клиентов к моменту now и возвращает интерполированные азимут
+// и расстояние до ближайшего для каждого клиента, у которого движется он сам или его ближайший
+func (u *GeolocationUsecase) InterpolateNearest(now time.Time) map[string]*models.GetNearestClientResponse {
+	maxAge := u.cfg.DeadReckoning.MaxAge
+	result := make(map[string]*models.GetNearestClientResponse)
+
+	for _, client := range u.repo.GetAllClients() {
+		if !client.HasPosition() || client.Position.ClosestClientID == "" {
+			continue
+		}
+
+		nearest, exists := u.repo.GetClient(client.Position.ClosestClientID)
+		if !exists || !nearest.HasPosition() {
+			continue
+		}
+
+		if !client.Position.IsMoving() && !nearest.Position.IsMoving() {
+			continue
+		}
+
+		fromLatitude, fromLongitude := client.Position.Extrapolate(now, maxAge)
+
+		// Азимут, расстояние и путь строятся до экстраполированной позиции ближайшего, огрубленной так же, как его текущая
+		extrapolated, position := *nearest, *nearest.Position
+		position.Latitude, position.Longitude = nearest.Position.Extrapolate(now, maxAge)
+		extrapolated.Position = &position
+
+		result[client.ID] = u.nearestResponse(client.ID, &models.Position{Latitude: fromLatitude, Longitude: fromLongitude},
+			&extrapolated, client.Preferences)
+	}
+
+	return result
+}
@@ -0,0 +1,90 @@
+package usecases
+
+import (
+	"github.com/appxpy/sphere-api/internal/geopath"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+const (
+	// defaultPathWaypoints - Количество точек пути, если клиент его не указал
+	defaultPathWaypoints = 16
+	// maxPathWaypoints - Максимальное количество точек пути
+	maxPathWaypoints = 256
+)
+
+// GetPairPath - Строит путь от клиента до его текущего ближайшего. Возвращает идентификатор ближайшего и путь.
+// Конец пути - позиция ближайшего в том виде, в котором ее разрешено видеть клиенту: огрубленная политикой
+// приватности, а если ближайший скрывает координаты, путь не строится.
+func (u *GeolocationUsecase) GetPairPath(clientID string, options *models.PathOptions) (string, *models.PairPath, error) {
+	options, err := normalizePathOptions(options)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return "", nil, util.ErrClientNotFound
+	}
+
+	if !client.HasPosition() {
+		return "", nil, util.ErrNoPositionProvided
+	}
+
+	nearest, exists := u.repo.GetClient(client.Position.ClosestClientID)
+	if !exists || !nearest.HasPosition() {
+		return "", nil, util.ErrNoClientsAvailable
+	}
+
+	path := u.pairPath(client.ID, client.Position, nearest, options)
+	if path == nil {
+		return "", nil, util.ErrNearestPositionHidden
+	}
+	return nearest.ID, path, nil
+}
+
+// NearestPath - Возвращает путь до ближайшего для уведомлений, если клиент на него подписан,
+// и nil, если ближайший скрывает координаты
+func (u *GeolocationUsecase) NearestPath(client *models.ClientInfo) *models.PairPath {
+	if client.Preferences == nil || client.Preferences.Path == nil || !client.HasPosition() {
+		return nil
+	}
+
+	nearest, exists := u.repo.GetClient(client.Position.ClosestClientID)
+	if !exists || !nearest.HasPosition() {
+		return nil
+	}
+
+	return u.pairPath(client.ID, client.Position, nearest, client.Preferences.Path)
+}
+
+// Строит путь от позиции from клиента viewerID до позиции ближайшего, раскрытой клиенту политикой приватности
+func (u *GeolocationUsecase) pairPath(viewerID string, from *models.Position, nearest *models.ClientInfo, options *models.PathOptions) *models.PairPath {
+	to := u.privacy.Expose(nearest, viewerID).Position
+	if to == nil {
+		return nil
+	}
+
+	return geopath.Build(options.Method, from.Latitude, from.Longitude, to.Latitude, to.Longitude, options.Waypoints)
+}
+
+// Подставляет значения по умолчанию и проверяет параметры пути
+func normalizePathOptions(options *models.PathOptions) (*models.PathOptions, error) {
+	normalized := models.PathOptions{Method: geopath.MethodGeodesic, Waypoints: defaultPathWaypoints}
+	if options == nil {
+		return &normalized, nil
+	}
+
+	if options.Method != "" {
+		if !geopath.IsValidMethod(options.Method) {
+			return nil, util.ErrInvalidPathMethod
+		}
+		normalized.Method = options.Method
+	}
+
+	if options.Waypoints > 0 {
+		normalized.Waypoints = min(max(options.Waypoints, 2), maxPathWaypoints)
+	}
+
+	return &normalized, nil
+}
@@ -0,0 +1,78 @@
+package usecases
+
+import (
+	"math"
+
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// SetPreferences - Сохраняет собственные допустимые расстояния клиента до ближайшего и пересчитывает его ближайшего.
+// Возвращает клиентов, которых нужно уведомить о смене ближайшего.
+func (u *GeolocationUsecase) SetPreferences(clientID string, preferences *models.PairingPreferences) ([]string, error) {
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil, util.ErrClientNotFound
+	}
+
+	if !validDistance(preferences.MinDistance) || !validDistance(preferences.MaxDistance) {
+		return nil, util.ErrInvalidDistanceBand
+	}
+
+	if preferences.Path != nil {
+		path, err := normalizePathOptions(preferences.Path)
+		if err != nil {
+			return nil, err
+		}
+		preferences.Path = path
+	}
+
+	updated := *client
+	updated.Preferences = preferences
+	if minimum, maximum := u.DistanceBand(&updated); maximum > 0 && minimum > maximum {
+		return nil, util.ErrInvalidDistanceBand
+	}
+	if err := u.repo.UpdateClientPreferences(clientID, preferences); err != nil {
+		return nil, err
+	}
+	u.record(&journal.Entry{Kind: journal.KindPreferencesChanged, ClientID: clientID, Preferences: preferences})
+
+	if !client.HasPosition() {
+		return []string{}, nil
+	}
+
+	return u.propagateMove(u.reload(client)), nil
+}
+
+// DistanceBand - Возвращает действующие для клиента минимальное и максимальное расстояния до ближайшего (0 - без ограничения)
+func (u *GeolocationUsecase) DistanceBand(client *models.ClientInfo) (minimum, maximum float64) {
+	minimum, maximum = u.cfg.Distance.Min, u.cfg.Distance.Max
+	if preferences := client.Preferences; preferences != nil {
+		if preferences.MinDistance != nil {
+			minimum = *preferences.MinDistance
+		}
+		if preferences.MaxDistance != nil {
+			maximum = *preferences.MaxDistance
+		}
+	}
+	return minimum, maximum
+}
+
+// Проверяет, что кандидат не ближе минимального расстояния клиента. Такие кандидаты пропускаются
+// при поиске в индексе, чтобы поиск продолжался дальше них.
+func (u *GeolocationUsecase) farEnough(client, candidate *models.ClientInfo) bool {
+	minimum, _ := u.DistanceBand(client)
+	return minimum <= 0 || client.Position.GeodesicDistanceTo(candidate.Position) >= minimum
+}
+
+// Проверяет, что кандидат не дальше максимального расстояния клиента. Проверяется после поиска:
+// если ближайший подходящий кандидат слишком далеко, то и все остальные тоже.
+func (u *GeolocationUsecase) closeEnough(client, candidate *models.ClientInfo) bool {
+	_, maximum := u.DistanceBand(client)
+	return maximum <= 0 || client.Position.GeodesicDistanceTo(candidate.Position) <= maximum
+}
+
+func validDistance(distance *float64) bool {
+	return distance == nil || (!math.IsNaN(*distance) && !math.IsInf(*distance, 0) && *distance >= 0)
+}
@@ -0,0 +1,92 @@
+package usecases
+
+import (
+	"slices"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// maxRoomNameLength - Максимальная длина названия комнаты
+const maxRoomNameLength = 64
+
+// JoinRoom - Переносит клиента в комнату name (создавая ее при необходимости) и пересчитывает пары в обеих комнатах.
+// Возвращает информацию о комнате и клиентов, которых нужно уведомить о смене ближайшего.
+// Комнаты не приватны: любой клиент, знающий название, может войти в комнату, пока в ней есть место.
+// Комната разделяет пространство подбора пар, но не ограничивает доступ, для закрытых групп название
+// должно быть неугадываемым.
+func (u *GeolocationUsecase) JoinRoom(clientID string, name string, options *models.RoomOptions) (*models.RoomInfo, []string, error) {
+	if len(name) == 0 || len(name) > maxRoomNameLength {
+		return nil, nil, util.ErrInvalidRoomName
+	}
+
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil, nil, util.ErrClientNotFound
+	}
+
+	if client.Room == name {
+		info, _ := u.repo.GetRoom(name)
+		return info, []string{}, nil
+	}
+
+	if options == nil {
+		options = &models.RoomOptions{}
+	}
+	if options.Pairing != "" && options.Pairing != config.PairingNearest && options.Pairing != config.PairingExclusive {
+		return nil, nil, util.ErrInvalidPairingMode
+	}
+	if options.Limit <= 0 {
+		options.Limit = u.cfg.Rooms.DefaultLimit
+	}
+	if u.cfg.Rooms.MaxLimit > 0 && (options.Limit <= 0 || options.Limit > u.cfg.Rooms.MaxLimit) {
+		options.Limit = u.cfg.Rooms.MaxLimit
+	}
+
+	// Запоминаем, кто ссылался на клиента в прежней комнате, до того как ссылки будут отброшены
+	referencing := u.repo.WhoReferenceMeAsNearest(clientID)
+
+	info, err := u.repo.MoveClientToRoom(clientID, name, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	logging.InfoLogger.Printf("Client %s joined room %s", clientID, name)
+	u.record(&journal.Entry{Kind: journal.KindRoomJoined, ClientID: clientID, Room: name, RoomOptions: options})
+
+	notify := make([]string, 0)
+	client = u.reload(client)
+	if client.HasPosition() {
+		position := *client.Position
+		position.ClosestClientID = ""
+		position.PendingClosestClientID = ""
+		logStoreError(u.repo.UpdateNearestReference(clientID, client.Position.ClosestClientID, &position), "drop nearest of %s", clientID)
+	}
+
+	// Клиенты прежней комнаты, считавшие клиента ближайшим, подбирают нового
+	for _, referencingID := range referencing {
+		referencingClient, exists := u.repo.GetClient(referencingID)
+		if exists && referencingClient.HasPosition() {
+			notify = append(notify, u.refreshNearest(referencingClient)...)
+		}
+	}
+
+	if client.HasPosition() {
+		notify = append(notify, u.propagateMove(u.reload(client))...)
+	}
+
+	slices.Sort(notify)
+	return info, slices.Compact(notify), nil
+}
+
+// GetRoom - Возвращает информацию о комнате
+func (u *GeolocationUsecase) GetRoom(name string) (*models.RoomInfo, bool) {
+	return u.repo.GetRoom(name)
+}
+
+// LeaveRoom - Возвращает клиента в глобальную комнату
+func (u *GeolocationUsecase) LeaveRoom(clientID string) (*models.RoomInfo, []string, error) {
+	return u.JoinRoom(clientID, models.GlobalRoom, nil)
+}
@@ -0,0 +1,144 @@
+package usecases
+
+import (
+	"crypto/subtle"
+	"slices"
+	"time"
+
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/snapshot"
+	"github.com/gorilla/websocket"
+)
+
+// Snapshot - Снимает состояние всех клиентов, их комнат и блокировок, включая еще не переподключившихся
+func (u *UsersUsecase) Snapshot(now time.Time) *snapshot.Snapshot {
+	result := &snapshot.Snapshot{
+		Version: snapshot.Version,
+		TakenAt: now,
+		Rooms:   make([]*models.RoomInfo, 0),
+		Clients: make([]*snapshot.Client, 0),
+		Blocks:  u.repo.Blocks(),
+	}
+
+	rooms := make(map[string]struct{})
+	for _, client := range u.repo.GetAllClients() {
+		result.Clients = append(result.Clients, snapshot.FromClient(client))
+
+		if _, ok := rooms[client.Room]; ok {
+			continue
+		}
+		rooms[client.Room] = struct{}{}
+		if room, ok := u.repo.GetRoom(client.Room); ok {
+			result.Rooms = append(result.Rooms, room)
+		}
+	}
+
+	return result
+}
+
+// Restore - Загружает клиентов из снимка без соединений. До переподключения через Resume они сохраняют
+// позицию, пару и настройки, а другие клиенты продолжают видеть их своими ближайшими.
+// Если хранилище не смогло сохранить снимок, часть клиентов может остаться загруженной.
+func (u *UsersUsecase) Restore(saved *snapshot.Snapshot) error {
+	clients := make([]*models.ClientInfo, 0, len(saved.Clients))
+	for _, state := range saved.Clients {
+		if _, exists := u.repo.GetClient(state.ID); exists {
+			continue
+		}
+		clients = append(clients, state.ClientInfo())
+	}
+
+	err := u.repo.LoadClients(saved.Rooms, clients)
+	// Отсоединенными помечаются все загруженные клиенты, даже если загрузка оборвалась: иначе они останутся навсегда
+	for _, client := range clients {
+		if _, exists := u.repo.GetClient(client.ID); exists {
+			u.detached[client.ID] = struct{}{}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for blocker, blocked := range saved.Blocks {
+		for _, identity := range blocked {
+			if err := u.repo.Block(blocker, identity); err != nil {
+				return err
+			}
+		}
+	}
+
+	logging.InfoLogger.Printf("Restored %d clients from snapshot taken at %s", len(clients), saved.TakenAt)
+	return nil
+}
+
+// Resume - Передает соединение восстановленному клиенту с идентичностью identity, если предъявлен токен
+// возобновления, выданный этой сессии при подключении. Идентичность и ID клиента секретом не являются.
+func (u *UsersUsecase) Resume(identity, resumeToken string, conn *websocket.Conn) (*models.ClientInfo, bool) {
+	if identity == "" || resumeToken == "" {
+		return nil, false
+	}
+
+	for id := range u.detached {
+		client, exists := u.repo.GetClient(id)
+		if !exists || client.Identity != identity || client.ResumeToken == "" ||
+			subtle.ConstantTimeCompare([]byte(client.ResumeToken), []byte(resumeToken)) != 1 {
+			continue
+		}
+
+		return u.Adopt(id, conn)
+	}
+
+	return nil, false
+}
+
+// Adopt - Передает соединение ожидающему переподключения клиенту с ID clientID
+func (u *UsersUsecase) Adopt(clientID string, conn *websocket.Conn) (*models.ClientInfo, bool) {
+	if _, ok := u.detached[clientID]; !ok {
+		return nil, false
+	}
+
+	if !u.repo.AttachConnection(clientID, conn) {
+		return nil, false
+	}
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil, false
+	}
+	delete(u.detached, clientID)
+	logging.InfoLogger.Printf("Client resumed: %s", clientID)
+	return client, true
+}
+
+// Detach - Помечает клиента без соединения ожидающим переподключения
+func (u *UsersUsecase) Detach(clientID string) {
+	if _, exists := u.repo.GetClient(clientID); exists {
+		u.detached[clientID] = struct{}{}
+	}
+}
+
+// IsDetached - Проверяет, ожидает ли клиент переподключения
+func (u *UsersUsecase) IsDetached(clientID string) bool {
+	_, ok := u.detached[clientID]
+	return ok
+}
+
+// DetachDisconnected - Помечает всех клиентов без соединения ожидающими переподключения. Нужен после повтора
+// журнала: клиенты, добавленные после снимка, восстанавливаются без соединений так же, как клиенты из снимка.
+func (u *UsersUsecase) DetachDisconnected() {
+	for _, client := range u.repo.GetAllClients() {
+		if client.Connection == nil {
+			u.detached[client.ID] = struct{}{}
+		}
+	}
+}
+
+// DetachedClients - Возвращает восстановленных клиентов, которые еще не переподключились
+func (u *UsersUsecase) DetachedClients() []string {
+	ids := make([]string, 0, len(u.detached))
+	for id := range u.detached {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -1,29 +1,70 @@
 package usecases
 
 import (
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/journal"
 	"github.com/appxpy/sphere-api/internal/logging"
 	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/privacy"
 	"github.com/appxpy/sphere-api/internal/storage"
 	"github.com/appxpy/sphere-api/internal/util"
 	"github.com/gorilla/websocket"
 )
 
 type UsersUsecase struct {
-	repo *storage.ClientRepository
+	repo    storage.ClientStore
+	privacy *privacy.Policy
+
+	// detached - Клиенты, восстановленные из снимка и еще не переподключившиеся
+	detached map[string]struct{}
+	journal  Journal
 }
 
-func NewUsersUsecase(repo *storage.ClientRepository) *UsersUsecase {
-	return &UsersUsecase{repo: repo}
+func NewUsersUsecase(repo storage.ClientStore, privacyCfg config.Privacy) *UsersUsecase {
+	return &UsersUsecase{repo: repo, privacy: privacy.NewPolicy(privacyCfg), detached: make(map[string]struct{})}
 }
 
-func (u *UsersUsecase) AddClient(client *models.ClientInfo) {
-	u.repo.AddClient(client)
+func (u *UsersUsecase) AddClient(client *models.ClientInfo) error {
+	// Смещение уже задано, когда клиент повторяется из журнала
+	if client.PrivacyOffset == nil {
+		client.PrivacyOffset = u.privacy.NewSessionOffset()
+	}
+	if err := u.repo.AddClient(client); err != nil {
+		return err
+	}
+	u.record(&journal.Entry{
+		Kind:          journal.KindClientAdded,
+		ClientID:      client.ID,
+		Identity:      client.Identity,
+		ResumeToken:   client.ResumeToken,
+		SphereID:      client.SphereID,
+		PrivacyOffset: client.PrivacyOffset,
+	})
 	logging.InfoLogger.Printf("Client added: %s", client.ID)
+	return nil
 }
 
-func (u *UsersUsecase) RemoveClient(clientID string) {
-	u.repo.RemoveClient(clientID)
+func (u *UsersUsecase) RemoveClient(clientID string) error {
+	if err := u.repo.RemoveClient(clientID); err != nil {
+		return err
+	}
+	delete(u.detached, clientID)
+	u.record(&journal.Entry{Kind: journal.KindClientRemoved, ClientID: clientID})
 	logging.InfoLogger.Printf("Client removed: %s", clientID)
+	return nil
+}
+
+// UpdateWindowSettings - Сохраняет настройки окна клиента
+func (u *UsersUsecase) UpdateWindowSettings(clientID string, settings *models.WindowSettings) error {
+	if _, err := u.GetClientInfo(clientID); err != nil {
+		return err
+	}
+
+	if err := u.repo.UpdateClientWindowSettings(clientID, settings); err != nil {
+		return err
+	}
+	u.record(&journal.Entry{Kind: journal.KindWindowSettingsChanged, ClientID: clientID, WindowSettings: settings})
+	return nil
 }
 
 func (u *UsersUsecase) GetClientInfo(clientID string) (*models.ClientInfo, error) {
@@ -48,3 +89,66 @@ func (u *UsersUsecase) GetClientIDByConnection(conn *websocket.Conn) (string, er
 func (u *UsersUsecase) GetClients() []*models.ClientInfo {
 	return u.repo.GetAllClients()
 }
+
+// GetExposedClients - Возвращает клиентов комнаты viewerID в том виде, в котором их разрешено видеть клиенту viewerID
+func (u *UsersUsecase) GetExposedClients(viewerID string) []*models.PublicClientInfo {
+	viewer, err := u.GetClientInfo(viewerID)
+	if err != nil {
+		return []*models.PublicClientInfo{}
+	}
+
+	clients := u.repo.GetRoomClients(viewer.Room)
+
+	exposed := make([]*models.PublicClientInfo, 0, len(clients))
+	for _, client := range clients {
+		if u.repo.IsBlocked(viewer.Identity, client.Identity) {
+			continue
+		}
+		exposed = append(exposed, u.privacy.Expose(client, viewerID))
+	}
+
+	return exposed
+}
+
+// GetExposedClientInfo - Возвращает клиента clientID в том виде, в котором его разрешено видеть клиенту viewerID
+func (u *UsersUsecase) GetExposedClientInfo(viewerID string, clientID string) (*models.PublicClientInfo, error) {
+	client, err := u.GetClientInfo(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Клиенты других комнат и заблокированные клиенты не видны
+	viewer, exists := u.repo.GetClient(viewerID)
+	if !exists || viewer.Room != client.Room || u.IsBlocked(viewer, client) {
+		return nil, util.ErrClientNotFound
+	}
+
+	return u.privacy.Expose(client, viewerID), nil
+}
+
+// SetPrivacy - Сохраняет собственные настройки приватности клиента
+func (u *UsersUsecase) SetPrivacy(clientID string, settings *models.PrivacySettings) error {
+	if settings.Coordinates != "" && !privacy.IsValidMode(settings.Coordinates) {
+		return util.ErrInvalidPrivacyMode
+	}
+
+	if _, err := u.GetClientInfo(clientID); err != nil {
+		return err
+	}
+
+	if err := u.repo.UpdateClientPrivacy(clientID, settings); err != nil {
+		return err
+	}
+	u.record(&journal.Entry{Kind: journal.KindPrivacyChanged, ClientID: clientID, Privacy: settings})
+	return nil
+}
+
+// Blocks - Возвращает все блокировки: идентичность -> заблокированные ею идентичности
+func (u *UsersUsecase) Blocks() map[string][]string {
+	return u.repo.Blocks()
+}
+
+// IsBlocked - Проверяет, заблокировал ли кто-либо из клиентов другого
+func (u *UsersUsecase) IsBlocked(a, b *models.ClientInfo) bool {
+	return u.repo.IsBlocked(a.Identity, b.Identity)
+}
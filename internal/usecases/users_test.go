@@ -0,0 +1,174 @@
+package usecases_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/appxpy/sphere-api/internal/config"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/storage"
+	"github.com/appxpy/sphere-api/internal/usecases"
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// UsersUsecaseTestSuite defines the suite structure
+type UsersUsecaseTestSuite struct {
+	suite.Suite
+	repo       *storage.ClientRepository
+	geoUsecase *usecases.GeolocationUsecase
+	cfg        config.Privacy
+
+	client1 *models.ClientInfo
+	client2 *models.ClientInfo
+}
+
+// SetupTest initializes two positioned clients before each test
+func (t *UsersUsecaseTestSuite) SetupTest() {
+	t.repo = storage.NewClientRepository()
+	t.geoUsecase = usecases.NewGeolocationUsecase(t.repo, config.Default().Geolocation)
+	t.cfg = config.Default().Privacy
+
+	t.client1 = &models.ClientInfo{ID: "client1"}
+	t.client2 = &models.ClientInfo{ID: "client2"}
+}
+
+// setup creates the usecase with the current privacy config, positions both clients and reads them back
+func (t *UsersUsecaseTestSuite) setup() *usecases.UsersUsecase {
+	usecase := usecases.NewUsersUsecase(t.repo, t.cfg)
+	usecase.AddClient(t.client1)
+	usecase.AddClient(t.client2)
+
+	t.geoUsecase.UpdatePosition(t.client1.ID, &models.Position{Latitude: 55.755820, Longitude: 37.617633})
+	t.geoUsecase.UpdatePosition(t.client2.ID, &models.Position{Latitude: 50.450514, Longitude: 30.523440})
+
+	// The repository keeps its own copies, so the positioned clients are read back
+	t.client1, _ = t.repo.GetClient(t.client1.ID)
+	t.client2, _ = t.repo.GetClient(t.client2.ID)
+	return usecase
+}
+
+// TestGridCoarsening tests that other clients see coarsened coordinates and no internal fields
+func (t *UsersUsecaseTestSuite) TestGridCoarsening() {
+	t.cfg.Coordinates = config.CoordinatesGrid
+	t.cfg.GridSize = 1000
+	t.cfg.SessionOffset = 500
+	usecase := t.setup()
+
+	exposed, err := usecase.GetExposedClientInfo(t.client2.ID, t.client1.ID)
+	t.Require().NoError(err)
+	t.Require().NotNil(exposed.Position)
+	t.Require().Equal(1000.0, exposed.Position.Precision)
+	t.Require().Empty(exposed.Position.ClosestClientID, "Nearest client should not be exposed by default")
+	t.Require().Zero(exposed.Position.Distance)
+
+	// The offset plus the half-diagonal of the grid cell bound the error
+	distance := t.client1.Position.GeodesicDistanceTo(&models.Position{Latitude: exposed.Position.Latitude, Longitude: exposed.Position.Longitude})
+	t.Require().Less(distance, 500+1000.0)
+
+	// The same session always gets the same coarsened coordinates
+	again, _ := usecase.GetExposedClientInfo(t.client2.ID, t.client1.ID)
+	t.Require().Equal(exposed.Position, again.Position)
+
+	// A client sees itself precisely
+	self, _ := usecase.GetExposedClientInfo(t.client1.ID, t.client1.ID)
+	t.Require().Equal(t.client1.Position.Latitude, self.Position.Latitude)
+	t.Require().Equal(t.client2.ID, self.Position.ClosestClientID)
+
+	// Server-internal calculations keep the precise position
+	t.Require().Equal(55.755820, t.client1.Position.Latitude)
+}
+
+// TestNearestExposureRounding tests that distances to third parties are rounded
+func (t *UsersUsecaseTestSuite) TestNearestExposureRounding() {
+	t.cfg.Coordinates = config.CoordinatesGeohash
+	t.cfg.GeohashPrecision = 4
+	t.cfg.ExposeNearest = true
+	t.cfg.DistanceRounding = 1000
+	usecase := t.setup()
+
+	exposed, err := usecase.GetExposedClientInfo(t.client2.ID, t.client1.ID)
+	t.Require().NoError(err)
+	t.Require().Equal(t.client2.ID, exposed.Position.ClosestClientID)
+	t.Require().Zero(int(exposed.Position.Distance)%1000, "Distance should be rounded to the configured step")
+	t.Require().InDelta(t.client1.Position.Distance, exposed.Position.Distance, 500)
+	t.Require().Greater(exposed.Position.Precision, 0.0)
+}
+
+// TestClientPrivacySettings tests that a client can tighten, but not loosen, the deployment policy
+func (t *UsersUsecaseTestSuite) TestClientPrivacySettings() {
+	t.cfg.Coordinates = config.CoordinatesGrid
+	t.cfg.ExposeNearest = true
+	usecase := t.setup()
+
+	t.Require().ErrorIs(usecase.SetPrivacy(t.client1.ID, &models.PrivacySettings{Coordinates: "street"}), util.ErrInvalidPrivacyMode)
+
+	hideNearest := false
+	t.Require().NoError(usecase.SetPrivacy(t.client1.ID, &models.PrivacySettings{Coordinates: config.CoordinatesExact, ExposeNearest: &hideNearest}))
+	exposed, _ := usecase.GetExposedClientInfo(t.client2.ID, t.client1.ID)
+	t.Require().NotEqual(t.client1.Position.Latitude, exposed.Position.Latitude, "Client cannot loosen the deployment policy")
+	t.Require().Empty(exposed.Position.ClosestClientID, "Client can hide its nearest")
+
+	t.Require().NoError(usecase.SetPrivacy(t.client1.ID, &models.PrivacySettings{Coordinates: config.CoordinatesHidden}))
+	for _, client := range usecase.GetExposedClients(t.client2.ID) {
+		if client.ID == t.client1.ID {
+			t.Require().Nil(client.Position, "Hidden coordinates should not be exposed")
+		}
+	}
+}
+
+// TestSnapshotRestore tests that a snapshot restores clients detached and that only the holder of the resume token
+// can resume them
+func (t *UsersUsecaseTestSuite) TestSnapshotRestore() {
+	t.client1.Identity = "alice"
+	t.client1.ResumeToken = "alice-resume"
+	t.client2.ResumeToken = "client2-resume"
+	usecase := t.setup()
+	usecase.SetPrivacy(t.client2.ID, &models.PrivacySettings{Coordinates: config.CoordinatesHidden})
+	t.repo.Block("alice", "mallory")
+	saved := usecase.Snapshot(time.Now())
+	t.Require().Len(saved.Clients, 2)
+
+	repo := storage.NewClientRepository()
+	restoredUsecase := usecases.NewUsersUsecase(repo, t.cfg)
+	restoredUsecase.Restore(saved)
+	t.Require().Equal([]string{t.client1.ID, t.client2.ID}, restoredUsecase.DetachedClients())
+	t.Require().True(repo.IsBlocked("mallory", "alice"))
+
+	restored, err := restoredUsecase.GetClientInfo(t.client1.ID)
+	t.Require().NoError(err)
+	t.Require().Equal(t.client2.ID, restored.Position.ClosestClientID, "The pairing is restored")
+	t.Require().Equal([]string{t.client1.ID}, repo.WhoReferenceMeAsNearest(t.client2.ID))
+	nearest, err := repo.FindNearestClient(t.client1.ID)
+	t.Require().NoError(err)
+	t.Require().Equal(t.client2.ID, nearest.ID, "Restored clients are indexed")
+
+	_, ok := restoredUsecase.Resume(t.client2.ID, "", &websocket.Conn{})
+	t.Require().False(ok, "A public client ID is not enough to resume a session")
+	_, ok = restoredUsecase.Resume("alice", "", &websocket.Conn{})
+	t.Require().False(ok, "An identity is not enough to resume a session")
+	_, ok = restoredUsecase.Resume("alice", "client2-resume", &websocket.Conn{})
+	t.Require().False(ok, "A resume token of another session is rejected")
+	_, ok = restoredUsecase.Resume("bob", "alice-resume", &websocket.Conn{})
+	t.Require().False(ok)
+
+	conn := &websocket.Conn{}
+	resumed, ok := restoredUsecase.Resume("alice", "alice-resume", conn)
+	t.Require().True(ok)
+	t.Require().Equal(t.client1.ID, resumed.ID)
+	t.Require().Equal(t.client1.SphereID, resumed.SphereID)
+	id, err := restoredUsecase.GetClientIDByConnection(conn)
+	t.Require().NoError(err)
+	t.Require().Equal(t.client1.ID, id)
+	t.Require().Equal([]string{t.client2.ID}, restoredUsecase.DetachedClients())
+
+	_, ok = restoredUsecase.Resume("alice", "alice-resume", &websocket.Conn{})
+	t.Require().False(ok, "A session is resumed only once")
+}
+
+// TestUsersUsecaseTestSuite runs the test suite
+func TestUsersUsecaseTestSuite(t *testing.T) {
+	suite.Run(t, new(UsersUsecaseTestSuite))
+}
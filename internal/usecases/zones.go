@@ -0,0 +1,110 @@
+package usecases
+
+import (
+	"slices"
+
+	"github.com/appxpy/sphere-api/internal/journal"
+	"github.com/appxpy/sphere-api/internal/logging"
+	"github.com/appxpy/sphere-api/internal/models"
+	"github.com/appxpy/sphere-api/internal/zones"
+)
+
+// AddZones - Добавляет зоны (или заменяет зоны с теми же идентификаторами), перемечает клиентов и пересчитывает пары.
+// Возвращает входы и выходы клиентов из зон и клиентов, которых нужно уведомить о смене ближайшего.
+func (u *GeolocationUsecase) AddZones(added []*zones.Zone) ([]*models.ZoneTransition, []string) {
+	for _, zone := range added {
+		u.zones.Add(zone)
+		logging.InfoLogger.Printf("Zone %s (%s) added with pairing rule %s", zone.ID, zone.Name, zone.Rule)
+	}
+
+	// Зоны записываются с уже присвоенными идентификаторами, чтобы повтор дал зонам те же идентификаторы
+	if u.journal != nil {
+		if encoded, err := zones.Encode(added); err != nil {
+			logging.ErrorLogger.Printf("Failed to encode zones for journal: %v", err)
+		} else {
+			u.record(&journal.Entry{Kind: journal.KindZonesAdded, Zones: encoded})
+		}
+	}
+	return u.retagZones()
+}
+
+// RemoveZone - Удаляет зону, перемечает клиентов и пересчитывает пары
+func (u *GeolocationUsecase) RemoveZone(zoneID string) ([]*models.ZoneTransition, []string, error) {
+	if err := u.zones.Remove(zoneID); err != nil {
+		return nil, nil, err
+	}
+	logging.InfoLogger.Printf("Zone %s removed", zoneID)
+	u.record(&journal.Entry{Kind: journal.KindZoneRemoved, ZoneID: zoneID})
+
+	transitions, notify := u.retagZones()
+	return transitions, notify, nil
+}
+
+// RestoreZones - Заменяет все зоны зонами из снимка. Клиенты не перемечаются: их зоны восстанавливаются из того же снимка.
+func (u *GeolocationUsecase) RestoreZones(restored []*zones.Zone) {
+	u.zones.Replace(restored)
+	logging.InfoLogger.Printf("Restored %d zones from snapshot", len(restored))
+}
+
+// ReplaceZones - Заменяет все зоны, например зонами другого узла кластера, перемечает клиентов и пересчитывает пары.
+// Замена не записывается в журнал.
+func (u *GeolocationUsecase) ReplaceZones(replaced []*zones.Zone) ([]*models.ZoneTransition, []string) {
+	u.zones.Replace(replaced)
+	logging.InfoLogger.Printf("Replaced zones with %d zones", len(replaced))
+	return u.retagZones()
+}
+
+func (u *GeolocationUsecase) GetZones() []*zones.Zone {
+	return u.zones.List()
+}
+
+// ClientZones - Возвращает зоны, в которых сейчас находится клиент
+func (u *GeolocationUsecase) ClientZones(clientID string) []string {
+	client, exists := u.repo.GetClient(clientID)
+	if !exists {
+		return nil
+	}
+	return client.Zones
+}
+
+// ZoneTransitions - Переводит изменение набора зон клиента во входы и выходы
+func ZoneTransitions(clientID string, before, after []string) []*models.ZoneTransition {
+	entered, left := zones.Diff(before, after)
+
+	transitions := make([]*models.ZoneTransition, 0, len(entered)+len(left))
+	for _, zoneID := range entered {
+		transitions = append(transitions, &models.ZoneTransition{ClientID: clientID, ZoneID: zoneID, Entered: true})
+	}
+	for _, zoneID := range left {
+		transitions = append(transitions, &models.ZoneTransition{ClientID: clientID, ZoneID: zoneID})
+	}
+	return transitions
+}
+
+// Перемечает всех клиентов после изменения набора зон и пересчитывает ближайших,
+// так как изменение правил может запретить уже существующие пары
+func (u *GeolocationUsecase) retagZones() ([]*models.ZoneTransition, []string) {
+	transitions := make([]*models.ZoneTransition, 0)
+	notify := make([]string, 0)
+
+	clients := u.repo.GetAllClients()
+	for _, client := range clients {
+		if !client.HasPosition() {
+			continue
+		}
+
+		after := u.zones.ZonesAt(client.Position.Latitude, client.Position.Longitude)
+		logStoreError(u.repo.UpdateClientZones(client.ID, after), "update zones of %s", client.ID)
+		transitions = append(transitions, ZoneTransitions(client.ID, client.Zones, after)...)
+	}
+
+	for _, client := range clients {
+		// Клиент перечитывается с новыми зонами и ближайшим, который мог смениться при пересчете предыдущих клиентов
+		if client = u.reload(client); client.HasPosition() {
+			notify = append(notify, u.refreshNearest(client)...)
+		}
+	}
+
+	slices.Sort(notify)
+	return transitions, slices.Compact(notify)
+}
@@ -12,6 +12,52 @@ var (
 	ErrInvalidMessage     = errors.New("invalid message format")
 	ErrNoClientsAvailable = errors.New("no clients available")
 	ErrNoPositionProvided = errors.New("no position provided for client")
+
+	ErrInvalidLatitude  = errors.New("latitude must be a finite number between -90 and 90")
+	ErrInvalidLongitude = errors.New("longitude must be a finite number between -180 and 180")
+	ErrInvalidAccuracy  = errors.New("accuracy must be a finite non-negative number")
+	ErrInvalidSource    = errors.New("unknown position source")
+	ErrInvalidSpeed     = errors.New("speed must be a finite non-negative number")
+	ErrInvalidCourse    = errors.New("course must be a finite number between 0 and 360")
+	ErrFixFromFuture    = errors.New("position fix timestamp is in the future")
+	ErrStaleFix         = errors.New("position fix is older than the last accepted one")
+	ErrLessAccurateFix  = errors.New("position fix is less accurate than the last accepted one")
+
+	ErrInvalidPrivacyMode = errors.New("unknown coordinates exposure mode")
+
+	ErrInvalidGeoJSON  = errors.New("invalid GeoJSON zone")
+	ErrDuplicateZoneID = errors.New("duplicate zone id in GeoJSON document")
+	ErrUnknownZoneRule = errors.New("unknown zone pairing rule")
+	ErrZoneNotFound    = errors.New("zone not found")
+	ErrZonesManagement = errors.New("zone management is not allowed")
+
+	ErrRoomFull        = errors.New("room is full")
+	ErrInvalidRoomName = errors.New("room name must be 1 to 64 characters long")
+
+	ErrCannotBlockSelf = errors.New("client cannot block itself")
+
+	ErrInvalidPairingMode  = errors.New("pairing mode must be nearest or exclusive")
+	ErrInvalidPathMethod   = errors.New("path method must be geodesic or rhumb")
+	ErrInvalidDistanceBand = errors.New("pairing distances must be non-negative and minimum must not exceed maximum")
+
+	ErrNearestPositionHidden = errors.New("nearest client hides its position")
+
+	ErrInvalidSmoothingFilter = errors.New("smoothing filter must be none, exponential or kalman")
+	ErrInvalidSmoothingAlpha  = errors.New("smoothing alpha must be in (0, 1]")
+	ErrInvalidSmoothingParams = errors.New("smoothing parameters must be finite non-negative numbers")
+
+	ErrUnknownStorageBackend = errors.New("unknown storage backend")
+
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+
+	ErrJournalCorrupted        = errors.New("journal corrupted")
+	ErrUnknownJournalEntryKind = errors.New("unknown journal entry kind")
+	ErrJournalRecordTooLarge   = errors.New("journal record is too large")
+
+	ErrUnknownClusterNode    = errors.New("unknown cluster node")
+	ErrBackplaneClosed       = errors.New("cluster backplane is closed")
+	ErrUnknownClusterMode    = errors.New("cluster mode must be replicated or partitioned")
+	ErrClusterSecretRequired = errors.New("cluster secret is required when the cluster is enabled")
 )
 
 func ErrorToInterface(err error) *models.Response[struct {
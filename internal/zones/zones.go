@@ -0,0 +1,324 @@
+package zones
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/appxpy/sphere-api/internal/util"
+)
+
+// Rule - Правило подбора пар для клиентов внутри зоны
+type Rule string
+
+const (
+	// RuleOpen - Зона только помечает клиентов и не ограничивает подбор пар
+	RuleOpen Rule = "open"
+	// RuleIsolated - Клиенты внутри зоны подбираются только друг с другом, пары через границу зоны не образуются
+	RuleIsolated Rule = "isolated"
+)
+
+// Zone - Именованная зона из одного или нескольких полигонов
+type Zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Rule Rule   `json:"rule"`
+
+	// polygons - Полигоны зоны: первое кольцо внешнее, остальные - дыры. Точки в порядке [долгота, широта].
+	polygons [][][][2]float64
+}
+
+// Contains - Проверяет, находится ли точка внутри зоны
+func (z *Zone) Contains(latitude, longitude float64) bool {
+	for _, polygon := range z.polygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], latitude, longitude) {
+			continue
+		}
+
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, latitude, longitude) {
+				inHole = true
+				break
+			}
+		}
+
+		if !inHole {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Проверка точки в кольце методом трассировки луча
+func ringContains(ring [][2]float64, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+
+		if (yi > latitude) != (yj > latitude) && longitude < (xj-xi)*(latitude-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type geoJSONObject struct {
+	Type        string           `json:"type"`
+	ID          any              `json:"id"`
+	Properties  map[string]any   `json:"properties"`
+	Geometry    *geoJSONObject   `json:"geometry"`
+	Features    []*geoJSONObject `json:"features"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+}
+
+// Parse - Разбирает GeoJSON (FeatureCollection, Feature, Polygon или MultiPolygon) в зоны.
+// Идентификатор зоны берется из id объекта или свойств id/name, правило - из свойства pairing.
+// Зоны без идентификатора получают его при добавлении в реестр, повтор идентификатора в документе - ошибка.
+func Parse(data []byte) ([]*Zone, error) {
+	var object geoJSONObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("%w: %v", util.ErrInvalidGeoJSON, err)
+	}
+
+	switch object.Type {
+	case "FeatureCollection":
+		zones := make([]*Zone, 0, len(object.Features))
+		for _, feature := range object.Features {
+			zone, err := parseFeature(feature)
+			if err != nil {
+				return nil, err
+			}
+			if zone.ID != "" && slices.ContainsFunc(zones, func(other *Zone) bool { return other.ID == zone.ID }) {
+				return nil, fmt.Errorf("%w: %q", util.ErrDuplicateZoneID, zone.ID)
+			}
+			zones = append(zones, zone)
+		}
+		return zones, nil
+	case "Feature":
+		zone, err := parseFeature(&object)
+		if err != nil {
+			return nil, err
+		}
+		return []*Zone{zone}, nil
+	default:
+		zone, err := parseFeature(&geoJSONObject{Type: "Feature", Geometry: &object})
+		if err != nil {
+			return nil, err
+		}
+		return []*Zone{zone}, nil
+	}
+}
+
+// LoadFile - Загружает зоны из GeoJSON файла
+func LoadFile(path string) ([]*Zone, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Encode - Записывает зоны в GeoJSON FeatureCollection, из которой Parse восстанавливает те же зоны
+func Encode(zones []*Zone) ([]byte, error) {
+	collection := &geoJSONObject{Type: "FeatureCollection", Features: make([]*geoJSONObject, 0, len(zones))}
+	for _, zone := range zones {
+		coordinates, err := json.Marshal(zone.polygons)
+		if err != nil {
+			return nil, err
+		}
+		collection.Features = append(collection.Features, &geoJSONObject{
+			Type:       "Feature",
+			Properties: map[string]any{"id": zone.ID, "name": zone.Name, "pairing": string(zone.Rule)},
+			Geometry:   &geoJSONObject{Type: "MultiPolygon", Coordinates: coordinates},
+		})
+	}
+	return json.Marshal(collection)
+}
+
+func parseFeature(feature *geoJSONObject) (*Zone, error) {
+	if feature.Type != "Feature" || feature.Geometry == nil {
+		return nil, fmt.Errorf("%w: expected a feature with geometry", util.ErrInvalidGeoJSON)
+	}
+
+	zone := &Zone{Rule: RuleOpen}
+	if id, ok := feature.ID.(string); ok && id != "" {
+		zone.ID = id
+	} else if id, ok := feature.ID.(float64); ok {
+		zone.ID = fmt.Sprint(id)
+	}
+
+	if id, ok := feature.Properties["id"].(string); ok && id != "" {
+		zone.ID = id
+	}
+	if name, ok := feature.Properties["name"].(string); ok {
+		zone.Name = name
+		if feature.ID == nil && feature.Properties["id"] == nil {
+			zone.ID = name
+		}
+	}
+	if rule, ok := feature.Properties["pairing"].(string); ok {
+		zone.Rule = Rule(rule)
+	}
+
+	if zone.Rule != RuleOpen && zone.Rule != RuleIsolated {
+		return nil, fmt.Errorf("%w: %q", util.ErrUnknownZoneRule, zone.Rule)
+	}
+
+	switch feature.Geometry.Type {
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("%w: %v", util.ErrInvalidGeoJSON, err)
+		}
+		zone.polygons = [][][][2]float64{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &zone.polygons); err != nil {
+			return nil, fmt.Errorf("%w: %v", util.ErrInvalidGeoJSON, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported geometry %q", util.ErrInvalidGeoJSON, feature.Geometry.Type)
+	}
+
+	if err := validatePolygons(zone.polygons); err != nil {
+		return nil, err
+	}
+
+	return zone, nil
+}
+
+// Проверяет, что у зоны есть полигоны, а каждое их кольцо замкнуто и содержит не меньше четырех точек
+func validatePolygons(polygons [][][][2]float64) error {
+	if len(polygons) == 0 {
+		return fmt.Errorf("%w: zone has no polygons", util.ErrInvalidGeoJSON)
+	}
+
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return fmt.Errorf("%w: polygon has no rings", util.ErrInvalidGeoJSON)
+		}
+
+		for _, ring := range polygon {
+			if len(ring) < 4 {
+				return fmt.Errorf("%w: ring must have at least 4 points, got %d", util.ErrInvalidGeoJSON, len(ring))
+			}
+			if ring[0] != ring[len(ring)-1] {
+				return fmt.Errorf("%w: ring is not closed", util.ErrInvalidGeoJSON)
+			}
+		}
+	}
+	return nil
+}
+
+// Registry - Набор зон, который можно менять во время работы сервера
+type Registry struct {
+	zones map[string]*Zone
+	mu    sync.RWMutex
+
+	// generated - Счетчик идентификаторов для зон, добавленных без идентификатора
+	generated int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{zones: make(map[string]*Zone)}
+}
+
+// Add - Добавляет зону или заменяет зону с тем же идентификатором.
+// Зона без идентификатора получает новый идентификатор zone-N, не занятый в реестре.
+func (r *Registry) Add(zone *Zone) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for zone.ID == "" {
+		r.generated++
+		if id := fmt.Sprintf("zone-%d", r.generated); r.zones[id] == nil {
+			zone.ID = id
+		}
+	}
+	r.zones[zone.ID] = zone
+}
+
+// Replace - Заменяет все зоны реестра зонами zones
+func (r *Registry) Replace(zones []*Zone) {
+	r.mu.Lock()
+	r.zones = make(map[string]*Zone, len(zones))
+	r.mu.Unlock()
+
+	for _, zone := range zones {
+		r.Add(zone)
+	}
+}
+
+func (r *Registry) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.zones[id]; !ok {
+		return util.ErrZoneNotFound
+	}
+	delete(r.zones, id)
+	return nil
+}
+
+// List - Возвращает все зоны, отсортированные по идентификатору
+func (r *Registry) List() []*Zone {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	zones := make([]*Zone, 0, len(r.zones))
+	for _, zone := range r.zones {
+		zones = append(zones, zone)
+	}
+	slices.SortFunc(zones, func(a, b *Zone) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return zones
+}
+
+// ZonesAt - Возвращает отсортированные идентификаторы зон, содержащих точку
+func (r *Registry) ZonesAt(latitude, longitude float64) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0)
+	for id, zone := range r.zones {
+		if zone.Contains(latitude, longitude) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// CanPair - Проверяет, разрешают ли изолирующие зоны пару клиентов с указанными наборами зон
+func (r *Registry) CanPair(zonesA, zonesB []string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id, zone := range r.zones {
+		if zone.Rule == RuleIsolated && slices.Contains(zonesA, id) != slices.Contains(zonesB, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff - Возвращает зоны, в которые клиент вошел и из которых вышел
+func Diff(before, after []string) (entered, left []string) {
+	for _, id := range after {
+		if !slices.Contains(before, id) {
+			entered = append(entered, id)
+		}
+	}
+	for _, id := range before {
+		if !slices.Contains(after, id) {
+			left = append(left, id)
+		}
+	}
+	return entered, left
+}